@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+/*
+Actions are the things the rules and the scheduler can do to the relays, digital outputs and fuel cells.
+Relays and outputs can be given by channel or by the name set in the settings.
+*/
+
+// Action types
+const (
+	ActionRelay         = "relay"
+	ActionOutput        = "output"
+	ActionFuelCellStart = "fuelCellStart"
+	ActionFuelCellStop  = "fuelCellStop"
+	ActionTargetPower   = "targetPower" // Change the fuel cell output power target
+	ActionExhaust       = "exhaust"     // Open (On) or close the fuel cell exhaust
+	ActionNotify        = "notify"      // Record an event
+)
+
+type ActionType struct {
+	Type     string // relay, output, fuelCellStart, fuelCellStop, targetPower, exhaust or notify
+	Board    uint8  // Node ID of the board for relay and output
+	Channel  uint8  // Relay or output
+	Name     string `json:",omitempty"` // Relay or output name. Used instead of Channel if given
+	On       bool
+	FuelCell int     // Fuel cell for fuelCellStart, fuelCellStop, targetPower and exhaust
+	Power    float64 `json:",omitempty"` // targetPower in kW
+	Message  string  `json:",omitempty"` // notify
+}
+
+/*
+channel returns the relay or output the action switches, looking it up by name if one is given
+*/
+func (a *ActionType) channel(board *BoardType) (uint8, error) {
+	if a.Name == "" {
+		if a.Type == ActionRelay && int(a.Channel) >= len(board.Relays.Relays) {
+			return 0, fmt.Errorf("relay must be 0 to %d", len(board.Relays.Relays)-1)
+		}
+		if a.Type == ActionOutput && int(a.Channel) >= len(board.Outputs.Outputs) {
+			return 0, fmt.Errorf("output must be 0 to %d", len(board.Outputs.Outputs)-1)
+		}
+		return a.Channel, nil
+	}
+	if a.Type == ActionRelay {
+		for idx := range board.Relays.Relays {
+			if strings.EqualFold(board.Relays.GetRelayName(uint8(idx)), a.Name) {
+				return uint8(idx), nil
+			}
+		}
+		return 0, fmt.Errorf("there is no relay called %s on board %d", a.Name, a.Board)
+	}
+	for idx := range board.Outputs.Outputs {
+		if strings.EqualFold(board.Outputs.GetOutputName(uint8(idx)), a.Name) {
+			return uint8(idx), nil
+		}
+	}
+	return 0, fmt.Errorf("there is no output called %s on board %d", a.Name, a.Board)
+}
+
+func (a *ActionType) validate() error {
+	switch a.Type {
+	case ActionRelay, ActionOutput:
+		board := GetBoard(a.Board)
+		if board == nil {
+			return fmt.Errorf("there is no board with node ID %d", a.Board)
+		}
+		if _, err := a.channel(board); err != nil {
+			return err
+		}
+	case ActionFuelCellStart, ActionFuelCellStop, ActionExhaust:
+		if GetFuelCell(a.FuelCell) == nil {
+			return fmt.Errorf("there is no fuel cell %d", a.FuelCell)
+		}
+	case ActionTargetPower:
+		if GetFuelCell(a.FuelCell) == nil {
+			return fmt.Errorf("there is no fuel cell %d", a.FuelCell)
+		}
+		if a.Power < 0 {
+			return fmt.Errorf("target power cannot be negative")
+		}
+	case ActionNotify:
+		if a.Message == "" {
+			return fmt.Errorf("notify needs a message")
+		}
+	default:
+		return fmt.Errorf("action type must be %s, %s, %s, %s, %s, %s or %s", ActionRelay, ActionOutput,
+			ActionFuelCellStart, ActionFuelCellStop, ActionTargetPower, ActionExhaust, ActionNotify)
+	}
+	return nil
+}
+
+// switchPort sets the relay or output. It returns an InterlockError if an interlock stops it being switched on.
+func (a *ActionType) switchPort() error {
+	board := GetBoard(a.Board)
+	if board == nil {
+		return fmt.Errorf("there is no board with node ID %d", a.Board)
+	}
+	channel, err := a.channel(board)
+	if err != nil {
+		return err
+	}
+	if a.Type == ActionRelay {
+		return board.Relays.SetRelay(channel, a.On)
+	}
+	return board.Outputs.SetOutput(channel, a.On)
+}
+
+// failed logs an action that could not be carried out. Actions stopped by an interlock are also recorded as events.
+func (a *ActionType) failed(source string, name string, err error) {
+	log.Printf("%s %s - %v", source, name, err)
+	var interlockErr *InterlockError
+	if errors.As(err, &interlockErr) {
+		Events.Record(EventSourceInterlock, interlockErr.Interlock, fmt.Sprintf("%s %s - %v", source, name, err))
+	}
+}
+
+// safe is true for the actions still carried out while the fail-safe state is in force
+func (a *ActionType) safe() bool {
+	switch a.Type {
+	case ActionRelay, ActionOutput, ActionExhaust:
+		return !a.On
+	case ActionFuelCellStop, ActionNotify:
+		return true
+	}
+	return false
+}
+
+/*
+run carries out the action. source and name identify the rule or schedule for notify events.
+It must not be called with the rules engine or scheduler locked. While the fail-safe state is in force only stops,
+switching relays and outputs off, closing the exhaust and notifications are carried out, unless the fail-safe itself is
+applying its safe states.
+*/
+func (a *ActionType) run(source string, name string) {
+	if source != EventSourceFailSafe && !a.safe() {
+		if tripped, reason := FailSafe.Tripped(); tripped {
+			log.Printf("%s %s - %s held off by the fail-safe state (%s)", source, name, a.String(), reason)
+			return
+		}
+	}
+	switch a.Type {
+	case ActionRelay, ActionOutput:
+		if err := a.switchPort(); err != nil {
+			a.failed(source, name, err)
+		}
+	case ActionFuelCellStart:
+		if fuelCell := GetFuelCell(a.FuelCell); fuelCell != nil {
+			if err := fuelCell.Start(); err != nil {
+				a.failed(source, name, err)
+			}
+		}
+	case ActionFuelCellStop:
+		if fuelCell := GetFuelCell(a.FuelCell); fuelCell != nil {
+			fuelCell.Stop()
+			fuelCell.Supervisor.CancelRetry()
+		}
+	case ActionTargetPower:
+		if fuelCell := GetFuelCell(a.FuelCell); fuelCell != nil {
+			if err := fuelCell.SetTargetPower(a.Power); err != nil {
+				a.failed(source, name, err)
+			} else if err := fuelCell.UpdateOutput(); err != nil {
+				a.failed(source, name, err)
+			}
+		}
+	case ActionExhaust:
+		if fuelCell := GetFuelCell(a.FuelCell); fuelCell != nil {
+			fuelCell.SetExhaust(a.On)
+		}
+	case ActionNotify:
+		Events.Record(source, name, a.Message)
+	}
+}
+
+func (a *ActionType) String() string {
+	switch a.Type {
+	case ActionRelay, ActionOutput:
+		state := "off"
+		if a.On {
+			state = "on"
+		}
+		if a.Name != "" {
+			return fmt.Sprintf("%s %s on board %d %s", a.Type, a.Name, a.Board, state)
+		}
+		return fmt.Sprintf("%s %d on board %d %s", a.Type, a.Channel, a.Board, state)
+	case ActionFuelCellStart, ActionFuelCellStop:
+		return fmt.Sprintf("%s %d", a.Type, a.FuelCell)
+	case ActionTargetPower:
+		return fmt.Sprintf("%s %d %0.1fkW", a.Type, a.FuelCell, a.Power)
+	case ActionExhaust:
+		state := "closed"
+		if a.On {
+			state = "open"
+		}
+		return fmt.Sprintf("%s %d %s", a.Type, a.FuelCell, state)
+	}
+	return fmt.Sprintf("%s %s", a.Type, a.Message)
+}
@@ -19,6 +19,7 @@ type AnalogInputsType struct {
 	RawTemperature uint16             `json:"RawTemperature"`
 	VrefValue      uint16             `json:"VrefValue"`
 	mu             sync.Mutex
+	board          *BoardType
 }
 
 func (ai *AnalogInputsType) InitAnalogInputs() {
@@ -30,29 +31,39 @@ func (ai *AnalogInputsType) InitAnalogInputs() {
 func (ai *AnalogInputsType) SetAnanlog0To3(data [8]byte) {
 	ai.mu.Lock()
 	defer ai.mu.Unlock()
+	channels := ai.calibration()
 
 	ai.Inputs[0].Raw = binary.LittleEndian.Uint16(data[0:2])
-	ai.Inputs[0].Value = (float32(ai.Inputs[0].Raw) * currentSettings.AnalogChannels[0].calibrationMultiplier) + currentSettings.AnalogChannels[0].calibrationConstant
+	ai.Inputs[0].Value = (float32(ai.Inputs[0].Raw) * channels[0].calibrationMultiplier) + channels[0].calibrationConstant
 	ai.Inputs[1].Raw = binary.LittleEndian.Uint16(data[2:4])
-	ai.Inputs[1].Value = (float32(ai.Inputs[1].Raw) * currentSettings.AnalogChannels[1].calibrationMultiplier) + currentSettings.AnalogChannels[1].calibrationConstant
+	ai.Inputs[1].Value = (float32(ai.Inputs[1].Raw) * channels[1].calibrationMultiplier) + channels[1].calibrationConstant
 	ai.Inputs[2].Raw = binary.LittleEndian.Uint16(data[4:6])
-	ai.Inputs[2].Value = (float32(ai.Inputs[2].Raw) * currentSettings.AnalogChannels[2].calibrationMultiplier) + currentSettings.AnalogChannels[2].calibrationConstant
+	ai.Inputs[2].Value = (float32(ai.Inputs[2].Raw) * channels[2].calibrationMultiplier) + channels[2].calibrationConstant
 	ai.Inputs[3].Raw = binary.LittleEndian.Uint16(data[6:8])
-	ai.Inputs[3].Value = (float32(ai.Inputs[3].Raw) * currentSettings.AnalogChannels[3].calibrationMultiplier) + currentSettings.AnalogChannels[3].calibrationConstant
+	ai.Inputs[3].Value = (float32(ai.Inputs[3].Raw) * channels[3].calibrationMultiplier) + channels[3].calibrationConstant
 }
 
 func (ai *AnalogInputsType) SetAnanlog4To7(data [8]byte) {
 	ai.mu.Lock()
 	defer ai.mu.Unlock()
+	channels := ai.calibration()
 
 	ai.Inputs[4].Raw = binary.LittleEndian.Uint16(data[0:2])
-	ai.Inputs[4].Value = (float32(ai.Inputs[4].Raw) * currentSettings.AnalogChannels[4].calibrationMultiplier) + currentSettings.AnalogChannels[4].calibrationConstant
+	ai.Inputs[4].Value = (float32(ai.Inputs[4].Raw) * channels[4].calibrationMultiplier) + channels[4].calibrationConstant
 	ai.Inputs[5].Raw = binary.LittleEndian.Uint16(data[2:4])
-	ai.Inputs[5].Value = (float32(ai.Inputs[5].Raw) * currentSettings.AnalogChannels[5].calibrationMultiplier) + currentSettings.AnalogChannels[5].calibrationConstant
+	ai.Inputs[5].Value = (float32(ai.Inputs[5].Raw) * channels[5].calibrationMultiplier) + channels[5].calibrationConstant
 	ai.Inputs[6].Raw = binary.LittleEndian.Uint16(data[4:6])
-	ai.Inputs[6].Value = (float32(ai.Inputs[6].Raw) * currentSettings.AnalogChannels[6].calibrationMultiplier) + currentSettings.AnalogChannels[6].calibrationConstant
+	ai.Inputs[6].Value = (float32(ai.Inputs[6].Raw) * channels[6].calibrationMultiplier) + channels[6].calibrationConstant
 	ai.Inputs[7].Raw = binary.LittleEndian.Uint16(data[6:8])
-	ai.Inputs[7].Value = (float32(ai.Inputs[7].Raw) * currentSettings.AnalogChannels[7].calibrationMultiplier) + currentSettings.AnalogChannels[7].calibrationConstant
+	ai.Inputs[7].Value = (float32(ai.Inputs[7].Raw) * channels[7].calibrationMultiplier) + channels[7].calibrationConstant
+}
+
+// calibration must be called with the inputs locked
+func (ai *AnalogInputsType) calibration() *[8]AnalogSettingType {
+	if ai.board != nil {
+		return ai.board.analogChannels()
+	}
+	return &currentSettings.AnalogChannels
 }
 
 func (ai *AnalogInputsType) SetAnanlogInternal(data [8]byte) {
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+AutoDispatch starts the fuel cell when the battery voltage falls below the start threshold and stops it when the
+voltage rises above the stop threshold. The voltage must stay past the threshold for DelaySeconds before we act.
+Minimum run and off times stop the fuel cell from cycling, and the number of automatic starts per day is limited.
+*/
+
+// Battery voltage sources
+const (
+	DispatchSourceDC     = "dc"
+	DispatchSourceAnalog = "analog"
+)
+
+type AutoDispatchSettingsType struct {
+	Enabled         bool    // Start and stop the fuel cell automatically
+	Source          string  // dc or analog
+	Board           uint8   // Node ID of the board with the voltage measurement
+	Channel         uint8   // DC measurement device (0-3) or analog input (0-7)
+	StartVolts      float64 // Start the fuel cell below this voltage
+	StopVolts       float64 // Stop the fuel cell above this voltage
+	DelaySeconds    float64 // Time the voltage must stay past a threshold
+	MinRunMinutes   float64 // Minimum time the fuel cell runs once started
+	MinOffMinutes   float64 // Minimum time the fuel cell stays off once stopped
+	MaxStartsPerDay int     // Automatic starts allowed per day. 0 = no limit
+}
+
+type AutoDispatchType struct {
+	mu          sync.Mutex
+	Volts       float64
+	VoltsValid  bool
+	LastStart   time.Time
+	LastStop    time.Time
+	StartsToday int
+	Day         string
+	State       string // What the dispatcher is doing or waiting for
+	LastAction  string
+	belowSince  time.Time
+	aboveSince  time.Time
+	wasRunning  bool
+}
+
+var AutoDispatch AutoDispatchType
+
+func defaultAutoDispatchSettings() AutoDispatchSettingsType {
+	return AutoDispatchSettingsType{
+		Source:          DispatchSourceDC,
+		StartVolts:      46,
+		StopVolts:       54,
+		DelaySeconds:    30,
+		MinRunMinutes:   30,
+		MinOffMinutes:   10,
+		MaxStartsPerDay: 4,
+	}
+}
+
+func (s *AutoDispatchSettingsType) validate() error {
+	if GetBoard(s.Board) == nil {
+		return fmt.Errorf("there is no board with node ID %d", s.Board)
+	}
+	switch s.Source {
+	case DispatchSourceDC:
+		if s.Channel > 3 {
+			return fmt.Errorf("DC measurement device must be 0 to 3")
+		}
+	case DispatchSourceAnalog:
+		if s.Channel > 7 {
+			return fmt.Errorf("analog channel must be 0 to 7")
+		}
+	default:
+		return fmt.Errorf("voltage source must be %s or %s", DispatchSourceDC, DispatchSourceAnalog)
+	}
+	if s.StopVolts <= s.StartVolts {
+		return fmt.Errorf("the stop voltage (%0.1fV) must be above the start voltage (%0.1fV)", s.StopVolts, s.StartVolts)
+	}
+	if s.DelaySeconds < 0 || s.MinRunMinutes < 0 || s.MinOffMinutes < 0 || s.MaxStartsPerDay < 0 {
+		return fmt.Errorf("times and start limits cannot be negative")
+	}
+	return nil
+}
+
+/*
+readVolts returns the battery voltage from the configured source. ok is false if the board or measurement is
+missing or its data is stale.
+*/
+func (s *AutoDispatchSettingsType) readVolts() (volts float64, ok bool) {
+	board := GetBoard(s.Board)
+	if board == nil {
+		return 0, false
+	}
+	switch s.Source {
+	case DispatchSourceDC:
+		if s.Channel > 3 || Freshness.IsStale(board.freshnessName(fmt.Sprintf("DC%d", s.Channel))) {
+			return 0, false
+		}
+		return float64(board.DCMeasurements[s.Channel].getVolts()), true
+	case DispatchSourceAnalog:
+		message := "Analog0to3"
+		if s.Channel > 3 {
+			message = "Analog4to7"
+		}
+		if s.Channel > 7 || Freshness.IsStale(board.freshnessName(message)) {
+			return 0, false
+		}
+		_, value := board.AnalogInputs.GetInput(s.Channel)
+		return float64(value), true
+	}
+	return 0, false
+}
+
+/*
+Run checks the battery voltage every second
+*/
+func (ad *AutoDispatchType) Run() {
+	checkTime := time.NewTicker(time.Second)
+	for {
+		now := <-checkTime.C
+		ad.step(now)
+	}
+}
+
+func (ad *AutoDispatchType) step(now time.Time) {
+	settings := currentSettings.FuelCellSettings.Dispatch
+	volts, ok := settings.readVolts()
+	running := AnyFuelCellOn()
+
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+
+	if day := now.Format("2006-01-02"); day != ad.Day {
+		ad.Day = day
+		ad.StartsToday = 0
+	}
+	// Track starts and stops made by hand as well so the minimum times still apply
+	if running && !ad.wasRunning {
+		ad.LastStart = now
+	} else if !running && ad.wasRunning {
+		ad.LastStop = now
+	}
+	ad.wasRunning = running
+	ad.Volts = volts
+	ad.VoltsValid = ok
+
+	if !settings.Enabled {
+		ad.State = "Automatic dispatch is off"
+		ad.belowSince = time.Time{}
+		ad.aboveSince = time.Time{}
+		return
+	}
+	if !currentSettings.FuelCellSettings.Enabled {
+		ad.State = "Fuel cell control is disabled"
+		return
+	}
+	if !ok {
+		ad.State = "No valid battery voltage"
+		ad.belowSince = time.Time{}
+		ad.aboveSince = time.Time{}
+		return
+	}
+
+	if volts < settings.StartVolts {
+		if ad.belowSince.IsZero() {
+			ad.belowSince = now
+		}
+	} else {
+		ad.belowSince = time.Time{}
+	}
+	if volts > settings.StopVolts {
+		if ad.aboveSince.IsZero() {
+			ad.aboveSince = now
+		}
+	} else {
+		ad.aboveSince = time.Time{}
+	}
+	delay := time.Duration(settings.DelaySeconds * float64(time.Second))
+
+	if running {
+		minRun := time.Duration(settings.MinRunMinutes * float64(time.Minute))
+		switch {
+		case ad.aboveSince.IsZero():
+			ad.State = fmt.Sprintf("Running until the battery is above %0.1fV", settings.StopVolts)
+		case now.Sub(ad.aboveSince) < delay:
+			ad.State = fmt.Sprintf("Battery above %0.1fV. Waiting %0.0fs before stopping", settings.StopVolts, (delay - now.Sub(ad.aboveSince)).Seconds())
+		case now.Sub(ad.LastStart) < minRun:
+			ad.State = fmt.Sprintf("Minimum run time. Stopping in %0.0f minutes", (minRun - now.Sub(ad.LastStart)).Minutes())
+		default:
+			ad.LastAction = fmt.Sprintf("%s stopped at %0.2fV", now.Format(time.RFC3339), volts)
+			ad.State = "Stopping"
+			log.Printf("Automatic dispatch is stopping the fuel cell. Battery = %0.2fV", volts)
+			ad.mu.Unlock()
+			StopFuelCells()
+			ad.mu.Lock()
+		}
+		return
+	}
+
+	if len(availableFuelCells()) == 0 {
+		ad.State = "Waiting for the fuel cell supervisor. Every fuel cell is faulted or waiting to retry"
+		return
+	}
+	minOff := time.Duration(settings.MinOffMinutes * float64(time.Minute))
+	switch {
+	case ad.belowSince.IsZero():
+		ad.State = fmt.Sprintf("Off until the battery is below %0.1fV", settings.StartVolts)
+	case now.Sub(ad.belowSince) < delay:
+		ad.State = fmt.Sprintf("Battery below %0.1fV. Waiting %0.0fs before starting", settings.StartVolts, (delay - now.Sub(ad.belowSince)).Seconds())
+	case !ad.LastStop.IsZero() && now.Sub(ad.LastStop) < minOff:
+		ad.State = fmt.Sprintf("Minimum off time. Starting in %0.0f minutes", (minOff - now.Sub(ad.LastStop)).Minutes())
+	case settings.MaxStartsPerDay > 0 && ad.StartsToday >= settings.MaxStartsPerDay:
+		ad.State = fmt.Sprintf("Daily limit of %d starts reached", settings.MaxStartsPerDay)
+	default:
+		// Only starts the fuel cells accepted count towards the daily limit
+		ad.mu.Unlock()
+		started, err := StartFuelCells()
+		ad.mu.Lock()
+		if started == 0 {
+			ad.State = fmt.Sprintf("Not started - %v", err)
+			return
+		}
+		ad.StartsToday++
+		ad.LastAction = fmt.Sprintf("%s started at %0.2fV", now.Format(time.RFC3339), volts)
+		ad.State = "Starting"
+		log.Printf("Automatic dispatch started the fuel cell. Battery = %0.2fV. Start %d today", volts, ad.StartsToday)
+	}
+}
+
+type AutoDispatchStatusType struct {
+	Settings    AutoDispatchSettingsType
+	Volts       float64
+	VoltsValid  bool
+	State       string
+	LastAction  string
+	LastStart   time.Time
+	LastStop    time.Time
+	StartsToday int
+}
+
+func (ad *AutoDispatchType) Status() AutoDispatchStatusType {
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	return AutoDispatchStatusType{Settings: currentSettings.FuelCellSettings.Dispatch, Volts: ad.Volts, VoltsValid: ad.VoltsValid,
+		State: ad.State, LastAction: ad.LastAction, LastStart: ad.LastStart, LastStop: ad.LastStop, StartsToday: ad.StartsToday}
+}
+
+func getAutoDispatch(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Auto Dispatch"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(AutoDispatch.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func setAutoDispatch(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Auto Dispatch"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	settings := currentSettings.FuelCellSettings.Dispatch
+	if err := json.Unmarshal(body, &settings); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	currentSettings.FuelCellSettings.Dispatch = settings
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getAutoDispatch(w, r)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// resetAutoDispatch forgets the starts, stops and threshold crossings
+func resetAutoDispatch() {
+	AutoDispatch.mu.Lock()
+	defer AutoDispatch.mu.Unlock()
+	AutoDispatch.LastStart = time.Time{}
+	AutoDispatch.LastStop = time.Time{}
+	AutoDispatch.StartsToday = 0
+	AutoDispatch.Day = ""
+	AutoDispatch.belowSince = time.Time{}
+	AutoDispatch.aboveSince = time.Time{}
+	AutoDispatch.wasRunning = false
+}
+
+/*
+TestAutoDispatchHysteresis walks the battery voltage down and up through the thresholds and checks the fuel cell is
+only started and stopped once the voltage has stayed past a threshold for the delay and the minimum times allow it
+*/
+func TestAutoDispatchHysteresis(t *testing.T) {
+	board := MainBoard()
+	saved := currentSettings.FuelCellSettings.Dispatch
+	defer func() {
+		currentSettings.FuelCellSettings.Dispatch = saved
+		StopFuelCells()
+		resetAutoDispatch()
+	}()
+	settings := defaultAutoDispatchSettings()
+	settings.Enabled = true
+	settings.Board = board.NodeID
+	settings.MaxStartsPerDay = 2
+	currentSettings.FuelCellSettings.Dispatch = settings
+
+	// The steps run in order as the threshold and start times carry over
+	start := time.Date(2026, 3, 2, 8, 0, 0, 0, time.Local)
+	tests := []struct {
+		name    string
+		after   time.Duration
+		volts   float64
+		running bool // After the step
+		starts  int
+	}{
+		{name: "Between the thresholds", volts: 50},
+		{name: "Below the start voltage", after: time.Second, volts: 45},
+		{name: "Not below for long enough", after: 30 * time.Second, volts: 45.5},
+		{name: "Started after the delay", after: 31 * time.Second, volts: 45, running: true, starts: 1},
+		{name: "Between the thresholds while running", after: time.Minute, volts: 50, running: true, starts: 1},
+		{name: "Above the stop voltage", after: 2 * time.Minute, volts: 55, running: true, starts: 1},
+		{name: "Held by the minimum run time", after: 10 * time.Minute, volts: 55, running: true, starts: 1},
+		{name: "Stopped after the minimum run time", after: 31 * time.Minute, volts: 55, starts: 1},
+		{name: "Below again", after: 32 * time.Minute, volts: 44, starts: 1},
+		{name: "Held by the minimum off time", after: 40 * time.Minute, volts: 44, starts: 1},
+		{name: "Started after the minimum off time", after: 42 * time.Minute, volts: 44, running: true, starts: 2},
+		{name: "Charging", after: 43 * time.Minute, volts: 50, running: true, starts: 2},
+		{name: "Above the stop voltage again", after: 80 * time.Minute, volts: 56, running: true, starts: 2},
+		{name: "Stopped after the delay", after: 81 * time.Minute, volts: 56, starts: 2},
+		{name: "Discharging", after: 82 * time.Minute, volts: 50, starts: 2},
+		{name: "Below once more", after: 100 * time.Minute, volts: 44, starts: 2},
+		{name: "Held by the daily limit", after: 110 * time.Minute, volts: 44, starts: 2},
+		{name: "Started the next day", after: 24 * time.Hour, volts: 44, running: true, starts: 1},
+	}
+	for _, test := range tests {
+		board.DCMeasurements[0].setVolts(uint16(test.volts * 100))
+		setLastSeen(board.freshnessName("DC0"), time.Now())
+		AutoDispatch.step(start.Add(test.after))
+		status := AutoDispatch.Status()
+		if running := AnyFuelCellOn(); running != test.running || status.StartsToday != test.starts {
+			t.Errorf("%s: running = %v with %d starts today, want %v and %d - %s", test.name, running, status.StartsToday,
+				test.running, test.starts, status.State)
+		}
+	}
+}
+
+func TestAutoDispatchStaleVoltage(t *testing.T) {
+	board := MainBoard()
+	saved := currentSettings.FuelCellSettings.Dispatch
+	defer func() {
+		currentSettings.FuelCellSettings.Dispatch = saved
+		resetAutoDispatch()
+	}()
+	settings := defaultAutoDispatchSettings()
+	settings.Enabled = true
+	settings.Board = board.NodeID
+	settings.DelaySeconds = 0
+	currentSettings.FuelCellSettings.Dispatch = settings
+
+	board.DCMeasurements[0].setVolts(4000)
+	setLastSeen(board.freshnessName("DC0"), time.Time{})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		AutoDispatch.step(now.Add(time.Duration(i) * time.Minute))
+	}
+	if AnyFuelCellOn() {
+		t.Error("the fuel cell was started on a stale voltage")
+	}
+	if status := AutoDispatch.Status(); status.VoltsValid {
+		t.Errorf("a stale voltage is reported as valid - %s", status.State)
+	}
+}
+
+func TestAutoDispatchSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(s *AutoDispatchSettingsType)
+		wantErr bool
+	}{
+		{name: "Defaults", change: func(s *AutoDispatchSettingsType) {}},
+		{name: "No such board", change: func(s *AutoDispatchSettingsType) { s.Board = 0x7F }, wantErr: true},
+		{name: "DC device out of range", change: func(s *AutoDispatchSettingsType) { s.Channel = 4 }, wantErr: true},
+		{name: "Analog channel", change: func(s *AutoDispatchSettingsType) { s.Source, s.Channel = DispatchSourceAnalog, 7 }},
+		{name: "Analog channel out of range", change: func(s *AutoDispatchSettingsType) { s.Source, s.Channel = DispatchSourceAnalog, 8 },
+			wantErr: true},
+		{name: "Unknown source", change: func(s *AutoDispatchSettingsType) { s.Source = "ac" }, wantErr: true},
+		{name: "Stop below start", change: func(s *AutoDispatchSettingsType) { s.StopVolts = s.StartVolts }, wantErr: true},
+		{name: "Negative delay", change: func(s *AutoDispatchSettingsType) { s.DelaySeconds = -1 }, wantErr: true},
+	}
+	for _, test := range tests {
+		settings := defaultAutoDispatchSettings()
+		settings.Board = MainBoard().NodeID
+		test.change(&settings)
+		if err := settings.validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: validate returned %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/brutella/can"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+/*
+Several FireflyIO boards can share one CAN bus. Each board has a node ID which offsets all of its CAN IDs by
+node * BoardNodeOffset, so board 0 uses 0x010 - 0x04F, board 1 uses 0x110 - 0x14F and so on.
+The main board is described by the top level settings and uses the Relays, Outputs, Inputs, AnalogInputs,
+ACMeasurements and DCMeasurements globals. Additional boards are listed in SettingsType.Boards.
+*/
+
+const BoardNodeOffset = 0x100
+const MaxBoardNodeID = 7
+
+type BoardType struct {
+	NodeID            uint8
+	Name              string
+	Relays            *RelaysType
+	Outputs           *DigitalOutputsType
+	Inputs            *DigitalInputsType
+	AnalogInputs      *AnalogInputsType
+	ACMeasurements    *[4]ACMeasurementsType
+	DCMeasurements    *[4]DCMeasurementsType
+	main              bool
+	returnedHeartbeat uint16
+	heartbeatLost     bool
+	mu                sync.Mutex
+}
+
+var Boards []*BoardType // Boards[0] is the main board
+
+/*
+InitBoards builds the board list from the settings. Must be called after the settings are loaded and before the CAN
+bus is connected.
+*/
+func InitBoards(settings *SettingsType) {
+	main := &BoardType{NodeID: settings.NodeID, Name: settings.Name, Relays: &Relays, Outputs: &Outputs, Inputs: &Inputs,
+		AnalogInputs: &AnalogInputs, ACMeasurements: &ACMeasurements, DCMeasurements: &DCMeasurements, main: true}
+	if main.NodeID > MaxBoardNodeID {
+		log.Printf("Invalid node ID %d for the main board. Using 0", main.NodeID)
+		main.NodeID = 0
+	}
+	Boards = []*BoardType{main}
+
+	for _, boardSettings := range settings.Boards {
+		if boardSettings.NodeID > MaxBoardNodeID {
+			log.Printf("Board %s has an invalid node ID %d. The highest node ID is %d", boardSettings.Name, boardSettings.NodeID, MaxBoardNodeID)
+			continue
+		}
+		if GetBoard(boardSettings.NodeID) != nil {
+			log.Printf("Board %s has node ID %d which is already in use", boardSettings.Name, boardSettings.NodeID)
+			continue
+		}
+		board := &BoardType{NodeID: boardSettings.NodeID, Name: boardSettings.Name, Relays: new(RelaysType),
+			Outputs: new(DigitalOutputsType), Inputs: new(DigitalInputsType), AnalogInputs: new(AnalogInputsType),
+			ACMeasurements: new([4]ACMeasurementsType), DCMeasurements: new([4]DCMeasurementsType)}
+		board.Relays.InitRelays()
+		board.Outputs.InitOutputs()
+		board.Inputs.InitInputs()
+		board.AnalogInputs.InitAnalogInputs()
+		for _, rl := range boardSettings.Relays {
+			board.Relays.Relays[rl.Port].Name = rl.Name
+		}
+		for _, op := range boardSettings.DigitalOutputs {
+			board.Outputs.Outputs[op.Port].Name = op.Name
+		}
+		for _, ip := range boardSettings.DigitalInputs {
+			board.Inputs.Inputs[ip.Port].Name = ip.Name
+		}
+		for _, analog := range boardSettings.AnalogChannels {
+			board.AnalogInputs.Inputs[analog.Port].Name = analog.Name
+		}
+		for i, ac := range boardSettings.ACMeasurement {
+			board.ACMeasurements[i].Name = ac.Name
+		}
+		for i, dc := range boardSettings.DCMeasurement {
+			board.DCMeasurements[i].Name = dc.Name
+		}
+		Boards = append(Boards, board)
+	}
+
+	for _, board := range Boards {
+		board.Relays.board = board
+		board.Outputs.board = board
+		board.AnalogInputs.board = board
+		Freshness.watchBoard(board)
+	}
+}
+
+// MainBoard returns the board described by the top level settings
+func MainBoard() *BoardType {
+	if len(Boards) == 0 {
+		return nil
+	}
+	return Boards[0]
+}
+
+// GetBoard returns the board with the given node ID or nil if there is no such board
+func GetBoard(nodeID uint8) *BoardType {
+	for _, board := range Boards {
+		if board.NodeID == nodeID {
+			return board
+		}
+	}
+	return nil
+}
+
+// canID returns the CAN ID used by this board for the given board 0 ID
+func (board *BoardType) canID(id uint32) uint32 {
+	return id + uint32(board.NodeID)*BoardNodeOffset
+}
+
+// freshnessName returns the name used to track the given message from this board
+func (board *BoardType) freshnessName(message string) string {
+	if board.main {
+		return message
+	}
+	return fmt.Sprintf("Board%d.%s", board.NodeID, message)
+}
+
+// analogChannels returns the calibration settings for the analog inputs
+func (board *BoardType) analogChannels() *[8]AnalogSettingType {
+	if !board.main {
+		for i := range currentSettings.Boards {
+			if currentSettings.Boards[i].NodeID == board.NodeID {
+				return &currentSettings.Boards[i].AnalogChannels
+			}
+		}
+	}
+	return &currentSettings.AnalogChannels
+}
+
+// modbusFlags returns the flags telling the board which Modbus measurement devices to poll
+func (board *BoardType) modbusFlags() uint8 {
+	if !board.main {
+		for i := range currentSettings.Boards {
+			if currentSettings.Boards[i].NodeID == board.NodeID {
+				return modbusFlags(currentSettings.Boards[i].ACMeasurement, currentSettings.Boards[i].DCMeasurement)
+			}
+		}
+	}
+	return currentSettings.getModbusFlags()
+}
+
+func (board *BoardType) setReturnedHeartbeat(value uint16) {
+	board.mu.Lock()
+	board.returnedHeartbeat = value
+	board.mu.Unlock()
+	if board.main {
+		returnedHeartbeat = value
+	}
+}
+
+/*
+checkHeartbeat logs when an additional board stops returning the heartbeat. The main board heartbeat is handled by
+MonitorCANBusComms as losing it means the CAN adapter needs to be recovered.
+*/
+func (board *BoardType) checkHeartbeat(sent uint16, limit uint16) {
+	board.mu.Lock()
+	defer board.mu.Unlock()
+	lost := sent-board.returnedHeartbeat > limit
+	if lost && !board.heartbeatLost {
+		log.Printf("Heartbeat from board %d (%s) has been lost", board.NodeID, board.Name)
+	} else if !lost && board.heartbeatLost {
+		log.Printf("Heartbeat from board %d (%s) has returned", board.NodeID, board.Name)
+	}
+	board.heartbeatLost = lost
+}
+
+/*
+addBoardHandlers registers the frame handlers for the board at its node offset
+*/
+func (canBus *CANBus) addBoardHandlers(board *BoardType) {
+	acVoltsAmpsIds := [4]uint32{AcVoltsAmpsCanId0, AcVoltsAmpsCanId1, AcVoltsAmpsCanId2, AcVoltsAmpsCanId3}
+	acPowerEnergyIds := [4]uint32{AcPowerEnergyCanId0, AcPowerEnergyCanId1, AcPowerEnergyCanId2, AcPowerEnergyCanId3}
+	acHertzPfIds := [4]uint32{AcHertzPfCanId0, AcHertzPfCanId1, AcHertzPfCanId2, AcHertzPfCanId3}
+	acErrorIds := [4]uint32{AcErrorCanId0, AcErrorCanId1, AcErrorCanId2, AcErrorCanId3}
+	dcVoltsAmpsIds := [4]uint32{DcVoltsAmpsCanId0, DcVoltsAmpsCanId1, DcVoltsAmpsCanId2, DcVoltsAmpsCanId3}
+	dcErrorIds := [4]uint32{DcErrorCanId0, DcErrorCanId1, DcErrorCanId2, DcErrorCanId3}
+
+	canBus.FrameHandlers[board.canID(FlagsCanId)] = flagsHandler
+	canBus.FrameHandlers[board.canID(RelaysAndDigitalOutCanId)] = flagsHandler // Only seen on a loopback bus
+	canBus.FrameHandlers[board.canID(RelaysOutputsAndHeartbeat)] = board.relayHandler
+	canBus.FrameHandlers[board.canID(AnalogInputs0to3CanId)] = board.analogInputs0to3Handler
+	canBus.FrameHandlers[board.canID(AnalogInputs4to7CanId)] = board.analogInputs4to7Handler
+	canBus.FrameHandlers[board.canID(AnalogInputsInternalCanId)] = board.analogInputsInternalHandler
+	for device := uint8(0); device < 4; device++ {
+		device := device
+		canBus.FrameHandlers[board.canID(acVoltsAmpsIds[device])] = func(frame can.Frame, _ *CANBus) {
+			board.acVoltsAndAmpsHandler(device, frame)
+		}
+		canBus.FrameHandlers[board.canID(acPowerEnergyIds[device])] = func(frame can.Frame, _ *CANBus) {
+			board.acPowerAndEnergyHandler(device, frame)
+		}
+		canBus.FrameHandlers[board.canID(acHertzPfIds[device])] = func(frame can.Frame, _ *CANBus) {
+			board.acPowerFactorAndFrequencyHandler(device, frame)
+		}
+		canBus.FrameHandlers[board.canID(acErrorIds[device])] = func(frame can.Frame, _ *CANBus) {
+			board.ACMeasurements[device].setError(frame.Data[0])
+		}
+		canBus.FrameHandlers[board.canID(dcVoltsAmpsIds[device])] = func(frame can.Frame, _ *CANBus) {
+			board.dcVoltsAndAmpsHandler(device, frame)
+		}
+		canBus.FrameHandlers[board.canID(dcErrorIds[device])] = func(frame can.Frame, _ *CANBus) {
+			board.DCMeasurements[device].setError(frame.Data[0])
+		}
+	}
+}
+
+func (board *BoardType) relayHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(board.freshnessName("Relays"))
+	Interlocks.reported(board, binary.LittleEndian.Uint16(frame.Data[0:2]), frame.Data[2])
+	board.setReturnedHeartbeat(binary.LittleEndian.Uint16(frame.Data[4:6]))
+}
+
+func (board *BoardType) analogInputs0to3Handler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(board.freshnessName("Analog0to3"))
+	board.AnalogInputs.SetAnanlog0To3(frame.Data)
+}
+
+func (board *BoardType) analogInputs4to7Handler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(board.freshnessName("Analog4to7"))
+	board.AnalogInputs.SetAnanlog4To7(frame.Data)
+}
+
+func (board *BoardType) analogInputsInternalHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(board.freshnessName("AnalogInternal"))
+	board.AnalogInputs.SetAnanlogInternal(frame.Data)
+	board.Inputs.SetAllInputs(frame.Data[6] & 0xf)
+}
+
+func (board *BoardType) acVoltsAndAmpsHandler(device uint8, frame can.Frame) {
+	Freshness.Seen(board.freshnessName(fmt.Sprintf("AC%d", device)))
+	board.ACMeasurements[device].setVolts(binary.LittleEndian.Uint16(frame.Data[0:2]))
+	board.ACMeasurements[device].setAmps(binary.LittleEndian.Uint32(frame.Data[2:6]))
+	board.ACMeasurements[device].setError(0)
+}
+
+func (board *BoardType) acPowerAndEnergyHandler(device uint8, frame can.Frame) {
+	Freshness.Seen(board.freshnessName(fmt.Sprintf("AC%d", device)))
+	board.ACMeasurements[device].setPower(binary.LittleEndian.Uint32(frame.Data[0:4]))
+	board.ACMeasurements[device].setEnergy(binary.LittleEndian.Uint32(frame.Data[4:8]))
+	board.ACMeasurements[device].setError(0)
+}
+
+func (board *BoardType) acPowerFactorAndFrequencyHandler(device uint8, frame can.Frame) {
+	Freshness.Seen(board.freshnessName(fmt.Sprintf("AC%d", device)))
+	board.ACMeasurements[device].setFrequency(binary.LittleEndian.Uint16(frame.Data[0:2]))
+	board.ACMeasurements[device].setPowerFactor(binary.LittleEndian.Uint16(frame.Data[2:4]))
+	board.ACMeasurements[device].setError(0)
+}
+
+func (board *BoardType) dcVoltsAndAmpsHandler(device uint8, frame can.Frame) {
+	Freshness.Seen(board.freshnessName(fmt.Sprintf("DC%d", device)))
+	board.DCMeasurements[device].setVolts(binary.LittleEndian.Uint16(frame.Data[0:2]))
+	board.DCMeasurements[device].setAmps(binary.LittleEndian.Uint32(frame.Data[2:6]))
+	board.DCMeasurements[device].setError(0)
+}
+
+type BoardStatusType struct {
+	NodeID         uint8
+	Name           string
+	HeartbeatLost  bool
+	Relays         *RelaysType
+	Analog         *AnalogInputsType
+	DigitalOut     *DigitalOutputsType
+	DigitalIn      *DigitalInputsType
+	ACMeasurements []ACValuesType
+	DCMeasurements []DCValuesType
+	StaleData      []string
+}
+
+func (board *BoardType) Status() BoardStatusType {
+	board.mu.Lock()
+	status := BoardStatusType{NodeID: board.NodeID, Name: board.Name, HeartbeatLost: board.heartbeatLost,
+		Relays: board.Relays, Analog: board.AnalogInputs, DigitalOut: board.Outputs, DigitalIn: board.Inputs}
+	board.mu.Unlock()
+	status.ACMeasurements = make([]ACValuesType, 0)
+	for idx := range board.ACMeasurements {
+		ac := &board.ACMeasurements[idx]
+		if ac.Name != "" {
+			status.ACMeasurements = append(status.ACMeasurements, ACValuesType{Name: ac.Name, ACVolts: ac.getVolts(),
+				ACAmps: ac.getAmps(), ACWatts: ac.getPower(), ACWattHours: ac.getEnergy(), ACHertz: ac.getFrequency(),
+				ACPowerFactor: ac.getPowerFactor(), Error: ac.getError(),
+				Stale: Freshness.IsStale(board.freshnessName(fmt.Sprintf("AC%d", idx)))})
+		}
+	}
+	status.DCMeasurements = make([]DCValuesType, 0)
+	for idx := range board.DCMeasurements {
+		dc := &board.DCMeasurements[idx]
+		if dc.Name != "" {
+			status.DCMeasurements = append(status.DCMeasurements, DCValuesType{Name: dc.Name, DCVolts: dc.getVolts(),
+				DCAmps: dc.getAmps(), Error: dc.getError(), Stale: Freshness.IsStale(board.freshnessName(fmt.Sprintf("DC%d", idx)))})
+		}
+	}
+	status.StaleData = Freshness.StaleBoard(board)
+	return status
+}
+
+// boardFromRequest returns the board named by the {id} route variable
+func boardFromRequest(w http.ResponseWriter, r *http.Request, deviceString string) *BoardType {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 8)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return nil
+	}
+	board := GetBoard(uint8(id))
+	if board == nil {
+		ReturnJSONErrorString(w, deviceString, fmt.Sprintf("There is no board with node ID %d", id), http.StatusNotFound, true)
+	}
+	return board
+}
+
+func getBoards(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Boards"
+	status := make([]BoardStatusType, 0, len(Boards))
+	for _, board := range Boards {
+		status = append(status, board.Status())
+	}
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(status); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func getBoard(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Get Board"
+	board := boardFromRequest(w, r, deviceString)
+	if board == nil {
+		return
+	}
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(board.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func setBoardRelay(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Board Relay"
+	board := boardFromRequest(w, r, deviceString)
+	if board == nil {
+		return
+	}
+	if setRelayOnBoard(w, r, board) {
+		getBoard(w, r)
+	}
+}
+
+func setBoardOutput(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Board Output"
+	board := boardFromRequest(w, r, deviceString)
+	if board == nil {
+		return
+	}
+	if setOutputOnBoard(w, r, board) {
+		getBoard(w, r)
+	}
+}
@@ -2,41 +2,108 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"github.com/brutella/can"
 	"log"
 	"net/http"
-	"os/exec"
+	"sort"
 	"sync"
 	"time"
 )
 
 var UnknownFrames map[uint32]time.Time
+var unknownFramesMu sync.Mutex
 
 func init() {
 	UnknownFrames = make(map[uint32]time.Time)
 }
 
-func getUnknownFrames(w http.ResponseWriter, _ *http.Request) {
+/*
+getUnknownFrames lists the frames we have no handler for. Add ?by=pgn to group the extended frames by J1939 PGN.
+*/
+func getUnknownFrames(w http.ResponseWriter, r *http.Request) {
 	const deviceString = "GetUnknownFrames"
+	if r.URL.Query().Get("by") == "pgn" {
+		getUnknownPGNs(w)
+		return
+	}
 	setContentTypeHeader(w)
+	unknownFramesMu.Lock()
+	defer unknownFramesMu.Unlock()
 	if _, err := fmt.Fprint(w, `{
   "UnknownFrames" : {
 `); err != nil {
 		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
 	}
+	separator := ""
 	for id, when := range UnknownFrames {
-		if _, err := fmt.Fprintf(w, `    "0x%08x" : "%v"
-`, id-0x80000000, when); err != nil {
+		if _, err := fmt.Fprintf(w, `%s    "0x%08x" : "%v"`, separator, id&can.MaskIDEff, when); err != nil {
 			ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
 		}
+		separator = ",\n"
 	}
-	if _, err := fmt.Fprint(w, `  }
+	if _, err := fmt.Fprint(w, `
+  }
 }`); err != nil {
 		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
 	}
 }
 
+type UnknownPGNType struct {
+	PGN          string
+	Priority     uint8
+	Sources      []string
+	Destinations []string
+	LastSeen     time.Time
+}
+
+func getUnknownPGNs(w http.ResponseWriter) {
+	const deviceString = "GetUnknownPGNs"
+	pgns := make(map[uint32]*UnknownPGNType)
+	unknownFramesMu.Lock()
+	for id, when := range UnknownFrames {
+		if id&can.MaskEff == 0 {
+			continue
+		}
+		j := ParseJ1939ID(id)
+		entry, found := pgns[j.PGN]
+		if !found {
+			entry = &UnknownPGNType{PGN: fmt.Sprintf("0x%05X", j.PGN), Priority: j.Priority}
+			pgns[j.PGN] = entry
+		}
+		entry.Sources = appendUnique(entry.Sources, fmt.Sprintf("0x%02X", j.Source))
+		if j.PDUFormat < 240 {
+			entry.Destinations = appendUnique(entry.Destinations, fmt.Sprintf("0x%02X", j.Destination))
+		}
+		if when.After(entry.LastSeen) {
+			entry.LastSeen = when
+		}
+	}
+	unknownFramesMu.Unlock()
+
+	result := make([]*UnknownPGNType, 0, len(pgns))
+	for _, entry := range pgns {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].PGN < result[j].PGN })
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(struct{ UnknownPGNs []*UnknownPGNType }{result}); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
 type FrameHandler func(frame can.Frame, canBus *CANBus)
 
 //type CANHandler struct {
@@ -45,8 +112,12 @@ type FrameHandler func(frame can.Frame, canBus *CANBus)
 //}
 
 type CANBus struct {
-	FrameHandlers  map[uint32]FrameHandler
-	bus            *can.Bus
+	FrameHandlers  map[uint32]FrameHandler // Handlers by raw frame ID. Used for the FireflyIO board
+	J1939          *J1939DispatcherType    // Handlers for extended frames by PGN and source address
+	bus            FrameTransport          // Set to nil by ConnectAndPublish when the transport stops. Read it through transport()
+	busMu          sync.Mutex
+	echoes         map[uint32]int // Frames we have sent on a loopback bus that have not come back yet, by ID
+	interfaceName  string
 	Analog         [8]uint16
 	Temperature    float32
 	RawTemperature uint16
@@ -96,87 +167,54 @@ const DcErrorCanId3 = 0x4F
 // handleCANFrame figures out what to do with each CAN frame received
 func (canBus *CANBus) handleCANFrame(frm can.Frame) {
 	handler := canBus.FrameHandlers[frm.ID]
+	if handler == nil && frm.ID&can.MaskEff != 0 {
+		handler = canBus.J1939.Handler(frm.ID)
+	}
+	if canBus.loopedBack(frm.ID) {
+		// Our own frame handed back by a loopback bus. Publish has already recorded and counted it.
+		RawFrames.Dispatch(frm, "tx")
+	} else {
+		CANRecorder.Record(canBus.interfaceName, frm, false)
+		CANStats.Received(frm, handler != nil)
+		RawFrames.Dispatch(frm, "rx")
+	}
 	if handler != nil {
 		handler(frm, canBus)
 	} else if frm.ID < 255 {
 		log.Printf("Frame %d received with data %v\n", frm.ID, frm.Data)
 	} else {
+		unknownFramesMu.Lock()
 		UnknownFrames[frm.ID] = time.Now()
+		unknownFramesMu.Unlock()
 		//		log.Printf("0x%x", frm.ID)
 	}
 }
 
 /*
 NewCANBus
- connects to the given interface and starts receiving frames.
+ connects to the given interface and starts receiving frames. The interface name selects the FrameTransport.
 */
 func NewCANBus(interfaceName string) (*CANBus, error) {
 	canBus := new(CANBus)
 	var err error
 
-	canBus.bus, err = can.NewBusForInterfaceWithName(interfaceName)
+	canBus.bus, err = NewFrameTransport(interfaceName)
+	canBus.interfaceName = interfaceName
 	canBus.FrameHandlers = make(map[uint32]FrameHandler)
+	canBus.J1939 = NewJ1939Dispatcher()
 	if err != nil {
 		log.Println("CAN interface not available.", err)
 	} else {
 		canBus.bus.SubscribeFunc(canBus.handleCANFrame)
-		canBus.FrameHandlers[FlagsCanId] = flagsHandler
-		canBus.FrameHandlers[RelaysOutputsAndHeartbeat] = relayHandler
-		canBus.FrameHandlers[AnalogInputs0to3CanId] = analogInputs0to3Handler
-		canBus.FrameHandlers[AnalogInputs4to7CanId] = analogInputs4to7Handler
-		canBus.FrameHandlers[AnalogInputsInternalCanId] = analogInputsInternalHandler
-		canBus.FrameHandlers[AcVoltsAmpsCanId0] = acVoltsAndAmpsHandler0
-		canBus.FrameHandlers[AcPowerEnergyCanId0] = acPowerAndEnergyHandler0
-		canBus.FrameHandlers[AcHertzPfCanId0] = acPowerFactorAndFrequencyHandler0
-		canBus.FrameHandlers[AcErrorCanId0] = acErrorHandler0
-		canBus.FrameHandlers[AcVoltsAmpsCanId1] = acVoltsAndAmpsHandler1
-		canBus.FrameHandlers[AcPowerEnergyCanId1] = acPowerAndEnergyHandler1
-		canBus.FrameHandlers[AcHertzPfCanId1] = acPowerFactorAndFrequencyHandler1
-		canBus.FrameHandlers[AcErrorCanId1] = acErrorHandler1
-		canBus.FrameHandlers[AcVoltsAmpsCanId2] = acVoltsAndAmpsHandler2
-		canBus.FrameHandlers[AcPowerEnergyCanId2] = acPowerAndEnergyHandler2
-		canBus.FrameHandlers[AcHertzPfCanId2] = acPowerFactorAndFrequencyHandler2
-		canBus.FrameHandlers[AcErrorCanId2] = acErrorHandler2
-		canBus.FrameHandlers[AcVoltsAmpsCanId3] = acVoltsAndAmpsHandler3
-		canBus.FrameHandlers[AcPowerEnergyCanId3] = acPowerAndEnergyHandler3
-		canBus.FrameHandlers[AcHertzPfCanId3] = acPowerFactorAndFrequencyHandler3
-		canBus.FrameHandlers[AcErrorCanId3] = acErrorHandler3
-		canBus.FrameHandlers[DcVoltsAmpsCanId0] = dcVoltsAndAmpsHandler0
-		canBus.FrameHandlers[DcErrorCanId0] = dcErrorHandler0
-		canBus.FrameHandlers[DcVoltsAmpsCanId1] = dcVoltsAndAmpsHandler1
-		canBus.FrameHandlers[DcErrorCanId1] = dcErrorHandler1
-		canBus.FrameHandlers[DcVoltsAmpsCanId2] = dcVoltsAndAmpsHandler2
-		canBus.FrameHandlers[DcErrorCanId2] = dcErrorHandler2
-		canBus.FrameHandlers[DcVoltsAmpsCanId3] = dcVoltsAndAmpsHandler3
-		canBus.FrameHandlers[DcErrorCanId3] = dcErrorHandler3
-
-		//canBus.FrameHandlers[CanOutputControlMsg] = CanOutputControlHandler
-		//canBus.FrameHandlers[CanBatterVoltageLimitsMsg] = CanBatterVoltageLimitsHandler
-		canBus.FrameHandlers[CanPowerModeMsg] = CanPowerModeHandler
-		canBus.FrameHandlers[CanPressuresMsg] = CanPressuresHandler
-		canBus.FrameHandlers[CanStackCoolantMsg] = CanStackCoolantHandler
-		canBus.FrameHandlers[CanAirFlowMsg] = CanAirFlowHandler
-		canBus.FrameHandlers[CanAlarmsMsg] = CanAlarmsHandler
-		canBus.FrameHandlers[CanStackOutputMsg] = CanStackOutputHandler
-		canBus.FrameHandlers[CanCff1Msg] = CanCff1Handler
-		canBus.FrameHandlers[CanInsulationMsg] = CanInsulationHanddler
-		canBus.FrameHandlers[CanStackCellsID1to4Msg] = CanStackHandler
-		canBus.FrameHandlers[CanStackCellsID5to8Msg] = CanStackHandler
-		canBus.FrameHandlers[CanStackCellsID9to12Msg] = CanStackHandler
-		canBus.FrameHandlers[CanStackCellsID13to16Msg] = CanStackHandler
-		canBus.FrameHandlers[CanStackCellsID17to20Msg] = CanStackHandler
-		canBus.FrameHandlers[CanStackCellsID21to24Msg] = CanStackHandler
-		canBus.FrameHandlers[CanStackCellsID25to28Msg] = CanStackHandler
-		canBus.FrameHandlers[CanStackCellsID29to32Msg] = CanStackHandler
-		canBus.FrameHandlers[CanMaxMinCellsMsg] = CanStackHandler
-		canBus.FrameHandlers[CanTotalStackVoltageMsg] = CanStackHandler
-		canBus.FrameHandlers[CanATSCoolingFanMsg] = CanATSCoolingFanHandler
-		canBus.FrameHandlers[CanWaterPumpMsg] = CanWaterPumpHandler
-		canBus.FrameHandlers[CanDCDCConverterMsg] = CanDCDCConverterHandler
-		canBus.FrameHandlers[CanDCOutputMsg] = CanDCOutputHandler
-		canBus.FrameHandlers[CanBMSSettingsMsg] = CanBMSSettingsHandler
-		canBus.FrameHandlers[CanKeyOnMsg] = CanKeyOnHandler
-		canBus.FrameHandlers[CanRunTimeMsg] = CanRunTimeHandler
+		for _, board := range Boards {
+			canBus.addBoardHandlers(board)
+		}
+
+		for _, fuelCell := range FuelCells {
+			if fuelCell.usesInterface(interfaceName) {
+				fuelCell.AddHandlers(canBus)
+			}
+		}
 
 		go ConnectAndPublish(canBus)
 	}
@@ -184,263 +222,253 @@ func NewCANBus(interfaceName string) (*CANBus, error) {
 	return canBus, err
 }
 
+/*
+AddHandlers registers the handlers for the messages sent by the PAN fuel cell. Each frame is also decoded into the
+fuel cell's DBC signal values.
+*/
+func (fc *PANFuelCell) AddHandlers(bus *CANBus) {
+	// The PAN controller messages share one PGN and use the source address to identify the message
+	//bus.J1939.AddHandlerForID(CanOutputControlMsg, false, CanOutputControlHandler)
+	//bus.J1939.AddHandlerForID(CanBatterVoltageLimitsMsg, false, CanBatterVoltageLimitsHandler)
+	fc.addHandler(bus, CanPowerModeMsg, false, fc.CanPowerModeHandler)
+	fc.addHandler(bus, CanPressuresMsg, false, fc.CanPressuresHandler)
+	fc.addHandler(bus, CanStackCoolantMsg, false, fc.CanStackCoolantHandler)
+	fc.addHandler(bus, CanAirFlowMsg, false, fc.CanAirFlowHandler)
+	fc.addHandler(bus, CanAlarmsMsg, false, fc.CanAlarmsHandler)
+	fc.addHandler(bus, CanStackOutputMsg, false, fc.CanStackOutputHandler)
+	fc.addHandler(bus, CanBMSSettingsMsg, false, fc.CanBMSSettingsHandler)
+	fc.addHandler(bus, CanKeyOnMsg, false, fc.CanKeyOnHandler)
+	fc.addHandler(bus, CanRunTimeMsg, false, fc.CanRunTimeHandler)
+	// The sensors and sub-assemblies are matched on PGN alone so any source address is accepted. A fuel cell with
+	// a source offset shares the bus with another so it only accepts its own addresses.
+	anySource := fc.offset == 0
+	fc.addHandler(bus, CanCff1Msg, anySource, fc.CanCff1Handler)
+	fc.addHandler(bus, CanInsulationMsg, anySource, fc.CanInsulationHanddler)
+	fc.addHandler(bus, CanStackCellsID1to4Msg, anySource, fc.CanStackHandler)
+	fc.addHandler(bus, CanStackCellsID5to8Msg, anySource, fc.CanStackHandler)
+	fc.addHandler(bus, CanStackCellsID9to12Msg, anySource, fc.CanStackHandler)
+	fc.addHandler(bus, CanStackCellsID13to16Msg, anySource, fc.CanStackHandler)
+	fc.addHandler(bus, CanStackCellsID17to20Msg, anySource, fc.CanStackHandler)
+	fc.addHandler(bus, CanStackCellsID21to24Msg, anySource, fc.CanStackHandler)
+	fc.addHandler(bus, CanStackCellsID25to28Msg, anySource, fc.CanStackHandler)
+	fc.addHandler(bus, CanStackCellsID29to32Msg, anySource, fc.CanStackHandler)
+	fc.addHandler(bus, CanMaxMinCellsMsg, anySource, fc.CanStackHandler)
+	fc.addHandler(bus, CanTotalStackVoltageMsg, anySource, fc.CanStackHandler)
+	fc.addHandler(bus, CanATSCoolingFanMsg, anySource, fc.CanATSCoolingFanHandler)
+	fc.addHandler(bus, CanWaterPumpMsg, anySource, fc.CanWaterPumpHandler)
+	fc.addHandler(bus, CanDCDCConverterMsg, anySource, fc.CanDCDCConverterHandler)
+	fc.addHandler(bus, CanDCOutputMsg, anySource, fc.CanDCOutputHandler)
+}
+
 func ConnectAndPublish(canBus *CANBus) {
-	if err := canBus.bus.ConnectAndPublish(); err != nil {
+	transport := canBus.transport()
+	if err := transport.ConnectAndPublish(); err != nil {
 		// The CAN bus has stopped working!
 		log.Println(err)
 	}
-	if disconnectErr := canBus.bus.Disconnect(); disconnectErr != nil {
+	if disconnectErr := transport.Disconnect(); disconnectErr != nil {
 		log.Println(disconnectErr)
 	}
+	canBus.busMu.Lock()
 	canBus.bus = nil
+	canBus.busMu.Unlock()
 }
 
-func flagsHandler(_ can.Frame, _ *CANBus) {
-
-}
-
-func CanKeyOnHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.SystemInfo.Run = frame.Data[0] != 0
+/*
+transport returns the frame transport or nil if the bus is not connected
+*/
+func (canBus *CANBus) transport() FrameTransport {
+	canBus.busMu.Lock()
+	defer canBus.busMu.Unlock()
+	return canBus.bus
+}
+
+// sent notes a frame published on a loopback bus so its echo is not recorded as received
+func (canBus *CANBus) sent(id uint32) {
+	canBus.busMu.Lock()
+	defer canBus.busMu.Unlock()
+	if canBus.echoes == nil {
+		canBus.echoes = make(map[uint32]int)
+	}
+	canBus.echoes[id]++
 }
 
-func CanRunTimeHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.SystemInfo.SetRunTime(frame.Data[2], frame.Data[3])
+// loopedBack reports whether the frame is the echo of one we sent on a loopback bus
+func (canBus *CANBus) loopedBack(id uint32) bool {
+	canBus.busMu.Lock()
+	defer canBus.busMu.Unlock()
+	if canBus.echoes[id] == 0 {
+		return false
+	}
+	canBus.echoes[id]--
+	return true
 }
 
-func CanPowerModeHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.PowerMode.Load(frame.Data)
-}
-func CanPressuresHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.Pressures.Load(frame.Data)
-}
-func CanStackCoolantHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.StackCoolant.Load(frame.Data)
-}
-func CanAirFlowHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.AirFlow.Load(frame.Data)
-}
-func CanAlarmsHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.Alarms.Load(frame.Data)
-}
-func CanStackOutputHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.StackOutput.Load(frame.Data)
-}
-func CanCff1Handler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.CffMsg.Load(frame.Data)
-}
-func CanInsulationHanddler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.Insulation.Load(frame.Data)
-}
-func CanStackHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.StackCells.Load(frame.ID, frame.Data)
-}
-func CanATSCoolingFanHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.ATSCoolingFan.Load(frame.Data)
-}
+func flagsHandler(_ can.Frame, _ *CANBus) {
 
-func CanWaterPumpHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.WaterPump.Load(frame.Data)
 }
 
-func CanDCDCConverterHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.DCDCConverter.Load(frame.Data)
-}
-func CanDCOutputHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.DCOutput.Load(frame.Data)
-}
-func CanBMSSettingsHandler(frame can.Frame, _ *CANBus) {
-	FuelCell.mu.Lock()
-	defer FuelCell.mu.Unlock()
-	FuelCell.BMSSettings.Load(frame.Data)
-	if (frame.Data[6] != 0) != FuelCell.SystemInfo.exhaustLastValue {
+func (fc *PANFuelCell) CanKeyOnHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("KeyOn"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.SystemInfo.Run = frame.Data[0] != 0
+}
+
+func (fc *PANFuelCell) CanRunTimeHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("RunTime"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.SystemInfo.SetRunTime(frame.Data[2], frame.Data[3])
+}
+
+func (fc *PANFuelCell) CanPowerModeHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("PowerMode"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.PowerMode.Load(frame.Data, fc)
+}
+func (fc *PANFuelCell) CanPressuresHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("Pressures"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.Pressures.Load(frame.Data, fc)
+}
+func (fc *PANFuelCell) CanStackCoolantHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("StackCoolant"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.StackCoolant.Load(frame.Data, fc)
+}
+func (fc *PANFuelCell) CanAirFlowHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("AirFlow"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.AirFlow.Load(frame.Data, fc)
+}
+func (fc *PANFuelCell) CanAlarmsHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("Alarms"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.Alarms.Load(frame.Data, fc)
+}
+func (fc *PANFuelCell) CanStackOutputHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("StackOutput"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.StackOutput.Load(frame.Data, fc)
+}
+func (fc *PANFuelCell) CanCff1Handler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("H2Concentration"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.CffMsg.Load(frame.Data, fc)
+}
+func (fc *PANFuelCell) CanInsulationHanddler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("Insulation"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.Insulation.Load(frame.Data, fc)
+}
+func (fc *PANFuelCell) CanStackHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("StackCells"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.StackCells.Load(frame.ID, frame.Data, fc)
+}
+func (fc *PANFuelCell) CanATSCoolingFanHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("ATSCoolingFan"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.ATSCoolingFan.Load(frame.Data, fc)
+}
+
+func (fc *PANFuelCell) CanWaterPumpHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("WaterPump"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.WaterPump.Load(frame.Data, fc)
+}
+
+func (fc *PANFuelCell) CanDCDCConverterHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("DCDCConverter"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.DCDCConverter.Load(frame.Data, fc)
+}
+func (fc *PANFuelCell) CanDCOutputHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("DCOutput"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.DCOutput.Load(frame.Data, fc)
+}
+func (fc *PANFuelCell) CanBMSSettingsHandler(frame can.Frame, _ *CANBus) {
+	Freshness.Seen(fc.freshnessName("BMSSettings"))
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.BMSSettings.Load(frame.Data)
+	if (frame.Data[6] != 0) != fc.SystemInfo.exhaustLastValue {
 		// Set the flag if it has changed since the last time we saw it. A timer resets it if it does not keep changing
-		FuelCell.SystemInfo.SetExhaustFlag()
+		fc.SystemInfo.SetExhaustFlag()
 	}
-	FuelCell.SystemInfo.exhaustLastValue = frame.Data[6] != 0
-}
-
-func relayHandler(frame can.Frame, _ *CANBus) {
-	Relays.SetAllRelays(binary.LittleEndian.Uint16(frame.Data[0:2]))
-	Outputs.SetAllOutputs(frame.Data[2])
-	returnedHeartbeat = binary.LittleEndian.Uint16(frame.Data[4:6])
+	fc.SystemInfo.exhaustLastValue = frame.Data[6] != 0
 }
 
-func analogInputs0to3Handler(frame can.Frame, _ *CANBus) {
-	AnalogInputs.SetAnanlog0To3(frame.Data)
-}
-
-func analogInputs4to7Handler(frame can.Frame, _ *CANBus) {
-	AnalogInputs.SetAnanlog4To7(frame.Data)
-}
-
-func analogInputsInternalHandler(frame can.Frame, _ *CANBus) {
-	AnalogInputs.SetAnanlogInternal(frame.Data)
-	Inputs.SetAllInputs(frame.Data[6] & 0xf)
-}
-
-func acVoltsAndAmpsHandler(device uint8, frame can.Frame) {
-	ACMeasurements[device].setVolts(binary.LittleEndian.Uint16(frame.Data[0:2]))
-	ACMeasurements[device].setAmps(binary.LittleEndian.Uint32(frame.Data[2:6]))
-	ACMeasurements[device].setError(0)
-}
-
-func acVoltsAndAmpsHandler0(frame can.Frame, _ *CANBus) {
-	acVoltsAndAmpsHandler(0, frame)
-}
-func acVoltsAndAmpsHandler1(frame can.Frame, _ *CANBus) {
-	acVoltsAndAmpsHandler(1, frame)
-}
-func acVoltsAndAmpsHandler2(frame can.Frame, _ *CANBus) {
-	acVoltsAndAmpsHandler(2, frame)
-}
-func acVoltsAndAmpsHandler3(frame can.Frame, _ *CANBus) {
-	acVoltsAndAmpsHandler(3, frame)
-}
-
-func acPowerAndEnergyHandler(device uint8, frame can.Frame) {
-	ACMeasurements[device].setPower(binary.LittleEndian.Uint32(frame.Data[0:4]))
-	ACMeasurements[device].setEnergy(binary.LittleEndian.Uint32(frame.Data[4:8]))
-	ACMeasurements[device].setError(0)
-}
-func acPowerAndEnergyHandler0(frame can.Frame, _ *CANBus) {
-	acPowerAndEnergyHandler(0, frame)
-}
-func acPowerAndEnergyHandler1(frame can.Frame, _ *CANBus) {
-	acPowerAndEnergyHandler(1, frame)
-}
-func acPowerAndEnergyHandler2(frame can.Frame, _ *CANBus) {
-	acPowerAndEnergyHandler(2, frame)
-}
-func acPowerAndEnergyHandler3(frame can.Frame, _ *CANBus) {
-	acPowerAndEnergyHandler(3, frame)
-}
-
-func acErrorHandler(device uint8, frame can.Frame) {
-	ACMeasurements[device].setError(frame.Data[0])
-}
-func acErrorHandler0(frame can.Frame, _ *CANBus) {
-	acErrorHandler(0, frame)
-}
-func acErrorHandler1(frame can.Frame, _ *CANBus) {
-	acErrorHandler(1, frame)
-}
-func acErrorHandler2(frame can.Frame, _ *CANBus) {
-	acErrorHandler(2, frame)
-}
-func acErrorHandler3(frame can.Frame, _ *CANBus) {
-	acErrorHandler(3, frame)
-}
-
-func acPowerFactorAndFrequencyHandler(device uint8, frame can.Frame) {
-	ACMeasurements[device].setFrequency(binary.LittleEndian.Uint16(frame.Data[0:2]))
-	ACMeasurements[device].setPowerFactor(binary.LittleEndian.Uint16(frame.Data[2:4]))
-	ACMeasurements[device].setError(0)
-}
-func acPowerFactorAndFrequencyHandler0(frame can.Frame, _ *CANBus) {
-	acPowerFactorAndFrequencyHandler(0, frame)
-}
-func acPowerFactorAndFrequencyHandler1(frame can.Frame, _ *CANBus) {
-	acPowerFactorAndFrequencyHandler(1, frame)
-}
-func acPowerFactorAndFrequencyHandler2(frame can.Frame, _ *CANBus) {
-	acPowerFactorAndFrequencyHandler(2, frame)
-}
-func acPowerFactorAndFrequencyHandler3(frame can.Frame, _ *CANBus) {
-	acPowerFactorAndFrequencyHandler(3, frame)
-}
-
-func dcVoltsAndAmpsHandler(device uint8, frame can.Frame) {
-	DCMeasurements[device].setVolts(binary.LittleEndian.Uint16(frame.Data[0:2]))
-	DCMeasurements[device].setAmps(binary.LittleEndian.Uint32(frame.Data[2:6]))
-	DCMeasurements[device].setError(0)
-}
-
-func dcVoltsAndAmpsHandler0(frame can.Frame, _ *CANBus) {
-	dcVoltsAndAmpsHandler(0, frame)
-}
-func dcVoltsAndAmpsHandler1(frame can.Frame, _ *CANBus) {
-	dcVoltsAndAmpsHandler(1, frame)
-}
-func dcVoltsAndAmpsHandler2(frame can.Frame, _ *CANBus) {
-	dcVoltsAndAmpsHandler(2, frame)
-}
-func dcVoltsAndAmpsHandler3(frame can.Frame, _ *CANBus) {
-	dcVoltsAndAmpsHandler(3, frame)
-}
-
-func dcErrorHandler(device uint8, frame can.Frame) {
-	DCMeasurements[device].setError(frame.Data[0])
-}
-func dcErrorHandler0(frame can.Frame, _ *CANBus) {
-	dcErrorHandler(0, frame)
-}
-func dcErrorHandler1(frame can.Frame, _ *CANBus) {
-	dcErrorHandler(1, frame)
-}
-func dcErrorHandler2(frame can.Frame, _ *CANBus) {
-	dcErrorHandler(2, frame)
-}
-func dcErrorHandler3(frame can.Frame, _ *CANBus) {
-	dcErrorHandler(3, frame)
+/*
+Publish transmits a frame on the bus, recording it if the CAN recorder is running.
+It is safe to call on a nil bus, which is reported as not connected, so SetRelays and SetDigitalOutputs are too.
+*/
+func (bus *CANBus) Publish(frame can.Frame) error {
+	if bus == nil {
+		err := fmt.Errorf("CAN bus is not connected")
+		CANStats.Transmitted(err)
+		return err
+	}
+	transport := bus.transport()
+	if transport == nil {
+		err := fmt.Errorf("CAN bus %s is not connected", bus.interfaceName)
+		CANStats.Transmitted(err)
+		return err
+	}
+	CANRecorder.Record(bus.interfaceName, frame, true)
+	if _, loopback := transport.(*MemoryTransport); loopback {
+		bus.sent(frame.ID)
+	} else {
+		// A loopback bus hands the frame straight back to handleCANFrame which shows it there
+		RawFrames.Dispatch(frame, "tx")
+	}
+	err := transport.Publish(frame)
+	CANStats.Transmitted(err)
+	return err
 }
 
-func (bus *CANBus) SetRelays(relays uint16) error {
+func (bus *CANBus) SetRelays(board *BoardType, relays uint16) error {
 	var frame can.Frame
 	binary.LittleEndian.PutUint16(frame.Data[:], relays)
-	frame.Data[2] = Outputs.GetAllOutputs()
+	frame.Data[2] = board.Outputs.GetAllOutputs()
 	binary.LittleEndian.PutUint16(frame.Data[4:6], heartbeat)
-	frame.ID = RelaysAndDigitalOutCanId
+	frame.ID = board.canID(RelaysAndDigitalOutCanId)
 	frame.Length = 8
-	if err := bus.bus.Publish(frame); err != nil {
+	if err := bus.Publish(frame); err != nil {
 		log.Println(err)
 		return err
 	}
 	return nil
 }
 
-func (bus *CANBus) SetDigitalOutputs(outputs uint8) error {
+func (bus *CANBus) SetDigitalOutputs(board *BoardType, outputs uint8) error {
 	var frame can.Frame
-	binary.LittleEndian.PutUint16(frame.Data[:], Relays.GetAllRelays())
+	binary.LittleEndian.PutUint16(frame.Data[:], board.Relays.GetAllRelays())
 	frame.Data[2] = outputs
-	frame.ID = RelaysAndDigitalOutCanId
-	if err := bus.bus.Publish(frame); err != nil {
+	frame.ID = board.canID(RelaysAndDigitalOutCanId)
+	if err := bus.Publish(frame); err != nil {
 		log.Println(err)
 		return err
 	}
 	return nil
 }
 
-func (bus *CANBus) SetFlags(flag0 uint8, flag1 uint8, flag2 uint8, flag3 uint8, flag4 uint8, flag5 uint8, flag6 uint8, flag7 uint8) error {
+func (bus *CANBus) SetFlags(board *BoardType, flag0 uint8, flag1 uint8, flag2 uint8, flag3 uint8, flag4 uint8, flag5 uint8, flag6 uint8, flag7 uint8) error {
 	var frame can.Frame
 	frame.Data[0] = flag0
 	frame.Data[1] = flag1
@@ -450,35 +478,38 @@ func (bus *CANBus) SetFlags(flag0 uint8, flag1 uint8, flag2 uint8, flag3 uint8,
 	frame.Data[5] = flag5
 	frame.Data[6] = flag6
 	frame.Data[7] = flag7
-	frame.ID = FlagsCanId
+	frame.ID = board.canID(FlagsCanId)
 	frame.Length = 8
-	if err := bus.bus.Publish(frame); err != nil {
+	if err := bus.Publish(frame); err != nil {
 		log.Println(err)
 		return err
 	}
 	return nil
 }
 
-func init() {
-	go MonitorCANBusComms()
-}
-
 func MonitorCANBusComms() {
 	heartbeatTimer := time.NewTicker(time.Second * 5)
 	for {
 		<-heartbeatTimer.C
 		diff := heartbeat - returnedHeartbeat
 
-		if diff > 10 {
-			log.Printf("CAN Heartbeat has been lost. Resetting the USB port. Heartbeat = %d | returnedHeartbeat = %d\n", heartbeat, returnedHeartbeat)
+		limit := uint16(10)
+		if currentSettings != nil && currentSettings.CANRecovery.HeartbeatLimit > 0 {
+			limit = currentSettings.CANRecovery.HeartbeatLimit
+		}
+		if diff > limit {
+			log.Printf("CAN Heartbeat has been lost. Heartbeat = %d | returnedHeartbeat = %d\n", heartbeat, returnedHeartbeat)
+			CANStats.SetHeartbeat(heartbeat, returnedHeartbeat, true)
 			heartbeat = 0
 			returnedHeartbeat = 0
-			// Reset the CAN bus interface
-			cmd := exec.Command("usbreset", "1d50:606f")
-			if err := cmd.Start(); err != nil {
-				log.Println("Failed to reset the CAN bus.", err)
-			}
+			// Try to recover the CAN bus interface
+			go CANRecovery.Recover(fmt.Sprintf("heartbeat lost (%d missed)", diff), false)
 		} else {
+			CANStats.SetHeartbeat(heartbeat, returnedHeartbeat, false)
+			CANRecovery.Healthy()
+			for _, board := range Boards[1:] {
+				board.checkHeartbeat(heartbeat, limit)
+			}
 			heartbeat++
 		}
 	}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/brutella/can"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+CANRecorderType writes every frame received or transmitted to a log file in the candump -l -x format
+
+	(1436509052.249713) can0 18FEA3B2#0102030405060708 R
+
+The trailing R or T marks frames we received or transmitted. The file is rotated when it reaches the maximum size,
+keeping a fixed number of old files as name.1, name.2 etc.
+*/
+type CANRecorderType struct {
+	mu       sync.Mutex
+	fileName string
+	maxSize  int64
+	keep     int
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+}
+
+var CANRecorder *CANRecorderType
+
+/*
+NewCANRecorder opens the log file for appending. maxSizeMB is the size at which the file is rotated.
+*/
+func NewCANRecorder(fileName string, maxSizeMB int, keep int) (*CANRecorderType, error) {
+	rec := new(CANRecorderType)
+	rec.fileName = fileName
+	rec.maxSize = int64(maxSizeMB) * 1024 * 1024
+	rec.keep = keep
+	if err := rec.open(); err != nil {
+		return nil, err
+	}
+	go rec.flushLoop()
+	return rec, nil
+}
+
+func (rec *CANRecorderType) open() error {
+	file, err := os.OpenFile(rec.fileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+		return err
+	}
+	rec.file = file
+	rec.writer = bufio.NewWriter(file)
+	rec.size = info.Size()
+	return nil
+}
+
+// rotate must be called with the recorder locked
+func (rec *CANRecorderType) rotate() error {
+	if err := rec.writer.Flush(); err != nil {
+		log.Println(err)
+	}
+	if err := rec.file.Close(); err != nil {
+		log.Println(err)
+	}
+	for i := rec.keep - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", rec.fileName, i), fmt.Sprintf("%s.%d", rec.fileName, i+1)); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+	if rec.keep > 0 {
+		if err := os.Rename(rec.fileName, rec.fileName+".1"); err != nil {
+			log.Println(err)
+		}
+	} else if err := os.Remove(rec.fileName); err != nil {
+		log.Println(err)
+	}
+	return rec.open()
+}
+
+func (rec *CANRecorderType) flushLoop() {
+	flushTime := time.NewTicker(time.Second)
+	for {
+		<-flushTime.C
+		rec.mu.Lock()
+		if rec.writer != nil {
+			if err := rec.writer.Flush(); err != nil {
+				log.Println(err)
+			}
+		}
+		rec.mu.Unlock()
+	}
+}
+
+/*
+Record logs a single frame seen on the named interface. transmitted is set for frames we sent.
+*/
+func (rec *CANRecorderType) Record(interfaceName string, frame can.Frame, transmitted bool) {
+	if rec == nil {
+		return
+	}
+	line := FormatCandump(time.Now(), interfaceName, frame, transmitted)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.writer == nil {
+		return
+	}
+	n, err := rec.writer.WriteString(line)
+	if err != nil {
+		log.Println("CAN recorder -", err)
+		return
+	}
+	rec.size += int64(n)
+	if rec.maxSize > 0 && rec.size >= rec.maxSize {
+		if err := rec.rotate(); err != nil {
+			log.Println("CAN recorder failed to rotate the log -", err)
+			rec.writer = nil
+		}
+	}
+}
+
+/*
+FormatCandump returns the frame as a line in the candump log format with the direction on the end
+*/
+func FormatCandump(when time.Time, interfaceName string, frame can.Frame, transmitted bool) string {
+	direction := "R"
+	if transmitted {
+		direction = "T"
+	}
+	var id string
+	if frame.ID&can.MaskEff != 0 {
+		id = fmt.Sprintf("%08X", frame.ID&can.MaskIDEff)
+	} else {
+		id = fmt.Sprintf("%03X", frame.ID&can.MaskIDSff)
+	}
+	length := frame.Length
+	if length > can.MaxFrameDataLength {
+		length = can.MaxFrameDataLength
+	}
+	if frame.ID&can.MaskRtr != 0 {
+		return fmt.Sprintf("(%d.%06d) %s %s#R %s\n", when.Unix(), when.Nanosecond()/1000, interfaceName, id, direction)
+	}
+	return fmt.Sprintf("(%d.%06d) %s %s#%s %s\n", when.Unix(), when.Nanosecond()/1000, interfaceName, id,
+		strings.ToUpper(hex.EncodeToString(frame.Data[:length])), direction)
+}
+
+/*
+ParseCandump decodes a single candump log line. Extended IDs (more than 3 hex digits) get the EFF flag set so they
+match the IDs used by the frame handlers. transmitted is set when the line ends in T. Lines without a direction
+are taken as received.
+*/
+func ParseCandump(line string) (when time.Time, interfaceName string, frame can.Frame, transmitted bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		err = fmt.Errorf("invalid candump line - %s", line)
+		return
+	}
+	ts := strings.Trim(fields[0], "()")
+	parts := strings.SplitN(ts, ".", 2)
+	secs, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return
+	}
+	var micros int64
+	if len(parts) == 2 {
+		fraction := (parts[1] + "000000")[:6]
+		if micros, err = strconv.ParseInt(fraction, 10, 64); err != nil {
+			return
+		}
+	}
+	when = time.Unix(secs, micros*1000)
+	interfaceName = fields[1]
+	transmitted = len(fields) > 3 && fields[3] == "T"
+
+	idData := strings.SplitN(fields[2], "#", 2)
+	if len(idData) != 2 {
+		err = fmt.Errorf("invalid frame in candump line - %s", fields[2])
+		return
+	}
+	id, err := strconv.ParseUint(idData[0], 16, 32)
+	if err != nil {
+		return
+	}
+	frame.ID = uint32(id)
+	if len(idData[0]) > 3 {
+		frame.ID |= can.MaskEff
+	}
+	if strings.HasPrefix(idData[1], "#") {
+		err = fmt.Errorf("CAN FD frames are not supported - %s", fields[2])
+		return
+	}
+	if strings.HasPrefix(strings.ToUpper(idData[1]), "R") {
+		frame.ID |= can.MaskRtr
+		return
+	}
+	data, err := hex.DecodeString(strings.ReplaceAll(idData[1], ".", ""))
+	if err != nil {
+		return
+	}
+	if len(data) > can.MaxFrameDataLength {
+		err = fmt.Errorf("frame data too long - %s", fields[2])
+		return
+	}
+	frame.Length = uint8(len(data))
+	copy(frame.Data[:], data)
+	return
+}
+
+/*
+ReplayCANLog feeds the received frames in a recorded candump file through the frame handlers of the given bus.
+Frames we transmitted are skipped. speed is a multiplier of real time (2 = twice as fast). A speed of zero replays
+the frames as fast as they can be decoded.
+*/
+func ReplayCANLog(fileName string, speed float64, bus *CANBus) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	log.Printf("Replaying %s at %0.1fx", fileName, speed)
+	var first time.Time
+	start := time.Now()
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		when, _, frame, transmitted, err := ParseCandump(line)
+		if err != nil {
+			log.Printf("%s line %d - %v", fileName, lineNum, err)
+			continue
+		}
+		if transmitted {
+			continue
+		}
+		if first.IsZero() {
+			first = when
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(when.Sub(first)) / speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		bus.handleCANFrame(frame)
+		count++
+	}
+	log.Printf("Replay of %s finished. %d frames", fileName, count)
+	return scanner.Err()
+}
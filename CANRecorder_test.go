@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/brutella/can"
+	"testing"
+	"time"
+)
+
+func TestParseCandump(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		when        time.Time
+		iface       string
+		frame       can.Frame
+		transmitted bool
+		wantErr     bool
+	}{
+		{name: "Extended frame", line: "(1436509052.249713) can0 18FEA3B2#0102030405060708",
+			when: time.Unix(1436509052, 249713000), iface: "can0",
+			frame: can.Frame{ID: 0x18FEA3B2 | can.MaskEff, Length: 8, Data: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{name: "Standard frame received", line: "(1436509052.000001) vcan1 011#00FF R",
+			when: time.Unix(1436509052, 1000), iface: "vcan1",
+			frame: can.Frame{ID: 0x011, Length: 2, Data: [8]byte{0x00, 0xFF}}},
+		{name: "Transmitted", line: "(1436509052.5) can0 010#0A T",
+			when: time.Unix(1436509052, 500000000), iface: "can0",
+			frame: can.Frame{ID: 0x010, Length: 1, Data: [8]byte{0x0A}}, transmitted: true},
+		{name: "Dotted data", line: "(1.000000) can0 123#11.22.33",
+			when: time.Unix(1, 0), iface: "can0",
+			frame: can.Frame{ID: 0x123, Length: 3, Data: [8]byte{0x11, 0x22, 0x33}}},
+		{name: "Remote request", line: "(1.000000) can0 123#R",
+			when: time.Unix(1, 0), iface: "can0", frame: can.Frame{ID: 0x123 | can.MaskRtr}},
+		{name: "Empty data", line: "(1.000000) can0 123#", when: time.Unix(1, 0), iface: "can0",
+			frame: can.Frame{ID: 0x123}},
+		{name: "Too few fields", line: "(1.000000) can0", wantErr: true},
+		{name: "No separator", line: "(1.000000) can0 12300", wantErr: true},
+		{name: "Bad timestamp", line: "(x.000000) can0 123#00", wantErr: true},
+		{name: "Bad data", line: "(1.000000) can0 123#0G", wantErr: true},
+		{name: "Too long", line: "(1.000000) can0 123#000102030405060708", wantErr: true},
+		{name: "CAN FD", line: "(1.000000) can0 123##100", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			when, iface, frame, transmitted, err := ParseCandump(test.line)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("ParseCandump(%q) returned no error", test.line)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCandump(%q) - %v", test.line, err)
+			}
+			if !when.Equal(test.when) || iface != test.iface || frame != test.frame || transmitted != test.transmitted {
+				t.Errorf("ParseCandump(%q) = %v %s %+v %v, want %v %s %+v %v", test.line, when, iface, frame, transmitted,
+					test.when, test.iface, test.frame, test.transmitted)
+			}
+		})
+	}
+}
+
+func TestFormatCandump(t *testing.T) {
+	when := time.Unix(1436509052, 249713000)
+	tests := []struct {
+		name        string
+		frame       can.Frame
+		transmitted bool
+		want        string
+	}{
+		{"Extended frame", can.Frame{ID: 0x18FEA3B2 | can.MaskEff, Length: 8, Data: [8]byte{1, 2, 3, 4, 5, 6, 7, 0xAB}}, false,
+			"(1436509052.249713) can0 18FEA3B2#01020304050607AB R\n"},
+		{"Standard frame", can.Frame{ID: 0x011, Length: 2, Data: [8]byte{0x00, 0xFF}}, true,
+			"(1436509052.249713) can0 011#00FF T\n"},
+		{"Remote request", can.Frame{ID: 0x123 | can.MaskRtr}, false, "(1436509052.249713) can0 123#R R\n"},
+		{"Length beyond 8", can.Frame{ID: 0x001, Length: 9, Data: [8]byte{1}}, false,
+			"(1436509052.249713) can0 001#0100000000000000 R\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := FormatCandump(when, "can0", test.frame, test.transmitted)
+			if line != test.want {
+				t.Fatalf("FormatCandump = %q, want %q", line, test.want)
+			}
+			// Every line we write must read back as the same frame
+			parsedWhen, iface, frame, transmitted, err := ParseCandump(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.frame
+			if want.Length > can.MaxFrameDataLength {
+				want.Length = can.MaxFrameDataLength
+			}
+			if !parsedWhen.Equal(when) || iface != "can0" || frame != want || transmitted != test.transmitted {
+				t.Errorf("%q read back as %v %s %+v %v", line, parsedWhen, iface, frame, transmitted)
+			}
+		})
+	}
+}
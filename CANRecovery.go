@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+CANRecovery tries to bring the CAN adapter back when the heartbeat from the FireflyIO board is lost. The configured
+strategies are tried in turn, one per attempt, with the delay between attempts doubling up to a maximum. Once the
+heartbeat returns the backoff is reset.
+*/
+
+// Recovery strategies
+const (
+	RecoveryLinkRestart = "linkRestart" // Take the interface down and bring it back up
+	RecoverySetBitrate  = "setBitrate"  // Take the interface down, set the bitrate and bring it back up
+	RecoveryCommand     = "command"     // Run a shell command
+	RecoveryUSBReset    = "usbReset"    // Reset the USB adapter with the given vendor:product
+)
+
+const recoveryHistorySize = 50
+const recoveryCommandTimeout = time.Second * 30
+
+type CANRecoverySettingsType struct {
+	Strategies        []string // Tried in this order, one per attempt
+	USBDevice         string   // vendor:product for usbReset
+	Bitrate           uint32   // bits per second for setBitrate
+	Command           string   // Shell command for the command strategy. Only read from the settings file
+	HeartbeatLimit    uint16   // Heartbeats that can be missed before recovery starts
+	BackoffSeconds    float64  // Delay after the first attempt
+	MaxBackoffSeconds float64  // Longest delay between attempts
+}
+
+type RecoveryAttemptType struct {
+	Time      time.Time
+	Reason    string
+	Strategy  string
+	Succeeded bool   // The recovery action completed without error
+	Recovered bool   // The heartbeat returned after this attempt
+	Error     string `json:",omitempty"`
+	Output    string `json:",omitempty"`
+}
+
+type CANRecoveryType struct {
+	mu          sync.Mutex
+	attempts    int // Attempts since the heartbeat was last healthy
+	backoff     time.Duration
+	nextAttempt time.Time
+	running     bool
+	disabled    string // Why recovery is turned off. Empty while it is available
+	history     []RecoveryAttemptType
+}
+
+var CANRecovery CANRecoveryType
+
+func defaultCANRecoverySettings() CANRecoverySettingsType {
+	return CANRecoverySettingsType{
+		Strategies:        []string{RecoveryUSBReset},
+		USBDevice:         "1d50:606f",
+		HeartbeatLimit:    10,
+		BackoffSeconds:    5,
+		MaxBackoffSeconds: 300,
+	}
+}
+
+func (s *CANRecoverySettingsType) validate() error {
+	if len(s.Strategies) == 0 {
+		return fmt.Errorf("at least one recovery strategy is required")
+	}
+	for _, strategy := range s.Strategies {
+		switch strategy {
+		case RecoveryLinkRestart:
+		case RecoverySetBitrate:
+			if s.Bitrate == 0 {
+				return fmt.Errorf("%s requires a bitrate", strategy)
+			}
+		case RecoveryCommand:
+			if strings.TrimSpace(s.Command) == "" {
+				return fmt.Errorf("%s requires a command", strategy)
+			}
+		case RecoveryUSBReset:
+			if !strings.Contains(s.USBDevice, ":") {
+				return fmt.Errorf("%s requires a USB device as vendor:product", strategy)
+			}
+		default:
+			return fmt.Errorf("unknown recovery strategy %s", strategy)
+		}
+	}
+	if s.HeartbeatLimit == 0 {
+		return fmt.Errorf("the heartbeat limit must be greater than zero")
+	}
+	if s.BackoffSeconds <= 0 || s.MaxBackoffSeconds < s.BackoffSeconds {
+		return fmt.Errorf("invalid backoff %0.1f - %0.1f seconds", s.BackoffSeconds, s.MaxBackoffSeconds)
+	}
+	return nil
+}
+
+/*
+Disable turns recovery off, for example while replaying a CAN log where there is no adapter to recover
+*/
+func (r *CANRecoveryType) Disable(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disabled = reason
+}
+
+/*
+Recover runs the next recovery strategy unless we are still waiting for the backoff delay to expire.
+Set force to ignore the backoff.
+*/
+func (r *CANRecoveryType) Recover(reason string, force bool) {
+	settings := currentSettings.CANRecovery
+	r.mu.Lock()
+	if r.running || r.disabled != "" || (!force && time.Now().Before(r.nextAttempt)) {
+		r.mu.Unlock()
+		return
+	}
+	r.running = true
+	strategy := RecoveryUSBReset
+	if len(settings.Strategies) > 0 {
+		strategy = settings.Strategies[r.attempts%len(settings.Strategies)]
+	}
+	r.attempts++
+	if r.backoff == 0 {
+		r.backoff = time.Duration(settings.BackoffSeconds * float64(time.Second))
+	} else {
+		r.backoff *= 2
+	}
+	if maxBackoff := time.Duration(settings.MaxBackoffSeconds * float64(time.Second)); r.backoff > maxBackoff {
+		r.backoff = maxBackoff
+	}
+	r.nextAttempt = time.Now().Add(r.backoff)
+	r.mu.Unlock()
+
+	attempt := RecoveryAttemptType{Time: time.Now(), Reason: reason, Strategy: strategy}
+	log.Printf("CAN recovery attempt using %s - %s", strategy, reason)
+	output, err := runRecoveryStrategy(strategy, settings)
+	attempt.Output = strings.TrimSpace(output)
+	if err != nil {
+		attempt.Error = err.Error()
+		log.Println("CAN recovery failed -", err)
+	} else {
+		attempt.Succeeded = true
+	}
+
+	// Drop the connection so ClientLoop reconnects to the recovered interface
+	if canBus != nil {
+		if transport := canBus.transport(); transport != nil {
+			if err := transport.Disconnect(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.running = false
+	r.history = append(r.history, attempt)
+	if len(r.history) > recoveryHistorySize {
+		r.history = r.history[len(r.history)-recoveryHistorySize:]
+	}
+	r.mu.Unlock()
+}
+
+/*
+Healthy is called while the heartbeat is good. It marks the last attempt as having recovered the bus and resets the
+backoff.
+*/
+func (r *CANRecoveryType) Healthy() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.attempts == 0 || r.running {
+		return
+	}
+	log.Printf("CAN bus recovered after %d attempt(s)", r.attempts)
+	if len(r.history) > 0 {
+		r.history[len(r.history)-1].Recovered = true
+	}
+	r.attempts = 0
+	r.backoff = 0
+	r.nextAttempt = time.Time{}
+}
+
+func runRecoveryStrategy(strategy string, settings CANRecoverySettingsType) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), recoveryCommandTimeout)
+	defer cancel()
+	run := func(name string, args ...string) (string, error) {
+		out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+		if err != nil {
+			return string(out), fmt.Errorf("%s %s - %v", name, strings.Join(args, " "), err)
+		}
+		return string(out), nil
+	}
+
+	switch strategy {
+	case RecoveryLinkRestart, RecoverySetBitrate:
+		if CANInterface == MemoryTransportName || CANInterface == LoopbackTransportName {
+			return "", fmt.Errorf("%s is not a SocketCAN interface", CANInterface)
+		}
+		output, err := run("ip", "link", "set", "dev", CANInterface, "down")
+		if err != nil {
+			return output, err
+		}
+		if strategy == RecoverySetBitrate {
+			out, err := run("ip", "link", "set", "dev", CANInterface, "type", "can", "bitrate", fmt.Sprint(settings.Bitrate))
+			output += out
+			if err != nil {
+				return output, err
+			}
+		}
+		out, err := run("ip", "link", "set", "dev", CANInterface, "up")
+		return output + out, err
+	case RecoveryCommand:
+		return run("sh", "-c", settings.Command)
+	case RecoveryUSBReset:
+		return run("usbreset", settings.USBDevice)
+	}
+	return "", fmt.Errorf("unknown recovery strategy %s", strategy)
+}
+
+type CANRecoveryStatusType struct {
+	Recovering  bool
+	Disabled    string `json:",omitempty"` // Why recovery is turned off
+	Attempts    int
+	Backoff     float64    // Seconds
+	NextAttempt *time.Time `json:",omitempty"`
+	Settings    CANRecoverySettingsType
+	History     []RecoveryAttemptType
+}
+
+func (r *CANRecoveryType) Status() CANRecoveryStatusType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := CANRecoveryStatusType{Recovering: r.running, Disabled: r.disabled, Attempts: r.attempts, Backoff: r.backoff.Seconds(),
+		Settings: currentSettings.CANRecovery}
+	if !r.nextAttempt.IsZero() {
+		next := r.nextAttempt
+		status.NextAttempt = &next
+	}
+	status.History = make([]RecoveryAttemptType, len(r.history))
+	copy(status.History, r.history)
+	return status
+}
+
+func getCANRecovery(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get CAN Recovery"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(CANRecovery.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+// startCANRecovery runs the next recovery strategy immediately
+func startCANRecovery(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Start CAN Recovery"
+	if !authorised(w, r, deviceString) {
+		return
+	}
+	if status := CANRecovery.Status(); status.Disabled != "" {
+		ReturnJSONErrorString(w, deviceString, "CAN recovery is turned off - "+status.Disabled, http.StatusConflict, false)
+		return
+	}
+	go CANRecovery.Recover("requested through the API", true)
+	getCANRecovery(w, r)
+}
+
+/*
+setCANRecoverySettings updates the recovery settings from the JSON body. The command run by the command strategy
+cannot be changed here. It can only be set in the settings file.
+*/
+func setCANRecoverySettings(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set CAN Recovery"
+	if !authorised(w, r, deviceString) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	settings := currentSettings.CANRecovery
+	if err := json.Unmarshal(body, &settings); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if settings.Command != currentSettings.CANRecovery.Command {
+		ReturnJSONErrorString(w, deviceString, "The recovery command can only be set in the settings file", http.StatusForbidden, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	currentSettings.CANRecovery = settings
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getCANRecovery(w, r)
+}
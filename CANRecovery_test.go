@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+func TestCANRecoverySettingsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(s *CANRecoverySettingsType)
+		wantErr bool
+	}{
+		{name: "Defaults", change: func(s *CANRecoverySettingsType) {}},
+		{name: "No strategies", change: func(s *CANRecoverySettingsType) { s.Strategies = nil }, wantErr: true},
+		{name: "Unknown strategy", change: func(s *CANRecoverySettingsType) { s.Strategies = []string{"reboot"} }, wantErr: true},
+		{name: "Bitrate missing", change: func(s *CANRecoverySettingsType) { s.Strategies = []string{RecoverySetBitrate} }, wantErr: true},
+		{name: "Bitrate given", change: func(s *CANRecoverySettingsType) {
+			s.Strategies = []string{RecoveryLinkRestart, RecoverySetBitrate}
+			s.Bitrate = 250000
+		}},
+		{name: "Command missing", change: func(s *CANRecoverySettingsType) { s.Strategies = []string{RecoveryCommand} }, wantErr: true},
+		{name: "Bad USB device", change: func(s *CANRecoverySettingsType) { s.USBDevice = "1d50" }, wantErr: true},
+		{name: "No heartbeat limit", change: func(s *CANRecoverySettingsType) { s.HeartbeatLimit = 0 }, wantErr: true},
+		{name: "Maximum below the backoff", change: func(s *CANRecoverySettingsType) { s.MaxBackoffSeconds = 1 }, wantErr: true},
+	}
+	for _, test := range tests {
+		settings := defaultCANRecoverySettings()
+		test.change(&settings)
+		if err := settings.validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: validate returned %v", test.name, err)
+		}
+	}
+}
+
+/*
+TestCANRecoveryStrategies runs the strategies in turn against the in-memory bus, where linkRestart fails, and checks
+the backoff doubles up to its limit and is reset once the heartbeat returns
+*/
+func TestCANRecoveryStrategies(t *testing.T) {
+	saved := currentSettings.CANRecovery
+	savedBus := canBus
+	defer func() {
+		currentSettings.CANRecovery = saved
+		canBus = savedBus
+	}()
+	// Recovery drops the connection to the bus. Keep the test bus connected for the other tests.
+	canBus = nil
+	currentSettings.CANRecovery = CANRecoverySettingsType{Strategies: []string{RecoveryCommand, RecoveryLinkRestart},
+		Command: "echo recovered", HeartbeatLimit: 10, BackoffSeconds: 5, MaxBackoffSeconds: 12}
+
+	var recovery CANRecoveryType
+	steps := []struct {
+		name      string
+		force     bool
+		attempts  int
+		strategy  string // Of the latest attempt
+		succeeded bool
+		backoff   float64
+	}{
+		{name: "First attempt", attempts: 1, strategy: RecoveryCommand, succeeded: true, backoff: 5},
+		{name: "Held off by the backoff", attempts: 1, strategy: RecoveryCommand, succeeded: true, backoff: 5},
+		{name: "Forced", force: true, attempts: 2, strategy: RecoveryLinkRestart, backoff: 10},
+		{name: "Backoff limited", force: true, attempts: 3, strategy: RecoveryCommand, succeeded: true, backoff: 12},
+	}
+	for _, step := range steps {
+		recovery.Recover("heartbeat lost", step.force)
+		status := recovery.Status()
+		if status.Attempts != step.attempts || len(status.History) != step.attempts || status.Backoff != step.backoff {
+			t.Fatalf("%s: %d attempts, %d in the history, backoff %vs, want %d and %vs", step.name, status.Attempts,
+				len(status.History), status.Backoff, step.attempts, step.backoff)
+		}
+		latest := status.History[len(status.History)-1]
+		if latest.Strategy != step.strategy || latest.Succeeded != step.succeeded {
+			t.Errorf("%s: latest attempt %s succeeded %v, want %s %v", step.name, latest.Strategy, latest.Succeeded,
+				step.strategy, step.succeeded)
+		}
+		if latest.Succeeded && latest.Output != "recovered" {
+			t.Errorf("%s: output %q", step.name, latest.Output)
+		}
+		if !latest.Succeeded && latest.Error == "" {
+			t.Errorf("%s: the failed attempt has no error", step.name)
+		}
+	}
+
+	recovery.Healthy()
+	status := recovery.Status()
+	if status.Attempts != 0 || status.Backoff != 0 || status.NextAttempt != nil {
+		t.Errorf("after the heartbeat returned: %d attempts, backoff %vs, next %v", status.Attempts, status.Backoff, status.NextAttempt)
+	}
+	if !status.History[len(status.History)-1].Recovered {
+		t.Error("the last attempt is not marked as having recovered the bus")
+	}
+	if status.History[0].Recovered {
+		t.Error("an earlier attempt is marked as having recovered the bus")
+	}
+
+	recovery.Disable("replaying a CAN log")
+	recovery.Recover("heartbeat lost", true)
+	if status := recovery.Status(); len(status.History) != len(steps)-1 || status.Disabled == "" {
+		t.Errorf("recovery ran while turned off")
+	}
+}
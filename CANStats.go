@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/brutella/can"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+CANStatsType counts the frames received and transmitted so wiring and termination problems can be diagnosed on site.
+Rates are recalculated every second. The interface counters are read from the kernel when the statistics are
+requested or a client is listening on /can/ws.
+*/
+
+type FrameStatsType struct {
+	ID        string
+	Name      string  // Message name from the DBC definitions if known
+	Handled   bool    // There is a frame handler for this ID
+	Count     uint64  // Frames received since startup
+	Rate      float64 // Frames per second over the last second
+	LastSeen  time.Time
+	LastData  string // Hex payload of the last frame
+	lastCount uint64
+}
+
+type CANInterfaceStatsType struct {
+	Name            string
+	State           string // ERROR-ACTIVE, ERROR-WARNING, ERROR-PASSIVE, BUS-OFF, STOPPED
+	RxPackets       uint64
+	RxErrors        uint64
+	RxDropped       uint64
+	RxOverErrors    uint64
+	TxPackets       uint64
+	TxErrors        uint64
+	TxDropped       uint64
+	BusErrors       uint64
+	ErrorWarning    uint64
+	ErrorPassive    uint64
+	BusOff          uint64
+	ArbitrationLost uint64
+	Restarts        uint64
+	TxErrorCounter  uint64 // Current transmit error counter from the controller
+	RxErrorCounter  uint64 // Current receive error counter from the controller
+	Error           string `json:",omitempty"`
+}
+
+type HeartbeatStatsType struct {
+	Sent     uint16
+	Returned uint16
+	Lag      uint16 // Heartbeats sent that have not come back from the board
+	Resets   uint64 // Number of times the heartbeat from the board has been lost
+}
+
+type CANStatsType struct {
+	mu            sync.Mutex
+	frames        map[uint32]*FrameStatsType
+	rxCount       uint64
+	txCount       uint64
+	txErrors      uint64
+	lastTxError   string
+	lastTxErrorAt time.Time
+	rxRate        float64
+	txRate        float64
+	lastRx        uint64
+	lastTx        uint64
+	heartbeat     HeartbeatStatsType
+}
+
+type CANStatsReportType struct {
+	Interface     string
+	Time          time.Time
+	RxFrames      uint64
+	RxRate        float64
+	TxFrames      uint64
+	TxRate        float64
+	TxErrors      uint64
+	LastTxError   string     `json:",omitempty"`
+	LastTxErrorAt *time.Time `json:",omitempty"`
+	Heartbeat     HeartbeatStatsType
+	Frames        []FrameStatsType
+	Kernel        *CANInterfaceStatsType `json:",omitempty"`
+}
+
+var CANStats CANStatsType
+var canStatsPool Pool
+
+func init() {
+	CANStats.frames = make(map[uint32]*FrameStatsType)
+}
+
+/*
+Received counts a received frame
+*/
+func (s *CANStatsType) Received(frame can.Frame, handled bool) {
+	length := frame.Length
+	if length > can.MaxFrameDataLength {
+		length = can.MaxFrameDataLength
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rxCount++
+	stats, found := s.frames[frame.ID]
+	if !found {
+		stats = new(FrameStatsType)
+		if frame.ID&can.MaskEff != 0 {
+			stats.ID = fmt.Sprintf("0x%08X", frame.ID&can.MaskIDEff)
+		} else {
+			stats.ID = fmt.Sprintf("0x%03X", frame.ID&can.MaskIDSff)
+		}
+		s.frames[frame.ID] = stats
+	}
+	stats.Handled = handled
+	stats.Count++
+	stats.LastSeen = time.Now()
+	stats.LastData = strings.ToUpper(hex.EncodeToString(frame.Data[:length]))
+}
+
+/*
+Transmitted counts a frame passed to Publish and the error, if any, that it returned
+*/
+func (s *CANStatsType) Transmitted(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.txErrors++
+		s.lastTxError = err.Error()
+		s.lastTxErrorAt = time.Now()
+	} else {
+		s.txCount++
+	}
+}
+
+/*
+SetHeartbeat records the heartbeat sent to the board and the value it last returned
+*/
+func (s *CANStatsType) SetHeartbeat(sent uint16, returned uint16, reset bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heartbeat.Sent = sent
+	s.heartbeat.Returned = returned
+	s.heartbeat.Lag = sent - returned
+	if reset {
+		s.heartbeat.Resets++
+	}
+}
+
+// updateRates must be called once a second
+func (s *CANStatsType) updateRates(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stats := range s.frames {
+		stats.Rate = math.Round(float64(stats.Count-stats.lastCount)/seconds*100) / 100
+		stats.lastCount = stats.Count
+	}
+	s.rxRate = math.Round(float64(s.rxCount-s.lastRx)/seconds*100) / 100
+	s.lastRx = s.rxCount
+	s.txRate = math.Round(float64(s.txCount-s.lastTx)/seconds*100) / 100
+	s.lastTx = s.txCount
+}
+
+/*
+Report returns a copy of the statistics. The kernel counters are only read for SocketCAN and virtual interfaces.
+*/
+func (s *CANStatsType) Report(bus *CANBus) CANStatsReportType {
+	var report CANStatsReportType
+	s.mu.Lock()
+	report.Time = time.Now()
+	report.RxFrames = s.rxCount
+	report.RxRate = s.rxRate
+	report.TxFrames = s.txCount
+	report.TxRate = s.txRate
+	report.TxErrors = s.txErrors
+	report.LastTxError = s.lastTxError
+	if !s.lastTxErrorAt.IsZero() {
+		when := s.lastTxErrorAt
+		report.LastTxErrorAt = &when
+	}
+	report.Heartbeat = s.heartbeat
+	report.Frames = make([]FrameStatsType, 0, len(s.frames))
+	for id, stats := range s.frames {
+		frame := *stats
+		frame.Name = CANDatabase().MessageName(id)
+		report.Frames = append(report.Frames, frame)
+	}
+	s.mu.Unlock()
+	sort.Slice(report.Frames, func(i, j int) bool { return report.Frames[i].ID < report.Frames[j].ID })
+
+	if bus != nil {
+		report.Interface = bus.interfaceName
+		if transport := bus.transport(); transport != nil {
+			if _, memory := transport.(*MemoryTransport); !memory {
+				report.Kernel = ReadCANInterfaceStats(bus.interfaceName)
+			}
+		}
+	}
+	return report
+}
+
+/*
+ReadCANInterfaceStats reads the interface counters from /sys/class/net/<interface>/statistics and adds the CAN
+controller state and error counters
+*/
+func ReadCANInterfaceStats(interfaceName string) *CANInterfaceStatsType {
+	stats := &CANInterfaceStatsType{Name: interfaceName}
+	dir := filepath.Join("/sys/class/net", interfaceName, "statistics")
+	counters := []struct {
+		file  string
+		value *uint64
+	}{
+		{"rx_packets", &stats.RxPackets},
+		{"rx_errors", &stats.RxErrors},
+		{"rx_dropped", &stats.RxDropped},
+		{"rx_over_errors", &stats.RxOverErrors},
+		{"tx_packets", &stats.TxPackets},
+		{"tx_errors", &stats.TxErrors},
+		{"tx_dropped", &stats.TxDropped},
+	}
+	for _, counter := range counters {
+		text, err := ioutil.ReadFile(filepath.Join(dir, counter.file))
+		if err != nil {
+			stats.Error = err.Error()
+			return stats
+		}
+		if *counter.value, err = strconv.ParseUint(strings.TrimSpace(string(text)), 10, 64); err != nil {
+			stats.Error = err.Error()
+			return stats
+		}
+	}
+	canControllers.read(interfaceName, stats)
+	return stats
+}
+
+// How long the CAN controller state is kept before ip is run again
+const canControllerRefresh = time.Second * 5
+
+/*
+canControllerCacheType holds the CAN controller state and error counters. They are only available through netlink
+so they come from the ip utility, which is run at most once every canControllerRefresh.
+*/
+type canControllerCacheType struct {
+	mu            sync.Mutex
+	interfaceName string
+	readAt        time.Time
+	stats         CANInterfaceStatsType
+	err           string
+}
+
+var canControllers canControllerCacheType
+
+// read copies the controller fields into stats, running ip if the cached values are too old
+func (c *canControllerCacheType) read(interfaceName string, stats *CANInterfaceStatsType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.interfaceName != interfaceName || time.Since(c.readAt) > canControllerRefresh {
+		c.interfaceName = interfaceName
+		c.readAt = time.Now()
+		c.stats, c.err = CANInterfaceStatsType{}, ""
+		if err := readCANController(interfaceName, &c.stats); err != nil {
+			c.err = err.Error()
+		}
+	}
+	stats.State = c.stats.State
+	stats.BusErrors = c.stats.BusErrors
+	stats.ErrorWarning = c.stats.ErrorWarning
+	stats.ErrorPassive = c.stats.ErrorPassive
+	stats.BusOff = c.stats.BusOff
+	stats.ArbitrationLost = c.stats.ArbitrationLost
+	stats.Restarts = c.stats.Restarts
+	stats.TxErrorCounter = c.stats.TxErrorCounter
+	stats.RxErrorCounter = c.stats.RxErrorCounter
+	if c.err != "" {
+		stats.Error = c.err
+	}
+}
+
+// readCANController reads the CAN controller state and error counters using ip -details -statistics -json
+func readCANController(interfaceName string, stats *CANInterfaceStatsType) error {
+	type ipLink struct {
+		LinkInfo struct {
+			InfoData struct {
+				State       string `json:"state"`
+				BerrCounter struct {
+					Tx uint64 `json:"tx"`
+					Rx uint64 `json:"rx"`
+				} `json:"berr_counter"`
+			} `json:"info_data"`
+			InfoXStats struct {
+				Restarts        uint64 `json:"restarts"`
+				BusError        uint64 `json:"bus_error"`
+				ArbitrationLost uint64 `json:"arbitration_lost"`
+				ErrorWarning    uint64 `json:"error_warning"`
+				ErrorPassive    uint64 `json:"error_passive"`
+				BusOff          uint64 `json:"bus_off"`
+			} `json:"info_xstats"`
+		} `json:"linkinfo"`
+	}
+
+	out, err := exec.Command("ip", "-details", "-statistics", "-json", "link", "show", "dev", interfaceName).Output()
+	if err != nil {
+		return err
+	}
+	var links []ipLink
+	if err := json.Unmarshal(out, &links); err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		return fmt.Errorf("interface not found")
+	}
+	link := links[0]
+	stats.State = link.LinkInfo.InfoData.State
+	stats.BusErrors = link.LinkInfo.InfoXStats.BusError
+	stats.ErrorWarning = link.LinkInfo.InfoXStats.ErrorWarning
+	stats.ErrorPassive = link.LinkInfo.InfoXStats.ErrorPassive
+	stats.BusOff = link.LinkInfo.InfoXStats.BusOff
+	stats.ArbitrationLost = link.LinkInfo.InfoXStats.ArbitrationLost
+	stats.Restarts = link.LinkInfo.InfoXStats.Restarts
+	stats.TxErrorCounter = link.LinkInfo.InfoData.BerrCounter.Tx
+	stats.RxErrorCounter = link.LinkInfo.InfoData.BerrCounter.Rx
+	return nil
+}
+
+/*
+CANStatsLoop recalculates the rates every second and pushes the statistics to any clients registered on /can/ws.
+The report is only built while there is a client.
+*/
+func CANStatsLoop() {
+	statsTime := time.NewTicker(time.Second)
+	last := time.Now()
+	for {
+		now := <-statsTime.C
+		CANStats.updateRates(now.Sub(last))
+		last = now
+		if canStatsPool.ClientCount() == 0 {
+			continue
+		}
+
+		bytes, err := json.Marshal(CANStats.Report(canBus))
+		if err != nil {
+			log.Print("Error marshalling the CAN statistics - ", err)
+			continue
+		}
+		select {
+		case canStatsPool.Broadcast <- bytes:
+		default:
+		}
+	}
+}
+
+func getCANStats(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get CAN Stats"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(CANStats.Report(canBus)); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func startCANStatsWebSocket(w http.ResponseWriter, r *http.Request) {
+	registerWebSocket(&canStatsPool, w, r)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"github.com/brutella/can"
+	"testing"
+	"time"
+)
+
+func TestCANStats(t *testing.T) {
+	stats := CANStatsType{frames: make(map[uint32]*FrameStatsType)}
+	for i := 0; i < 4; i++ {
+		stats.Received(can.Frame{ID: 0x110, Length: 2, Data: [8]byte{0xAB, 0xCD, 0xEF}}, true)
+	}
+	stats.Received(can.Frame{ID: 0x18FF0001 | can.MaskEff, Length: 12}, false)
+	stats.Received(can.Frame{ID: 0x010, Length: 1, Data: [8]byte{0x01}}, false)
+	stats.Transmitted(nil)
+	stats.Transmitted(nil)
+	stats.Transmitted(errors.New("no buffer space available"))
+	stats.updateRates(2 * time.Second)
+	stats.SetHeartbeat(2, 0xFFFF, false)
+	stats.SetHeartbeat(3, 0xFFFF, true)
+
+	report := stats.Report(nil)
+	if report.RxFrames != 6 || report.TxFrames != 2 || report.TxErrors != 1 {
+		t.Errorf("rx %d, tx %d, tx errors %d, want 6, 2 and 1", report.RxFrames, report.TxFrames, report.TxErrors)
+	}
+	if report.RxRate != 3 || report.TxRate != 1 {
+		t.Errorf("rx rate %v, tx rate %v, want 3 and 1", report.RxRate, report.TxRate)
+	}
+	if report.LastTxError != "no buffer space available" || report.LastTxErrorAt == nil {
+		t.Errorf("last transmit error %q at %v", report.LastTxError, report.LastTxErrorAt)
+	}
+	if report.Heartbeat.Lag != 4 || report.Heartbeat.Resets != 1 {
+		t.Errorf("heartbeat lag %d, resets %d, want 4 and 1", report.Heartbeat.Lag, report.Heartbeat.Resets)
+	}
+
+	want := []FrameStatsType{
+		{ID: "0x010", Count: 1, Rate: 0.5, LastData: "01"},
+		{ID: "0x110", Handled: true, Count: 4, Rate: 2, LastData: "ABCD"},
+		{ID: "0x18FF0001", Count: 1, Rate: 0.5, LastData: "0000000000000000"},
+	}
+	if len(report.Frames) != len(want) {
+		t.Fatalf("%d frames reported, want %d", len(report.Frames), len(want))
+	}
+	for i, frame := range report.Frames {
+		if frame.ID != want[i].ID || frame.Handled != want[i].Handled || frame.Count != want[i].Count ||
+			frame.Rate != want[i].Rate || frame.LastData != want[i].LastData {
+			t.Errorf("frame %d = %+v, want %+v", i, frame, want[i])
+		}
+	}
+
+	// The rates are per interval, not since startup
+	stats.Received(can.Frame{ID: 0x110, Length: 2}, true)
+	stats.updateRates(time.Second)
+	if report := stats.Report(nil); report.RxRate != 1 || report.TxRate != 0 {
+		t.Errorf("second interval rx rate %v, tx rate %v, want 1 and 0", report.RxRate, report.TxRate)
+	}
+}
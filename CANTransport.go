@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brutella/can"
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+/*
+FrameTransport is the hardware abstraction between CANBus and whatever is actually carrying the frames.
+The -can flag selects the implementation. "mem" (or "loopback") gives an in-memory bus, names starting with "vcan" use
+a Linux virtual CAN interface and anything else is treated as a real SocketCAN adapter.
+*/
+type FrameTransport interface {
+	Publish(frame can.Frame) error    // Transmit a frame
+	SubscribeFunc(fn can.HandlerFunc) // Register a function to receive every frame
+	ConnectAndPublish() error         // Blocks, delivering received frames to the subscribers until the transport fails or is disconnected
+	Disconnect() error                // Close the transport. ConnectAndPublish will return.
+	Name() string                     // Interface name for logging
+}
+
+const MemoryTransportName = "mem"
+const LoopbackTransportName = "loopback"
+
+/*
+NewFrameTransport returns the transport selected by the interface name.
+The error is checked before returning so a failed transport is a nil interface rather than an interface holding a
+nil pointer.
+*/
+func NewFrameTransport(interfaceName string) (FrameTransport, error) {
+	switch {
+	case interfaceName == MemoryTransportName || interfaceName == LoopbackTransportName:
+		return NewMemoryTransport(interfaceName), nil
+	case strings.HasPrefix(interfaceName, "vcan"):
+		transport, err := NewVCANTransport(interfaceName)
+		if err != nil {
+			return nil, err
+		}
+		return transport, nil
+	default:
+		transport, err := NewSocketCANTransport(interfaceName)
+		if err != nil {
+			return nil, err
+		}
+		return transport, nil
+	}
+}
+
+/*
+SocketCANTransport talks to a real CAN adapter through the Linux SocketCAN stack.
+*/
+type SocketCANTransport struct {
+	bus  *can.Bus
+	name string
+}
+
+func NewSocketCANTransport(interfaceName string) (*SocketCANTransport, error) {
+	bus, err := can.NewBusForInterfaceWithName(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	return &SocketCANTransport{bus: bus, name: interfaceName}, nil
+}
+
+func (t *SocketCANTransport) Publish(frame can.Frame) error {
+	return t.bus.Publish(frame)
+}
+
+func (t *SocketCANTransport) SubscribeFunc(fn can.HandlerFunc) {
+	t.bus.SubscribeFunc(fn)
+}
+
+func (t *SocketCANTransport) ConnectAndPublish() error {
+	return t.bus.ConnectAndPublish()
+}
+
+func (t *SocketCANTransport) Disconnect() error {
+	return t.bus.Disconnect()
+}
+
+func (t *SocketCANTransport) Name() string {
+	return t.name
+}
+
+/*
+VCANTransport uses a Linux virtual CAN interface. If the interface does not exist we try to create it and bring it up
+so the service can be run on a laptop or CI machine with nothing more than the vcan kernel module loaded.
+*/
+type VCANTransport struct {
+	SocketCANTransport
+}
+
+func NewVCANTransport(interfaceName string) (*VCANTransport, error) {
+	if _, err := net.InterfaceByName(interfaceName); err != nil {
+		log.Printf("Virtual CAN interface %s not found. Attempting to create it.", interfaceName)
+		if out, err := exec.Command("ip", "link", "add", "dev", interfaceName, "type", "vcan").CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("failed to create %s - %v : %s", interfaceName, err, strings.TrimSpace(string(out)))
+		}
+		if out, err := exec.Command("ip", "link", "set", "up", interfaceName).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("failed to bring up %s - %v : %s", interfaceName, err, strings.TrimSpace(string(out)))
+		}
+	}
+	socketCAN, err := NewSocketCANTransport(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	return &VCANTransport{SocketCANTransport: *socketCAN}, nil
+}
+
+/*
+MemoryTransport is a pure in-memory loopback bus. Every published frame is delivered back to the subscribers, and
+frames can be injected as if they had been received from another node.
+*/
+type MemoryTransport struct {
+	name     string
+	frames   chan can.Frame
+	done     chan struct{}
+	handlers []can.HandlerFunc
+	closed   bool
+	mu       sync.Mutex
+}
+
+func NewMemoryTransport(name string) *MemoryTransport {
+	t := new(MemoryTransport)
+	t.name = name
+	t.frames = make(chan can.Frame, 256)
+	t.done = make(chan struct{})
+	return t
+}
+
+// Publish loops the frame back to the subscribers
+func (t *MemoryTransport) Publish(frame can.Frame) error {
+	return t.Inject(frame)
+}
+
+// Inject queues a frame for delivery to the subscribers as if another node had sent it
+func (t *MemoryTransport) Inject(frame can.Frame) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return io.ErrClosedPipe
+	}
+	select {
+	case t.frames <- frame:
+		return nil
+	default:
+		return fmt.Errorf("in-memory CAN bus %s is full. Frame 0x%x dropped", t.name, frame.ID)
+	}
+}
+
+func (t *MemoryTransport) SubscribeFunc(fn can.HandlerFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlers = append(t.handlers, fn)
+}
+
+func (t *MemoryTransport) ConnectAndPublish() error {
+	for {
+		select {
+		case frame := <-t.frames:
+			t.mu.Lock()
+			handlers := t.handlers
+			t.mu.Unlock()
+			for _, fn := range handlers {
+				fn(frame)
+			}
+		case <-t.done:
+			return nil
+		}
+	}
+}
+
+func (t *MemoryTransport) Disconnect() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+	return nil
+}
+
+func (t *MemoryTransport) Name() string {
+	return t.name
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+CellHealth looks for cells that are falling behind the rest of the stack. Cell voltages depend heavily on the load so
+cells are only compared while the fuel cell is running with the stack current inside the configured band. Each cell's
+deviation from the stack mean is averaged per day and the trend of those daily deviations shows which cells are
+drifting. A cell is flagged as weak when it sits well below the mean or is drifting down quickly, which should happen
+well before the fuel cell raises its own cell under-voltage alarm. The analysis covers the main fuel cell.
+*/
+
+const stackCellCount = 32
+const cellHealthSampleTime = time.Second * 10
+const cellHealthSmoothing = 0.1 // Weight given to each new sample in the live deviation
+
+type CellHealthSettingsType struct {
+	LoadMinAmps     float64 // Only compare cells with the stack current in this band
+	LoadMaxAmps     float64
+	WeakDeviationMV float64 // A cell this far below the stack mean is weak
+	DriftMVPerWeek  float64 // A cell losing ground on the mean this quickly is weak
+	HistoryDays     int     // Days of history analysed by default
+}
+
+// CellDayType holds the average voltage of each cell over one day at the comparable load
+type CellDayType struct {
+	Date    string
+	Samples int
+	MeanMV  float64                 // Stack mean
+	CellMV  [stackCellCount]float64 `json:"-"`
+}
+
+type CellReportType struct {
+	Cell           int       // Numbered from 1
+	LiveMV         float64   // Most recent sample at load
+	LiveDeviation  float64   // Smoothed deviation from the stack mean at load
+	DeviationMV    float64   // Deviation on the most recent day
+	DriftMVPerWeek float64   // Trend of the daily deviation
+	Score          float64   // 0 = healthy, 100 = badly degraded
+	Weak           bool      // Needs attention
+	Reason         string    `json:",omitempty"`
+	History        []float64 // Daily deviation from the stack mean in mV, one per entry in Days
+}
+
+type CellHealthReportType struct {
+	Source      string // database or memory
+	LoadMinAmps float64
+	LoadMaxAmps float64
+	LiveTime    *time.Time `json:",omitempty"`
+	LiveAmps    float64
+	LiveMeanMV  float64
+	Days        []CellDayType
+	Cells       []CellReportType
+	WeakCells   []int
+}
+
+type cellDayTotalsType struct {
+	samples int
+	sum     [stackCellCount]float64
+}
+
+type CellHealthType struct {
+	mu            sync.Mutex
+	liveTime      time.Time
+	liveAmps      float64
+	liveMV        [stackCellCount]float64
+	liveMean      float64
+	liveDeviation [stackCellCount]float64
+	liveSamples   int
+	days          map[string]*cellDayTotalsType // Samples taken since we started, used when there is no database
+}
+
+var CellHealth = CellHealthType{days: make(map[string]*cellDayTotalsType)}
+
+func defaultCellHealthSettings() CellHealthSettingsType {
+	return CellHealthSettingsType{
+		LoadMinAmps:     50,
+		LoadMaxAmps:     150,
+		WeakDeviationMV: 30,
+		DriftMVPerWeek:  5,
+		HistoryDays:     56,
+	}
+}
+
+/*
+Run samples the cell voltages while the fuel cell is running at a comparable load
+*/
+func (ch *CellHealthType) Run() {
+	sampleTime := time.NewTicker(cellHealthSampleTime)
+	for {
+		now := <-sampleTime.C
+		ch.sample(now)
+	}
+}
+
+func (ch *CellHealthType) sample(now time.Time) {
+	settings := currentSettings.FuelCellSettings.CellHealth
+	measurements := MainFuelCell().Measurements()
+	if !measurements.CellsValid || !measurements.StackValid || !measurements.ModeValid || len(measurements.CellMV) != stackCellCount {
+		return
+	}
+	var cells [stackCellCount]float64
+	copy(cells[:], measurements.CellMV)
+	running := measurements.PowerMode == PMManual
+	amps := measurements.StackAmps
+	if !running || amps < settings.LoadMinAmps || amps > settings.LoadMaxAmps {
+		return
+	}
+
+	mean := 0.0
+	for _, mv := range cells {
+		mean += mv
+	}
+	mean /= stackCellCount
+
+	weak := make(map[string]string)
+	ch.mu.Lock()
+	ch.liveTime = now
+	ch.liveAmps = amps
+	ch.liveMV = cells
+	ch.liveMean = mean
+	for cell, mv := range cells {
+		if ch.liveSamples == 0 {
+			ch.liveDeviation[cell] = mv - mean
+		} else {
+			ch.liveDeviation[cell] += cellHealthSmoothing * (mv - mean - ch.liveDeviation[cell])
+		}
+		if ch.liveDeviation[cell] <= -settings.WeakDeviationMV {
+			weak[fmt.Sprintf("Cell%02d", cell+1)] = fmt.Sprintf("Cell %d is %0.0fmV below the stack mean at %0.0fA", cell+1, -ch.liveDeviation[cell], amps)
+		}
+	}
+	ch.liveSamples++
+	day := now.Format("2006-01-02")
+	totals, found := ch.days[day]
+	if !found {
+		totals = new(cellDayTotalsType)
+		ch.days[day] = totals
+		// Only keep what the analysis can use
+		oldest := now.AddDate(0, 0, -settings.HistoryDays).Format("2006-01-02")
+		for d := range ch.days {
+			if d < oldest {
+				delete(ch.days, d)
+			}
+		}
+	}
+	totals.samples++
+	for cell, mv := range cells {
+		totals.sum[cell] += mv
+	}
+	ch.mu.Unlock()
+
+	Events.Update(EventSourceCellHealth, weak)
+}
+
+// daysFromMemory returns the daily averages collected since the service started. These use the configured load band.
+func (ch *CellHealthType) daysFromMemory(start time.Time, end time.Time) []CellDayType {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	days := make([]CellDayType, 0)
+	first, last := start.Format("2006-01-02"), end.Format("2006-01-02")
+	for date, totals := range ch.days {
+		if date < first || date > last || totals.samples == 0 {
+			continue
+		}
+		day := CellDayType{Date: date, Samples: totals.samples}
+		for cell := range totals.sum {
+			day.CellMV[cell] = totals.sum[cell] / float64(totals.samples)
+		}
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	for i := range days {
+		days[i].setMean()
+	}
+	return days
+}
+
+func (day *CellDayType) setMean() {
+	day.MeanMV = 0
+	for _, mv := range day.CellMV {
+		day.MeanMV += mv
+	}
+	day.MeanMV /= stackCellCount
+}
+
+/*
+cellDaysFromDatabase averages each cell per day from the PANFuelCell table. Cell voltages are logged in mV and the
+stack current in 0.1A. Only rows logged while running (power mode manual) inside the load band are used.
+*/
+func cellDaysFromDatabase(db *sql.DB, start time.Time, end time.Time, minAmps float64, maxAmps float64) ([]CellDayType, error) {
+	columns := make([]string, stackCellCount)
+	for cell := range columns {
+		columns[cell] = fmt.Sprintf("avg(Cell%02dVolts)", cell)
+	}
+	rqst := `select date(logged) as day, count(*) as samples, ` + strings.Join(columns, ", ") + `
+	           from PANFuelCell
+	          where logged between ? and ?
+	            and PowerModeState = ?
+	            and StackCurrent between ? and ?
+	          group by date(logged)
+	          order by day`
+	rows, err := db.Query(rqst, start, end, byte(PMManual), uint16(minAmps*10), uint16(maxAmps*10))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+	days := make([]CellDayType, 0)
+	for rows.Next() {
+		var day CellDayType
+		var date time.Time
+		values := []interface{}{&date, &day.Samples}
+		for cell := range day.CellMV {
+			values = append(values, &day.CellMV[cell])
+		}
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+		day.Date = date.Format("2006-01-02")
+		day.setMean()
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+/*
+driftPerWeek fits a straight line to the daily deviations and returns the slope in mV per week
+*/
+func driftPerWeek(days []CellDayType, deviations []float64) float64 {
+	if len(days) < 3 {
+		return 0
+	}
+	first, err := time.Parse("2006-01-02", days[0].Date)
+	if err != nil {
+		return 0
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for i, day := range days {
+		date, err := time.Parse("2006-01-02", day.Date)
+		if err != nil {
+			return 0
+		}
+		x := date.Sub(first).Hours() / (24 * 7)
+		sumX += x
+		sumY += deviations[i]
+		sumXY += x * deviations[i]
+		sumXX += x * x
+	}
+	n := float64(len(days))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+func roundTo(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
+
+/*
+analyse builds the report from the daily averages and the live samples. The score weights how far the cell sits
+below the mean at 60% and how fast it is drifting down at 40%. It reaches 100 at twice the weak thresholds.
+*/
+func (ch *CellHealthType) analyse(days []CellDayType, settings CellHealthSettingsType) CellHealthReportType {
+	report := CellHealthReportType{LoadMinAmps: settings.LoadMinAmps, LoadMaxAmps: settings.LoadMaxAmps, Days: days,
+		Cells: make([]CellReportType, stackCellCount), WeakCells: make([]int, 0)}
+	ch.mu.Lock()
+	if ch.liveSamples > 0 {
+		liveTime := ch.liveTime
+		report.LiveTime = &liveTime
+		report.LiveAmps = ch.liveAmps
+		report.LiveMeanMV = roundTo(ch.liveMean, 1)
+	}
+	for cell := range report.Cells {
+		report.Cells[cell].Cell = cell + 1
+		if ch.liveSamples > 0 {
+			report.Cells[cell].LiveMV = ch.liveMV[cell]
+			report.Cells[cell].LiveDeviation = roundTo(ch.liveDeviation[cell], 1)
+		}
+	}
+	live := ch.liveSamples > 0
+	ch.mu.Unlock()
+
+	for cell := range report.Cells {
+		c := &report.Cells[cell]
+		c.History = make([]float64, len(days))
+		for i, day := range days {
+			c.History[i] = roundTo(day.CellMV[cell]-day.MeanMV, 1)
+		}
+		if len(days) > 0 {
+			c.DeviationMV = c.History[len(days)-1]
+		}
+		c.DriftMVPerWeek = roundTo(driftPerWeek(days, c.History), 2)
+
+		deviation := c.DeviationMV
+		if live && len(days) == 0 {
+			deviation = c.LiveDeviation
+		}
+		var reasons []string
+		if settings.WeakDeviationMV > 0 && deviation <= -settings.WeakDeviationMV {
+			reasons = append(reasons, fmt.Sprintf("%0.0fmV below the stack mean", -deviation))
+		}
+		if settings.DriftMVPerWeek > 0 && c.DriftMVPerWeek <= -settings.DriftMVPerWeek {
+			reasons = append(reasons, fmt.Sprintf("losing %0.1fmV a week", -c.DriftMVPerWeek))
+		}
+		if live && settings.WeakDeviationMV > 0 && c.LiveDeviation <= -settings.WeakDeviationMV && deviation != c.LiveDeviation {
+			reasons = append(reasons, fmt.Sprintf("%0.0fmV below the stack mean now", -c.LiveDeviation))
+		}
+		c.Weak = len(reasons) > 0
+		c.Reason = strings.Join(reasons, ", ")
+		if c.Weak {
+			report.WeakCells = append(report.WeakCells, c.Cell)
+		}
+
+		score := 0.0
+		if settings.WeakDeviationMV > 0 {
+			score += 60 * math.Min(1, math.Max(0, -deviation)/(2*settings.WeakDeviationMV))
+		}
+		if settings.DriftMVPerWeek > 0 {
+			score += 40 * math.Min(1, math.Max(0, -c.DriftMVPerWeek)/(2*settings.DriftMVPerWeek))
+		}
+		c.Score = roundTo(score, 1)
+	}
+	for i := range report.Days {
+		report.Days[i].MeanMV = roundTo(report.Days[i].MeanMV, 1)
+	}
+	return report
+}
+
+/*
+getCellHealth reports the health of each cell. The optional query parameters are start and end (yyyy-m-d h:m) to
+choose the history analysed, and minAmps and maxAmps to override the load band.
+*/
+func getCellHealth(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Cell Health"
+	settings := currentSettings.FuelCellSettings.CellHealth
+	params := r.URL.Query()
+
+	end := time.Now()
+	start := end.AddDate(0, 0, -settings.HistoryDays)
+	if params.Get("start") != "" || params.Get("end") != "" {
+		var err error
+		if start, end, err = GetTimeRange(r); err != nil {
+			ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+			return
+		}
+	}
+	for name, value := range map[string]*float64{"minAmps": &settings.LoadMinAmps, "maxAmps": &settings.LoadMaxAmps} {
+		if text := params.Get(name); text != "" {
+			amps, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+				return
+			}
+			*value = amps
+		}
+	}
+	if settings.LoadMaxAmps <= settings.LoadMinAmps {
+		ReturnJSONErrorString(w, deviceString, "maxAmps must be above minAmps", http.StatusBadRequest, false)
+		return
+	}
+
+	var days []CellDayType
+	source := "database"
+	if db := pDB; db != nil {
+		var err error
+		if days, err = cellDaysFromDatabase(db, start, end, settings.LoadMinAmps, settings.LoadMaxAmps); err != nil {
+			log.Println("Cell history from the database -", err)
+			days = nil
+		}
+	}
+	if days == nil {
+		source = "memory"
+		days = CellHealth.daysFromMemory(start, end)
+	}
+	report := CellHealth.analyse(days, settings)
+	report.Source = source
+
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(report); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// weeklyCellDays returns a day a week for the given number of weeks with every cell at 700mV, adjusted by cellMV
+func weeklyCellDays(weeks int, cellMV func(cell int, week int) float64) []CellDayType {
+	first := time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+	days := make([]CellDayType, weeks)
+	for week := range days {
+		days[week] = CellDayType{Date: first.AddDate(0, 0, 7*week).Format("2006-01-02"), Samples: 100}
+		for cell := range days[week].CellMV {
+			days[week].CellMV[cell] = 700 + cellMV(cell, week)
+		}
+		days[week].setMean()
+	}
+	return days
+}
+
+func TestDriftPerWeek(t *testing.T) {
+	days := weeklyCellDays(4, func(int, int) float64 { return 0 })
+	tests := []struct {
+		name       string
+		days       []CellDayType
+		deviations []float64
+		want       float64
+	}{
+		{name: "Steady", days: days, deviations: []float64{-5, -5, -5, -5}, want: 0},
+		{name: "Falling", days: days, deviations: []float64{0, -2, -4, -6}, want: -2},
+		{name: "Rising", days: days, deviations: []float64{-9, -6, -3, 0}, want: 3},
+		{name: "Too few days", days: days[:2], deviations: []float64{0, -10}, want: 0},
+	}
+	for _, test := range tests {
+		if drift := driftPerWeek(test.days, test.deviations); math.Abs(drift-test.want) > 1e-9 {
+			t.Errorf("%s: drift = %v, want %v", test.name, drift, test.want)
+		}
+	}
+}
+
+func TestCellHealthAnalyse(t *testing.T) {
+	// Cell 3 sits 40mV low and cell 5 is losing 7mV a week
+	days := weeklyCellDays(4, func(cell int, week int) float64 {
+		switch cell {
+		case 2:
+			return -40
+		case 4:
+			return -7 * float64(week)
+		}
+		return 0
+	})
+	var ch CellHealthType
+	report := ch.analyse(days, defaultCellHealthSettings())
+	if len(report.WeakCells) != 2 || report.WeakCells[0] != 3 || report.WeakCells[1] != 5 {
+		t.Fatalf("weak cells = %v, want [3 5]", report.WeakCells)
+	}
+	if low := report.Cells[2]; low.DeviationMV > -30 || low.Score <= 0 || low.Reason == "" || len(low.History) != len(days) {
+		t.Errorf("the low cell = %+v", low)
+	}
+	if drifting := report.Cells[4]; drifting.DriftMVPerWeek > -5 || drifting.DeviationMV > -15 || drifting.Score <= 0 {
+		t.Errorf("the drifting cell = %+v", drifting)
+	}
+	if healthy := report.Cells[0]; healthy.Weak || healthy.Score != 0 || healthy.DeviationMV < 0 {
+		t.Errorf("a healthy cell = %+v", healthy)
+	}
+	if report.LiveTime != nil {
+		t.Error("live figures were reported without any samples")
+	}
+}
+
+func TestCellHealthLiveOnly(t *testing.T) {
+	ch := CellHealthType{liveSamples: 1, liveTime: time.Now(), liveAmps: 100, liveMean: 700}
+	ch.liveDeviation[7] = -35
+	report := ch.analyse(nil, defaultCellHealthSettings())
+	if len(report.WeakCells) != 1 || report.WeakCells[0] != 8 {
+		t.Errorf("weak cells = %v from the live samples, want [8]", report.WeakCells)
+	}
+	if report.LiveTime == nil || report.LiveAmps != 100 {
+		t.Errorf("live figures missing - %+v", report)
+	}
+}
+
+func TestCellHealthDaysFromMemory(t *testing.T) {
+	ch := CellHealthType{days: map[string]*cellDayTotalsType{
+		"2026-03-01": {samples: 2},
+		"2026-03-02": {samples: 4},
+		"2026-03-03": {},
+		"2026-03-09": {samples: 1},
+	}}
+	for cell := range ch.days["2026-03-02"].sum {
+		ch.days["2026-03-01"].sum[cell] = 1400
+		ch.days["2026-03-02"].sum[cell] = 2800 + float64(cell)*4
+	}
+	days := ch.daysFromMemory(time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local), time.Date(2026, 3, 8, 0, 0, 0, 0, time.Local))
+	if len(days) != 2 || days[0].Date != "2026-03-01" || days[1].Date != "2026-03-02" {
+		t.Fatalf("days = %+v, want 2026-03-01 and 2026-03-02", days)
+	}
+	if days[0].CellMV[0] != 700 || days[0].MeanMV != 700 {
+		t.Errorf("first day cell 1 = %vmV, mean %vmV, want 700", days[0].CellMV[0], days[0].MeanMV)
+	}
+	if days[1].CellMV[31] != 731 || days[1].MeanMV != 715.5 {
+		t.Errorf("second day cell 32 = %vmV, mean %vmV, want 731 and 715.5", days[1].CellMV[31], days[1].MeanMV)
+	}
+}
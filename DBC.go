@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/brutella/can"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The PAN message layouts are described in a DBC file so a new firmware revision can be supported by editing the file.
+The default definitions are built in and are replaced by the file given by the -dbc flag if it can be loaded.
+
+The definitions are shared but the decoded values are not. Each fuel cell decodes the frames it receives into its
+own DBCValuesType, using the message definition for the default CAN ID, so fuel cells with a source offset or on
+their own interface do not overwrite each other.
+*/
+
+//go:embed PAN.dbc
+var defaultDBC string
+
+type DBCSignalType struct {
+	Name         string
+	StartBit     uint
+	Length       uint
+	LittleEndian bool // @1 = Intel, @0 = Motorola
+	Signed       bool
+	Factor       float64
+	Offset       float64
+	Min          float64
+	Max          float64
+	Unit         string
+	Multiplexer  bool // This signal selects which multiplexed signals are present
+	MuxValue     int  // The multiplexer value this signal is present for. -1 if not multiplexed
+	Values       map[int64]string
+}
+
+type DBCMessageType struct {
+	ID      uint32
+	Name    string
+	Length  uint8
+	Sender  string
+	Signals []*DBCSignalType
+}
+
+type DBCValueType struct {
+	Value   float64
+	Raw     int64 `json:"-"`
+	Unit    string
+	Text    string `json:",omitempty"`
+	Message string
+	Updated time.Time
+}
+
+// DBCDatabaseType holds the definitions from one DBC file. It is not changed once parsed.
+type DBCDatabaseType struct {
+	source   string
+	Messages map[uint32]*DBCMessageType
+	signals  map[string]*DBCSignalType // Every signal by name
+}
+
+// DBCValuesType holds the last decoded value of each signal for one fuel cell
+type DBCValuesType struct {
+	mu     sync.Mutex
+	values map[string]DBCValueType
+}
+
+var canDatabase *DBCDatabaseType
+var canDatabaseMu sync.RWMutex
+
+// CANDatabase returns the DBC definitions in use
+func CANDatabase() *DBCDatabaseType {
+	canDatabaseMu.RLock()
+	defer canDatabaseMu.RUnlock()
+	return canDatabase
+}
+
+// SetCANDatabase replaces the DBC definitions in use
+func SetCANDatabase(db *DBCDatabaseType) {
+	canDatabaseMu.Lock()
+	defer canDatabaseMu.Unlock()
+	canDatabase = db
+}
+
+var dbcMessageRegex = regexp.MustCompile(`^BO_\s+(\d+)\s+(\w+)\s*:\s*(\d+)\s+(\w+)`)
+var dbcSignalRegex = regexp.MustCompile(`^SG_\s+(\w+)\s*(M|m\d+)?\s*:\s*(\d+)\|(\d+)@([01])([+-])\s*\(([^,]+),([^)]+)\)\s*\[([^|]+)\|([^\]]+)\]\s*"([^"]*)"`)
+var dbcValueRegex = regexp.MustCompile(`^VAL_\s+(\d+)\s+(\w+)\s+(.*);`)
+var dbcValuePairRegex = regexp.MustCompile(`(-?\d+)\s+"([^"]*)"`)
+
+/*
+LoadDBC reads the named DBC file. If the file cannot be read the built in definitions are used instead.
+*/
+func LoadDBC(fileName string) *DBCDatabaseType {
+	if fileName != "" {
+		if db, err := ReadDBCFile(fileName); err != nil {
+			log.Println("Using the built in DBC definitions.", err)
+		} else {
+			return db
+		}
+	}
+	db, err := ParseDBC(strings.NewReader(defaultDBC), "built in")
+	if err != nil {
+		// The built in file is part of the source so this is a programming error
+		log.Panic(err)
+	}
+	return db
+}
+
+// ReadDBCFile parses the named DBC file
+func ReadDBCFile(fileName string) (*DBCDatabaseType, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	return ParseDBC(file, fileName)
+}
+
+/*
+ParseDBC parses the message, signal and value table definitions from a DBC file
+*/
+func ParseDBC(r io.Reader, source string) (*DBCDatabaseType, error) {
+	db := new(DBCDatabaseType)
+	db.source = source
+	db.Messages = make(map[uint32]*DBCMessageType)
+	db.signals = make(map[string]*DBCSignalType)
+
+	var current *DBCMessageType
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "BO_ "):
+			match := dbcMessageRegex.FindStringSubmatch(line)
+			if match == nil {
+				return nil, fmt.Errorf("%s line %d : invalid message definition - %s", source, lineNum, line)
+			}
+			id, err := strconv.ParseUint(match[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d : %v", source, lineNum, err)
+			}
+			length, err := strconv.ParseUint(match[3], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d : %v", source, lineNum, err)
+			}
+			current = &DBCMessageType{ID: uint32(id), Name: match[2], Length: uint8(length), Sender: match[4]}
+			db.Messages[current.ID] = current
+		case strings.HasPrefix(line, "SG_ "):
+			if current == nil {
+				return nil, fmt.Errorf("%s line %d : signal defined outside a message", source, lineNum)
+			}
+			signal, err := parseDBCSignal(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d : %v", source, lineNum, err)
+			}
+			current.Signals = append(current.Signals, signal)
+			db.signals[signal.Name] = signal
+		case strings.HasPrefix(line, "VAL_ "):
+			match := dbcValueRegex.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			id, err := strconv.ParseUint(match[1], 10, 32)
+			if err != nil {
+				continue
+			}
+			if msg, found := db.Messages[uint32(id)]; found {
+				for _, signal := range msg.Signals {
+					if signal.Name == match[2] {
+						signal.Values = make(map[int64]string)
+						for _, pair := range dbcValuePairRegex.FindAllStringSubmatch(match[3], -1) {
+							if val, err := strconv.ParseInt(pair[1], 10, 64); err == nil {
+								signal.Values[val] = pair[2]
+							}
+						}
+					}
+				}
+			}
+		default:
+			// A blank line or any other keyword ends the message. CM_, BA_ etc. are not needed for decoding.
+			current = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(db.Messages) == 0 {
+		return nil, fmt.Errorf("%s : no messages defined", source)
+	}
+	return db, nil
+}
+
+func parseDBCSignal(line string) (*DBCSignalType, error) {
+	match := dbcSignalRegex.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("invalid signal definition - %s", line)
+	}
+	signal := &DBCSignalType{Name: match[1], MuxValue: -1, Unit: match[11]}
+	switch {
+	case match[2] == "M":
+		signal.Multiplexer = true
+	case strings.HasPrefix(match[2], "m"):
+		mux, err := strconv.Atoi(match[2][1:])
+		if err != nil {
+			return nil, err
+		}
+		signal.MuxValue = mux
+	}
+	start, err := strconv.ParseUint(match[3], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseUint(match[4], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 || length > 64 {
+		return nil, fmt.Errorf("signal %s has an invalid length of %d bits", signal.Name, length)
+	}
+	signal.StartBit = uint(start)
+	signal.Length = uint(length)
+	signal.LittleEndian = match[5] == "1"
+	signal.Signed = match[6] == "-"
+	floats := make([]float64, 4)
+	for i, s := range match[7:11] {
+		if floats[i], err = strconv.ParseFloat(strings.TrimSpace(s), 64); err != nil {
+			return nil, fmt.Errorf("signal %s - %v", signal.Name, err)
+		}
+	}
+	signal.Factor, signal.Offset, signal.Min, signal.Max = floats[0], floats[1], floats[2], floats[3]
+	return signal, nil
+}
+
+/*
+Raw extracts the unscaled value of the signal from the frame data
+*/
+func (signal *DBCSignalType) Raw(data [8]byte) int64 {
+	var value uint64
+	if signal.LittleEndian {
+		for i := uint(0); i < signal.Length; i++ {
+			bit := signal.StartBit + i
+			if bit >= 64 {
+				break
+			}
+			value |= uint64((data[bit/8]>>(bit%8))&1) << i
+		}
+	} else {
+		// Motorola. The start bit is the most significant bit and the bit numbering runs backwards within each byte.
+		bit := signal.StartBit
+		for i := uint(0); i < signal.Length; i++ {
+			if bit >= 64 {
+				break
+			}
+			value = (value << 1) | uint64((data[bit/8]>>(bit%8))&1)
+			if bit%8 == 0 {
+				bit += 15
+			} else {
+				bit--
+			}
+		}
+	}
+	if signal.Signed && signal.Length < 64 && value&(uint64(1)<<(signal.Length-1)) != 0 {
+		value |= math.MaxUint64 << signal.Length
+	}
+	return int64(value)
+}
+
+/*
+Decode returns the scaled value of the signal rounded to the resolution given by the factor, along with the raw value
+*/
+func (signal *DBCSignalType) Decode(data [8]byte) (float64, int64) {
+	raw := signal.Raw(data)
+	var value float64
+	if signal.Signed {
+		value = float64(raw)*signal.Factor + signal.Offset
+	} else {
+		value = float64(uint64(raw))*signal.Factor + signal.Offset
+	}
+	if signal.Factor > 0 && signal.Factor < 1 {
+		scale := math.Pow(10, math.Ceil(-math.Log10(signal.Factor)))
+		value = math.Round(value*scale) / scale
+	}
+	return value, raw
+}
+
+/*
+Scale applies the factor and offset of the named signal to a raw value. This is used for values such as the cell
+voltages that are averaged over several frames before they are scaled. found is false if the signal is not defined.
+*/
+func (db *DBCDatabaseType) Scale(name string, raw float64) (value float64, found bool) {
+	if db == nil {
+		return 0, false
+	}
+	signal, found := db.signals[name]
+	if !found {
+		return 0, false
+	}
+	return raw*signal.Factor + signal.Offset, true
+}
+
+func NewDBCValues() *DBCValuesType {
+	return &DBCValuesType{values: make(map[string]DBCValueType)}
+}
+
+/*
+Decode decodes all the signals in the frame using the definition of message id and stores the values. The id is
+given separately so a frame from a fuel cell with a source offset is decoded using the default definition.
+It returns false if the message is not defined.
+*/
+func (v *DBCValuesType) Decode(db *DBCDatabaseType, id uint32, frame can.Frame) bool {
+	if db == nil {
+		return false
+	}
+	msg, found := db.Messages[id]
+	if !found {
+		return false
+	}
+	now := time.Now()
+	muxValue := int64(-1)
+	for _, signal := range msg.Signals {
+		if signal.Multiplexer {
+			muxValue = signal.Raw(frame.Data)
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, signal := range msg.Signals {
+		if signal.MuxValue >= 0 && int64(signal.MuxValue) != muxValue {
+			continue
+		}
+		value, raw := signal.Decode(frame.Data)
+		v.values[signal.Name] = DBCValueType{Value: value, Raw: raw, Unit: signal.Unit, Text: signal.Values[raw], Message: msg.Name, Updated: now}
+	}
+	return true
+}
+
+/*
+Signal returns the full decoded value record of the named signal. found is false if the signal is not defined or no
+frame containing it has been received.
+*/
+func (v *DBCValuesType) Signal(name string) (DBCValueType, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	value, found := v.values[name]
+	return value, found
+}
+
+/*
+Signals returns a copy of all the decoded signal values
+*/
+func (v *DBCValuesType) Signals() map[string]DBCValueType {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	signals := make(map[string]DBCValueType, len(v.values))
+	for name, value := range v.values {
+		signals[name] = value
+	}
+	return signals
+}
+
+// Clear forgets every decoded value. Called when the definitions are reloaded.
+func (v *DBCValuesType) Clear() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values = make(map[string]DBCValueType)
+}
+
+/*
+DBCDecoder is implemented by fuel cell drivers that decode their frames using the DBC definitions
+*/
+type DBCDecoder interface {
+	DecodedSignals() *DBCValuesType
+}
+
+// decodedSignals returns the signals decoded for the fuel cell given by the {n} route variable
+func decodedSignals(w http.ResponseWriter, r *http.Request, deviceString string) *DBCValuesType {
+	fuelCell := fuelCellFromRequest(w, r, deviceString)
+	if fuelCell == nil {
+		return nil
+	}
+	decoder, ok := fuelCell.FuelCellDriver.(DBCDecoder)
+	if !ok {
+		ReturnJSONErrorString(w, deviceString, fmt.Sprintf("The %s driver does not use the DBC definitions", fuelCell.Name()), http.StatusNotFound, false)
+		return nil
+	}
+	return decoder.DecodedSignals()
+}
+
+/*
+MessageName returns the DBC name for the frame ID or an empty string
+*/
+func (db *DBCDatabaseType) MessageName(id uint32) string {
+	if db == nil {
+		return ""
+	}
+	if msg, found := db.Messages[id]; found {
+		return msg.Name
+	}
+	return ""
+}
+
+// getSignals returns every signal decoded for the fuel cell
+func getSignals(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Get Signals"
+	type signalsType struct {
+		Source  string
+		Signals map[string]DBCValueType
+	}
+	values := decodedSignals(w, r, deviceString)
+	if values == nil {
+		return
+	}
+	var result signalsType
+	result.Source = CANDatabase().source
+	result.Signals = values.Signals()
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(result); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+// getSignal returns a single decoded signal
+func getSignal(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Get Signal"
+	name := mux.Vars(r)["name"]
+	values := decodedSignals(w, r, deviceString)
+	if values == nil {
+		return
+	}
+	value, found := values.Signal(name)
+	if !found {
+		ReturnJSONErrorString(w, deviceString, fmt.Sprintf("signal %s has not been received or is not defined", name), http.StatusNotFound, false)
+		return
+	}
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(value); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+// getDBCMessages lists the message and signal definitions currently loaded
+func getDBCMessages(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get DBC"
+	db := CANDatabase()
+	messages := make([]*DBCMessageType, 0, len(db.Messages))
+	for _, msg := range db.Messages {
+		messages = append(messages, msg)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Name < messages[j].Name })
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(messages); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+reloadDBC reloads the DBC file so an edited file can be used without restarting the service. If the file cannot be
+parsed the error is returned and the definitions already loaded are kept.
+*/
+func reloadDBC(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Reload DBC"
+	db, err := ReadDBCFile(dbcFile)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusUnprocessableEntity, true)
+		return
+	}
+	SetCANDatabase(db)
+	// Values decoded with the old definitions may not match the new ones
+	for _, fuelCell := range FuelCells {
+		if decoder, ok := fuelCell.FuelCellDriver.(DBCDecoder); ok {
+			decoder.DecodedSignals().Clear()
+		}
+	}
+	log.Println("DBC definitions loaded from", db.source)
+	getDBCMessages(w, r)
+}
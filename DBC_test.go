@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/brutella/can"
+	"strings"
+	"testing"
+)
+
+const testDBC = `VERSION ""
+
+BO_ 2147483904 Status: 8 FCU
+ SG_ Mode : 0|8@1+ (1,0) [0|9] "" VCU
+ SG_ Temperature : 8|16@1- (0.1,-40) [-40|100] "degC" VCU
+ SG_ Pressure : 31|16@0+ (0.5,0) [0|1000] "kPa" VCU
+
+BO_ 513 Muxed: 8 CVM
+ SG_ Page M : 0|8@1+ (1,0) [0|1] "" VCU
+ SG_ LowCell m0 : 8|16@1+ (1,0) [0|65535] "mV" VCU
+ SG_ HighCell m1 : 8|16@1+ (1,0) [0|65535] "mV" VCU
+
+VAL_ 2147483904 Mode 0 "Off" 1 "Run" ;
+`
+
+func TestParseDBC(t *testing.T) {
+	tests := []struct {
+		name     string
+		dbc      string
+		messages int
+		wantErr  string
+	}{
+		{"Test definitions", testDBC, 2, ""},
+		{"Built in definitions", defaultDBC, len(strings.Split(defaultDBC, "\nBO_ ")) - 1, ""},
+		{"No messages", "VERSION \"\"\n", 0, "no messages defined"},
+		{"Bad message", "BO_ x Status: 8 FCU\n", 0, "invalid message definition"},
+		{"Signal outside a message", "BO_ 1 Status: 8 FCU\n\n SG_ Mode : 0|8@1+ (1,0) [0|9] \"\" VCU\n", 0,
+			"signal defined outside a message"},
+		{"Bad signal", "BO_ 1 Status: 8 FCU\n SG_ Mode : 0|8@1 (1,0) [0|9] \"\" VCU\n", 0, "invalid signal definition"},
+		{"Zero length signal", "BO_ 1 Status: 8 FCU\n SG_ Mode : 0|0@1+ (1,0) [0|9] \"\" VCU\n", 0, "invalid length"},
+		{"Bad factor", "BO_ 1 Status: 8 FCU\n SG_ Mode : 0|8@1+ (x,0) [0|9] \"\" VCU\n", 0, "signal Mode"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, err := ParseDBC(strings.NewReader(test.dbc), "test.dbc")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseDBC returned %v, want an error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(db.Messages) != test.messages {
+				t.Errorf("ParseDBC found %d messages, want %d", len(db.Messages), test.messages)
+			}
+		})
+	}
+}
+
+func TestDBCSignalDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		signal string
+		data   [8]byte
+		value  float64
+		raw    int64
+	}{
+		{"Intel unsigned byte", `SG_ A : 8|8@1+ (1,0) [0|255] "" X`, [8]byte{0, 0xC8}, 200, 200},
+		{"Intel unsigned word", `SG_ A : 0|16@1+ (0.1,0) [0|6553.5] "V" X`, [8]byte{0x34, 0x12}, 466, 0x1234},
+		{"Intel with offset", `SG_ A : 0|16@1+ (0.1,-40) [-40|100] "degC" X`, [8]byte{0x2C, 0x01}, -10, 300},
+		{"Intel signed negative", `SG_ A : 0|16@1- (1,0) [-100|100] "" X`, [8]byte{0xFE, 0xFF}, -2, -2},
+		{"Intel nibble", `SG_ A : 4|4@1+ (1,0) [0|15] "" X`, [8]byte{0xA5}, 10, 10},
+		{"Intel across bytes", `SG_ A : 20|2@1+ (1,0) [0|3] "" X`, [8]byte{0, 0, 0x30}, 3, 3},
+		{"Motorola word", `SG_ A : 7|16@0+ (1,0) [0|65535] "" X`, [8]byte{0x12, 0x34}, 0x1234, 0x1234},
+		{"Motorola signed", `SG_ A : 7|8@0- (1,0) [-128|127] "" X`, [8]byte{0x80}, -128, -128},
+		{"Factor rounding", `SG_ A : 0|8@1+ (0.1,0) [0|25.5] "" X`, [8]byte{3}, 0.3, 3},
+		{"Full 32 bits", `SG_ A : 0|32@1+ (1,0) [0|4294967295] "" X`, [8]byte{0xFF, 0xFF, 0xFF, 0xFF}, 4294967295, 0xFFFFFFFF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signal, err := parseDBCSignal(test.signal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, raw := signal.Decode(test.data)
+			if value != test.value || raw != test.raw {
+				t.Errorf("Decode(% X) = %v (raw %d), want %v (raw %d)", test.data, value, raw, test.value, test.raw)
+			}
+		})
+	}
+}
+
+func TestDBCValuesDecode(t *testing.T) {
+	db, err := ParseDBC(strings.NewReader(testDBC), "test.dbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		id      uint32
+		data    [8]byte
+		known   bool
+		want    map[string]float64
+		text    map[string]string
+		missing []string
+	}{
+		{name: "Values and text", id: 0x100 | can.MaskEff, data: [8]byte{1, 0x2C, 0x01, 0x00, 0xC8}, known: true,
+			want: map[string]float64{"Mode": 1, "Temperature": -10, "Pressure": 100},
+			text: map[string]string{"Mode": "Run"}},
+		{name: "Multiplexer page 0", id: 0x201, data: [8]byte{0, 0xE8, 0x03}, known: true,
+			want: map[string]float64{"Page": 0, "LowCell": 1000}, missing: []string{"HighCell"}},
+		{name: "Multiplexer page 1", id: 0x201, data: [8]byte{1, 0xD0, 0x07}, known: true,
+			want: map[string]float64{"Page": 1, "HighCell": 2000}, missing: []string{"LowCell"}},
+		{name: "Unknown message", id: 0x300, known: false, missing: []string{"Mode", "Page"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := NewDBCValues()
+			if known := values.Decode(db, test.id, can.Frame{ID: test.id, Length: 8, Data: test.data}); known != test.known {
+				t.Fatalf("Decode returned %v, want %v", known, test.known)
+			}
+			for name, want := range test.want {
+				value, found := values.Signal(name)
+				if !found || value.Value != want {
+					t.Errorf("%s = %v (found %v), want %v", name, value.Value, found, want)
+				}
+				if value.Text != test.text[name] {
+					t.Errorf("%s text = %q, want %q", name, value.Text, test.text[name])
+				}
+			}
+			for _, name := range test.missing {
+				if _, found := values.Signal(name); found {
+					t.Errorf("%s was decoded but should not have been", name)
+				}
+			}
+		})
+	}
+
+	// A nil database decodes nothing
+	if NewDBCValues().Decode(nil, 0x201, can.Frame{ID: 0x201}) {
+		t.Error("Decode with no database returned true")
+	}
+}
+
+func TestDBCScale(t *testing.T) {
+	db, err := ParseDBC(strings.NewReader(testDBC), "test.dbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		raw   float64
+		value float64
+		found bool
+	}{
+		{"Temperature", 300, -10, true},
+		{"Pressure", 200, 100, true},
+		{"Unknown", 1, 0, false},
+	}
+	for _, test := range tests {
+		value, found := db.Scale(test.name, test.raw)
+		if value != test.value || found != test.found {
+			t.Errorf("Scale(%s, %v) = %v %v, want %v %v", test.name, test.raw, value, found, test.value, test.found)
+		}
+	}
+}
@@ -15,6 +15,7 @@ type DigitalOutputType struct {
 type DigitalOutputsType struct {
 	Outputs [6]DigitalOutputType `json:"Outputs"`
 	mu      sync.Mutex
+	board   *BoardType
 }
 
 func (do *DigitalOutputsType) InitOutputs() {
@@ -31,7 +32,7 @@ func (do *DigitalOutputsType) SetAllOutputs(settings uint8) {
 	do.mu.Lock()
 	defer do.mu.Unlock()
 
-	for idx := range Outputs.Outputs {
+	for idx := range do.Outputs {
 		do.Outputs[idx].Pin = (settings & 1) != 0
 		settings >>= 1
 	}
@@ -86,27 +87,37 @@ func (do *DigitalOutputsType) GetAllOutputs() uint8 {
 	return val
 }
 
-func (do *DigitalOutputsType) SetOutput(pin uint8, on bool) {
+/*
+SetOutput switches the output. An InterlockError is returned if an interlock stops it being switched on.
+*/
+func (do *DigitalOutputsType) SetOutput(pin uint8, on bool) error {
+	Interlocks.mu.Lock()
+	defer Interlocks.mu.Unlock()
+	if on {
+		if err := Interlocks.check(do.board, ActionOutput, pin); err != nil {
+			return err
+		}
+	}
 	op := do.GetAllOutputs()
-	fmt.Printf("Outputs = %b\n", op)
+	wasOn := op&(uint8(1)<<pin) != 0
 	if on {
 		op |= uint8(1) << pin
 	} else {
 		op &= ^(uint8(1) << pin)
 	}
 	do.SetAllOutputs(op)
-	fmt.Printf("New outputs = %b\n", op)
-	if err := canBus.SetDigitalOutputs(op); err != nil {
+	if err := canBus.SetDigitalOutputs(do.board, op); err != nil {
 		log.Print(err)
 	}
+	Interlocks.switched(do.board, ActionOutput, pin, wasOn, on)
+	return nil
 }
 
 func (do *DigitalOutputsType) SetOutputByName(pin string, on bool) error {
 	pin = strings.ToLower(pin)
 	for idx, op := range do.Outputs {
 		if op.Name == pin {
-			do.SetOutput(uint8(idx), on)
-			return nil
+			return do.SetOutput(uint8(idx), on)
 		}
 	}
 	return fmt.Errorf("invalid output port - %s", pin)
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Events records fuel cell alarms and faults as they are raised and cleared. Each condition is identified by its
+source and code. The CAN handlers report the full set of conditions that are currently active for a source and the
+event log works out which have appeared and which have gone away. Events are written to the FuelCellEvents table
+and the most recent are also kept in memory so they can be served when the database is not available.
+*/
+
+// Event sources
+const (
+	EventSourceAlarm       = "Alarm"       // Bits in the PAN alarm message
+	EventSourceFault       = "Fault"       // FaultLevel / FaultCode in the power mode message
+	EventSourceDCOutput    = "DCOutput"    // DC output error code
+	EventSourceInsulation  = "Insulation"  // Insulation monitor alarm level
+	EventSourceCellHealth  = "CellHealth"  // Weak cells found by the cell health analysis
+	EventSourcePurge       = "Purge"       // Exhaust purges opened by the purge scheduler
+	EventSourceMaintenance = "Maintenance" // Service intervals that are due
+	EventSourceRule        = "Rule"        // Notifications from the rules
+	EventSourceSchedule    = "Schedule"    // Notifications from the scheduler
+	EventSourceFailSafe    = "FailSafe"    // The fail-safe state was applied
+	EventSourceInterlock   = "Interlock"   // Automation that an interlock stopped
+)
+
+const eventHistorySize = 500
+const eventQueueLength = 100
+const eventsDefaultPageSize = 50
+const eventsMaxPageSize = 1000
+
+const createEventsTable = `CREATE TABLE IF NOT EXISTS firefly.FuelCellEvents (
+	id BIGINT NOT NULL AUTO_INCREMENT,
+	started DATETIME(3) NOT NULL,
+	ended DATETIME(3) NULL,
+	duration DOUBLE NULL,
+	source VARCHAR(32) NOT NULL,
+	code VARCHAR(32) NOT NULL,
+	description VARCHAR(255) NOT NULL,
+	PRIMARY KEY (id),
+	KEY started (started),
+	KEY source_code (source, code))`
+
+type EventType struct {
+	ID          int64 `json:",omitempty"`
+	Source      string
+	Code        string
+	Description string
+	Started     time.Time
+	Ended       *time.Time `json:",omitempty"`
+	Duration    float64    // Seconds. For active events this is the time so far
+	Active      bool
+}
+
+type EventLogType struct {
+	mu      sync.Mutex
+	active  map[string]*EventType // Keyed on source and code
+	history []*EventType          // Most recent last
+	queue   chan *EventType       // Events waiting to be written to the database
+}
+
+var Events = EventLogType{active: make(map[string]*EventType), queue: make(chan *EventType, eventQueueLength)}
+
+func eventKey(source string, code string) string {
+	return source + "/" + code
+}
+
+/*
+Update is given every condition that is currently active for the source as code -> description. New conditions are
+raised and conditions that are no longer present are cleared.
+*/
+func (el *EventLogType) Update(source string, conditions map[string]string) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	now := time.Now()
+	for code, description := range conditions {
+		if _, found := el.active[eventKey(source, code)]; !found {
+			el.raise(now, source, code, description)
+		}
+	}
+	for key, event := range el.active {
+		if event.Source != source {
+			continue
+		}
+		if _, found := conditions[event.Code]; !found {
+			el.clear(now, key, event)
+		}
+	}
+}
+
+/*
+Record logs something that happened at a single point in time, such as a command being sent
+*/
+func (el *EventLogType) Record(source string, code string, description string) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	now := time.Now()
+	event := &EventType{Source: source, Code: code, Description: description, Started: now, Ended: &now}
+	log.Printf("Event %s %s - %s", source, code, description)
+	el.remember(event)
+	el.save(event)
+}
+
+// raise must be called with the event log locked
+func (el *EventLogType) raise(now time.Time, source string, code string, description string) {
+	event := &EventType{Source: source, Code: code, Description: description, Started: now, Active: true}
+	log.Printf("Event raised %s %s - %s", source, code, description)
+	el.active[eventKey(source, code)] = event
+	el.remember(event)
+	el.save(event)
+}
+
+// clear must be called with the event log locked
+func (el *EventLogType) clear(now time.Time, key string, event *EventType) {
+	ended := now
+	event.Ended = &ended
+	event.Duration = now.Sub(event.Started).Seconds()
+	event.Active = false
+	delete(el.active, key)
+	log.Printf("Event cleared %s %s after %0.1fs - %s", event.Source, event.Code, event.Duration, event.Description)
+	el.save(event)
+}
+
+// remember must be called with the event log locked
+func (el *EventLogType) remember(event *EventType) {
+	el.history = append(el.history, event)
+	if len(el.history) > eventHistorySize {
+		el.history = el.history[len(el.history)-eventHistorySize:]
+	}
+}
+
+// save queues the event for the database writer. It must be called with the event log locked.
+func (el *EventLogType) save(event *EventType) {
+	copied := *event
+	select {
+	case el.queue <- &copied:
+	default:
+		log.Printf("Event queue is full. %s %s was not saved to the database", event.Source, event.Code)
+	}
+}
+
+/*
+Writer saves queued events to the database. Raised events are inserted and the row is updated when they clear.
+An event that was raised while the database was down is inserted in full when it clears.
+*/
+func (el *EventLogType) Writer() {
+	var (
+		db      *sql.DB
+		created bool
+	)
+	// Row IDs of the raised events, so the row can be updated when the event clears
+	ids := make(map[string]int64)
+	for event := range el.queue {
+		if db != pDB {
+			db = pDB
+			created = false
+		}
+		if db == nil {
+			continue
+		}
+		if !created {
+			if _, err := db.Exec(createEventsTable); err != nil {
+				log.Println("Events table -", err)
+				continue
+			}
+			created = true
+		}
+		key := fmt.Sprintf("%s/%d", eventKey(event.Source, event.Code), event.Started.UnixNano())
+		if id, found := ids[key]; found && event.Ended != nil {
+			delete(ids, key)
+			if _, err := db.Exec("UPDATE firefly.FuelCellEvents SET ended = ?, duration = ? WHERE id = ?", *event.Ended, event.Duration, id); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		var duration sql.NullFloat64
+		var ended sql.NullTime
+		if event.Ended != nil {
+			ended = sql.NullTime{Time: *event.Ended, Valid: true}
+			duration = sql.NullFloat64{Float64: event.Duration, Valid: true}
+		}
+		result, err := db.Exec("INSERT INTO firefly.FuelCellEvents (started, ended, duration, source, code, description) VALUES (?,?,?,?,?,?)",
+			event.Started, ended, duration, event.Source, event.Code, event.Description)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if event.Ended == nil {
+			if id, err := result.LastInsertId(); err != nil {
+				log.Println(err)
+			} else {
+				ids[key] = id
+			}
+		}
+	}
+}
+
+/*
+ActiveEvents returns the conditions that are currently raised
+*/
+func (el *EventLogType) ActiveEvents() []EventType {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	events := make([]EventType, 0, len(el.active))
+	for _, event := range el.active {
+		copied := *event
+		copied.Duration = time.Since(event.Started).Seconds()
+		events = append(events, copied)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Started.Before(events[j].Started) })
+	return events
+}
+
+// alarmEvents turns the alarm bitmap into event conditions
+func alarmEvents(bitMap uint32) map[string]string {
+	conditions := make(map[string]string)
+	for _, alarm := range alarmDescriptions {
+		if bitMap&alarm.bit != 0 {
+			conditions[fmt.Sprintf("0x%08X", alarm.bit)] = alarm.text
+		}
+	}
+	return conditions
+}
+
+type EventFilterType struct {
+	Source     string
+	Code       string
+	ActiveOnly bool
+	Start      time.Time
+	End        time.Time
+	Page       int // From 1
+	PageSize   int
+}
+
+type EventPageType struct {
+	Page     int
+	PageSize int
+	Total    int
+	Events   []EventType
+}
+
+/*
+parseEventFilter reads the query parameters
+source, code, active=true, start and end (yyyy-m-d h:m), page and pageSize
+*/
+func parseEventFilter(r *http.Request) (EventFilterType, error) {
+	params := r.URL.Query()
+	filter := EventFilterType{Source: params.Get("source"), Code: params.Get("code"), Page: 1, PageSize: eventsDefaultPageSize}
+	filter.ActiveOnly = params.Get("active") == "true"
+	var err error
+	if text := params.Get("start"); text != "" {
+		if filter.Start, err = time.ParseInLocation("2006-1-2 15:4", text, time.Local); err != nil {
+			return filter, err
+		}
+	}
+	if text := params.Get("end"); text != "" {
+		if filter.End, err = time.ParseInLocation("2006-1-2 15:4", text, time.Local); err != nil {
+			return filter, err
+		}
+	}
+	if text := params.Get("page"); text != "" {
+		if filter.Page, err = strconv.Atoi(text); err != nil || filter.Page < 1 {
+			return filter, fmt.Errorf("invalid page %s", text)
+		}
+	}
+	if text := params.Get("pageSize"); text != "" {
+		if filter.PageSize, err = strconv.Atoi(text); err != nil || filter.PageSize < 1 || filter.PageSize > eventsMaxPageSize {
+			return filter, fmt.Errorf("page size must be 1 to %d", eventsMaxPageSize)
+		}
+	}
+	return filter, nil
+}
+
+func (filter *EventFilterType) matches(event *EventType) bool {
+	return (filter.Source == "" || event.Source == filter.Source) &&
+		(filter.Code == "" || event.Code == filter.Code) &&
+		(!filter.ActiveOnly || event.Active) &&
+		(filter.Start.IsZero() || !event.Started.Before(filter.Start)) &&
+		(filter.End.IsZero() || event.Started.Before(filter.End))
+}
+
+// fromMemory serves the page from the events kept in memory, newest first
+func (el *EventLogType) fromMemory(filter EventFilterType) EventPageType {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	page := EventPageType{Page: filter.Page, PageSize: filter.PageSize, Events: make([]EventType, 0)}
+	skip := (filter.Page - 1) * filter.PageSize
+	for i := len(el.history) - 1; i >= 0; i-- {
+		event := el.history[i]
+		if !filter.matches(event) {
+			continue
+		}
+		page.Total++
+		if page.Total > skip && len(page.Events) < filter.PageSize {
+			copied := *event
+			if copied.Active {
+				copied.Duration = time.Since(copied.Started).Seconds()
+			}
+			page.Events = append(page.Events, copied)
+		}
+	}
+	return page
+}
+
+// fromDatabase serves the page from the FuelCellEvents table, newest first
+func fromDatabase(db *sql.DB, filter EventFilterType) (EventPageType, error) {
+	page := EventPageType{Page: filter.Page, PageSize: filter.PageSize, Events: make([]EventType, 0)}
+	where := " WHERE 1 = 1"
+	var args []interface{}
+	if filter.Source != "" {
+		where += " AND source = ?"
+		args = append(args, filter.Source)
+	}
+	if filter.Code != "" {
+		where += " AND code = ?"
+		args = append(args, filter.Code)
+	}
+	if filter.ActiveOnly {
+		where += " AND ended IS NULL"
+	}
+	if !filter.Start.IsZero() {
+		where += " AND started >= ?"
+		args = append(args, filter.Start)
+	}
+	if !filter.End.IsZero() {
+		where += " AND started < ?"
+		args = append(args, filter.End)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM firefly.FuelCellEvents"+where, args...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+	args = append(args, filter.PageSize, (filter.Page-1)*filter.PageSize)
+	rows, err := db.Query("SELECT id, started, ended, duration, source, code, description FROM firefly.FuelCellEvents"+where+
+		" ORDER BY started DESC, id DESC LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return page, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+	for rows.Next() {
+		var event EventType
+		var ended sql.NullTime
+		var duration sql.NullFloat64
+		if err := rows.Scan(&event.ID, &event.Started, &ended, &duration, &event.Source, &event.Code, &event.Description); err != nil {
+			return page, err
+		}
+		if ended.Valid {
+			event.Ended = &ended.Time
+			event.Duration = duration.Float64
+		} else {
+			event.Active = true
+			event.Duration = time.Since(event.Started).Seconds()
+		}
+		page.Events = append(page.Events, event)
+	}
+	return page, rows.Err()
+}
+
+/*
+getEvents returns a page of events, newest first. If the database is not connected the events kept in memory are used.
+*/
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Get Events"
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	var page EventPageType
+	if db := pDB; db != nil {
+		if page, err = fromDatabase(db, filter); err != nil {
+			log.Println("Events from the database -", err)
+			page = Events.fromMemory(filter)
+		}
+	} else {
+		page = Events.fromMemory(filter)
+	}
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(page); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func getActiveEvents(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Active Events"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(Events.ActiveEvents()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestEventLog returns an event log of its own so the tests do not see events raised elsewhere
+func newTestEventLog() *EventLogType {
+	return &EventLogType{active: make(map[string]*EventType), queue: make(chan *EventType, eventQueueLength)}
+}
+
+// queued returns the events waiting for the database writer
+func (el *EventLogType) queued() []*EventType {
+	var events []*EventType
+	for {
+		select {
+		case event := <-el.queue:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventEdges(t *testing.T) {
+	el := newTestEventLog()
+	steps := []struct {
+		name       string
+		conditions map[string]string
+		active     []string // Codes, in the order they were raised
+		queued     int      // Events raised or cleared by the step
+	}{
+		{name: "Nothing active"},
+		{name: "Raised", conditions: map[string]string{"1": "Low coolant"}, active: []string{"1"}, queued: 1},
+		{name: "Still active", conditions: map[string]string{"1": "Low coolant"}, active: []string{"1"}},
+		{name: "Second raised", conditions: map[string]string{"1": "Low coolant", "2": "High temperature"},
+			active: []string{"1", "2"}, queued: 1},
+		{name: "First cleared", conditions: map[string]string{"2": "High temperature"}, active: []string{"2"}, queued: 1},
+		{name: "All cleared", active: nil, queued: 1},
+		{name: "Raised again", conditions: map[string]string{"1": "Low coolant"}, active: []string{"1"}, queued: 1},
+	}
+	for _, step := range steps {
+		el.Update(EventSourceAlarm, step.conditions)
+		// Another source must not clear them
+		el.Update(EventSourceFault, nil)
+		active := el.ActiveEvents()
+		if len(active) != len(step.active) {
+			t.Fatalf("%s: %d events active, want %d", step.name, len(active), len(step.active))
+		}
+		for i, event := range active {
+			if event.Code != step.active[i] || event.Source != EventSourceAlarm || !event.Active {
+				t.Errorf("%s: active event %d = %+v, want %s", step.name, i, event, step.active[i])
+			}
+		}
+		if queued := el.queued(); len(queued) != step.queued {
+			t.Errorf("%s: %d events queued for the database, want %d", step.name, len(queued), step.queued)
+		}
+	}
+
+	page := el.fromMemory(EventFilterType{Source: EventSourceAlarm, Code: "1", Page: 1, PageSize: 10})
+	if page.Total != 2 {
+		t.Fatalf("%d events for code 1 in memory, want 2", page.Total)
+	}
+	// Newest first
+	if !page.Events[0].Active || page.Events[1].Active || page.Events[1].Ended == nil {
+		t.Errorf("events for code 1 = %+v", page.Events)
+	}
+}
+
+func TestEventRecord(t *testing.T) {
+	el := newTestEventLog()
+	el.Record(EventSourceFault, "Stop", "Stop command sent")
+	if active := el.ActiveEvents(); len(active) != 0 {
+		t.Errorf("a recorded event is active - %+v", active)
+	}
+	queued := el.queued()
+	if len(queued) != 1 || queued[0].Ended == nil || !queued[0].Ended.Equal(queued[0].Started) {
+		t.Errorf("recorded events queued = %+v", queued)
+	}
+}
+
+func TestEventPages(t *testing.T) {
+	el := newTestEventLog()
+	for _, code := range []string{"a", "b", "c", "d", "e"} {
+		el.Record(EventSourceFault, code, "")
+	}
+	el.Record(EventSourceDCOutput, "f", "")
+	tests := []struct {
+		name   string
+		filter EventFilterType
+		total  int
+		codes  []string
+	}{
+		{name: "First page", filter: EventFilterType{Page: 1, PageSize: 2}, total: 6, codes: []string{"f", "e"}},
+		{name: "Last page", filter: EventFilterType{Page: 3, PageSize: 2}, total: 6, codes: []string{"b", "a"}},
+		{name: "Past the end", filter: EventFilterType{Page: 4, PageSize: 2}, total: 6},
+		{name: "Source", filter: EventFilterType{Source: EventSourceFault, Page: 1, PageSize: 10}, total: 5,
+			codes: []string{"e", "d", "c", "b", "a"}},
+		{name: "Active only", filter: EventFilterType{ActiveOnly: true, Page: 1, PageSize: 10}},
+	}
+	for _, test := range tests {
+		page := el.fromMemory(test.filter)
+		if page.Total != test.total || len(page.Events) != len(test.codes) {
+			t.Errorf("%s: %d events of %d, want %d of %d", test.name, len(page.Events), page.Total, len(test.codes), test.total)
+			continue
+		}
+		for i, event := range page.Events {
+			if event.Code != test.codes[i] {
+				t.Errorf("%s: event %d is %s, want %s", test.name, i, event.Code, test.codes[i])
+			}
+		}
+	}
+}
+
+func TestParseEventFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{query: ""},
+		{query: "source=Alarm&active=true&start=2026-3-2%208:00&end=2026-3-3%208:00&page=2&pageSize=20"},
+		{query: "start=yesterday", wantErr: true},
+		{query: "page=0", wantErr: true},
+		{query: "pageSize=1001", wantErr: true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/Events", nil)
+		r.URL.RawQuery = test.query
+		if _, err := parseEventFilter(r); (err != nil) != test.wantErr {
+			t.Errorf("%q: parseEventFilter returned %v", test.query, err)
+		}
+	}
+}
+
+func TestAlarmEvents(t *testing.T) {
+	first, second := alarmDescriptions[0], alarmDescriptions[1]
+	conditions := alarmEvents(first.bit | second.bit)
+	if len(conditions) != 2 {
+		t.Fatalf("%d conditions for two alarm bits", len(conditions))
+	}
+	for _, alarm := range alarmDescriptions[:2] {
+		found := false
+		for _, text := range conditions {
+			found = found || text == alarm.text
+		}
+		if !found {
+			t.Errorf("alarm %s is missing", alarm.text)
+		}
+	}
+	if len(alarmEvents(0)) != 0 {
+		t.Error("conditions raised with no alarm bits set")
+	}
+}
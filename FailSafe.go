@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The fail-safe puts the relays, digital outputs and fuel cells into configured safe states when something goes
+wrong, rather than leaving them as they were until the board's heartbeat times out. It is triggered by the loss of
+CAN communication with the main board, loss of the database, the watchdog not being kicked in time, or by hand.
+
+Once applied the fail-safe state is held until it is reset. While it is held the fuel cells will not start and the
+rules, scheduler and timed switches cannot switch anything on. Relays and outputs can still be set by hand.
+
+When the service is told to stop (SIGTERM or SIGINT) the safe states are applied, every fuel cell is stopped and we
+wait for them to report Off before the state is saved and the service exits. If CAN has been lost the board cannot
+be told about the safe states, but they are what it will be sent when communication returns.
+*/
+
+// Fail-safe triggers
+const (
+	FailSafeCAN      = "CAN"
+	FailSafeDatabase = "database"
+	FailSafeWatchdog = "watchdog"
+	FailSafeManual   = "manual"
+	FailSafeShutdown = "shutdown"
+)
+
+const failSafeOffCheckInterval = time.Millisecond * 500
+
+type FailSafeSettingsType struct {
+	SafeStates             []ActionType // relay, output, fuelCellStop and exhaust actions
+	OnCANLoss              bool
+	CANLossSeconds         float64 // Time without frames from the main board before CAN counts as lost
+	OnDatabaseLoss         bool
+	DatabaseLossSeconds    float64 // Time without a database connection before it counts as lost
+	WatchdogSeconds        float64 // The watchdog must be kicked within this time. 0 turns it off
+	ShutdownTimeoutSeconds float64 // Longest wait for the fuel cells to reach Off when the service stops
+}
+
+type FailSafeType struct {
+	mu           sync.Mutex
+	tripped      bool
+	trigger      string
+	reason       string
+	since        time.Time
+	canLost      time.Time // When CAN was last seen to be lost. Zero while it is working
+	dbLost       time.Time
+	lastKick     time.Time
+	shuttingDown bool
+}
+
+var FailSafe FailSafeType
+
+func defaultFailSafeSettings() FailSafeSettingsType {
+	return FailSafeSettingsType{
+		CANLossSeconds:         10,
+		DatabaseLossSeconds:    300,
+		ShutdownTimeoutSeconds: 120,
+	}
+}
+
+func (s *FailSafeSettingsType) validate() error {
+	for i := range s.SafeStates {
+		switch s.SafeStates[i].Type {
+		case ActionRelay, ActionOutput, ActionFuelCellStop, ActionExhaust:
+		default:
+			return fmt.Errorf("safe state %d: must be %s, %s, %s or %s", i+1, ActionRelay, ActionOutput, ActionFuelCellStop, ActionExhaust)
+		}
+		if err := s.SafeStates[i].validate(); err != nil {
+			return fmt.Errorf("safe state %d: %v", i+1, err)
+		}
+	}
+	if s.CANLossSeconds <= 0 || s.DatabaseLossSeconds <= 0 {
+		return fmt.Errorf("loss times must be greater than zero")
+	}
+	if s.WatchdogSeconds < 0 || s.ShutdownTimeoutSeconds < 0 {
+		return fmt.Errorf("the watchdog and shutdown times cannot be negative")
+	}
+	return nil
+}
+
+// Tripped returns true and the reason if the fail-safe state is being held
+func (fs *FailSafeType) Tripped() (bool, string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.tripped, fs.reason
+}
+
+/*
+Trip applies the safe states and holds them until Reset is called. Nothing is done if they are already held.
+*/
+func (fs *FailSafeType) Trip(trigger string, reason string) {
+	fs.mu.Lock()
+	if fs.tripped {
+		fs.mu.Unlock()
+		return
+	}
+	fs.tripped = true
+	fs.trigger = trigger
+	fs.reason = reason
+	fs.since = time.Now()
+	fs.mu.Unlock()
+
+	log.Printf("Fail-safe - %s", reason)
+	Events.Record(EventSourceFailSafe, trigger, reason)
+	fs.apply()
+}
+
+// apply carries out the safe state actions. It must not be called with the fail-safe locked.
+func (fs *FailSafeType) apply() {
+	for _, action := range currentSettings.FailSafe.SafeStates {
+		action.run(EventSourceFailSafe, "safe state")
+	}
+}
+
+/*
+Reset releases the fail-safe state. It fails if a trigger is still present as the state would just be applied again.
+*/
+func (fs *FailSafeType) Reset() error {
+	if _, reasons := fs.triggers(time.Now()); len(reasons) > 0 {
+		return fmt.Errorf("cannot reset the fail-safe while %s", strings.Join(reasons, " and "))
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.shuttingDown {
+		return fmt.Errorf("the service is shutting down")
+	}
+	if fs.tripped {
+		log.Printf("Fail-safe reset. It was applied at %s - %s", fs.since.Format(time.RFC3339), fs.reason)
+	}
+	fs.tripped = false
+	fs.trigger = ""
+	fs.reason = ""
+	return nil
+}
+
+// Kick restarts the watchdog timer
+func (fs *FailSafeType) Kick() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.lastKick = time.Now()
+}
+
+/*
+Run checks the triggers every second
+*/
+func (fs *FailSafeType) Run() {
+	fs.Kick()
+	checkTime := time.NewTicker(time.Second)
+	for {
+		now := <-checkTime.C
+		if triggers, reasons := fs.triggers(now); len(triggers) > 0 {
+			fs.Trip(strings.Join(triggers, ", "), strings.Join(reasons, " and "))
+		}
+	}
+}
+
+/*
+triggers updates the CAN and database loss times and returns every trigger that is present with its reason
+*/
+func (fs *FailSafeType) triggers(now time.Time) (triggers []string, reasons []string) {
+	settings := currentSettings.FailSafe
+	canLost := canBus == nil || Freshness.IsStale(MainBoard().freshnessName("Relays"))
+	dbLost := pDB == nil
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !canLost {
+		fs.canLost = time.Time{}
+	} else if fs.canLost.IsZero() {
+		fs.canLost = now
+	}
+	if !dbLost {
+		fs.dbLost = time.Time{}
+	} else if fs.dbLost.IsZero() {
+		fs.dbLost = now
+	}
+
+	if settings.OnCANLoss && !fs.canLost.IsZero() && now.Sub(fs.canLost).Seconds() >= settings.CANLossSeconds {
+		triggers = append(triggers, FailSafeCAN)
+		reasons = append(reasons, fmt.Sprintf("CAN communication with the main board has been lost for %0.0fs", now.Sub(fs.canLost).Seconds()))
+	}
+	if settings.OnDatabaseLoss && !fs.dbLost.IsZero() && now.Sub(fs.dbLost).Seconds() >= settings.DatabaseLossSeconds {
+		triggers = append(triggers, FailSafeDatabase)
+		reasons = append(reasons, fmt.Sprintf("the database has been lost for %0.0fs", now.Sub(fs.dbLost).Seconds()))
+	}
+	if settings.WatchdogSeconds > 0 && now.Sub(fs.lastKick).Seconds() >= settings.WatchdogSeconds {
+		triggers = append(triggers, FailSafeWatchdog)
+		reasons = append(reasons, fmt.Sprintf("the watchdog has not been kicked for %0.0fs", now.Sub(fs.lastKick).Seconds()))
+	}
+	return triggers, reasons
+}
+
+// fuelCellsNotOff returns the fuel cells that still report a power mode other than Off
+func fuelCellsNotOff() (running []string) {
+	for _, fuelCell := range FuelCells {
+		measurements := fuelCell.Measurements()
+		// If we have no data from the fuel cell there is nothing to wait for
+		if measurements.ModeValid && measurements.PowerMode != PMOff {
+			running = append(running, fmt.Sprintf("%s (%s)", fuelCell.Label(), measurements.PowerMode))
+		}
+	}
+	return running
+}
+
+/*
+Shutdown applies the safe states, stops the fuel cells and waits for them to reach Off, saves the state and exits.
+The CAN heartbeat keeps running so the stop command and safe states continue to be sent while we wait.
+*/
+func (fs *FailSafeType) Shutdown(signal os.Signal) {
+	fs.stop(signal)
+	log.Println("Shutdown complete")
+	if logFile != nil {
+		if err := logFile.Close(); err != nil {
+			_, _ = fmt.Fprint(os.Stderr, err)
+		}
+	}
+	os.Exit(0)
+}
+
+// stop does everything Shutdown does short of exiting
+func (fs *FailSafeType) stop(signal os.Signal) {
+	fs.mu.Lock()
+	fs.shuttingDown = true
+	fs.mu.Unlock()
+
+	log.Printf("Received %v. Shutting down", signal)
+	if tripped, _ := fs.Tripped(); tripped {
+		// Apply the safe states again in case something has been changed by hand since they were applied
+		fs.apply()
+	} else {
+		fs.Trip(FailSafeShutdown, fmt.Sprintf("the service is stopping (%v)", signal))
+	}
+	StopFuelCells()
+
+	timeout := time.Duration(currentSettings.FailSafe.ShutdownTimeoutSeconds * float64(time.Second))
+	deadline := time.Now().Add(timeout)
+	for {
+		running := fuelCellsNotOff()
+		if len(running) == 0 {
+			log.Println("Every fuel cell is off")
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Gave up waiting after %v for %s to reach Off", timeout, strings.Join(running, ", "))
+			break
+		}
+		time.Sleep(failSafeOffCheckInterval)
+	}
+
+	if err := State.Save(); err != nil {
+		log.Println("Save state -", err)
+	}
+	if db := pDB; db != nil {
+		if err := db.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/*
+HandleSignals starts the shutdown on the first signal. A second signal exits straight away.
+*/
+func (fs *FailSafeType) HandleSignals(signals chan os.Signal) {
+	signal := <-signals
+	go fs.Shutdown(signal)
+	signal = <-signals
+	log.Printf("Received %v during the shutdown. Exiting now", signal)
+	os.Exit(1)
+}
+
+type FailSafeStatusType struct {
+	Settings          FailSafeSettingsType
+	Tripped           bool
+	Trigger           string     `json:",omitempty"`
+	Reason            string     `json:",omitempty"`
+	Since             *time.Time `json:",omitempty"`
+	CANLost           bool
+	DatabaseLost      bool
+	WatchdogRemaining float64 `json:",omitempty"` // Seconds before the watchdog must be kicked
+	ShuttingDown      bool
+}
+
+func (fs *FailSafeType) Status() FailSafeStatusType {
+	settings := currentSettings.FailSafe
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	status := FailSafeStatusType{Settings: settings, Tripped: fs.tripped, Trigger: fs.trigger, Reason: fs.reason,
+		CANLost: !fs.canLost.IsZero(), DatabaseLost: !fs.dbLost.IsZero(), ShuttingDown: fs.shuttingDown}
+	if fs.tripped {
+		since := fs.since
+		status.Since = &since
+	}
+	if settings.WatchdogSeconds > 0 {
+		status.WatchdogRemaining = settings.WatchdogSeconds - time.Since(fs.lastKick).Seconds()
+		if status.WatchdogRemaining < 0 {
+			status.WatchdogRemaining = 0
+		}
+	}
+	return status
+}
+
+func getFailSafe(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Fail-Safe"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(FailSafe.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func setFailSafe(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Fail-Safe"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	settings := currentSettings.FailSafe
+	if err := json.Unmarshal(body, &settings); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	// Give the client a full period to start kicking the watchdog
+	FailSafe.Kick()
+	currentSettings.FailSafe = settings
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getFailSafe(w, r)
+}
+
+func tripFailSafe(w http.ResponseWriter, r *http.Request) {
+	FailSafe.Trip(FailSafeManual, "applied by hand")
+	getFailSafe(w, r)
+}
+
+func resetFailSafe(w http.ResponseWriter, r *http.Request) {
+	if err := FailSafe.Reset(); err != nil {
+		ReturnJSONError(w, "Reset Fail-Safe", err, http.StatusConflict, false)
+		return
+	}
+	getFailSafe(w, r)
+}
+
+func kickWatchdog(w http.ResponseWriter, r *http.Request) {
+	FailSafe.Kick()
+	getFailSafe(w, r)
+}
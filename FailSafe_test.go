@@ -0,0 +1,265 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// useFailSafeSettings installs the settings for the test and clears the fail-safe state when it finishes
+func useFailSafeSettings(t *testing.T, settings FailSafeSettingsType) {
+	t.Helper()
+	saved := currentSettings.FailSafe
+	currentSettings.FailSafe = settings
+	t.Cleanup(func() {
+		currentSettings.FailSafe = saved
+		FailSafe.mu.Lock()
+		FailSafe.tripped = false
+		FailSafe.trigger = ""
+		FailSafe.reason = ""
+		FailSafe.canLost = time.Time{}
+		FailSafe.dbLost = time.Time{}
+		FailSafe.shuttingDown = false
+		FailSafe.mu.Unlock()
+		MainBoard().Relays.SetAllRelays(0)
+		MainBoard().Outputs.SetAllOutputs(0)
+	})
+}
+
+// setRelaysSeen marks the relay message from the main board as just received, or as never received
+func setRelaysSeen(seen bool) {
+	Freshness.mu.Lock()
+	defer Freshness.mu.Unlock()
+	msg := Freshness.messages[MainBoard().freshnessName("Relays")]
+	msg.LastSeen = time.Time{}
+	if seen {
+		msg.LastSeen = time.Now()
+	}
+}
+
+func TestFailSafeTriggers(t *testing.T) {
+	settings := defaultFailSafeSettings()
+	settings.OnCANLoss = true
+	settings.OnDatabaseLoss = true
+	settings.WatchdogSeconds = 30
+	useFailSafeSettings(t, settings)
+
+	start := time.Now()
+	FailSafe.mu.Lock()
+	FailSafe.lastKick = start
+	FailSafe.mu.Unlock()
+
+	// The steps run in order as the loss times carry over. There is no database in the tests.
+	tests := []struct {
+		name    string
+		after   time.Duration
+		canSeen bool
+		want    []string
+	}{
+		{name: "Just lost", after: 0},
+		{name: "CAN lost for long enough", after: 10 * time.Second, want: []string{FailSafeCAN}},
+		{name: "CAN back", after: 11 * time.Second, canSeen: true},
+		{name: "CAN lost again restarts the time", after: 12 * time.Second},
+		{name: "Still within the loss time", after: 21 * time.Second},
+		{name: "Watchdog not kicked", after: 30 * time.Second, canSeen: true, want: []string{FailSafeWatchdog}},
+		{name: "Database lost for long enough", after: 300 * time.Second, canSeen: true,
+			want: []string{FailSafeDatabase, FailSafeWatchdog}},
+	}
+	defer setRelaysSeen(false)
+	for _, test := range tests {
+		setRelaysSeen(test.canSeen)
+		triggers, reasons := FailSafe.triggers(start.Add(test.after))
+		if !reflect.DeepEqual(triggers, test.want) {
+			t.Errorf("%s: triggers = %v, want %v", test.name, triggers, test.want)
+		}
+		if len(reasons) != len(triggers) {
+			t.Errorf("%s: %d reasons for %d triggers", test.name, len(reasons), len(triggers))
+		}
+	}
+
+	t.Run("Turned off", func(t *testing.T) {
+		useFailSafeSettings(t, defaultFailSafeSettings())
+		if triggers, _ := FailSafe.triggers(start.Add(time.Hour)); len(triggers) != 0 {
+			t.Errorf("triggers = %v with every trigger turned off", triggers)
+		}
+	})
+}
+
+func TestFailSafeTripWithoutCANBus(t *testing.T) {
+	board := MainBoard()
+	settings := defaultFailSafeSettings()
+	settings.OnCANLoss = true
+	settings.SafeStates = []ActionType{
+		{Type: ActionRelay, Board: board.NodeID, Channel: 2, On: true},
+		{Type: ActionOutput, Board: board.NodeID, Channel: 1},
+	}
+	useFailSafeSettings(t, settings)
+	board.Outputs.SetAllOutputs(0x02)
+	setRelaysSeen(true)
+
+	saved := canBus
+	canBus = nil
+	defer func() { canBus = saved }()
+
+	start := time.Now()
+	FailSafe.triggers(start)
+	triggers, reasons := FailSafe.triggers(start.Add(10 * time.Second))
+	if !reflect.DeepEqual(triggers, []string{FailSafeCAN}) {
+		t.Fatalf("triggers = %v without a CAN bus, want %s", triggers, FailSafeCAN)
+	}
+	FailSafe.Trip(triggers[0], reasons[0])
+	if tripped, _ := FailSafe.Tripped(); !tripped {
+		t.Error("the fail-safe is not tripped")
+	}
+	// The board cannot be told but the local state is what it will be sent when the bus returns
+	if !board.Relays.GetRelay(2) {
+		t.Error("relay 2 was not switched on")
+	}
+	if board.Outputs.GetOutput(1) {
+		t.Error("output 1 was not switched off")
+	}
+}
+
+func TestFailSafeHoldsOff(t *testing.T) {
+	board := MainBoard()
+	fuelCell := MainFuelCell()
+	useFailSafeSettings(t, defaultFailSafeSettings())
+	defer fuelCell.SetExhaust(false)
+
+	tests := []struct {
+		name   string
+		action ActionType
+		before bool // The state of the relay, output or exhaust before the action. It must be off afterwards.
+	}{
+		{name: "Relay on", action: ActionType{Type: ActionRelay, Board: board.NodeID, Channel: 3, On: true}},
+		{name: "Relay off", action: ActionType{Type: ActionRelay, Board: board.NodeID, Channel: 3}, before: true},
+		{name: "Output on", action: ActionType{Type: ActionOutput, Board: board.NodeID, Channel: 3, On: true}},
+		{name: "Output off", action: ActionType{Type: ActionOutput, Board: board.NodeID, Channel: 3}, before: true},
+		{name: "Open the exhaust", action: ActionType{Type: ActionExhaust, On: true}},
+		{name: "Close the exhaust", action: ActionType{Type: ActionExhaust}, before: true},
+	}
+	state := func(action ActionType) bool {
+		switch action.Type {
+		case ActionRelay:
+			return board.Relays.GetRelay(action.Channel)
+		case ActionOutput:
+			return board.Outputs.GetOutput(action.Channel)
+		}
+		return fuelCell.Commands().Exhaust
+	}
+	set := func(action ActionType, on bool) {
+		switch action.Type {
+		case ActionRelay:
+			board.Relays.SetAllRelays(uint16(btoi(on)) << action.Channel)
+		case ActionOutput:
+			board.Outputs.SetAllOutputs(uint8(btoi(on)) << action.Channel)
+		default:
+			fuelCell.SetExhaust(on)
+		}
+	}
+
+	FailSafe.Trip(FailSafeManual, "test")
+	for _, test := range tests {
+		set(test.action, test.before)
+		test.action.run(EventSourceRule, test.name)
+		if state(test.action) {
+			t.Errorf("%s while tripped: left on", test.name)
+		}
+	}
+	// The fail-safe itself is not held off
+	set(tests[0].action, false)
+	tests[0].action.run(EventSourceFailSafe, "safe state")
+	if !state(tests[0].action) {
+		t.Error("the fail-safe could not switch a relay on")
+	}
+
+	if err := FailSafe.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		set(test.action, test.before)
+		test.action.run(EventSourceRule, test.name)
+		if got := state(test.action); got != test.action.On {
+			t.Errorf("%s after the reset: state = %v, want %v", test.name, got, test.action.On)
+		}
+	}
+}
+
+// btoi returns 1 for true
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+/*
+TestFailSafeShutdown checks that the safe states are applied and the fuel cells stopped first, and that the state is
+only saved once the fuel cells report Off or the wait times out
+*/
+func TestFailSafeShutdown(t *testing.T) {
+	board := MainBoard()
+	fuelCell := MainFuelCell()
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	if err := State.Load(statePath); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = State.Load("") }()
+
+	tests := []struct {
+		name        string
+		timeout     float64
+		reportOff   bool
+		maxDuration time.Duration
+	}{
+		{name: "Fuel cell reports Off", timeout: 5, reportOff: true, maxDuration: 2 * time.Second},
+		{name: "Gave up waiting", timeout: 0.3, maxDuration: 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := defaultFailSafeSettings()
+			settings.SafeStates = []ActionType{{Type: ActionRelay, Board: board.NodeID, Channel: 4, On: true}}
+			settings.ShutdownTimeoutSeconds = test.timeout
+			useFailSafeSettings(t, settings)
+			_ = os.Remove(statePath)
+			fuelCell.FuelCellDriver.Start()
+			reportPowerMode(t, PMManual)
+			defer reportPowerMode(t, PMOff)
+
+			done := make(chan struct{})
+			go func() {
+				FailSafe.stop(syscall.SIGTERM)
+				close(done)
+			}()
+			waitFor(t, "the safe states", func() bool { return board.Relays.GetRelay(4) })
+			if test.reportOff {
+				select {
+				case <-done:
+					t.Fatal("the shutdown finished while the fuel cell was running")
+				case <-time.After(2 * failSafeOffCheckInterval):
+				}
+				if _, err := os.Stat(statePath); err == nil {
+					t.Error("the state was saved while the fuel cell was running")
+				}
+				reportPowerMode(t, PMOff)
+			}
+			select {
+			case <-done:
+			case <-time.After(test.maxDuration):
+				t.Fatal("the shutdown did not finish")
+			}
+			if fuelCell.Commands().FuelCellOn {
+				t.Error("the fuel cell was not stopped")
+			}
+			if _, err := os.Stat(statePath); err != nil {
+				t.Errorf("the state was not saved - %v", err)
+			}
+			if err := FailSafe.Reset(); err == nil {
+				t.Error("the fail-safe was reset during the shutdown")
+			}
+		})
+	}
+}
@@ -7,6 +7,8 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -38,6 +40,15 @@ var (
 	FuelCell         PANFuelCell
 	logFile          *os.File
 	logFileName      string
+	simulate         bool
+	canLogFile       string
+	canLogSizeMB     int
+	canLogKeep       int
+	replayFile       string
+	replaySpeed      float64
+	dbcFile          string
+	apiToken         string
+	stateFile        string
 )
 
 func connectToDatabase() (*sql.Stmt, *sql.DB, error) {
@@ -47,8 +58,8 @@ func connectToDatabase() (*sql.Stmt, *sql.DB, error) {
 		}
 		pDB = nil
 	}
-	// Set the time zone to Local to correctly record times
-	var sConnectionString = databaseLogin + ":" + databasePassword + "@tcp(" + databaseServer + ":" + databasePort + ")/" + databaseName + "?loc=Local"
+	// Set the time zone to Local to correctly record times and return DATETIME columns as time.Time
+	var sConnectionString = databaseLogin + ":" + databasePassword + "@tcp(" + databaseServer + ":" + databasePort + ")/" + databaseName + "?loc=Local&parseTime=true"
 
 	db, err := sql.Open("mysql", sConnectionString)
 	if err != nil {
@@ -71,71 +82,11 @@ func connectToDatabase() (*sql.Stmt, *sql.DB, error) {
 		}
 		return nil, nil, err
 	}
-	dbRecord.stmt, err = db.Prepare(`INSERT INTO firefly.PANFuelCell (StackCurrent
-	, StackVoltage
-	, CoolantInlTemp
-	, CoolantOutTemp
-	, OutputVoltage
-	, OutputCurrent
-	, CoolantFanSpeed
-	, CoolantPumpSpeed
-	, CoolantPumpVolts
-	, CoolantPumpAmps
-	, InsulationResistance
-	, HydrogenPressure
-	, AirPressure
-	, CoolantPressure
-	, AirinletTemp
-	, AmbientTemp
-	, AirFlow
-	, HydrogenConcentration
-	, DCDCTemp, DCDCInVolts
-	, DCDCOutVolts
-	, DCDCInAmps
-	, DCDCOutAmps
-	, MinCellVolts
-	, MaxCellVolts
-	, AvgCellVolts
-	, IdxMaxCell
-	, IdxMinCell
-	, RunStage
-	, FaultLevel
-	, PowerModeState
-	, Cell00Volts
-	, Cell01Volts
-	, Cell02Volts
-	, Cell03Volts
-	, Cell04Volts
-	, Cell05Volts
-	, Cell06Volts
-	, Cell07Volts
-	, Cell08Volts
-	, Cell09Volts
-	, Cell10Volts
-	, Cell11Volts
-	, Cell12Volts
-	, Cell13Volts
-	, Cell14Volts
-	, Cell15Volts
-	, Cell16Volts
-	, Cell17Volts
-	, Cell18Volts
-	, Cell19Volts
-	, Cell20Volts
-	, Cell21Volts
-	, Cell22Volts
-	, Cell23Volts
-	, Cell24Volts
-	, Cell25Volts
-	, Cell26Volts
-	, Cell27Volts
-	, Cell28Volts
-	, Cell29Volts
-	, Cell30Volts
-	, Cell31Volts
-	, Alarms
-	) 
-		 VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);`)
+	for _, fuelCell := range FuelCells {
+		if prepareErr := fuelCell.PrepareDatabase(db); prepareErr != nil {
+			err = prepareErr
+		}
+	}
 
 	return logAnalog, db, err
 }
@@ -145,13 +96,16 @@ func ConnectCANBus() *CANBus {
 		log.Println(err)
 		return nil
 	} else {
+		if simulate {
+			Simulator.Attach(Bus)
+		}
 		return Bus
 	}
 }
 
 func init() {
 
-	flag.StringVar(&CANInterface, "can", "can0", "CAN Interface Name")
+	flag.StringVar(&CANInterface, "can", "can0", "CAN Interface Name (can0 etc. for SocketCAN, vcan0 etc. for a virtual CAN interface or mem for an in-memory loopback bus)")
 	flag.StringVar(&WebPort, "WebPort", "20080", "Web port")
 	flag.StringVar(&jsonSettings, "jsonSettings", "/etc/FireFlyIO.json", "JSON file containing the system control parameters")
 	flag.StringVar(&webFiles, "webFiles", "/FireflyIO/web", "Path to the WEB files location")
@@ -161,10 +115,27 @@ func init() {
 	flag.StringVar(&databasePassword, "dbPassword", "logger", "Database user password")
 	flag.StringVar(&databasePort, "dbPort", "3306", "Database port")
 	flag.StringVar(&logFileName, "logfile", "/var/log/FireflyIO", "Name of the log file")
+	flag.BoolVar(&simulate, "simulate", false, "Simulate the FireflyIO board and PAN fuel cell on an in-memory or virtual CAN bus")
+	flag.StringVar(&dbcFile, "dbc", "/FireflyIO/PAN.dbc", "DBC file describing the fuel cell CAN messages. The built in definitions are used if it cannot be loaded")
+	flag.StringVar(&canLogFile, "canLog", "", "Record all CAN traffic to this file in candump log format")
+	flag.IntVar(&canLogSizeMB, "canLogSize", 50, "Size in MB at which the CAN traffic log is rotated")
+	flag.IntVar(&canLogKeep, "canLogKeep", 5, "Number of rotated CAN traffic logs to keep")
+	flag.StringVar(&replayFile, "replay", "", "Replay a candump log file through the frame handlers instead of using the CAN bus")
+	flag.Float64Var(&replaySpeed, "replaySpeed", 1, "Replay speed as a multiple of real time. 0 replays as fast as possible")
+	flag.StringVar(&apiToken, "apiToken", "", "Token required by the raw CAN frame endpoints. They are disabled if this is not set")
+	flag.StringVar(&stateFile, "stateFile", "/etc/FireFlyIO-state.json", "JSON file holding running totals such as the hydrogen used")
+}
+
+/*
+startUp parses the flags, loads the settings, connects to the CAN bus and starts everything running. It is called
+from main rather than init so the tests can be built without the service starting.
+*/
+func startUp() {
 	flag.Parse()
 
 	// open log file
-	logFile, err := os.OpenFile(logFileName, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+	var err error
+	logFile, err = os.OpenFile(logFileName, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -183,18 +154,78 @@ func init() {
 		log.Print(err)
 	}
 
+	InitBoards(currentSettings)
+	InitFuelCells(currentSettings)
+	// There were no boards or fuel cells to check the rules, schedule and interlocks against as they were loaded
+	currentSettings.checkAutomation()
+
+	if err := State.Load(stateFile); err != nil {
+		log.Print(err)
+	}
+
+	SetCANDatabase(LoadDBC(dbcFile))
+	log.Println("DBC definitions loaded from", CANDatabase().source)
+
+	if canLogFile != "" {
+		log.Println("Recording CAN traffic to", canLogFile)
+		if CANRecorder, err = NewCANRecorder(canLogFile, canLogSizeMB, canLogKeep); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if replayFile != "" {
+		if simulate {
+			log.Println("Simulation is not available while replaying a CAN log")
+			simulate = false
+		}
+		CANInterface = MemoryTransportName
+		CANRecovery.Disable("replaying a CAN log")
+	}
+
+	if simulate {
+		log.Println("Starting the hardware simulator")
+		CANInterface = SimulatedInterfaceName(CANInterface)
+		StartSimulator()
+	}
+
 	log.Println("Connecting to can bus")
 	canBus = ConnectCANBus()
-	FuelCell.init(canBus)
-	if err := FuelCell.setTargetBattHigh(currentSettings.FuelCellSettings.HighBatterySetpoint); err != nil {
-		log.Print(err)
+	ConnectFuelCells(canBus)
+	if replayFile != "" && canBus != nil {
+		go func(bus *CANBus) {
+			if err := ReplayCANLog(replayFile, replaySpeed, bus); err != nil {
+				log.Print(err)
+			}
+		}(canBus)
 	}
-	if err := FuelCell.setTargetBattLow(currentSettings.FuelCellSettings.LowBatterySetpoint); err != nil {
-		log.Print(err)
+	for _, fuelCell := range FuelCells {
+		if err := fuelCell.SetTargetBattHigh(currentSettings.FuelCellSettings.HighBatterySetpoint); err != nil {
+			log.Print(err)
+		}
+		if err := fuelCell.SetTargetBattLow(currentSettings.FuelCellSettings.LowBatterySetpoint); err != nil {
+			log.Print(err)
+		}
+		if err := fuelCell.SetTargetPower(currentSettings.FuelCellSettings.PowerSetting); err != nil {
+			log.Print(err)
+		}
 	}
-	if err := FuelCell.setTargetPower(currentSettings.FuelCellSettings.PowerSetting); err != nil {
-		log.Print(err)
+
+	go Freshness.Monitor()
+	go Events.Writer()
+	for _, fuelCell := range FuelCells {
+		go fuelCell.Supervisor.Run()
+		go fuelCell.Purge.Run()
 	}
+	go PowerControl.Run()
+	go AutoDispatch.Run()
+	go CellHealth.Run()
+	go Hydrogen.Run()
+	go Maintenance.Run()
+	go Rules.Run()
+	go Scheduler.Run()
+	go FailSafe.Run()
+	go State.Run()
+	go MonitorCANBusComms()
 
 	log.Println("Starting the WEB site.")
 	go setUpWebSite()
@@ -211,20 +242,21 @@ func ClientLoop() {
 		select {
 		case <-broadcastTime.C:
 			{
-				if canBus == nil || canBus.bus == nil {
+				if canBus == nil || canBus.transport() == nil {
 					log.Println("Adding the CAN bus monitor")
 					if canBus != nil {
-						if canBus.bus != nil {
-							if err := canBus.bus.Disconnect(); err != nil {
+						if transport := canBus.transport(); transport != nil {
+							if err := transport.Disconnect(); err != nil {
 								log.Println(err)
 							}
 						}
 						canBus = nil
-						FuelCell.bus = nil
+						ConnectFuelCells(nil)
 					}
 					canBus = ConnectCANBus()
-					FuelCell.bus = canBus
+					ConnectFuelCells(canBus)
 				}
+				reconnectFuelCells()
 
 				//				log.Println("Broadcast")
 				bytes, err := getJsonStatus()
@@ -279,13 +311,17 @@ func DatabaseLogger() {
 					pDB = nil
 					logAnalog = nil
 				}
-				if err := dbRecord.saveToDatabase(); err != nil {
-					log.Println(err)
-					if closeErr := pDB.Close(); closeErr != nil {
-						log.Println(closeErr)
+				for _, fuelCell := range FuelCells {
+					if pDB == nil {
+						break
+					}
+					if err := fuelCell.SaveToDatabase(); err != nil {
+						log.Println(err)
+						if closeErr := pDB.Close(); closeErr != nil {
+							log.Println(closeErr)
+						}
+						pDB = nil
 					}
-					pDB = nil
-					dbRecord.stmt = nil
 				}
 			} else {
 				log.Println("Database is not connected")
@@ -304,15 +340,19 @@ func CANHeartbeat() {
 		case <-heartbeatTime.C:
 			{
 				if canBus != nil {
-					Relays.UpdateRelays() // Heartbeat to the FireflyIO board. If we don't send this the board will turn all relays off after about a minute.
-					if err := canBus.SetFlags(currentSettings.getModbusFlags(), 0, 0, 0, 0, 0, 0, 0); err != nil {
-						log.Println(err)
-					}
-					if err := FuelCell.updateOutput(); err != nil {
-						log.Print(err)
+					for _, board := range Boards {
+						board.Relays.UpdateRelays() // Heartbeat to the FireflyIO board. If we don't send this the board will turn all relays off after about a minute.
+						if err := canBus.SetFlags(board, board.modbusFlags(), 0, 0, 0, 0, 0, 0, 0); err != nil {
+							log.Println(err)
+						}
 					}
-					if err := FuelCell.updateSettings(); err != nil {
-						log.Print(err)
+					for _, fuelCell := range FuelCells {
+						if err := fuelCell.UpdateOutput(); err != nil {
+							log.Print(err)
+						}
+						if err := fuelCell.UpdateSettings(); err != nil {
+							log.Print(err)
+						}
 					}
 				} else {
 					log.Println("No CAN bus available")
@@ -324,6 +364,7 @@ func CANHeartbeat() {
 }
 
 func main() {
+	startUp()
 	defer func() {
 		if err := logFile.Close(); err != nil {
 			_, _ = fmt.Fprint(os.Stderr, err)
@@ -333,6 +374,11 @@ func main() {
 	// ToDo
 	//	go AcquireElectrolysers()
 
+	// Stop in an orderly way so the outputs are left in their safe states
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go FailSafe.HandleSignals(signals)
+
 	go CANHeartbeat()
 	go DatabaseLogger()
 	ClientLoop()
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brutella/can"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+TestMain sets up the globals the way startUp does, with one board and the main fuel cell on an in-memory CAN bus.
+Nothing else is started so the tests drive the step functions themselves.
+*/
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+
+	Relays.InitRelays()
+	Outputs.InitOutputs()
+	Inputs.InitInputs()
+	AnalogInputs.InitAnalogInputs()
+	currentSettings = NewSettings()
+	currentSettings.FuelCellSettings.Enabled = true
+	InitBoards(currentSettings)
+	InitFuelCells(currentSettings)
+	SetCANDatabase(LoadDBC(""))
+
+	var err error
+	CANInterface = MemoryTransportName
+	if canBus, err = NewCANBus(CANInterface); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	ConnectFuelCells(canBus)
+	os.Exit(m.Run())
+}
+
+// testBus returns the in-memory transport so frames can be injected as if the fuel cell or a board sent them
+func testBus(t *testing.T) *MemoryTransport {
+	t.Helper()
+	transport, ok := canBus.transport().(*MemoryTransport)
+	if !ok {
+		t.Fatal("the test CAN bus is not an in-memory bus")
+	}
+	return transport
+}
+
+// inject sends the frame on the test bus and waits until done reports that it has been handled
+func inject(t *testing.T, frame can.Frame, done func() bool) {
+	t.Helper()
+	if err := testBus(t).Inject(frame); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, fmt.Sprintf("frame 0x%08X to be handled", frame.ID), done)
+}
+
+// waitFor polls done for up to a second
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !done(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for %s", what)
+		}
+	}
+}
+
+// reportPowerMode has the main fuel cell report the given power mode
+func reportPowerMode(t *testing.T, mode PowerModeStateType) {
+	t.Helper()
+	fuelCell := MainFuelCell()
+	inject(t, can.Frame{ID: CanPowerModeMsg, Length: 8, Data: [8]byte{byte(mode)}}, func() bool {
+		measurements := fuelCell.Measurements()
+		return measurements.ModeValid && measurements.PowerMode == mode
+	})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Freshness tracks when each CAN message was last received so values that have stopped updating can be flagged as
+stale instead of being reported forever.
+*/
+
+const (
+	FreshnessGroupFuelCell = "FuelCell"
+	FreshnessGroupBoard    = "Board"
+	FreshnessGroupAC       = "AC"
+	FreshnessGroupDC       = "DC"
+)
+
+// Fault actions taken when fuel cell data goes stale while the fuel cell is running
+const (
+	StaleActionNone             = "none"
+	StaleActionStopFuelCell     = "stopFuelCell"
+	StaleActionOpenRelay        = "openRelay"
+	StaleActionStopAndOpenRelay = "stopFuelCellAndOpenRelay"
+)
+
+type StaleDataSettingsType struct {
+	Timeouts    map[string]float64 // Seconds. Overrides the default timeout for the named message
+	FaultAction string             // none, stopFuelCell, openRelay or stopFuelCellAndOpenRelay
+	FaultRelay  uint8              // Relay turned off by the openRelay actions
+}
+
+type MessageFreshnessType struct {
+	Name     string
+	Group    string
+	Fields   []string `json:"-"` // PanStatus fields that come from this message
+	Node     int      `json:"-"` // Node ID of the board that sends this message. -1 for the fuel cell
+	Unit     int      `json:"-"` // Fuel cell that sends this message. 0 for the main fuel cell
+	Period   time.Duration
+	Timeout  time.Duration
+	LastSeen time.Time
+	Stale    bool
+}
+
+type FreshnessMonitorType struct {
+	mu          sync.Mutex
+	messages    map[string]*MessageFreshnessType
+	faultActive map[int]bool // Keyed on fuel cell number
+}
+
+// The map is created here rather than in init() so it is ready whenever the boards and fuel cells are added
+var Freshness = FreshnessMonitorType{messages: make(map[string]*MessageFreshnessType), faultActive: make(map[int]bool)}
+
+/*
+watchFuelCell adds the messages sent by a fuel cell
+*/
+func (fm *FreshnessMonitorType) watchFuelCell(number int) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fc := func(message string, period time.Duration, fields ...string) {
+		name := fuelCellFreshnessName(number, message)
+		fm.watch(name, FreshnessGroupFuelCell, period, fields...)
+		fm.messages[name].Unit = number
+	}
+	fc("PowerMode", time.Millisecond*100, "RunStatus")
+	fc("Pressures", time.Millisecond*100, "H2Pressure", "AirPressure", "CoolantPressure", "H2AirPressureDiff")
+	fc("StackCoolant", time.Millisecond*100, "CoolantInletTemp", "CoolantOutletTemp", "AirTemp", "AmbientTemp")
+	fc("AirFlow", time.Millisecond*100, "AirFlow")
+	fc("Alarms", time.Millisecond*100, "Alarms")
+	fc("StackOutput", time.Millisecond*100, "StackVolts", "StackCurrent", "StackPower")
+	fc("H2Concentration", time.Millisecond*100)
+	fc("Insulation", time.Millisecond*100, "InsulationResistance", "InsulationStatus", "InsulationFault")
+	fc("StackCells", time.Millisecond*100)
+	fc("ATSCoolingFan", time.Millisecond*100, "CoolingFanSpeed")
+	fc("WaterPump", time.Millisecond*100, "WaterPumpSpeed")
+	fc("DCDCConverter", time.Millisecond*100, "DCInVolts", "DCInAmps", "DCOutVolts", "DCOutAmps")
+	fc("DCOutput", time.Millisecond*100, "DCOutputStatus", "DCOutputFaultCode")
+	fc("BMSSettings", time.Millisecond*100, "BMSPower", "BMSHigh", "BMSLow", "BMSCurrentPower", "ExhaustOpen")
+	fc("KeyOn", time.Millisecond*100, "RunState")
+	fc("RunTime", time.Second, "RunTimeHours", "RunTimeMinutes")
+}
+
+/*
+watchBoard adds the messages sent by a FireflyIO board
+*/
+func (fm *FreshnessMonitorType) watchBoard(board *BoardType) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	watch := func(message string, group string, period time.Duration) {
+		fm.watch(board.freshnessName(message), group, period)
+		fm.messages[board.freshnessName(message)].Node = int(board.NodeID)
+	}
+	watch("Relays", FreshnessGroupBoard, time.Millisecond*500)
+	watch("Analog0to3", FreshnessGroupBoard, time.Millisecond*100)
+	watch("Analog4to7", FreshnessGroupBoard, time.Millisecond*100)
+	watch("AnalogInternal", FreshnessGroupBoard, time.Millisecond*100)
+	for device := 0; device < 4; device++ {
+		watch(fmt.Sprintf("AC%d", device), FreshnessGroupAC, time.Second)
+		watch(fmt.Sprintf("DC%d", device), FreshnessGroupDC, time.Second)
+	}
+}
+
+/*
+watch adds a message with its expected period. The default timeout is five periods but never less than three seconds.
+*/
+func (fm *FreshnessMonitorType) watch(name string, group string, period time.Duration, fields ...string) {
+	timeout := period * 5
+	if timeout < time.Second*3 {
+		timeout = time.Second * 3
+	}
+	fm.messages[name] = &MessageFreshnessType{Name: name, Group: group, Fields: fields, Node: -1, Period: period, Timeout: timeout, Stale: true}
+}
+
+/*
+Seen records that the named message has just been received
+*/
+func (fm *FreshnessMonitorType) Seen(name string) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if msg, found := fm.messages[name]; found {
+		msg.LastSeen = time.Now()
+		msg.Stale = false
+	}
+}
+
+// timeout must be called with the monitor locked
+func (fm *FreshnessMonitorType) timeout(msg *MessageFreshnessType) time.Duration {
+	if currentSettings != nil {
+		if seconds, found := currentSettings.StaleData.Timeouts[msg.Name]; found && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+	}
+	return msg.Timeout
+}
+
+// update must be called with the monitor locked
+func (fm *FreshnessMonitorType) update() {
+	now := time.Now()
+	for _, msg := range fm.messages {
+		msg.Stale = now.Sub(msg.LastSeen) > fm.timeout(msg)
+	}
+}
+
+/*
+IsStale returns true if the named message has not been received within its timeout
+*/
+func (fm *FreshnessMonitorType) IsStale(name string) bool {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.update()
+	if msg, found := fm.messages[name]; found {
+		return msg.Stale
+	}
+	return false
+}
+
+/*
+StaleFuelCellValues returns the names of the PanStatus fields whose messages from the fuel cell are stale, and the
+stale messages
+*/
+func (fm *FreshnessMonitorType) StaleFuelCellValues(number int) (fields []string, messages []string) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.update()
+	fields = make([]string, 0)
+	messages = make([]string, 0)
+	for _, msg := range fm.messages {
+		if msg.Group == FreshnessGroupFuelCell && msg.Unit == number && msg.Stale {
+			messages = append(messages, msg.Name)
+			fields = append(fields, msg.Fields...)
+		}
+	}
+	sort.Strings(fields)
+	sort.Strings(messages)
+	return
+}
+
+/*
+StaleGroup returns the names of the stale messages in the group
+*/
+func (fm *FreshnessMonitorType) StaleGroup(group string) []string {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.update()
+	stale := make([]string, 0)
+	for _, msg := range fm.messages {
+		if msg.Group == group && msg.Stale {
+			stale = append(stale, msg.Name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+/*
+StaleBoard returns the names of the stale relay and analog messages from the board
+*/
+func (fm *FreshnessMonitorType) StaleBoard(board *BoardType) []string {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.update()
+	stale := make([]string, 0)
+	for _, msg := range fm.messages {
+		if msg.Group == FreshnessGroupBoard && msg.Node == int(board.NodeID) && msg.Stale {
+			stale = append(stale, msg.Name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+/*
+Monitor checks the fuel cell messages every second and applies the configured fault action when any of them go
+stale while the fuel cell is running. The action is taken once per fault and rearmed when the data is fresh again.
+Each fuel cell is checked separately and only the fuel cell with stale data is stopped.
+*/
+func (fm *FreshnessMonitorType) Monitor() {
+	checkTime := time.NewTicker(time.Second)
+	for {
+		<-checkTime.C
+		for _, fuelCell := range FuelCells {
+			fm.check(fuelCell)
+		}
+	}
+}
+
+func (fm *FreshnessMonitorType) check(fuelCell *FuelCellUnitType) {
+	_, stale := fm.StaleFuelCellValues(fuelCell.Number)
+	running := currentSettings.FuelCellSettings.Enabled && fuelCell.Commands().FuelCellOn
+	fm.mu.Lock()
+	if len(stale) == 0 {
+		fm.faultActive[fuelCell.Number] = false
+		fm.mu.Unlock()
+		return
+	}
+	if !running || fm.faultActive[fuelCell.Number] {
+		fm.mu.Unlock()
+		return
+	}
+	fm.faultActive[fuelCell.Number] = true
+	fm.mu.Unlock()
+
+	action := currentSettings.StaleData.FaultAction
+	log.Printf("%s data is stale (%s). Fault action = %s", fuelCell.Label(), strings.Join(stale, ", "), action)
+	switch action {
+	case StaleActionStopFuelCell:
+		fuelCell.Stop()
+	case StaleActionOpenRelay:
+		fm.openFaultRelay()
+	case StaleActionStopAndOpenRelay:
+		fuelCell.Stop()
+		fm.openFaultRelay()
+	}
+}
+
+func (fm *FreshnessMonitorType) openFaultRelay() {
+	relay := currentSettings.StaleData.FaultRelay
+	if int(relay) >= len(Relays.Relays) {
+		log.Printf("Invalid stale data fault relay %d", relay)
+		return
+	}
+	if err := Relays.SetRelay(relay, false); err != nil {
+		log.Print(err)
+	}
+}
+
+// getFreshness returns the receive status of every monitored message
+func getFreshness(w http.ResponseWriter, _ *http.Request) {
+	type messageStatus struct {
+		Name     string
+		Group    string
+		Period   float64 // Seconds
+		Timeout  float64 // Seconds
+		Age      float64 // Seconds since the message was received. -1 if never received
+		LastSeen time.Time
+		Stale    bool
+	}
+	const deviceString = "Get Freshness"
+
+	Freshness.mu.Lock()
+	Freshness.update()
+	result := make([]messageStatus, 0, len(Freshness.messages))
+	for _, msg := range Freshness.messages {
+		status := messageStatus{Name: msg.Name, Group: msg.Group, Period: msg.Period.Seconds(), Timeout: Freshness.timeout(msg).Seconds(),
+			Age: -1, LastSeen: msg.LastSeen, Stale: msg.Stale}
+		if !msg.LastSeen.IsZero() {
+			status.Age = time.Since(msg.LastSeen).Seconds()
+		}
+		result = append(result, status)
+	}
+	Freshness.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(result); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
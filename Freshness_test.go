@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setLastSeen sets when the named message was last received. A zero time means it never has been.
+func setLastSeen(name string, when time.Time) {
+	Freshness.mu.Lock()
+	defer Freshness.mu.Unlock()
+	Freshness.messages[name].LastSeen = when
+}
+
+func TestFreshnessIsStale(t *testing.T) {
+	name := fuelCellFreshnessName(0, "StackOutput")
+	saved := currentSettings.StaleData.Timeouts
+	defer func() {
+		currentSettings.StaleData.Timeouts = saved
+		setLastSeen(name, time.Time{})
+	}()
+
+	tests := []struct {
+		name    string
+		age     time.Duration // Since the message was last seen. 0 if it never has been
+		timeout float64       // Overrides the default timeout if set
+		stale   bool
+	}{
+		{name: "Never seen", stale: true},
+		{name: "Just seen", age: time.Millisecond},
+		{name: "Within the default timeout", age: 2 * time.Second},
+		{name: "Past the default timeout", age: 4 * time.Second, stale: true},
+		{name: "Within a longer timeout", age: 4 * time.Second, timeout: 5},
+		{name: "Past a shorter timeout", age: 2 * time.Second, timeout: 1, stale: true},
+	}
+	for _, test := range tests {
+		currentSettings.StaleData.Timeouts = map[string]float64{}
+		if test.timeout > 0 {
+			currentSettings.StaleData.Timeouts[name] = test.timeout
+		}
+		when := time.Time{}
+		if test.age > 0 {
+			when = time.Now().Add(-test.age)
+		}
+		setLastSeen(name, when)
+		if stale := Freshness.IsStale(name); stale != test.stale {
+			t.Errorf("%s: stale = %v, want %v", test.name, stale, test.stale)
+		}
+	}
+	if Freshness.IsStale("NotWatched") {
+		t.Error("a message that is not watched is reported as stale")
+	}
+}
+
+/*
+TestStaleFaultRelayWithoutCANBus checks that the fault relay is opened when the fuel cell data goes stale while the
+CAN bus is not connected
+*/
+func TestStaleFaultRelayWithoutCANBus(t *testing.T) {
+	fuelCell := MainFuelCell()
+	saved := currentSettings.StaleData
+	savedBus := canBus
+	defer func() {
+		canBus = savedBus
+		currentSettings.StaleData = saved
+		fuelCell.FuelCellDriver.Stop()
+		Relays.SetAllRelays(0)
+		Freshness.mu.Lock()
+		Freshness.faultActive[fuelCell.Number] = false
+		Freshness.mu.Unlock()
+	}()
+	currentSettings.StaleData.FaultAction = StaleActionOpenRelay
+	currentSettings.StaleData.FaultRelay = 5
+	fuelCell.FuelCellDriver.Start()
+	Relays.SetAllRelays(0x0020)
+	setLastSeen(fuelCellFreshnessName(0, "PowerMode"), time.Time{})
+
+	canBus = nil
+	Freshness.check(fuelCell)
+	if Relays.GetRelay(5) {
+		t.Error("the fault relay was not opened")
+	}
+	if !fuelCell.Commands().FuelCellOn {
+		t.Error("the fuel cell was stopped by the openRelay action")
+	}
+}
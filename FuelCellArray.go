@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+/*
+Several fuel cells can be run in parallel. The main fuel cell is described by the top level fuel cell settings and
+uses the main CAN bus. Additional fuel cells are listed in FuelCellSettings.Units. Each one either has its own CAN
+interface or shares a bus and uses a source offset so its messages can be told apart. Every fuel cell has its own
+state, supervisor, freshness monitoring, events and database table.
+
+PowerControl works out the total demand for all of the fuel cells that are running and PowerSharing splits it
+between them.
+*/
+
+type FuelCellUnitType struct {
+	FuelCellDriver
+	Number     int // 0 for the main fuel cell
+	Settings   FuelCellUnitSettingsType
+	Supervisor *FuelCellSupervisorType
+	Purge      *PurgeSchedulerType
+	bus        *CANBus // Only set if the fuel cell has its own CAN interface
+}
+
+var FuelCells []*FuelCellUnitType // FuelCells[0] is the main fuel cell
+
+// Power sharing modes
+const (
+	SharingProportional = "proportional" // In proportion to each fuel cell's target power
+	SharingEqual        = "equal"        // The same share for every fuel cell
+	SharingSequential   = "sequential"   // Load each fuel cell fully in turn before using the next
+)
+
+type PowerSharingSettingsType struct {
+	Mode string // proportional, equal or sequential
+}
+
+type PowerSharingType struct{}
+
+var PowerSharing PowerSharingType
+
+func defaultPowerSharingSettings() PowerSharingSettingsType {
+	return PowerSharingSettingsType{Mode: SharingProportional}
+}
+
+func (s *PowerSharingSettingsType) validate() error {
+	if s.Mode != SharingProportional && s.Mode != SharingEqual && s.Mode != SharingSequential {
+		return fmt.Errorf("mode must be %s, %s or %s", SharingProportional, SharingEqual, SharingSequential)
+	}
+	return nil
+}
+
+// fuelCellFreshnessName returns the name used for the given message, or event source, from the fuel cell
+func fuelCellFreshnessName(number int, message string) string {
+	if number == 0 {
+		return message
+	}
+	return fmt.Sprintf("FuelCell%d.%s", number, message)
+}
+
+// busName returns the CAN interface the fuel cell is on
+func busName(settings FuelCellUnitSettingsType) string {
+	if settings.Interface == "" {
+		return CANInterface
+	}
+	return settings.Interface
+}
+
+/*
+InitFuelCells builds the fuel cell list from the settings. Must be called after the settings are loaded and before
+the CAN bus is connected.
+*/
+func InitFuelCells(settings *SettingsType) {
+	// A fuel cell with an unknown driver is not created. We cannot know what to send it.
+	newUnit := func(number int, driverName string, unitSettings FuelCellUnitSettingsType) (*FuelCellUnitType, error) {
+		driver, err := NewFuelCellDriver(driverName, number, unitSettings)
+		if err != nil {
+			return nil, err
+		}
+		fuelCell := &FuelCellUnitType{FuelCellDriver: driver, Number: number, Settings: unitSettings}
+		fuelCell.Supervisor = &FuelCellSupervisorType{state: SupervisorIdle, fuelCell: fuelCell}
+		fuelCell.Purge = &PurgeSchedulerType{state: PurgeIdle, fuelCell: fuelCell}
+		return fuelCell, nil
+	}
+	mainFuelCell, err := newUnit(0, settings.FuelCellSettings.Driver, FuelCellUnitSettingsType{})
+	if err != nil {
+		log.Panicf("The main fuel cell cannot be created. Correct FuelCellSettings.Driver in %s - %v", settings.filepath, err)
+	}
+	FuelCells = []*FuelCellUnitType{mainFuelCell}
+
+	for _, unitSettings := range settings.FuelCellSettings.Units {
+		if int(unitSettings.SourceOffset)+panMaxSourceAddress > 0xFF {
+			log.Printf("Fuel cell %s has an invalid source offset %d. The highest offset is %d", unitSettings.Name,
+				unitSettings.SourceOffset, 0xFF-panMaxSourceAddress)
+			continue
+		}
+		if unitSettings.Interface == "" && unitSettings.SourceOffset == 0 {
+			log.Printf("Fuel cell %s shares the main CAN bus so it needs a source offset", unitSettings.Name)
+			continue
+		}
+		inUse := false
+		for _, fuelCell := range FuelCells {
+			if busName(fuelCell.Settings) == busName(unitSettings) && panOffsetsClash(fuelCell.Settings.SourceOffset, unitSettings.SourceOffset) {
+				log.Printf("Fuel cell %s has CAN IDs that clash with %s on the same CAN interface. Source offsets must be at least 0x22 apart",
+					unitSettings.Name, fuelCell.Label())
+				inUse = true
+			}
+		}
+		if inUse {
+			continue
+		}
+		driverName := unitSettings.Driver
+		if driverName == "" {
+			driverName = settings.FuelCellSettings.Driver
+		}
+		fuelCell, err := newUnit(len(FuelCells), driverName, unitSettings)
+		if err != nil {
+			log.Printf("Fuel cell %s is not used - %v", unitSettings.Name, err)
+			continue
+		}
+		FuelCells = append(FuelCells, fuelCell)
+	}
+
+	for _, fuelCell := range FuelCells {
+		Freshness.watchFuelCell(fuelCell.Number)
+		log.Printf("%s uses the %s driver", fuelCell.Label(), fuelCell.Name())
+	}
+}
+
+// MainFuelCell returns the fuel cell described by the top level settings
+func MainFuelCell() *FuelCellUnitType {
+	if len(FuelCells) == 0 {
+		return nil
+	}
+	return FuelCells[0]
+}
+
+// GetFuelCell returns the fuel cell with the given number or nil if there is no such fuel cell
+func GetFuelCell(number int) *FuelCellUnitType {
+	if number < 0 || number >= len(FuelCells) {
+		return nil
+	}
+	return FuelCells[number]
+}
+
+// Label returns the name used for the fuel cell in the logs
+func (fuelCell *FuelCellUnitType) Label() string {
+	if fuelCell.Number == 0 {
+		return "Fuel cell"
+	}
+	if fuelCell.Settings.Name != "" {
+		return fuelCell.Settings.Name
+	}
+	return fmt.Sprintf("Fuel cell %d", fuelCell.Number)
+}
+
+// ownBus is true if the fuel cell has a CAN interface of its own
+func (fuelCell *FuelCellUnitType) ownBus() bool {
+	return fuelCell.Settings.Interface != "" && fuelCell.Settings.Interface != CANInterface
+}
+
+// usesInterface is true if the fuel cell is on the named CAN interface
+func (fuelCell *FuelCellUnitType) usesInterface(interfaceName string) bool {
+	if fuelCell.ownBus() {
+		return fuelCell.Settings.Interface == interfaceName
+	}
+	return interfaceName == CANInterface
+}
+
+/*
+ConnectFuelCells gives the fuel cells on the main CAN bus the new bus and connects any fuel cells with their own
+CAN interface that are not connected
+*/
+func ConnectFuelCells(mainBus *CANBus) {
+	for _, fuelCell := range FuelCells {
+		if !fuelCell.ownBus() {
+			fuelCell.Attach(mainBus)
+		}
+	}
+	reconnectFuelCells()
+}
+
+/*
+reconnectFuelCells connects the fuel cells with their own CAN interface if the bus has failed
+*/
+func reconnectFuelCells() {
+	for _, fuelCell := range FuelCells {
+		if !fuelCell.ownBus() || (fuelCell.bus != nil && fuelCell.bus.transport() != nil) {
+			continue
+		}
+		log.Printf("Connecting %s to %s", fuelCell.Label(), fuelCell.Settings.Interface)
+		bus, err := NewCANBus(fuelCell.Settings.Interface)
+		if err != nil {
+			log.Println(err)
+			fuelCell.bus = nil
+			fuelCell.Attach(nil)
+			continue
+		}
+		fuelCell.bus = bus
+		fuelCell.Attach(bus)
+	}
+}
+
+/*
+GetStatus adds the fuel cell number, driver and supervisor state to the status from the driver
+*/
+func (fuelCell *FuelCellUnitType) GetStatus() FuelCellStatus {
+	status := fuelCell.FuelCellDriver.GetStatus()
+	common := status.Common()
+	common.FuelCell = fuelCell.Number
+	common.FuelCellName = fuelCell.Settings.Name
+	common.Driver = fuelCell.Name()
+	common.Supervisor, common.SupervisorReason = fuelCell.Supervisor.State()
+	return status
+}
+
+// Start returns an error rather than starting the fuel cell while the fail-safe state is held
+func (fuelCell *FuelCellUnitType) Start() error {
+	if tripped, reason := FailSafe.Tripped(); tripped {
+		err := fmt.Errorf("%s not started. The fail-safe state is held - %s", fuelCell.Label(), reason)
+		log.Println(err)
+		return err
+	}
+	fuelCell.FuelCellDriver.Start()
+	return nil
+}
+
+func (fuelCell *FuelCellUnitType) GetStatusAsJSON() (string, error) {
+	jsonBytes, err := json.MarshalIndent(fuelCell.GetStatus(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(jsonBytes), nil
+}
+
+// ratedKW returns the total rated power of all of the fuel cells
+func ratedKW() float64 {
+	rated := 0.0
+	for _, fuelCell := range FuelCells {
+		rated += fuelCell.RatedKW()
+	}
+	return rated
+}
+
+// AnyFuelCellOn is true if any fuel cell has been commanded to run
+func AnyFuelCellOn() bool {
+	for _, fuelCell := range FuelCells {
+		if fuelCell.Commands().FuelCellOn {
+			return true
+		}
+	}
+	return false
+}
+
+// availableFuelCells returns the fuel cells whose supervisor is not faulted or waiting to retry
+func availableFuelCells() []*FuelCellUnitType {
+	available := make([]*FuelCellUnitType, 0, len(FuelCells))
+	for _, fuelCell := range FuelCells {
+		if state, _ := fuelCell.Supervisor.State(); state != SupervisorFaulted && state != SupervisorRetryWait {
+			available = append(available, fuelCell)
+		}
+	}
+	return available
+}
+
+// StartFuelCells starts every fuel cell that is available and returns the number started
+func StartFuelCells() (int, error) {
+	started := 0
+	var err error
+	for _, fuelCell := range availableFuelCells() {
+		if startErr := fuelCell.Start(); startErr != nil {
+			err = startErr
+		} else {
+			started++
+		}
+	}
+	if started == 0 && err == nil {
+		err = fmt.Errorf("every fuel cell is faulted or waiting to retry")
+	}
+	return started, err
+}
+
+// StopFuelCells stops every fuel cell
+func StopFuelCells() {
+	for _, fuelCell := range FuelCells {
+		fuelCell.Stop()
+		fuelCell.Supervisor.CancelRetry()
+	}
+}
+
+/*
+allocate splits the total in proportion to the weights without taking any share past its limit. Whatever a limited
+share cannot take is spread across the others.
+*/
+func allocate(total float64, weights []float64, limits []float64) []float64 {
+	shares := make([]float64, len(weights))
+	full := make([]bool, len(weights))
+	remaining := total
+	for remaining > 1e-9 {
+		sum := 0.0
+		for i, weight := range weights {
+			if !full[i] {
+				sum += weight
+			}
+		}
+		if sum <= 0 {
+			break
+		}
+		limited := false
+		for i, weight := range weights {
+			if !full[i] && shares[i]+remaining*weight/sum >= limits[i] {
+				remaining -= limits[i] - shares[i]
+				shares[i] = limits[i]
+				full[i] = true
+				limited = true
+			}
+		}
+		if !limited {
+			for i, weight := range weights {
+				if !full[i] {
+					shares[i] += remaining * weight / sum
+				}
+			}
+			remaining = 0
+		}
+	}
+	return shares
+}
+
+/*
+shares splits the power demand between the fuel cells that are commanded on. The result is indexed by fuel cell
+number. Only the driver commands are read so this is safe to call while a fuel cell is locked.
+*/
+func (ps *PowerSharingType) shares() []float64 {
+	total := PowerControl.Demand()
+	weights := make([]float64, len(FuelCells))
+	limits := make([]float64, len(FuelCells))
+	targets := 0.0
+	for i, fuelCell := range FuelCells {
+		if commands := fuelCell.Commands(); commands.FuelCellOn {
+			limits[i] = fuelCell.RatedKW()
+			weights[i] = commands.TargetPower
+			targets += commands.TargetPower
+		}
+	}
+	mode := currentSettings.FuelCellSettings.Sharing.Mode
+	if mode == SharingEqual || (mode == SharingProportional && targets <= 0) {
+		for i := range weights {
+			weights[i] = 0
+			if limits[i] > 0 {
+				weights[i] = 1
+			}
+		}
+	}
+	if mode != SharingSequential {
+		return allocate(total, weights, limits)
+	}
+	shares := make([]float64, len(FuelCells))
+	for i := range shares {
+		shares[i] = math.Min(total, limits[i])
+		total -= shares[i]
+	}
+	return shares
+}
+
+/*
+Demand returns the power demand in kW for the given fuel cell
+*/
+func (ps *PowerSharingType) Demand(number int) float64 {
+	shares := ps.shares()
+	if number < 0 || number >= len(shares) {
+		return 0
+	}
+	return shares[number]
+}
+
+type FuelCellShareType struct {
+	FuelCell int
+	Name     string
+	On       bool
+	Share    float64 // kW
+}
+
+type PowerSharingStatusType struct {
+	Settings PowerSharingSettingsType
+	Demand   float64 // Total kW from power control
+	Shares   []FuelCellShareType
+}
+
+func (ps *PowerSharingType) Status() PowerSharingStatusType {
+	status := PowerSharingStatusType{Settings: currentSettings.FuelCellSettings.Sharing, Demand: roundTo(PowerControl.Demand(), 3)}
+	for i, share := range ps.shares() {
+		fuelCell := FuelCells[i]
+		status.Shares = append(status.Shares, FuelCellShareType{FuelCell: fuelCell.Number, Name: fuelCell.Settings.Name,
+			On: fuelCell.Commands().FuelCellOn, Share: roundTo(share, 3)})
+	}
+	return status
+}
+
+/*
+fuelCellFromRequest returns the fuel cell numbered in the request. Requests without a fuel cell number are for the
+main fuel cell.
+*/
+func fuelCellFromRequest(w http.ResponseWriter, r *http.Request, deviceString string) *FuelCellUnitType {
+	text, found := mux.Vars(r)["n"]
+	if !found {
+		return MainFuelCell()
+	}
+	number, err := strconv.Atoi(text)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return nil
+	}
+	fuelCell := GetFuelCell(number)
+	if fuelCell == nil {
+		ReturnJSONErrorString(w, deviceString, fmt.Sprintf("There is no fuel cell %d", number), http.StatusNotFound, true)
+	}
+	return fuelCell
+}
+
+type FuelCellsStatusType struct {
+	Sharing   PowerSharingStatusType
+	FuelCells []FuelCellStatus
+}
+
+func getFuelCells(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Fuel Cells"
+	status := FuelCellsStatusType{Sharing: PowerSharing.Status(), FuelCells: make([]FuelCellStatus, 0, len(FuelCells))}
+	for _, fuelCell := range FuelCells {
+		status.FuelCells = append(status.FuelCells, fuelCell.GetStatus())
+	}
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(status); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func startFuelCells(w http.ResponseWriter, r *http.Request) {
+	if started, err := StartFuelCells(); started == 0 {
+		ReturnJSONError(w, "Start Fuel Cells", err, http.StatusConflict, false)
+		return
+	}
+	getFuelCells(w, r)
+}
+
+func stopFuelCells(w http.ResponseWriter, r *http.Request) {
+	StopFuelCells()
+	getFuelCells(w, r)
+}
+
+func setPowerSharing(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Power Sharing"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	settings := currentSettings.FuelCellSettings.Sharing
+	if err := json.Unmarshal(body, &settings); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	currentSettings.FuelCellSettings.Sharing = settings
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getFuelCells(w, r)
+}
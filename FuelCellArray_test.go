@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   float64
+		weights []float64
+		limits  []float64
+		want    []float64
+	}{
+		{"Equal shares", 10, []float64{1, 1}, []float64{10, 10}, []float64{5, 5}},
+		{"Proportional", 9, []float64{1, 2}, []float64{10, 10}, []float64{3, 6}},
+		{"One limited", 10, []float64{1, 1}, []float64{2, 10}, []float64{2, 8}},
+		{"Limit spread over the rest", 12, []float64{1, 1, 2}, []float64{10, 10, 4}, []float64{4, 4, 4}},
+		{"A limit uncovered by the first split", 10, []float64{1, 1, 1}, []float64{1, 3, 10}, []float64{1, 3, 6}},
+		{"Everything full", 30, []float64{1, 1}, []float64{5, 8}, []float64{5, 8}},
+		{"Zero weight takes nothing", 6, []float64{0, 1}, []float64{10, 10}, []float64{0, 6}},
+		{"No weights", 6, []float64{0, 0}, []float64{10, 10}, []float64{0, 0}},
+		{"Nothing to share", 0, []float64{1, 1}, []float64{10, 10}, []float64{0, 0}},
+		{"No fuel cells", 5, nil, nil, []float64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shares := allocate(test.total, test.weights, test.limits)
+			if len(shares) != len(test.want) {
+				t.Fatalf("allocate returned %d shares, want %d", len(shares), len(test.want))
+			}
+			for i := range shares {
+				if math.Abs(shares[i]-test.want[i]) > 1e-9 {
+					t.Errorf("allocate(%v, %v, %v) = %v, want %v", test.total, test.weights, test.limits, shares, test.want)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+FuelCellDriver is implemented for each make of fuel cell. The web API, automation, analytics and database logging
+all work through it so adding a new stack only needs a new driver registered in fuelCellDrivers. The driver is
+chosen by FuelCellSettings.Driver, or the Driver in the unit settings for additional fuel cells.
+
+Drivers report their run state using the PAN power modes (PowerModeStateType) as the common vocabulary, with
+PMManual meaning running and delivering power. Commands and status use the driver neutral FuelCellCommandsType and
+FuelCellStatusType so a driver does not have to produce PAN structures.
+*/
+type FuelCellDriver interface {
+	Name() string
+	Attach(bus *CANBus)      // Use this bus to send commands. nil while the bus is being reconnected
+	AddHandlers(bus *CANBus) // Register the handlers for the frames the fuel cell sends
+	Start()
+	Stop()
+	SetExhaust(open bool)
+	SetTargetPower(kw float64) error
+	SetTargetBattHigh(volts float64) error
+	SetTargetBattLow(volts float64) error
+	RatedKW() float64               // Highest power demand the fuel cell accepts
+	Commands() FuelCellCommandsType // The commands we are sending
+	Running() bool                  // The fuel cell reports that it is on
+	UpdateOutput() error            // Send the run command and power demand
+	UpdateSettings() error          // Send the battery limits
+	GetStatus() FuelCellStatus
+	GetStatusAsJSON() (string, error)
+	AlarmText() []string
+	Measurements() FuelCellMeasurementsType
+	PrepareDatabase(db *sql.DB) error // Called each time the database is connected
+	SaveToDatabase() error
+}
+
+// FuelCellCommandsType holds the commands we are sending to a fuel cell
+type FuelCellCommandsType struct {
+	TargetPower       float64 // kW requested
+	TargetBatteryHigh float64 // Battery voltage at which the fuel cell reduces its output
+	TargetBatteryLow  float64 // Battery voltage at which the fuel cell delivers full output
+	FuelCellOn        bool    // The fuel cell is being told to run
+	Exhaust           bool    // The fuel cell is being told to open its exhaust
+}
+
+/*
+FuelCellStatusType is the part of the status that every driver reports. A driver embeds it in its own status type,
+along with the values only that make provides, so they are all in one JSON object.
+*/
+type FuelCellStatusType struct {
+	FuelCell         int // 0 for the main fuel cell
+	FuelCellName     string
+	Driver           string
+	SystemName       string
+	Enable           bool // Fuel cell control is enabled
+	Start            bool // The fuel cell is being told to run
+	RunState         bool // The fuel cell reports that it is on
+	RunStatus        string
+	ExhaustOpen      bool
+	Alarms           []string
+	StackVolts       float64
+	StackCurrent     float64
+	StackPower       float64
+	DCOutVolts       float64
+	DCOutAmps        float64
+	PowerDemand      float64  // kW being requested from the fuel cell after ramping, load following and sharing
+	Stale            bool     // One or more of the values have not been updated within their timeout
+	StaleValues      []string // Names of the fields that are stale
+	StaleMessages    []string // Messages that have not been received within their timeout
+	Supervisor       string   // Fuel cell supervisor state
+	SupervisorReason string   // Why the supervisor is in that state
+}
+
+// FuelCellStatus is the status returned by a driver. Common gives the fields every driver reports.
+type FuelCellStatus interface {
+	Common() *FuelCellStatusType
+}
+
+func (status *FuelCellStatusType) Common() *FuelCellStatusType {
+	return status
+}
+
+/*
+FuelCellMeasurementsType holds the values the supervisor and analytics need from any make of fuel cell.
+The Valid flags are false if the values have not been received or are stale.
+*/
+type FuelCellMeasurementsType struct {
+	PowerMode   PowerModeStateType
+	FaultCode   uint16
+	ModeValid   bool
+	StackVolts  float64
+	StackAmps   float64
+	StackValid  bool
+	OutputVolts float64 // DC-DC converter output
+	OutputAmps  float64
+	OutputValid bool
+	CellMV      []float64
+	CellsValid  bool
+	// Coolant pressure in kPa
+	CoolantPressure float64
+	PressuresValid  bool
+	ExhaustOpen     bool // The fuel cell reports that the exhaust is open
+	ExhaustValid    bool
+}
+
+// OutputKW returns the DC-DC converter output power
+func (m *FuelCellMeasurementsType) OutputKW() float64 {
+	return m.OutputVolts * m.OutputAmps / 1000.0
+}
+
+const DefaultFuelCellDriver = "pan"
+
+// The drivers are given the fuel cell number, 0 for the main fuel cell, and the unit settings
+var fuelCellDrivers = map[string]func(number int, settings FuelCellUnitSettingsType) FuelCellDriver{
+	"pan": newPANFuelCell,
+}
+
+/*
+NewFuelCellDriver returns a driver of the named make for the given fuel cell
+*/
+func NewFuelCellDriver(name string, number int, settings FuelCellUnitSettingsType) (FuelCellDriver, error) {
+	if name == "" {
+		name = DefaultFuelCellDriver
+	}
+	if newDriver, found := fuelCellDrivers[strings.ToLower(name)]; found {
+		return newDriver(number, settings), nil
+	}
+	names := make([]string, 0, len(fuelCellDrivers))
+	for driver := range fuelCellDrivers {
+		names = append(names, driver)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown fuel cell driver %s. Available drivers are %s", name, strings.Join(names, ", "))
+}
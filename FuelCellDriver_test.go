@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewFuelCellDriver(t *testing.T) {
+	tests := []struct {
+		name    string
+		driver  string // Expected driver name. Empty if the driver is refused
+		wantErr bool
+	}{
+		{name: "", driver: DefaultFuelCellDriver},
+		{name: "pan", driver: "pan"},
+		{name: "PAN", driver: "pan"},
+		{name: "ballard", wantErr: true},
+	}
+	for _, test := range tests {
+		driver, err := NewFuelCellDriver(test.name, 1, FuelCellUnitSettingsType{})
+		if test.wantErr {
+			if err == nil || driver != nil {
+				t.Errorf("%q: driver %v and error %v, want no driver and an error", test.name, driver, err)
+			} else if !strings.Contains(err.Error(), "pan") {
+				t.Errorf("%q: the error does not list the available drivers - %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.name, err)
+			continue
+		}
+		if !strings.EqualFold(driver.Name(), test.driver) {
+			t.Errorf("%q: driver %s, want %s", test.name, driver.Name(), test.driver)
+		}
+	}
+}
+
+// TestFuelCellCommands checks the driver neutral commands follow what the fuel cell has been told to do
+func TestFuelCellCommands(t *testing.T) {
+	// Fuel cell 1 so the main fuel cell, which the CAN handlers are using, is left alone
+	driver, err := NewFuelCellDriver("pan", 1, FuelCellUnitSettingsType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.Start()
+	driver.SetExhaust(true)
+	if err := driver.SetTargetPower(2.5); err != nil {
+		t.Fatal(err)
+	}
+	if commands := driver.Commands(); !commands.FuelCellOn || !commands.Exhaust || commands.TargetPower != 2.5 {
+		t.Errorf("commands = %+v after starting with the exhaust open at 2.5kW", commands)
+	}
+	if err := driver.SetTargetPower(driver.RatedKW() + 1); err == nil {
+		t.Error("a target power above the rating was accepted")
+	}
+	driver.Stop()
+	if commands := driver.Commands(); commands.FuelCellOn {
+		t.Errorf("commands = %+v after stopping", commands)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+The supervisor compares the run command we send the fuel cell with the power mode it reports. A start must move
+through Hydrogen intake, Start and AirPurge to running (manual) with each stage finishing within its timeout. If a
+stage sticks, the fuel cell reports a fault or drops out of running, the start is retried after a delay. Once the
+retries are used up the fuel cell is shut down and the supervisor stays faulted until it is reset or started again.
+Each fuel cell has its own supervisor.
+*/
+
+// Supervisor states
+const (
+	SupervisorDisabled  = "Disabled"  // We are not controlling the fuel cell
+	SupervisorIdle      = "Idle"      // Off and not commanded to run
+	SupervisorStarting  = "Starting"  // Commanded to run and working through the start sequence
+	SupervisorRunning   = "Running"   // Running and delivering power
+	SupervisorStopping  = "Stopping"  // Commanded off and waiting for the fuel cell to shut down
+	SupervisorRetryWait = "RetryWait" // A start failed. Shutting down before trying again
+	SupervisorFaulted   = "Faulted"   // Gave up. The fuel cell has been shut down
+)
+
+const supervisorHistorySize = 50
+
+type SupervisorSettingsType struct {
+	CommandTimeoutSeconds float64 // Time for the fuel cell to leave Off/Standby after a start command
+	H2IntakeSeconds       float64 // Longest time in Hydrogen intake
+	StartSeconds          float64 // Longest time in Start
+	AirPurgeSeconds       float64 // Longest time in AirPurge
+	LeakCheckSeconds      float64 // Longest time in Hydrogen leak check
+	StopTimeoutSeconds    float64 // Time for the fuel cell to reach Off after a stop command
+	StartRetries          int     // Further start attempts after a failure
+	RetryDelaySeconds     float64 // Minimum time between a failure and the next attempt
+}
+
+type SupervisorEventType struct {
+	Time   time.Time
+	From   string
+	To     string
+	Reason string
+}
+
+type FuelCellSupervisorType struct {
+	mu          sync.Mutex
+	state       string
+	reason      string
+	attempt     int                // Start attempt, 1 for the first
+	entered     time.Time          // Time we entered the current supervisor state
+	mode        PowerModeStateType // Last power mode reported
+	modeEntered time.Time          // Time the fuel cell entered the reported power mode
+	commanded   bool               // FuelCellOn on the last pass
+	history     []SupervisorEventType
+	fuelCell    *FuelCellUnitType
+}
+
+func defaultSupervisorSettings() SupervisorSettingsType {
+	return SupervisorSettingsType{
+		CommandTimeoutSeconds: 15,
+		H2IntakeSeconds:       60,
+		StartSeconds:          90,
+		AirPurgeSeconds:       60,
+		LeakCheckSeconds:      60,
+		StopTimeoutSeconds:    120,
+		StartRetries:          2,
+		RetryDelaySeconds:     30,
+	}
+}
+
+func (s *SupervisorSettingsType) validate() error {
+	if s.CommandTimeoutSeconds <= 0 || s.H2IntakeSeconds <= 0 || s.StartSeconds <= 0 || s.AirPurgeSeconds <= 0 ||
+		s.LeakCheckSeconds <= 0 || s.StopTimeoutSeconds <= 0 {
+		return fmt.Errorf("all timeouts must be greater than zero")
+	}
+	if s.StartRetries < 0 || s.RetryDelaySeconds < 0 {
+		return fmt.Errorf("retries and the retry delay cannot be negative")
+	}
+	return nil
+}
+
+// stageTimeout returns the longest time the fuel cell should spend in the given mode while starting
+func (s *SupervisorSettingsType) stageTimeout(mode PowerModeStateType) time.Duration {
+	seconds := s.CommandTimeoutSeconds
+	switch mode {
+	case PMH2Purge:
+		seconds = s.H2IntakeSeconds
+	case PMStartup:
+		seconds = s.StartSeconds
+	case PMAirPurge:
+		seconds = s.AirPurgeSeconds
+	case PMH2LeakCheck:
+		seconds = s.LeakCheckSeconds
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// setState must be called with the supervisor locked
+func (sv *FuelCellSupervisorType) setState(state string, reason string) {
+	if state == sv.state && reason == sv.reason {
+		return
+	}
+	if state != sv.state {
+		log.Printf("%s supervisor %s -> %s. %s", sv.fuelCell.Label(), sv.state, state, reason)
+		sv.history = append(sv.history, SupervisorEventType{Time: time.Now(), From: sv.state, To: state, Reason: reason})
+		if len(sv.history) > supervisorHistorySize {
+			sv.history = sv.history[len(sv.history)-supervisorHistorySize:]
+		}
+		sv.entered = time.Now()
+	}
+	sv.state = state
+	sv.reason = reason
+}
+
+/*
+Run checks the fuel cell every second
+*/
+func (sv *FuelCellSupervisorType) Run() {
+	checkTime := time.NewTicker(time.Second)
+	for {
+		now := <-checkTime.C
+		sv.step(now)
+	}
+}
+
+func (sv *FuelCellSupervisorType) step(now time.Time) {
+	settings := currentSettings.FuelCellSettings.Supervisor
+	measurements := sv.fuelCell.Measurements()
+	mode := measurements.PowerMode
+	faultCode := measurements.FaultCode
+	commanded := sv.fuelCell.Commands().FuelCellOn
+	stale := !measurements.ModeValid
+
+	// action is carried out once the supervisor is unlocked
+	var action func()
+
+	sv.mu.Lock()
+	if mode != sv.mode || sv.modeEntered.IsZero() {
+		sv.mode = mode
+		sv.modeEntered = now
+	}
+	// Time in the current power mode since we entered the current supervisor state
+	modeChanged := sv.modeEntered.After(sv.entered)
+	inMode := now.Sub(sv.entered)
+	if modeChanged {
+		inMode = now.Sub(sv.modeEntered)
+	}
+	started := commanded && !sv.commanded
+	stopped := !commanded && sv.commanded
+	sv.commanded = commanded
+
+	// fail retries the start or gives up and shuts the fuel cell down
+	fail := func(reason string) {
+		if sv.attempt <= settings.StartRetries {
+			sv.setState(SupervisorRetryWait, fmt.Sprintf("Attempt %d of %d failed - %s", sv.attempt, settings.StartRetries+1, reason))
+		} else {
+			sv.setState(SupervisorFaulted, fmt.Sprintf("Shut down after %d failed attempt(s) - %s", sv.attempt, reason))
+		}
+		sv.commanded = false
+		action = sv.fuelCell.Stop
+	}
+
+	switch {
+	case !currentSettings.FuelCellSettings.Enabled:
+		sv.attempt = 0
+		sv.setState(SupervisorDisabled, "Fuel cell control is disabled")
+
+	case started:
+		// A new start from the user or automation. Anything that went before is forgotten.
+		sv.attempt = 1
+		sv.setState(SupervisorStarting, "Start requested")
+
+	case stopped:
+		sv.setState(SupervisorStopping, "Stop requested")
+
+	case sv.state == SupervisorDisabled:
+		if commanded {
+			sv.attempt = 1
+			sv.setState(SupervisorStarting, "Fuel cell control enabled while commanded on")
+		} else {
+			sv.setState(SupervisorStopping, "Fuel cell control enabled")
+		}
+
+	case commanded && (mode == PMFault || mode == PMEmergencyShut):
+		fail(fmt.Sprintf("the fuel cell reported %s, fault code 0x%04X", mode, faultCode))
+
+	case sv.state == SupervisorStarting:
+		switch {
+		case stale:
+			sv.setState(SupervisorStarting, "Waiting for power mode messages")
+			if now.Sub(sv.entered) > settings.stageTimeout(PMOff) {
+				fail("no power mode messages from the fuel cell")
+			}
+		case mode == PMManual:
+			sv.setState(SupervisorRunning, fmt.Sprintf("Running after %0.0fs", now.Sub(sv.entered).Seconds()))
+		case mode == PMShutdown && modeChanged:
+			fail("the fuel cell shut down during the start sequence")
+		case inMode > settings.stageTimeout(mode):
+			fail(fmt.Sprintf("stuck in %s for %0.0fs", mode, inMode.Seconds()))
+		default:
+			sv.setState(SupervisorStarting, fmt.Sprintf("Attempt %d - %s", sv.attempt, mode))
+		}
+
+	case sv.state == SupervisorRunning:
+		switch {
+		case stale:
+			sv.setState(SupervisorRunning, "Power mode messages are stale")
+		case mode != PMManual:
+			fail(fmt.Sprintf("dropped out of running to %s", mode))
+		default:
+			sv.setState(SupervisorRunning, "")
+		}
+
+	case sv.state == SupervisorRetryWait:
+		off := !stale && (mode == PMOff || mode == PMInit)
+		delay := time.Duration(settings.RetryDelaySeconds * float64(time.Second))
+		if off && now.Sub(sv.entered) >= delay {
+			sv.attempt++
+			sv.commanded = true
+			sv.setState(SupervisorStarting, fmt.Sprintf("Retrying the start. Attempt %d of %d", sv.attempt, settings.StartRetries+1))
+			action = func() {
+				// A refused start is logged by Start. The next step sees the fuel cell has not been commanded and stops.
+				_ = sv.fuelCell.Start()
+			}
+		} else if now.Sub(sv.entered) > delay+time.Duration(settings.StopTimeoutSeconds*float64(time.Second)) {
+			sv.setState(SupervisorFaulted, fmt.Sprintf("Did not shut down for a retry. Still in %s", mode))
+		}
+
+	case sv.state == SupervisorStopping:
+		if !stale && (mode == PMOff || mode == PMInit) {
+			sv.setState(SupervisorIdle, "")
+		} else if now.Sub(sv.entered) > time.Duration(settings.StopTimeoutSeconds*float64(time.Second)) {
+			sv.setState(SupervisorFaulted, fmt.Sprintf("Did not shut down within %0.0fs. Still in %s", settings.StopTimeoutSeconds, mode))
+		}
+
+	case sv.state == SupervisorFaulted:
+		// Nothing to do. fail turned the run command off and CANHeartbeat keeps sending it. We stay here until
+		// someone starts the fuel cell again or resets the supervisor.
+
+	case sv.state == SupervisorIdle && commanded:
+		sv.attempt = 1
+		sv.setState(SupervisorStarting, "Start requested")
+
+	case sv.state == SupervisorIdle && !stale && mode != PMOff && mode != PMInit && mode != PMShutdown:
+		sv.setState(SupervisorIdle, fmt.Sprintf("The fuel cell reports %s but has not been commanded to run", mode))
+
+	case sv.state == SupervisorIdle:
+		sv.setState(SupervisorIdle, "")
+	}
+	sv.mu.Unlock()
+
+	if action != nil {
+		action()
+	}
+}
+
+// Faulted is true if the supervisor has given up on the fuel cell
+func (sv *FuelCellSupervisorType) Faulted() bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.state == SupervisorFaulted
+}
+
+// State returns the supervisor state and the reason for it
+func (sv *FuelCellSupervisorType) State() (string, string) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.state, sv.reason
+}
+
+/*
+CancelRetry abandons a pending retry after a manual stop
+*/
+func (sv *FuelCellSupervisorType) CancelRetry() {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.state == SupervisorRetryWait {
+		sv.setState(SupervisorStopping, "Stop requested. Retry cancelled")
+	}
+}
+
+/*
+Reset clears a fault or a pending retry. The fuel cell is left stopped.
+*/
+func (sv *FuelCellSupervisorType) Reset() {
+	sv.mu.Lock()
+	sv.attempt = 0
+	sv.setState(SupervisorStopping, "Reset")
+	sv.mu.Unlock()
+	if sv.fuelCell.Commands().FuelCellOn {
+		sv.fuelCell.Stop()
+	}
+}
+
+type SupervisorStatusType struct {
+	State      string
+	Reason     string
+	Attempt    int
+	Since      time.Time
+	PowerMode  string
+	InModeSecs float64
+	Settings   SupervisorSettingsType
+	History    []SupervisorEventType
+}
+
+func (sv *FuelCellSupervisorType) Status() SupervisorStatusType {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	status := SupervisorStatusType{State: sv.state, Reason: sv.reason, Attempt: sv.attempt, Since: sv.entered,
+		PowerMode: sv.mode.String(), Settings: currentSettings.FuelCellSettings.Supervisor}
+	if !sv.modeEntered.IsZero() {
+		status.InModeSecs = time.Since(sv.modeEntered).Seconds()
+	}
+	status.History = make([]SupervisorEventType, len(sv.history))
+	copy(status.History, sv.history)
+	return status
+}
+
+func getSupervisor(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Get Fuel Cell Supervisor"
+	fuelCell := fuelCellFromRequest(w, r, deviceString)
+	if fuelCell == nil {
+		return
+	}
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(fuelCell.Supervisor.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func resetSupervisor(w http.ResponseWriter, r *http.Request) {
+	fuelCell := fuelCellFromRequest(w, r, "Reset Fuel Cell Supervisor")
+	if fuelCell == nil {
+		return
+	}
+	fuelCell.Supervisor.Reset()
+	getSupervisor(w, r)
+}
+
+func setSupervisorSettings(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Fuel Cell Supervisor"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	settings := currentSettings.FuelCellSettings.Supervisor
+	if err := json.Unmarshal(body, &settings); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	currentSettings.FuelCellSettings.Supervisor = settings
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getSupervisor(w, r)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// supervisorStepType is one pass of the supervisor. The command is sent and the power mode reported first.
+type supervisorStepType struct {
+	command string             // start, stop or empty
+	mode    PowerModeStateType // Reported by the fuel cell
+	stale   bool               // The power mode messages have stopped instead
+	after   time.Duration      // Added to the time of the step to move it past a timeout
+	state   string             // Expected supervisor state after the step
+	reason  string             // Text expected in the reason. Not checked if empty
+	on      bool               // The fuel cell should be commanded on after the step
+}
+
+func TestSupervisorStep(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		disabled bool
+		steps    []supervisorStepType
+	}{
+		{name: "Normal start", retries: 2, steps: []supervisorStepType{
+			{command: "start", mode: PMOff, state: SupervisorStarting, reason: "Start requested", on: true},
+			{mode: PMH2Purge, state: SupervisorStarting, reason: "Hydrogen intake", on: true},
+			{mode: PMStartup, state: SupervisorStarting, on: true},
+			{mode: PMManual, state: SupervisorRunning, on: true},
+		}},
+		{name: "Start command ignored", retries: 2, steps: []supervisorStepType{
+			{command: "start", mode: PMOff, state: SupervisorStarting, on: true},
+			{mode: PMOff, after: 16 * time.Second, state: SupervisorRetryWait, reason: "Attempt 1 of 3 failed - stuck in Off"},
+		}},
+		{name: "Retry after the delay", retries: 2, steps: []supervisorStepType{
+			{command: "start", mode: PMOff, state: SupervisorStarting, on: true},
+			{mode: PMH2Purge, state: SupervisorStarting, on: true},
+			{mode: PMH2Purge, after: 61 * time.Second, state: SupervisorRetryWait, reason: "stuck in Hydrogen intake"},
+			{mode: PMOff, after: 10 * time.Second, state: SupervisorRetryWait},
+			{mode: PMOff, after: 31 * time.Second, state: SupervisorStarting, reason: "Attempt 2 of 3", on: true},
+			{mode: PMManual, after: 31 * time.Second, state: SupervisorRunning, on: true},
+		}},
+		{name: "No retries left", retries: 0, steps: []supervisorStepType{
+			{command: "start", mode: PMOff, state: SupervisorStarting, on: true},
+			{mode: PMFault, state: SupervisorFaulted, reason: "fault code"},
+			{mode: PMOff, after: time.Hour, state: SupervisorFaulted},
+		}},
+		{name: "Shut down while starting", retries: 1, steps: []supervisorStepType{
+			{command: "start", mode: PMOff, state: SupervisorStarting, on: true},
+			{mode: PMShutdown, state: SupervisorRetryWait, reason: "shut down during the start sequence"},
+		}},
+		{name: "No power mode messages", retries: 0, steps: []supervisorStepType{
+			{command: "start", stale: true, state: SupervisorStarting, on: true},
+			{stale: true, state: SupervisorStarting, reason: "Waiting for power mode messages", on: true},
+			{stale: true, after: 16 * time.Second, state: SupervisorFaulted, reason: "no power mode messages"},
+		}},
+		{name: "Dropped out of running", retries: 2, steps: []supervisorStepType{
+			{command: "start", mode: PMManual, state: SupervisorStarting, on: true},
+			{mode: PMManual, state: SupervisorRunning, on: true},
+			{stale: true, state: SupervisorRunning, reason: "stale", on: true},
+			{mode: PMShutdown, state: SupervisorRetryWait, reason: "dropped out of running to shutdown"},
+		}},
+		{name: "Stop", retries: 2, steps: []supervisorStepType{
+			{command: "start", mode: PMManual, state: SupervisorStarting, on: true},
+			{mode: PMManual, state: SupervisorRunning, on: true},
+			{command: "stop", mode: PMShutdown, state: SupervisorStopping},
+			{mode: PMOff, state: SupervisorIdle},
+		}},
+		{name: "Did not stop", retries: 2, steps: []supervisorStepType{
+			{command: "start", mode: PMManual, state: SupervisorStarting, on: true},
+			{command: "stop", mode: PMManual, state: SupervisorStopping},
+			{mode: PMManual, after: 121 * time.Second, state: SupervisorFaulted, reason: "Did not shut down within 120s"},
+		}},
+		{name: "Running without a command", retries: 2, steps: []supervisorStepType{
+			{mode: PMManual, state: SupervisorIdle, reason: "has not been commanded to run"},
+			{mode: PMOff, state: SupervisorIdle},
+		}},
+		{name: "Control disabled", retries: 2, disabled: true, steps: []supervisorStepType{
+			{command: "start", mode: PMManual, state: SupervisorDisabled, on: true},
+		}},
+	}
+
+	fuelCell := MainFuelCell()
+	savedSettings := currentSettings.FuelCellSettings
+	defer func() {
+		currentSettings.FuelCellSettings = savedSettings
+		fuelCell.Stop()
+	}()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			currentSettings.FuelCellSettings.Supervisor = defaultSupervisorSettings()
+			currentSettings.FuelCellSettings.Supervisor.StartRetries = test.retries
+			currentSettings.FuelCellSettings.Enabled = !test.disabled
+			fuelCell.Stop()
+			reportPowerMode(t, PMOff)
+			sv := &FuelCellSupervisorType{state: SupervisorIdle, fuelCell: fuelCell}
+			fuelCell.Supervisor = sv
+			sv.step(time.Now())
+
+			for i, step := range test.steps {
+				switch step.command {
+				case "start":
+					if err := fuelCell.Start(); err != nil {
+						t.Fatal(err)
+					}
+				case "stop":
+					fuelCell.Stop()
+				}
+				if step.stale {
+					Freshness.mu.Lock()
+					Freshness.messages[fuelCellFreshnessName(fuelCell.Number, "PowerMode")].LastSeen = time.Time{}
+					Freshness.mu.Unlock()
+				} else {
+					reportPowerMode(t, step.mode)
+				}
+				sv.step(time.Now().Add(step.after))
+
+				state, reason := sv.State()
+				if state != step.state || !strings.Contains(reason, step.reason) {
+					t.Fatalf("step %d: state %s (%s), want %s (%s)", i+1, state, reason, step.state, step.reason)
+				}
+				if on := fuelCell.Commands().FuelCellOn; on != step.on {
+					t.Fatalf("step %d: fuel cell commanded on is %v, want %v", i+1, on, step.on)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Hydrogen estimates the fuel used from the stack current. By Faraday's law each cell consumes one H2 molecule for
+every two electrons so the stack uses cells * I / 2F moles per second. Efficiencies are against the lower heating
+value of hydrogen. The stack efficiency uses the stack output power and the system efficiency the DC-DC converter
+output, so it includes the converter and the balance of plant drawn through it. With several fuel cells the
+figures are the totals for all of them.
+*/
+
+const (
+	faradayConstant    = 96485.332  // C/mol
+	h2MolarMass        = 2.01588e-3 // kg/mol
+	h2LowerHeatingKWh  = 33.33      // kWh/kg
+	hydrogenSampleTime = time.Second
+	hydrogenMaxStep    = time.Second * 5 // Longest gap we integrate across
+	hydrogenDaysKept   = 400
+)
+
+type HydrogenSettingsType struct {
+	CellCount  int     // Cells in the stack
+	PricePerKg float64 // Cost of hydrogen
+	Currency   string
+}
+
+// HydrogenUsageType holds totals for a period
+type HydrogenUsageType struct {
+	KgH2      float64
+	StackKWh  float64
+	OutputKWh float64 // DC-DC converter output
+	RunHours  float64
+}
+
+type HydrogenTotalsType struct {
+	Since time.Time
+	HydrogenUsageType
+	Days map[string]*HydrogenUsageType // Keyed on yyyy-mm-dd
+}
+
+type HydrogenType struct {
+	mu         sync.Mutex
+	lastSample time.Time
+	live       HydrogenLiveType
+}
+
+type HydrogenLiveType struct {
+	Time             time.Time
+	StackAmps        float64
+	StackKW          float64
+	OutputKW         float64
+	GramsPerHour     float64
+	LitresPerMinute  float64 // Normal litres (0C, 1 atm)
+	StackEfficiency  float64 // % of the LHV
+	SystemEfficiency float64 // % of the LHV
+	CostPerKWh       float64
+}
+
+var Hydrogen HydrogenType
+
+func defaultHydrogenSettings() HydrogenSettingsType {
+	return HydrogenSettingsType{CellCount: stackCellCount, Currency: "USD"}
+}
+
+// h2KgPerSecond applies Faraday's law
+func h2KgPerSecond(cells int, amps float64) float64 {
+	return float64(cells) * amps / (2 * faradayConstant) * h2MolarMass
+}
+
+// efficiency returns the power as a percentage of the hydrogen LHV power
+func efficiency(kw float64, kgPerSecond float64) float64 {
+	if kgPerSecond <= 0 {
+		return 0
+	}
+	return 100 * kw / (kgPerSecond * 3600 * h2LowerHeatingKWh)
+}
+
+func (usage *HydrogenUsageType) add(kg float64, stackKWh float64, outputKWh float64, hours float64) {
+	usage.KgH2 += kg
+	usage.StackKWh += stackKWh
+	usage.OutputKWh += outputKWh
+	usage.RunHours += hours
+}
+
+func (h *HydrogenType) setLive(live HydrogenLiveType) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.live = live
+}
+
+func (h *HydrogenType) Live() HydrogenLiveType {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.live
+}
+
+/*
+Run integrates the hydrogen used every second while the stack is delivering current
+*/
+func (h *HydrogenType) Run() {
+	sampleTime := time.NewTicker(hydrogenSampleTime)
+	for {
+		now := <-sampleTime.C
+		h.sample(now)
+	}
+}
+
+func (h *HydrogenType) sample(now time.Time) {
+	settings := currentSettings.FuelCellSettings.Hydrogen
+	step := now.Sub(h.lastSample)
+	h.lastSample = now
+	if step > hydrogenMaxStep {
+		step = 0
+	}
+	stackAmps, stackKW, outputKW, kgPerSecond := 0.0, 0.0, 0.0, 0.0
+	for _, fuelCell := range FuelCells {
+		measurements := fuelCell.Measurements()
+		if !measurements.StackValid || measurements.StackAmps <= 0 {
+			continue
+		}
+		stackAmps += measurements.StackAmps
+		stackKW += measurements.StackVolts * measurements.StackAmps / 1000.0
+		kgPerSecond += h2KgPerSecond(settings.CellCount, measurements.StackAmps)
+		if measurements.OutputValid {
+			outputKW += measurements.OutputKW()
+		}
+	}
+	if stackAmps <= 0 {
+		h.setLive(HydrogenLiveType{Time: now})
+		return
+	}
+
+	live := HydrogenLiveType{Time: now, StackAmps: stackAmps, StackKW: roundTo(stackKW, 3), OutputKW: roundTo(outputKW, 3),
+		GramsPerHour: roundTo(kgPerSecond*3600*1000, 2),
+		// 22.414 normal litres per mole
+		LitresPerMinute:  roundTo(kgPerSecond/h2MolarMass*22.414*60, 2),
+		StackEfficiency:  roundTo(efficiency(stackKW, kgPerSecond), 1),
+		SystemEfficiency: roundTo(efficiency(outputKW, kgPerSecond), 1)}
+	if outputKW > 0 {
+		live.CostPerKWh = roundTo(kgPerSecond*3600*settings.PricePerKg/outputKW, 3)
+	}
+	h.setLive(live)
+
+	if step <= 0 {
+		return
+	}
+	seconds := step.Seconds()
+	hours := seconds / 3600
+	kg := kgPerSecond * seconds
+	State.mu.Lock()
+	defer State.mu.Unlock()
+	totals := &State.Hydrogen
+	if totals.Since.IsZero() {
+		totals.Since = now
+	}
+	if totals.Days == nil {
+		totals.Days = make(map[string]*HydrogenUsageType)
+	}
+	day := now.Format("2006-01-02")
+	if _, found := totals.Days[day]; !found {
+		totals.Days[day] = new(HydrogenUsageType)
+		if len(totals.Days) > hydrogenDaysKept {
+			oldest := now.AddDate(0, 0, -hydrogenDaysKept).Format("2006-01-02")
+			for d := range totals.Days {
+				if d < oldest {
+					delete(totals.Days, d)
+				}
+			}
+		}
+	}
+	totals.add(kg, stackKW*hours, outputKW*hours, hours)
+	totals.Days[day].add(kg, stackKW*hours, outputKW*hours, hours)
+}
+
+type HydrogenUsageReportType struct {
+	Date string `json:",omitempty"`
+	HydrogenUsageType
+	StackEfficiency  float64
+	SystemEfficiency float64
+	Cost             float64
+	CostPerKWh       float64
+}
+
+func newHydrogenUsageReport(date string, usage HydrogenUsageType, price float64) HydrogenUsageReportType {
+	report := HydrogenUsageReportType{Date: date, HydrogenUsageType: usage, Cost: roundTo(usage.KgH2*price, 2)}
+	report.KgH2 = roundTo(usage.KgH2, 4)
+	report.StackKWh = roundTo(usage.StackKWh, 3)
+	report.OutputKWh = roundTo(usage.OutputKWh, 3)
+	report.RunHours = roundTo(usage.RunHours, 3)
+	if usage.KgH2 > 0 {
+		report.StackEfficiency = roundTo(100*usage.StackKWh/(usage.KgH2*h2LowerHeatingKWh), 1)
+		report.SystemEfficiency = roundTo(100*usage.OutputKWh/(usage.KgH2*h2LowerHeatingKWh), 1)
+	}
+	if usage.OutputKWh > 0 {
+		report.CostPerKWh = roundTo(usage.KgH2*price/usage.OutputKWh, 3)
+	}
+	return report
+}
+
+type HydrogenReportType struct {
+	Site     string
+	Currency string
+	Price    float64 // Per kg
+	Live     HydrogenLiveType
+	Since    time.Time
+	Total    HydrogenUsageReportType
+	Days     []HydrogenUsageReportType
+}
+
+/*
+getHydrogen reports the current consumption and efficiency, the totals since they were last reset and the daily
+totals, newest first. Add days=n to limit the number of days returned.
+*/
+func getHydrogen(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Hydrogen Usage"
+	settings := currentSettings.FuelCellSettings.Hydrogen
+	days := hydrogenDaysKept
+	if text := r.URL.Query().Get("days"); text != "" {
+		if _, err := fmt.Sscan(text, &days); err != nil || days < 0 {
+			ReturnJSONErrorString(w, deviceString, "days must be a positive number", http.StatusBadRequest, false)
+			return
+		}
+	}
+
+	report := HydrogenReportType{Site: currentSettings.Name, Currency: settings.Currency, Price: settings.PricePerKg,
+		Live: Hydrogen.Live(), Days: make([]HydrogenUsageReportType, 0)}
+	State.mu.Lock()
+	report.Since = State.Hydrogen.Since
+	report.Total = newHydrogenUsageReport("", State.Hydrogen.HydrogenUsageType, settings.PricePerKg)
+	for date, usage := range State.Hydrogen.Days {
+		report.Days = append(report.Days, newHydrogenUsageReport(date, *usage, settings.PricePerKg))
+	}
+	State.mu.Unlock()
+	sort.Slice(report.Days, func(i, j int) bool { return report.Days[i].Date > report.Days[j].Date })
+	if len(report.Days) > days {
+		report.Days = report.Days[:days]
+	}
+
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(report); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+resetHydrogen starts the totals again. The daily history is kept.
+*/
+func resetHydrogen(w http.ResponseWriter, r *http.Request) {
+	State.mu.Lock()
+	log.Printf("Hydrogen totals reset. %0.3fkg used since %s", State.Hydrogen.KgH2, State.Hydrogen.Since.Format(time.RFC3339))
+	State.Hydrogen.HydrogenUsageType = HydrogenUsageType{}
+	State.Hydrogen.Since = time.Now()
+	State.mu.Unlock()
+	if err := State.Save(); err != nil {
+		ReturnJSONError(w, "Hydrogen Reset", err, http.StatusInternalServerError, true)
+		return
+	}
+	getHydrogen(w, r)
+}
+
+/*
+setHydrogenPrice sets the price per kg used for the cost figures
+*/
+func setHydrogenPrice(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Hydrogen Price"
+	var price float64
+	if _, err := fmt.Sscan(mux.Vars(r)["price"], &price); err != nil || price < 0 {
+		ReturnJSONErrorString(w, deviceString, "Invalid price", http.StatusBadRequest, false)
+		return
+	}
+	currentSettings.FuelCellSettings.Hydrogen.PricePerKg = price
+	if currency := r.URL.Query().Get("currency"); currency != "" {
+		currentSettings.FuelCellSettings.Hydrogen.Currency = currency
+	}
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getHydrogen(w, r)
+}
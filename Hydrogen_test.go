@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/brutella/can"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// reportStackOutput has the main fuel cell report its stack voltage and current
+func reportStackOutput(t *testing.T, volts float64, amps float64, now time.Time) {
+	t.Helper()
+	frame := can.Frame{ID: CanStackOutputMsg, Length: 8}
+	binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(volts*10))
+	binary.LittleEndian.PutUint16(frame.Data[2:4], uint16(amps*10))
+	// Sampling at the same time again adds nothing to the totals
+	inject(t, frame, func() bool {
+		Hydrogen.sample(now)
+		return Hydrogen.Live().StackAmps == amps
+	})
+}
+
+func TestH2KgPerSecond(t *testing.T) {
+	// 32 cells at 100A use 32 * 100 / 2F moles of hydrogen a second
+	kgPerSecond := h2KgPerSecond(32, 100)
+	if gramsPerHour := kgPerSecond * 3600 * 1000; math.Abs(gramsPerHour-120.34) > 0.01 {
+		t.Errorf("%0.3fg/h at 100A, want 120.34", gramsPerHour)
+	}
+	// All of the hydrogen's energy
+	if e := efficiency(kgPerSecond*3600*h2LowerHeatingKWh, kgPerSecond); math.Abs(e-100) > 1e-9 {
+		t.Errorf("efficiency = %v, want 100", e)
+	}
+	if e := efficiency(5, 0); e != 0 {
+		t.Errorf("efficiency = %v with no hydrogen used", e)
+	}
+}
+
+/*
+TestHydrogenTotals integrates a steady stack current and checks the totals, that gaps in the samples are not
+integrated across and that the totals survive a save and reload of the state file
+*/
+func TestHydrogenTotals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := State.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	saved := currentSettings.FuelCellSettings.Hydrogen
+	defer func() {
+		currentSettings.FuelCellSettings.Hydrogen = saved
+		State.mu.Lock()
+		State.Hydrogen = HydrogenTotalsType{}
+		State.mu.Unlock()
+		_ = State.Load("")
+	}()
+	currentSettings.FuelCellSettings.Hydrogen = HydrogenSettingsType{CellCount: 32, PricePerKg: 10}
+
+	start := time.Date(2026, 3, 2, 23, 59, 57, 0, time.Local)
+	reportStackOutput(t, 60, 100, start)
+	defer reportStackOutput(t, 0, 0, start)
+	for _, after := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second,
+		// A gap too long to integrate across
+		time.Minute} {
+		Hydrogen.sample(start.Add(after))
+	}
+
+	kgPerSecond := h2KgPerSecond(32, 100)
+	State.mu.Lock()
+	totals := State.Hydrogen
+	State.mu.Unlock()
+	if math.Abs(totals.KgH2-4*kgPerSecond) > 1e-12 || math.Abs(totals.StackKWh-6*4/3600.0) > 1e-9 {
+		t.Errorf("totals %vkg and %vkWh, want %vkg and %vkWh", totals.KgH2, totals.StackKWh, 4*kgPerSecond, 6*4/3600.0)
+	}
+	// Two seconds on each side of midnight
+	if len(totals.Days) != 2 || math.Abs(totals.Days["2026-03-02"].KgH2-2*kgPerSecond) > 1e-12 {
+		t.Errorf("daily totals = %v", totals.Days)
+	}
+	if !totals.Since.Equal(start.Add(time.Second)) {
+		t.Errorf("totals since %v, want %v", totals.Since, start.Add(time.Second))
+	}
+
+	report := newHydrogenUsageReport("", totals.HydrogenUsageType, 10)
+	if report.StackEfficiency != roundTo(efficiency(6, kgPerSecond), 1) || report.Cost != roundTo(4*kgPerSecond*10, 2) {
+		t.Errorf("usage report = %+v", report)
+	}
+
+	if err := State.Save(); err != nil {
+		t.Fatal(err)
+	}
+	State.mu.Lock()
+	State.Hydrogen = HydrogenTotalsType{}
+	State.mu.Unlock()
+	if err := State.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	State.mu.Lock()
+	defer State.mu.Unlock()
+	if State.Hydrogen.KgH2 != totals.KgH2 || len(State.Hydrogen.Days) != 2 {
+		t.Errorf("reloaded totals = %+v, want %+v", State.Hydrogen, totals)
+	}
+}
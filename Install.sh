@@ -1,4 +1,5 @@
 systemctl stop FireflyIO
 cp bin/amd64/FireflyIO /usr/bin
 cp -r web/* /FireflyIO/web
+cp PAN.dbc /FireflyIO
 systemctl start FireflyIO
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+Interlocks stop relays and digital outputs being switched on when it would be unsafe. An exclusive interlock allows
+no more than one of its ports to be on, such as forward and reverse contactors. A requireInput interlock only allows
+its ports on while a digital input is in the given state, such as a door being closed. A minOffTime interlock keeps
+its ports off for a minimum time after they were switched off, to protect compressors.
+
+Every switch goes through RelaysType.SetRelay or DigitalOutputsType.SetOutput, which check the interlocks, so the
+web handlers, rules, scheduler, timed switches and fail-safe are all covered. Switching off is never blocked.
+Interlocks do not switch off a port that is already on when an input changes. Use a rule for that.
+
+The off times for minOffTime come from our own switching and from the board reporting a port has gone off. They are
+not saved, so after a restart a port is not held off until it has been seen to go off again.
+*/
+
+// Interlock types
+const (
+	InterlockExclusive    = "exclusive"    // No more than one of the ports may be on
+	InterlockRequireInput = "requireInput" // The ports may only be switched on while the input is in the given state
+	InterlockMinOffTime   = "minOffTime"   // The ports must stay off for MinOffSeconds before they are switched on
+)
+
+type InterlockPortType struct {
+	Type    string // relay or output
+	Board   uint8  // Node ID of the board
+	Channel uint8
+}
+
+type InterlockType struct {
+	Name          string
+	Type          string // exclusive, requireInput or minOffTime
+	Ports         []InterlockPortType
+	InputBoard    uint8   `json:",omitempty"` // requireInput: node ID of the board with the input
+	Input         uint8   `json:",omitempty"` // requireInput: digital input 0 to 3
+	InputState    string  `json:",omitempty"` // requireInput: on or off
+	MinOffSeconds float64 `json:",omitempty"` // minOffTime
+}
+
+/*
+InterlockError is returned when an interlock stops a port being switched on
+*/
+type InterlockError struct {
+	Interlock string
+	Port      string
+	Reason    string
+}
+
+func (e *InterlockError) Error() string {
+	return fmt.Sprintf("%s cannot be switched on. Interlock %s - %s", e.Port, e.Interlock, e.Reason)
+}
+
+// interlockStatus returns the HTTP status for an error from switching a port
+func interlockStatus(err error) int {
+	var interlockErr *InterlockError
+	if errors.As(err, &interlockErr) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+type InterlocksType struct {
+	mu       sync.Mutex           // Held while a port is checked and switched so two switches cannot both pass
+	offSince map[string]time.Time // When each port went off, keyed on portKey
+}
+
+var Interlocks = InterlocksType{offSince: make(map[string]time.Time)}
+
+func portKey(portType string, board uint8, channel uint8) string {
+	return fmt.Sprintf("%s/%d/%d", portType, board, channel)
+}
+
+func (p *InterlockPortType) String() string {
+	if board := GetBoard(p.Board); board != nil {
+		if p.Type == ActionRelay && int(p.Channel) < len(board.Relays.Relays) {
+			return fmt.Sprintf("relay %d (%s) on board %d", p.Channel, board.Relays.GetRelayName(p.Channel), p.Board)
+		}
+		if p.Type == ActionOutput && int(p.Channel) < len(board.Outputs.Outputs) {
+			return fmt.Sprintf("output %d (%s) on board %d", p.Channel, board.Outputs.GetOutputName(p.Channel), p.Board)
+		}
+	}
+	return fmt.Sprintf("%s %d on board %d", p.Type, p.Channel, p.Board)
+}
+
+// isOn returns the state we last set or the board reported for the port. A port the board does not have is off.
+func (p *InterlockPortType) isOn() bool {
+	board := GetBoard(p.Board)
+	if board == nil {
+		return false
+	}
+	if p.Type == ActionRelay {
+		return int(p.Channel) < len(board.Relays.Relays) && board.Relays.GetRelay(p.Channel)
+	}
+	return int(p.Channel) < len(board.Outputs.Outputs) && board.Outputs.GetOutput(p.Channel)
+}
+
+func (il *InterlockType) covers(port InterlockPortType) bool {
+	for _, p := range il.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (il *InterlockType) validate() error {
+	if il.Name == "" {
+		return fmt.Errorf("every interlock needs a name")
+	}
+	switch il.Type {
+	case InterlockExclusive:
+		if len(il.Ports) < 2 {
+			return fmt.Errorf("%s: an exclusive interlock needs at least two ports", il.Name)
+		}
+	case InterlockRequireInput:
+		if GetBoard(il.InputBoard) == nil {
+			return fmt.Errorf("%s: there is no board with node ID %d", il.Name, il.InputBoard)
+		}
+		if il.Input > 3 {
+			return fmt.Errorf("%s: digital input must be 0 to 3", il.Name)
+		}
+		if il.InputState != "on" && il.InputState != "off" {
+			return fmt.Errorf("%s: input state must be on or off", il.Name)
+		}
+	case InterlockMinOffTime:
+		if il.MinOffSeconds <= 0 {
+			return fmt.Errorf("%s: the minimum off time must be greater than zero", il.Name)
+		}
+	default:
+		return fmt.Errorf("%s: interlock type must be %s, %s or %s", il.Name, InterlockExclusive, InterlockRequireInput, InterlockMinOffTime)
+	}
+	if len(il.Ports) == 0 {
+		return fmt.Errorf("%s: an interlock needs at least one port", il.Name)
+	}
+	for i, port := range il.Ports {
+		if port.Type != ActionRelay && port.Type != ActionOutput {
+			return fmt.Errorf("%s port %d: type must be %s or %s", il.Name, i+1, ActionRelay, ActionOutput)
+		}
+		action := ActionType{Type: port.Type, Board: port.Board, Channel: port.Channel}
+		if err := action.validate(); err != nil {
+			return fmt.Errorf("%s port %d: %v", il.Name, i+1, err)
+		}
+	}
+	return nil
+}
+
+func validateInterlocks(interlocks []InterlockType) error {
+	names := make(map[string]bool)
+	for i := range interlocks {
+		if err := interlocks[i].validate(); err != nil {
+			return err
+		}
+		if names[interlocks[i].Name] {
+			return fmt.Errorf("there is more than one interlock called %s", interlocks[i].Name)
+		}
+		names[interlocks[i].Name] = true
+	}
+	return nil
+}
+
+/*
+checkedInterlocks returns the interlocks that pass validation and have a name not already used. The others are logged
+and dropped as they cannot be enforced.
+*/
+func checkedInterlocks(interlocks []InterlockType) []InterlockType {
+	checked := make([]InterlockType, 0, len(interlocks))
+	names := make(map[string]bool)
+	for i := range interlocks {
+		err := interlocks[i].validate()
+		if err == nil && names[interlocks[i].Name] {
+			err = fmt.Errorf("there is more than one interlock called %s", interlocks[i].Name)
+		}
+		if err != nil {
+			log.Printf("Interlock %d is not used - %v", i+1, err)
+			continue
+		}
+		names[interlocks[i].Name] = true
+		checked = append(checked, interlocks[i])
+	}
+	return checked
+}
+
+/*
+blocks returns why the interlock stops the port being switched on, or an empty string if it does not.
+It must be called with the interlocks locked.
+*/
+func (it *InterlocksType) blocks(il *InterlockType, port InterlockPortType, now time.Time) string {
+	switch il.Type {
+	case InterlockExclusive:
+		for _, other := range il.Ports {
+			if other != port && other.isOn() {
+				return fmt.Sprintf("%s is on", other.String())
+			}
+		}
+	case InterlockRequireInput:
+		board := GetBoard(il.InputBoard)
+		if board == nil {
+			return fmt.Sprintf("there is no board with node ID %d", il.InputBoard)
+		}
+		if int(il.Input) >= len(board.Inputs.Inputs) {
+			return fmt.Sprintf("there is no input %d on board %d", il.Input, il.InputBoard)
+		}
+		if Freshness.IsStale(board.freshnessName("AnalogInternal")) {
+			return fmt.Sprintf("input %d on board %d is stale", il.Input, il.InputBoard)
+		}
+		if board.Inputs.GetInput(il.Input) != (il.InputState == "on") {
+			return fmt.Sprintf("input %d (%s) on board %d must be %s", il.Input, board.Inputs.GetInputName(il.Input), il.InputBoard, il.InputState)
+		}
+	case InterlockMinOffTime:
+		offSince, found := it.offSince[portKey(port.Type, port.Board, port.Channel)]
+		minOff := time.Duration(il.MinOffSeconds * float64(time.Second))
+		if found && now.Sub(offSince) < minOff {
+			return fmt.Sprintf("it has only been off for %0.0fs of %0.0fs", now.Sub(offSince).Seconds(), il.MinOffSeconds)
+		}
+	}
+	return ""
+}
+
+/*
+check returns an InterlockError if any interlock stops the port being switched on. A port that is already on is
+allowed. It must be called with the interlocks locked.
+*/
+func (it *InterlocksType) check(board *BoardType, portType string, channel uint8) error {
+	if board == nil {
+		return nil
+	}
+	port := InterlockPortType{Type: portType, Board: board.NodeID, Channel: channel}
+	if port.isOn() {
+		return nil
+	}
+	now := time.Now()
+	interlocks := currentSettings.interlockList()
+	for i := range interlocks {
+		if !interlocks[i].covers(port) {
+			continue
+		}
+		if reason := it.blocks(&interlocks[i], port, now); reason != "" {
+			return &InterlockError{Interlock: interlocks[i].Name, Port: port.String(), Reason: reason}
+		}
+	}
+	return nil
+}
+
+// switched records when a port is switched off. It must be called with the interlocks locked.
+func (it *InterlocksType) switched(board *BoardType, portType string, channel uint8, wasOn bool, on bool) {
+	if board != nil && wasOn && !on {
+		it.offSince[portKey(portType, board.NodeID, channel)] = time.Now()
+	}
+}
+
+/*
+reported sets the relays and outputs the board reports, recording any that have gone off without us switching them,
+such as when the board has turned everything off after losing our heartbeat
+*/
+func (it *InterlocksType) reported(board *BoardType, relays uint16, outputs uint8) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	wasRelays := board.Relays.GetAllRelays()
+	for relay := range board.Relays.Relays {
+		bit := uint16(1) << relay
+		it.switched(board, ActionRelay, uint8(relay), wasRelays&bit != 0, relays&bit != 0)
+	}
+	wasOutputs := board.Outputs.GetAllOutputs()
+	for output := range board.Outputs.Outputs {
+		bit := uint8(1) << output
+		it.switched(board, ActionOutput, uint8(output), wasOutputs&bit != 0, outputs&bit != 0)
+	}
+	board.Relays.SetAllRelays(relays)
+	board.Outputs.SetAllOutputs(outputs)
+}
+
+type InterlockStatusType struct {
+	InterlockType
+	Blocking []string `json:",omitempty"` // Ports that cannot be switched on now and why
+}
+
+func (it *InterlocksType) Status() []InterlockStatusType {
+	interlocks := currentSettings.interlockList()
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	now := time.Now()
+	status := make([]InterlockStatusType, 0, len(interlocks))
+	for i := range interlocks {
+		interlockStatus := InterlockStatusType{InterlockType: interlocks[i]}
+		for _, port := range interlocks[i].Ports {
+			if port.isOn() {
+				continue
+			}
+			if reason := it.blocks(&interlocks[i], port, now); reason != "" {
+				interlockStatus.Blocking = append(interlockStatus.Blocking, fmt.Sprintf("%s - %s", port.String(), reason))
+			}
+		}
+		status = append(status, interlockStatus)
+	}
+	return status
+}
+
+func getInterlocks(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Interlocks"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(Interlocks.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+setInterlocks replaces every interlock with the JSON array in the body
+*/
+func setInterlocks(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Interlocks"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	var interlocks []InterlockType
+	if err := json.Unmarshal(body, &interlocks); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := validateInterlocks(interlocks); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	currentSettings.setInterlockList(interlocks)
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getInterlocks(w, r)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInterlockCheck(t *testing.T) {
+	board := MainBoard()
+	relay := func(channel uint8) InterlockPortType {
+		return InterlockPortType{Type: ActionRelay, Board: board.NodeID, Channel: channel}
+	}
+	output := func(channel uint8) InterlockPortType {
+		return InterlockPortType{Type: ActionOutput, Board: board.NodeID, Channel: channel}
+	}
+	contactors := InterlockType{Name: "Contactors", Type: InterlockExclusive, Ports: []InterlockPortType{relay(0), relay(1)}}
+	door := InterlockType{Name: "Door", Type: InterlockRequireInput, Ports: []InterlockPortType{output(2)},
+		InputBoard: board.NodeID, Input: 1, InputState: "on"}
+	compressor := InterlockType{Name: "Compressor", Type: InterlockMinOffTime, Ports: []InterlockPortType{relay(3)}, MinOffSeconds: 60}
+
+	tests := []struct {
+		name       string
+		interlocks []InterlockType
+		relays     uint16
+		outputs    uint8
+		inputs     uint8
+		stale      bool
+		offFor     time.Duration // How long relay 3 has been off. 0 if it has never been switched
+		portType   string
+		channel    uint8
+		blockedBy  string // Empty if the port may be switched on
+	}{
+		{name: "No interlocks", portType: ActionRelay, channel: 0},
+		{name: "Exclusive with the other off", interlocks: []InterlockType{contactors}, portType: ActionRelay, channel: 0},
+		{name: "Exclusive with the other on", interlocks: []InterlockType{contactors}, relays: 0x0002, portType: ActionRelay,
+			channel: 0, blockedBy: "Contactors"},
+		{name: "Already on is allowed", interlocks: []InterlockType{contactors}, relays: 0x0003, portType: ActionRelay, channel: 0},
+		{name: "Port not covered", interlocks: []InterlockType{contactors}, relays: 0x0002, portType: ActionRelay, channel: 5},
+		{name: "Output is not the relay", interlocks: []InterlockType{contactors}, relays: 0x0002, portType: ActionOutput, channel: 0},
+		{name: "Input in the required state", interlocks: []InterlockType{door}, inputs: 0x02, portType: ActionOutput, channel: 2},
+		{name: "Input in the wrong state", interlocks: []InterlockType{door}, inputs: 0x01, portType: ActionOutput, channel: 2,
+			blockedBy: "Door"},
+		{name: "Input stale", interlocks: []InterlockType{door}, inputs: 0x02, stale: true, portType: ActionOutput, channel: 2,
+			blockedBy: "Door"},
+		{name: "Never switched off", interlocks: []InterlockType{compressor}, portType: ActionRelay, channel: 3},
+		{name: "Off for too short a time", interlocks: []InterlockType{compressor}, offFor: 10 * time.Second,
+			portType: ActionRelay, channel: 3, blockedBy: "Compressor"},
+		{name: "Off for long enough", interlocks: []InterlockType{compressor}, offFor: 61 * time.Second, portType: ActionRelay, channel: 3},
+		{name: "First blocking interlock is reported", interlocks: []InterlockType{compressor, contactors,
+			{Name: "Pair", Type: InterlockExclusive, Ports: []InterlockPortType{relay(0), relay(3)}}},
+			relays: 0x0001, offFor: time.Second, portType: ActionRelay, channel: 3, blockedBy: "Compressor"},
+	}
+	saved := currentSettings.interlockList()
+	defer func() {
+		currentSettings.setInterlockList(saved)
+		board.Relays.SetAllRelays(0)
+		board.Outputs.SetAllOutputs(0)
+		board.Inputs.SetAllInputs(0)
+	}()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			currentSettings.setInterlockList(test.interlocks)
+			board.Relays.SetAllRelays(test.relays)
+			board.Outputs.SetAllOutputs(test.outputs)
+			board.Inputs.SetAllInputs(test.inputs)
+			Freshness.mu.Lock()
+			analog := Freshness.messages[board.freshnessName("AnalogInternal")]
+			analog.LastSeen = time.Now()
+			if test.stale {
+				analog.LastSeen = time.Time{}
+			}
+			Freshness.mu.Unlock()
+
+			Interlocks.mu.Lock()
+			defer Interlocks.mu.Unlock()
+			Interlocks.offSince = make(map[string]time.Time)
+			if test.offFor > 0 {
+				Interlocks.offSince[portKey(ActionRelay, board.NodeID, 3)] = time.Now().Add(-test.offFor)
+			}
+			err := Interlocks.check(board, test.portType, test.channel)
+			if test.blockedBy == "" {
+				if err != nil {
+					t.Errorf("check returned %v", err)
+				}
+				return
+			}
+			interlockErr, ok := err.(*InterlockError)
+			if !ok || interlockErr.Interlock != test.blockedBy {
+				t.Errorf("check returned %v, want it blocked by %s", err, test.blockedBy)
+			}
+		})
+	}
+}
+
+func TestCheckedInterlocks(t *testing.T) {
+	board := MainBoard().NodeID
+	interlocks := checkedInterlocks([]InterlockType{
+		{Name: "Contactors", Type: InterlockExclusive, Ports: []InterlockPortType{{ActionRelay, board, 0}, {ActionRelay, board, 1}}},
+		{Name: "No relay 16", Type: InterlockExclusive, Ports: []InterlockPortType{{ActionRelay, board, 0}, {ActionRelay, board, 16}}},
+		{Name: "No input 4", Type: InterlockRequireInput, Ports: []InterlockPortType{{ActionOutput, board, 0}},
+			InputBoard: board, Input: 4, InputState: "on"},
+		{Name: "Contactors", Type: InterlockMinOffTime, Ports: []InterlockPortType{{ActionRelay, board, 2}}, MinOffSeconds: 5},
+	})
+	if len(interlocks) != 1 || interlocks[0].Name != "Contactors" || interlocks[0].Type != InterlockExclusive {
+		t.Errorf("checkedInterlocks kept %+v, want only the first", interlocks)
+	}
+}
+
+// TestInterlockBadChannel checks that interlocks that did not pass validation cannot index past the ports
+func TestInterlockBadChannel(t *testing.T) {
+	board := MainBoard()
+	saved := currentSettings.interlockList()
+	defer currentSettings.setInterlockList(saved)
+	currentSettings.setInterlockList([]InterlockType{
+		{Name: "Bad relay", Type: InterlockExclusive, Ports: []InterlockPortType{{ActionRelay, board.NodeID, 0}, {ActionRelay, board.NodeID, 20}}},
+		{Name: "Bad input", Type: InterlockRequireInput, Ports: []InterlockPortType{{ActionRelay, board.NodeID, 0}},
+			InputBoard: board.NodeID, Input: 9, InputState: "on"},
+	})
+	Interlocks.mu.Lock()
+	err := Interlocks.check(board, ActionRelay, 0)
+	Interlocks.mu.Unlock()
+	if interlockErr, ok := err.(*InterlockError); !ok || interlockErr.Interlock != "Bad input" {
+		t.Errorf("check returned %v, want it blocked by the missing input", err)
+	}
+}
+
+// TestInterlockReportedOff checks that a port the board turns off by itself starts the minimum off time
+func TestInterlockReportedOff(t *testing.T) {
+	board := MainBoard()
+	saved := currentSettings.interlockList()
+	defer func() {
+		currentSettings.setInterlockList(saved)
+		board.Relays.SetAllRelays(0)
+	}()
+	currentSettings.setInterlockList([]InterlockType{{Name: "Compressor", Type: InterlockMinOffTime,
+		Ports: []InterlockPortType{{ActionRelay, board.NodeID, 3}}, MinOffSeconds: 60}})
+	Interlocks.mu.Lock()
+	Interlocks.offSince = make(map[string]time.Time)
+	Interlocks.mu.Unlock()
+
+	board.Relays.SetAllRelays(0x0008)
+	Interlocks.reported(board, 0x0001, 0)
+	if board.Relays.GetAllRelays() != 0x0001 {
+		t.Errorf("relays = %04x, want the reported 0001", board.Relays.GetAllRelays())
+	}
+	if err := board.Relays.SetRelay(3, true); err == nil {
+		t.Error("relay 3 was switched on straight after the board turned it off")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brutella/can"
+	"sync"
+)
+
+/*
+Most of the fuel cell messages use 29 bit J1939 style identifiers
+	bits 26-28 priority, bit 25 extended data page, bit 24 data page, bits 16-23 PDU format, bits 8-15 PDU specific, bits 0-7 source address
+For PDU format values below 240 (PDU1) the PDU specific byte is a destination address and is not part of the PGN.
+Handlers are registered by PGN and source address so a unit using a different source address is still decoded.
+*/
+
+const J1939AnySource = -1
+
+type J1939IDType struct {
+	Priority      uint8
+	PGN           uint32
+	Source        uint8
+	Destination   uint8 // Only meaningful for PDU1 messages. 0xFF (global) for PDU2
+	PDUFormat     uint8
+	PDUSpecific   uint8
+	ExtendedFrame bool
+}
+
+type j1939KeyType struct {
+	pgn    uint32
+	source int
+}
+
+type J1939DispatcherType struct {
+	mu       sync.Mutex
+	handlers map[j1939KeyType]FrameHandler
+}
+
+/*
+ParseJ1939ID splits an extended frame identifier into its J1939 fields
+*/
+func ParseJ1939ID(id uint32) J1939IDType {
+	var j J1939IDType
+	j.ExtendedFrame = id&can.MaskEff != 0
+	id &= can.MaskIDEff
+	j.Priority = uint8((id >> 26) & 0x07)
+	j.PDUFormat = uint8(id >> 16)
+	j.PDUSpecific = uint8(id >> 8)
+	j.Source = uint8(id)
+	dataPages := (id >> 24) & 0x03
+	if j.PDUFormat < 240 {
+		j.PGN = dataPages<<16 | uint32(j.PDUFormat)<<8
+		j.Destination = j.PDUSpecific
+	} else {
+		j.PGN = dataPages<<16 | uint32(j.PDUFormat)<<8 | uint32(j.PDUSpecific)
+		j.Destination = 0xFF
+	}
+	return j
+}
+
+/*
+ID rebuilds the extended frame identifier
+*/
+func (j J1939IDType) ID() uint32 {
+	id := uint32(j.Priority&0x07)<<26 | (j.PGN&0x3FF00)<<8 | uint32(j.Source)
+	if j.PDUFormat < 240 {
+		id |= uint32(j.Destination) << 8
+	} else {
+		id |= (j.PGN & 0xFF) << 8
+	}
+	return id | can.MaskEff
+}
+
+func (j J1939IDType) String() string {
+	return fmt.Sprintf("PGN 0x%05X SA 0x%02X DA 0x%02X P%d", j.PGN, j.Source, j.Destination, j.Priority)
+}
+
+// pgnOf returns the PGN of an extended frame identifier
+func pgnOf(id uint32) uint32 {
+	return ParseJ1939ID(id).PGN
+}
+
+func NewJ1939Dispatcher() *J1939DispatcherType {
+	d := new(J1939DispatcherType)
+	d.handlers = make(map[j1939KeyType]FrameHandler)
+	return d
+}
+
+/*
+AddHandler registers a handler for the PGN from the given source address. Use J1939AnySource to accept the PGN
+from any source.
+*/
+func (d *J1939DispatcherType) AddHandler(pgn uint32, source int, handler FrameHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers[j1939KeyType{pgn: pgn, source: source}] = handler
+}
+
+/*
+AddHandlerForID registers a handler using the PGN of a known frame identifier. If anySource is true the source
+address in the identifier is ignored.
+*/
+func (d *J1939DispatcherType) AddHandlerForID(id uint32, anySource bool, handler FrameHandler) {
+	j := ParseJ1939ID(id)
+	if anySource {
+		d.AddHandler(j.PGN, J1939AnySource, handler)
+	} else {
+		d.AddHandler(j.PGN, int(j.Source), handler)
+	}
+}
+
+/*
+Handler finds the handler for the frame. A handler for the specific source address takes priority over one
+registered for any source.
+*/
+func (d *J1939DispatcherType) Handler(id uint32) FrameHandler {
+	j := ParseJ1939ID(id)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if handler, found := d.handlers[j1939KeyType{pgn: j.PGN, source: int(j.Source)}]; found {
+		return handler
+	}
+	return d.handlers[j1939KeyType{pgn: j.PGN, source: J1939AnySource}]
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/brutella/can"
+	"testing"
+)
+
+func TestParseJ1939ID(t *testing.T) {
+	tests := []struct {
+		name        string
+		id          uint32
+		priority    uint8
+		pgn         uint32
+		source      uint8
+		destination uint8
+		extended    bool
+	}{
+		{"PDU2 broadcast", 0x18FEF100 | can.MaskEff, 6, 0x0FEF1, 0x00, 0xFF, true},
+		{"PDU1 to a destination", 0x0CEF2A91 | can.MaskEff, 3, 0x0EF00, 0x91, 0x2A, true},
+		{"PDU1 global destination", 0x18EAFF33, 6, 0x0EA00, 0x33, 0xFF, false},
+		{"Data page set", 0x19FECA17 | can.MaskEff, 6, 0x1FECA, 0x17, 0xFF, true},
+		{"Extended data page set", 0x1AFECA17 | can.MaskEff, 6, 0x2FECA, 0x17, 0xFF, true},
+		{"Lowest priority", 0x1CFF1C91 | can.MaskEff, 7, 0x0FF1C, 0x91, 0xFF, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			j := ParseJ1939ID(test.id)
+			if j.Priority != test.priority || j.PGN != test.pgn || j.Source != test.source ||
+				j.Destination != test.destination || j.ExtendedFrame != test.extended {
+				t.Errorf("ParseJ1939ID(0x%08X) = %s extended %v, want PGN 0x%05X SA 0x%02X DA 0x%02X P%d extended %v",
+					test.id, j, j.ExtendedFrame, test.pgn, test.source, test.destination, test.priority, test.extended)
+			}
+			if id := j.ID(); id != test.id|can.MaskEff {
+				t.Errorf("ID() = 0x%08X, want 0x%08X", id, test.id|can.MaskEff)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+Maintenance keeps lifetime counters for each fuel cell in the state file: run hours, starts, stops, kWh delivered,
+purges, alarms and faults. The run time the fuel cell sends only has a byte each for hours and minutes so we count
+the run hours ourselves.
+
+Service intervals are set against one of the counters, or calendar days. When an interval is used up a reminder is
+raised as an event and shown on the dashboard until a technician acknowledges it, which records the service and
+starts the interval again.
+*/
+
+// Counters that service intervals can be set against
+const (
+	MaintenanceRunHours = "runHours"
+	MaintenanceStarts   = "starts"
+	MaintenanceKWh      = "kWh"
+	MaintenancePurges   = "purges"
+	MaintenanceDays     = "days"
+)
+
+// Event sources counted as alarms or faults
+var maintenanceAlarmSources = []string{EventSourceAlarm, EventSourceDCOutput, EventSourceInsulation}
+
+// Run time steps longer than this are not counted. The fuel cell data was probably lost.
+const maintenanceMaxStep = time.Second * 5
+
+type ServiceIntervalType struct {
+	Name       string  // Filter change, coolant etc.
+	Counter    string  // runHours, starts, kWh, purges or days
+	Interval   float64 // Counter units between services
+	WarnBefore float64 // Show the reminder as due soon this many counter units before it is due
+}
+
+type MaintenanceSettingsType struct {
+	Intervals []ServiceIntervalType
+}
+
+// MaintenanceCountersType holds the lifetime counters for a fuel cell
+type MaintenanceCountersType struct {
+	Since    time.Time // When counting started
+	RunHours float64
+	Starts   int
+	Stops    int
+	KWh      float64 // DC-DC converter output
+	Purges   int
+	Alarms   int
+	Faults   int
+}
+
+type ServiceRecordType struct {
+	Time    time.Time
+	Counter float64 // Counter value at the service
+	By      string  `json:",omitempty"`
+	Note    string  `json:",omitempty"`
+}
+
+// FuelCellMaintenanceType is kept in the state file for each fuel cell
+type FuelCellMaintenanceType struct {
+	Counters MaintenanceCountersType
+	Services map[string]ServiceRecordType // Last service keyed on interval name
+}
+
+type MaintenanceType struct {
+	mu      sync.Mutex
+	running map[int]bool      // Fuel cells running on the last pass with a valid run state
+	events  map[string]string // Alarm and fault events seen on the last pass. Key -> start time
+	last    time.Time
+}
+
+var Maintenance = MaintenanceType{running: make(map[int]bool), events: make(map[string]string)}
+
+func defaultMaintenanceSettings() MaintenanceSettingsType {
+	return MaintenanceSettingsType{Intervals: []ServiceIntervalType{
+		{Name: "Air filter", Counter: MaintenanceRunHours, Interval: 2000, WarnBefore: 100},
+		{Name: "Coolant", Counter: MaintenanceDays, Interval: 365, WarnBefore: 30},
+	}}
+}
+
+func (s *MaintenanceSettingsType) validate() error {
+	names := make(map[string]bool)
+	for _, interval := range s.Intervals {
+		if interval.Name == "" {
+			return fmt.Errorf("every service interval needs a name")
+		}
+		if names[interval.Name] {
+			return fmt.Errorf("there is more than one service interval called %s", interval.Name)
+		}
+		names[interval.Name] = true
+		switch interval.Counter {
+		case MaintenanceRunHours, MaintenanceStarts, MaintenanceKWh, MaintenancePurges, MaintenanceDays:
+		default:
+			return fmt.Errorf("%s: counter must be %s, %s, %s, %s or %s", interval.Name, MaintenanceRunHours, MaintenanceStarts,
+				MaintenanceKWh, MaintenancePurges, MaintenanceDays)
+		}
+		if interval.Interval <= 0 {
+			return fmt.Errorf("%s: the interval must be greater than zero", interval.Name)
+		}
+		if interval.WarnBefore < 0 || interval.WarnBefore >= interval.Interval {
+			return fmt.Errorf("%s: the warning must be between zero and the interval", interval.Name)
+		}
+	}
+	return nil
+}
+
+func (s *MaintenanceSettingsType) find(name string) (ServiceIntervalType, bool) {
+	for _, interval := range s.Intervals {
+		if interval.Name == name {
+			return interval, true
+		}
+	}
+	return ServiceIntervalType{}, false
+}
+
+// maintenance must be called with the state locked
+func (st *PersistentStateType) maintenance(number int) *FuelCellMaintenanceType {
+	if st.Maintenance == nil {
+		st.Maintenance = make(map[int]*FuelCellMaintenanceType)
+	}
+	record, found := st.Maintenance[number]
+	if !found {
+		record = &FuelCellMaintenanceType{Counters: MaintenanceCountersType{Since: time.Now()}}
+		st.Maintenance[number] = record
+	}
+	if record.Services == nil {
+		record.Services = make(map[string]ServiceRecordType)
+	}
+	return record
+}
+
+// value returns the counter an interval is set against
+func (c *MaintenanceCountersType) value(counter string, now time.Time) float64 {
+	switch counter {
+	case MaintenanceRunHours:
+		return c.RunHours
+	case MaintenanceStarts:
+		return float64(c.Starts)
+	case MaintenanceKWh:
+		return c.KWh
+	case MaintenancePurges:
+		return float64(c.Purges)
+	case MaintenanceDays:
+		return now.Sub(c.Since).Hours() / 24
+	}
+	return 0
+}
+
+/*
+Run updates the counters and reminders every second
+*/
+func (mt *MaintenanceType) Run() {
+	checkTime := time.NewTicker(time.Second)
+	for {
+		now := <-checkTime.C
+		mt.step(now)
+	}
+}
+
+func (mt *MaintenanceType) step(now time.Time) {
+	type sample struct {
+		valid    bool // The run state is up to date
+		running  bool
+		outputKW float64
+	}
+	samples := make([]sample, len(FuelCells))
+	for i, fuelCell := range FuelCells {
+		measurements := fuelCell.Measurements()
+		samples[i].valid = measurements.ModeValid
+		samples[i].running = measurements.PowerMode == PMManual
+		if measurements.OutputValid {
+			samples[i].outputKW = measurements.OutputKW()
+		}
+	}
+	active := Events.ActiveEvents()
+
+	mt.mu.Lock()
+	// Nothing has changed on the first pass. It only sets up the running flags and the events already raised.
+	first := mt.last.IsZero()
+	step := now.Sub(mt.last)
+	mt.last = now
+	hours := 0.0
+	if step <= maintenanceMaxStep {
+		hours = step.Hours()
+	}
+	seen := make(map[string]string)
+	State.mu.Lock()
+	for i, fuelCell := range FuelCells {
+		counters := &State.maintenance(fuelCell.Number).Counters
+		running := samples[i].running
+		wasRunning, known := mt.running[fuelCell.Number]
+		switch {
+		case !samples[i].valid:
+			// Stale data is not a stop. Leave the running flag alone until the run state is fresh again.
+		case first || !known:
+		case running && !wasRunning:
+			counters.Starts++
+		case !running && wasRunning:
+			counters.Stops++
+		case running:
+			counters.RunHours += hours
+			counters.KWh += samples[i].outputKW * hours
+		}
+		if samples[i].valid {
+			mt.running[fuelCell.Number] = running
+		}
+
+		// Count the alarms and faults raised since the last pass
+		for _, event := range active {
+			isFault := event.Source == fuelCellFreshnessName(fuelCell.Number, EventSourceFault)
+			isAlarm := false
+			for _, source := range maintenanceAlarmSources {
+				isAlarm = isAlarm || event.Source == fuelCellFreshnessName(fuelCell.Number, source)
+			}
+			if !isFault && !isAlarm {
+				continue
+			}
+			key := eventKey(event.Source, event.Code)
+			started := event.Started.String()
+			seen[key] = started
+			if mt.events[key] == started || first {
+				continue
+			}
+			if isFault {
+				counters.Faults++
+			} else {
+				counters.Alarms++
+			}
+		}
+	}
+	State.mu.Unlock()
+	mt.events = seen
+	mt.mu.Unlock()
+
+	for _, fuelCell := range FuelCells {
+		due := make(map[string]string)
+		for _, reminder := range mt.Reminders(fuelCell, now) {
+			if reminder.Due {
+				due[reminder.Name] = fmt.Sprintf("%s service due. %0.1f %s since the last service", reminder.Name, reminder.Used, reminder.Counter)
+			}
+		}
+		Events.Update(fuelCellFreshnessName(fuelCell.Number, EventSourceMaintenance), due)
+	}
+}
+
+// countPurge must be called with the state locked
+func (st *PersistentStateType) countPurge(number int) {
+	st.maintenance(number).Counters.Purges++
+}
+
+type ServiceReminderType struct {
+	FuelCell     int
+	FuelCellName string `json:",omitempty"`
+	ServiceIntervalType
+	Used        float64 // Counter units since the last service
+	Remaining   float64
+	Due         bool
+	DueSoon     bool
+	LastService *ServiceRecordType `json:",omitempty"`
+}
+
+/*
+Reminders returns the state of every service interval for the fuel cell
+*/
+func (mt *MaintenanceType) Reminders(fuelCell *FuelCellUnitType, now time.Time) []ServiceReminderType {
+	intervals := currentSettings.FuelCellSettings.Maintenance.Intervals
+	reminders := make([]ServiceReminderType, 0, len(intervals))
+	State.mu.Lock()
+	defer State.mu.Unlock()
+	record := State.maintenance(fuelCell.Number)
+	for _, interval := range intervals {
+		reminder := ServiceReminderType{FuelCell: fuelCell.Number, FuelCellName: fuelCell.Settings.Name, ServiceIntervalType: interval}
+		value := record.Counters.value(interval.Counter, now)
+		if service, found := record.Services[interval.Name]; found {
+			if interval.Counter == MaintenanceDays {
+				value = now.Sub(service.Time).Hours() / 24
+			} else {
+				value -= service.Counter
+			}
+			reminder.LastService = &service
+		}
+		reminder.Used = roundTo(value, 2)
+		reminder.Remaining = roundTo(interval.Interval-value, 2)
+		reminder.Due = value >= interval.Interval
+		reminder.DueSoon = !reminder.Due && value >= interval.Interval-interval.WarnBefore
+		reminders = append(reminders, reminder)
+	}
+	return reminders
+}
+
+/*
+DueReminders returns the reminders that are due or due soon for every fuel cell
+*/
+func (mt *MaintenanceType) DueReminders() []ServiceReminderType {
+	due := make([]ServiceReminderType, 0)
+	now := time.Now()
+	for _, fuelCell := range FuelCells {
+		for _, reminder := range mt.Reminders(fuelCell, now) {
+			if reminder.Due || reminder.DueSoon {
+				due = append(due, reminder)
+			}
+		}
+	}
+	return due
+}
+
+/*
+Acknowledge records that the named service has been carried out on the fuel cell and starts the interval again
+*/
+func (mt *MaintenanceType) Acknowledge(fuelCell *FuelCellUnitType, name string, by string, note string) error {
+	interval, found := currentSettings.FuelCellSettings.Maintenance.find(name)
+	if !found {
+		return fmt.Errorf("there is no service interval called %s", name)
+	}
+	now := time.Now()
+	State.mu.Lock()
+	record := State.maintenance(fuelCell.Number)
+	record.Services[name] = ServiceRecordType{Time: now, Counter: record.Counters.value(interval.Counter, now), By: by, Note: note}
+	State.mu.Unlock()
+	log.Printf("%s %s service acknowledged by %s. %s", fuelCell.Label(), name, by, note)
+	if err := State.Save(); err != nil {
+		log.Println("Save state -", err)
+	}
+	return nil
+}
+
+type FuelCellMaintenanceStatusType struct {
+	FuelCell     int
+	FuelCellName string `json:",omitempty"`
+	Counters     MaintenanceCountersType
+	Reminders    []ServiceReminderType
+}
+
+func (mt *MaintenanceType) Status() []FuelCellMaintenanceStatusType {
+	now := time.Now()
+	status := make([]FuelCellMaintenanceStatusType, 0, len(FuelCells))
+	for _, fuelCell := range FuelCells {
+		State.mu.Lock()
+		counters := State.maintenance(fuelCell.Number).Counters
+		State.mu.Unlock()
+		counters.RunHours = roundTo(counters.RunHours, 3)
+		counters.KWh = roundTo(counters.KWh, 3)
+		status = append(status, FuelCellMaintenanceStatusType{FuelCell: fuelCell.Number, FuelCellName: fuelCell.Settings.Name,
+			Counters: counters, Reminders: mt.Reminders(fuelCell, now)})
+	}
+	return status
+}
+
+func getMaintenance(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Maintenance"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(Maintenance.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func getMaintenanceReminders(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Maintenance Reminders"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(Maintenance.DueReminders()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+acknowledgeMaintenance records a service. The by and note query parameters say who did it and anything found.
+*/
+func acknowledgeMaintenance(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Acknowledge Maintenance"
+	fuelCell := fuelCellFromRequest(w, r, deviceString)
+	if fuelCell == nil {
+		return
+	}
+	params := r.URL.Query()
+	if err := Maintenance.Acknowledge(fuelCell, mux.Vars(r)["name"], params.Get("by"), params.Get("note")); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusNotFound, false)
+		return
+	}
+	getMaintenance(w, r)
+}
+
+func setMaintenanceSettings(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Maintenance"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	var settings MaintenanceSettingsType
+	if err := json.Unmarshal(body, &settings); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	currentSettings.FuelCellSettings.Maintenance = settings
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getMaintenance(w, r)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useMaintenanceState points the state file at a temporary directory and clears the counters when the test finishes
+func useMaintenanceState(t *testing.T) {
+	t.Helper()
+	if err := State.Load(filepath.Join(t.TempDir(), "state.json")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		State.mu.Lock()
+		State.Maintenance = nil
+		State.mu.Unlock()
+		_ = State.Load("")
+	})
+}
+
+func maintenanceCounters() MaintenanceCountersType {
+	State.mu.Lock()
+	defer State.mu.Unlock()
+	return State.maintenance(0).Counters
+}
+
+/*
+TestMaintenanceCounters runs the main fuel cell through a start, a spell of stale data and a stop and checks the
+counters. Alarms are counted once each time they are raised.
+*/
+func TestMaintenanceCounters(t *testing.T) {
+	useMaintenanceState(t)
+	alarms := fuelCellFreshnessName(0, EventSourceAlarm)
+	defer Events.Update(alarms, nil)
+	mt := MaintenanceType{running: make(map[int]bool), events: make(map[string]string)}
+	start := time.Now()
+
+	steps := []struct {
+		name       string
+		after      time.Duration
+		mode       PowerModeStateType
+		stale      bool   // The power mode has not been received
+		alarm      string // Raised by the step. The others are cleared.
+		starts     int
+		stops      int
+		runSeconds float64
+		alarms     int
+	}{
+		{name: "First pass", mode: PMOff},
+		{name: "Started", after: time.Second, mode: PMManual, starts: 1},
+		{name: "Running", after: 2 * time.Second, mode: PMManual, starts: 1, runSeconds: 1},
+		{name: "Alarm raised", after: 3 * time.Second, mode: PMManual, alarm: "A", starts: 1, runSeconds: 2, alarms: 1},
+		{name: "Alarm still active", after: 4 * time.Second, mode: PMManual, alarm: "A", starts: 1, runSeconds: 3, alarms: 1},
+		{name: "Gap in the samples", after: 20 * time.Second, mode: PMManual, starts: 1, runSeconds: 3, alarms: 1},
+		{name: "Stale", after: 21 * time.Second, stale: true, starts: 1, runSeconds: 3, alarms: 1},
+		{name: "Fresh again", after: 22 * time.Second, mode: PMManual, starts: 1, runSeconds: 4, alarms: 1},
+		{name: "Alarm raised again", after: 23 * time.Second, mode: PMManual, alarm: "A", starts: 1, runSeconds: 5, alarms: 2},
+		{name: "Stopped", after: 24 * time.Second, mode: PMOff, starts: 1, stops: 1, runSeconds: 5, alarms: 2},
+	}
+	defer reportPowerMode(t, PMOff)
+	for _, step := range steps {
+		if step.stale {
+			setLastSeen(fuelCellFreshnessName(0, "PowerMode"), time.Time{})
+		} else {
+			reportPowerMode(t, step.mode)
+		}
+		conditions := map[string]string{}
+		if step.alarm != "" {
+			conditions[step.alarm] = "Test alarm"
+		}
+		Events.Update(alarms, conditions)
+		mt.step(start.Add(step.after))
+
+		counters := maintenanceCounters()
+		if counters.Starts != step.starts || counters.Stops != step.stops || counters.Alarms != step.alarms {
+			t.Errorf("%s: %d starts, %d stops and %d alarms, want %d, %d and %d", step.name, counters.Starts, counters.Stops,
+				counters.Alarms, step.starts, step.stops, step.alarms)
+		}
+		if runSeconds := counters.RunHours * 3600; runSeconds < step.runSeconds-1e-6 || runSeconds > step.runSeconds+1e-6 {
+			t.Errorf("%s: run for %0.3fs, want %0.0fs", step.name, runSeconds, step.runSeconds)
+		}
+	}
+}
+
+func TestMaintenanceReminders(t *testing.T) {
+	useMaintenanceState(t)
+	saved := currentSettings.FuelCellSettings.Maintenance
+	defer func() { currentSettings.FuelCellSettings.Maintenance = saved }()
+	currentSettings.FuelCellSettings.Maintenance = MaintenanceSettingsType{Intervals: []ServiceIntervalType{
+		{Name: "Valves", Counter: MaintenanceStarts, Interval: 3, WarnBefore: 1},
+	}}
+	fuelCell := MainFuelCell()
+
+	tests := []struct {
+		starts  int
+		due     bool
+		dueSoon bool
+	}{
+		{starts: 1},
+		{starts: 2, dueSoon: true},
+		{starts: 3, due: true},
+	}
+	for _, test := range tests {
+		State.mu.Lock()
+		State.maintenance(0).Counters.Starts = test.starts
+		State.mu.Unlock()
+		reminder := Maintenance.Reminders(fuelCell, time.Now())[0]
+		if reminder.Due != test.due || reminder.DueSoon != test.dueSoon || reminder.Remaining != float64(3-test.starts) {
+			t.Errorf("%d starts: %+v", test.starts, reminder)
+		}
+	}
+
+	if err := Maintenance.Acknowledge(fuelCell, "Filters", "Sam", ""); err == nil {
+		t.Error("a service with no interval was acknowledged")
+	}
+	if err := Maintenance.Acknowledge(fuelCell, "Valves", "Sam", "Replaced"); err != nil {
+		t.Fatal(err)
+	}
+	reminder := Maintenance.Reminders(fuelCell, time.Now())[0]
+	if reminder.Due || reminder.Used != 0 || reminder.LastService == nil || reminder.LastService.By != "Sam" {
+		t.Errorf("after the service: %+v", reminder)
+	}
+}
+
+func TestMaintenanceSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		intervals []ServiceIntervalType
+		wantErr   bool
+	}{
+		{name: "Defaults", intervals: defaultMaintenanceSettings().Intervals},
+		{name: "No name", intervals: []ServiceIntervalType{{Counter: MaintenanceDays, Interval: 10}}, wantErr: true},
+		{name: "Duplicate", intervals: []ServiceIntervalType{{Name: "A", Counter: MaintenanceDays, Interval: 10},
+			{Name: "A", Counter: MaintenanceKWh, Interval: 10}}, wantErr: true},
+		{name: "Unknown counter", intervals: []ServiceIntervalType{{Name: "A", Counter: "litres", Interval: 10}}, wantErr: true},
+		{name: "No interval", intervals: []ServiceIntervalType{{Name: "A", Counter: MaintenancePurges}}, wantErr: true},
+		{name: "Warning past the interval", intervals: []ServiceIntervalType{{Name: "A", Counter: MaintenanceDays, Interval: 10,
+			WarnBefore: 10}}, wantErr: true},
+	}
+	for _, test := range tests {
+		settings := MaintenanceSettingsType{Intervals: test.intervals}
+		if err := settings.validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: validate returned %v", test.name, err)
+		}
+	}
+}
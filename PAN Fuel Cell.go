@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/brutella/can"
 	"log"
+	"math"
 	"time"
 
 	//	"log"
@@ -53,15 +54,15 @@ func (t *OutputControlType) GetPowerDemand() float64 {
 	return float64(t.PowerDemand) / 10.0
 }
 
-func (t *OutputControlType) UpdateFuelCell(bus *CANBus) error {
+func (t *OutputControlType) UpdateFuelCell(bus *CANBus, id uint32) error {
 	var frame can.Frame
 
-	frame.ID = CanOutputControlMsg
+	frame.ID = id
 	frame.Length = 8
 	frame.Data[0] = byte(t.FuelCellRunEnable)
 	frame.Data[1] = t.PowerDemand
 	frame.Data[2] = byte(t.ExhaustMode)
-	return bus.bus.Publish(frame)
+	return bus.Publish(frame)
 }
 
 const CanBatteryVoltageLimitsMsg = 0x961088C2
@@ -73,10 +74,10 @@ type BatteryVoltageLimitsType struct {
 }
 
 // UpdateFuelCell sends the frame to the CAN bus
-func (t *BatteryVoltageLimitsType) UpdateFuelCell(bus *CANBus) error {
+func (t *BatteryVoltageLimitsType) UpdateFuelCell(bus *CANBus, id uint32) error {
 	var frame can.Frame
 
-	frame.ID = CanBatteryVoltageLimitsMsg
+	frame.ID = id
 	frame.Length = 8
 	binary.LittleEndian.PutUint16(frame.Data[0:2], t.BMSHighVoltage)
 	binary.LittleEndian.PutUint16(frame.Data[2:4], t.BMSLowVoltage)
@@ -85,26 +86,29 @@ func (t *BatteryVoltageLimitsType) UpdateFuelCell(bus *CANBus) error {
 	} else {
 		frame.Data[4] = 0
 	}
-	return bus.bus.Publish(frame)
+	return bus.Publish(frame)
 }
 
 type PowerModeStateType byte
 
-//const (
-//	PMOff = iota
-//	PMInit
-//	PMH2Purge
-//	PMStartup
-//	PMAirPurge
-//	PMH2LeakCheck
-//	PMManual
-//	PMEmergencyShut
-//	PMFault
-//	PM_Shutdown
-//)
+const (
+	PMOff PowerModeStateType = iota
+	PMInit
+	PMH2Purge
+	PMStartup
+	PMAirPurge
+	PMH2LeakCheck
+	PMManual
+	PMEmergencyShut
+	PMFault
+	PMShutdown
+)
 
 func (pm PowerModeStateType) String() string {
 	modeStates := [...]string{"Off", "Standby", "Hydrogen intake", "Start", "AirPurge", "Hydrogen leak check", "manual", "emergency stop", "fault", "shutdown"}
+	if int(pm) >= len(modeStates) {
+		return fmt.Sprintf("unknown (%d)", pm)
+	}
 	return modeStates[pm]
 }
 
@@ -117,16 +121,21 @@ type PowerModeType struct {
 	RunStage       byte
 }
 
-func (t *PowerModeType) Load(data [8]byte) {
+func (t *PowerModeType) Load(data [8]byte, fc *PANFuelCell) {
 	t.PowerModeState = PowerModeStateType(data[0])
 	t.FaultLevel = data[1]
 	t.FaultCode = binary.LittleEndian.Uint16(data[2:4])
 	t.RunStage = data[4]
-	dbRecord.mu.Lock()
-	defer dbRecord.mu.Unlock()
-	dbRecord.PowerModeState = data[0]
-	dbRecord.RunStage = data[4]
-	dbRecord.FaultLevel = data[1]
+	faults := make(map[string]string)
+	if t.FaultLevel != 0 || t.FaultCode != 0 {
+		faults[fmt.Sprintf("L%d-0x%04X", t.FaultLevel, t.FaultCode)] = fmt.Sprintf("Fault level %d, code 0x%04X", t.FaultLevel, t.FaultCode)
+	}
+	Events.Update(fc.eventSource(EventSourceFault), faults)
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.PowerModeState = data[0]
+	fc.record.RunStage = data[4]
+	fc.record.FaultLevel = data[1]
 }
 
 const CanPressuresMsg = 0x961088A2
@@ -138,32 +147,32 @@ type PressuresType struct {
 	H2AirPressureDiff uint16 // Hydrogen air pressure difference
 }
 
-func (t *PressuresType) Load(data [8]byte) {
+func (t *PressuresType) Load(data [8]byte, fc *PANFuelCell) {
 	t.H2Pressure = binary.LittleEndian.Uint16(data[0:2])
 	t.AirPressure = binary.LittleEndian.Uint16(data[2:4])
 	t.CoolantPressure = binary.LittleEndian.Uint16(data[4:6])
 	t.H2AirPressureDiff = binary.LittleEndian.Uint16(data[6:8])
-	dbRecord.mu.Lock()
-	defer dbRecord.mu.Unlock()
-	dbRecord.HydrogenPressure = t.H2Pressure
-	dbRecord.AirPressure = t.AirPressure
-	dbRecord.CoolantPressure = t.CoolantPressure
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.HydrogenPressure = t.H2Pressure
+	fc.record.AirPressure = t.AirPressure
+	fc.record.CoolantPressure = t.CoolantPressure
 }
 
 func (t *PressuresType) GetH2Pressure() float64 {
-	return float64(t.H2Pressure) / 10.0
+	return (float64(t.H2Pressure) - 500) / 10.0
 }
 
 func (t *PressuresType) GetAirPressure() float64 {
-	return float64(t.AirPressure) / 10.0
+	return (float64(t.AirPressure) - 500) / 10.0
 }
 
 func (t *PressuresType) GetCoolantPressure() float64 {
-	return float64(t.CoolantPressure) / 10.0
+	return (float64(t.CoolantPressure) - 500) / 10.0
 }
 
 func (t *PressuresType) GetH2AirPressureDiff() float64 {
-	return float64(t.H2AirPressureDiff) / 10.0
+	return (float64(t.H2AirPressureDiff) - 50) / 10.0
 }
 
 const CanStackCoolantMsg = 0x961088A3
@@ -175,33 +184,33 @@ type StackCoolantType struct {
 	AmbientTemp    uint16 // Ambient temperature
 }
 
-func (t *StackCoolantType) Load(data [8]byte) {
+func (t *StackCoolantType) Load(data [8]byte, fc *PANFuelCell) {
 	t.CoolantInTemp = binary.LittleEndian.Uint16(data[0:2])
 	t.CoolantOutTemp = binary.LittleEndian.Uint16(data[2:4])
 	t.AirTemp = binary.LittleEndian.Uint16(data[4:6])
 	t.AmbientTemp = binary.LittleEndian.Uint16(data[6:8])
-	dbRecord.mu.Lock()
-	defer dbRecord.mu.Unlock()
-	dbRecord.CoolantInlTemp = t.CoolantInTemp
-	dbRecord.CoolantOutTemp = t.CoolantOutTemp
-	dbRecord.AirinletTemp = t.AirTemp
-	dbRecord.AmbientTemp = t.AmbientTemp
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.CoolantInlTemp = t.CoolantInTemp
+	fc.record.CoolantOutTemp = t.CoolantOutTemp
+	fc.record.AirinletTemp = t.AirTemp
+	fc.record.AmbientTemp = t.AmbientTemp
 }
 
 func (t *StackCoolantType) GetCoolantInTemp() float64 {
-	return float64(t.CoolantInTemp) / 10.0
+	return (float64(t.CoolantInTemp) - 400) / 10.0
 }
 
 func (t *StackCoolantType) GetCoolantOutTemp() float64 {
-	return float64(t.CoolantOutTemp) / 10.0
+	return (float64(t.CoolantOutTemp) - 400) / 10.0
 }
 
 func (t *StackCoolantType) GetAirTemp() float64 {
-	return float64(t.AirTemp) / 10.0
+	return (float64(t.AirTemp) - 400) / 10.0
 }
 
 func (t *StackCoolantType) GetAmbientTemp() float64 {
-	return float64(t.AmbientTemp) / 10.0
+	return (float64(t.AmbientTemp) - 400) / 10.0
 }
 
 const CanAirFlowMsg = 0x961088A4
@@ -210,11 +219,11 @@ type AirFlowType struct {
 	Flow uint16 //Air flow Lpm * 10
 }
 
-func (t *AirFlowType) Load(data [8]byte) {
+func (t *AirFlowType) Load(data [8]byte, fc *PANFuelCell) {
 	t.Flow = binary.LittleEndian.Uint16(data[4:6])
-	dbRecord.mu.Lock()
-	dbRecord.mu.Unlock()
-	dbRecord.AirFlow = t.Flow
+	fc.record.mu.Lock()
+	fc.record.mu.Unlock()
+	fc.record.AirFlow = t.Flow
 }
 
 func (t *AirFlowType) GetFlow() float64 {
@@ -227,8 +236,12 @@ type AlarmsType struct {
 	bitMap uint32
 }
 
-func (al *AlarmsType) Load(data [8]byte) {
+func (al *AlarmsType) Load(data [8]byte, fc *PANFuelCell) {
 	al.bitMap = binary.LittleEndian.Uint32(data[0:4])
+	Events.Update(fc.eventSource(EventSourceAlarm), alarmEvents(al.bitMap))
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.Alarms = al.bitMap
 }
 
 const AlarmVoltageLow = 0b00000000000000000000000000000001
@@ -262,97 +275,51 @@ const AlarmH2AirDiffHighPlus = 0b00001000000000000000000000000000
 const AlarmStartUploss = 0b00010000000000000000000000000000
 const AlarmH2Leakageloss = 0b00100000000000000000000000000000
 
+/*
+alarmDescriptions lists the alarm bits in the order they are reported
+*/
+var alarmDescriptions = []struct {
+	bit  uint32
+	text string
+}{
+	{AlarmAirPressureLow, "Abnormal low air pressure"},
+	{AlarmAirPressureHigh, "Abnormal high air pressure"},
+	{AlarmAirTempHigh, "Abnormally high air temperature"},
+	{AlarmCoolantTempOutDiff, "Abnormal temperature difference between inlet and outlet"},
+	{AlarmCoolantTempHigh, "Abnormally high outlet water temperature"},
+	{AlarmCoolantPressureHigh, "Abnormal high cooling water pressure"},
+	{AlarmCellVoltageHigh, "Stack cell high voltage abnormality"},
+	{AlarmDcdcFault, "DC to DC Converter Fault"},
+	{AlarmDcdcCommunicationFault, "DC to DC Converter Communication Fault"},
+	{AlarmFcuToVcuFault, "FCU communication abnormal"},
+	{AlarmH2AirDiffHighMinus, "Abnormal large hydrogen-air pressure difference (negative direction)"},
+	{AlarmH2AirDiffHighPlus, "Abnormal hydrogen-air pressure difference (forward direction)"},
+	{AlarmH2concentration, "Abnormal hydrogen concentration in the module"},
+	{AlarmH2CirculatingPumpFault, "Abnormal hydrogen pump"},
+	{AlarmH2Leakageloss, "Hydrogen leak check failed"},
+	{AlarmH2OutPressureLow, "H2 Outlet Pressure Low"},
+	{AlarmH2PressureHigh, "Abnormally high hydrogen pressure"},
+	{AlarmH2PressureSensorFault, "The hydrogen outlet pressure sensor is abnormal"},
+	{AlarmH2SOCLow, "Hydrogen tank SOC is too low"},
+	{AlarmH2SPCheckFault, "Hydrogen pressure sensor self-test is abnormal"},
+	{AlarmH2TankLowPressure, "Abnormal low pressure of hydrogen tank"},
+	{AlarmH2TankMidPressure, "Abnormal pressure in the hydrogen tank"},
+	{AlarmH2TankHighPressure, "Abnormal high pressure of hydrogen tank"},
+	{AlarmH2TankTemp, "Abnormal temperature of hydrogen tank"},
+	{AlarmIsoLow, "Abnormal low insulation"},
+	{AlarmPtcFault, "Heater failure"},
+	{AlarmStartUploss, "Low starting hydrogen pressure (below 20KPA)"},
+	{AlarmTempSensorFault, "Abnormal temperature sensor"},
+	{AlarmVoltageLow, "Single cell voltage undervoltage"},
+	{AlarmWaterPumpFault, "Water pump failure"},
+}
+
 func (al *AlarmsType) Text() []string {
 	alarmText := make([]string, 0)
-	if (al.bitMap & AlarmAirPressureLow) != 0 {
-		alarmText = append(alarmText, "Abnormal low air pressure")
-	}
-	if (al.bitMap & AlarmAirPressureHigh) != 0 {
-		alarmText = append(alarmText, "Abnormal high air pressure")
-	}
-	if (al.bitMap & AlarmAirTempHigh) != 0 {
-		alarmText = append(alarmText, "Abnormally high air temperature")
-	}
-	if (al.bitMap & AlarmCoolantTempOutDiff) != 0 {
-		alarmText = append(alarmText, "Abnormal temperature difference between inlet and outlet")
-	}
-	if (al.bitMap & AlarmCoolantTempHigh) != 0 {
-		alarmText = append(alarmText, "Abnormally high outlet water temperature")
-	}
-	if (al.bitMap & AlarmCoolantPressureHigh) != 0 {
-		alarmText = append(alarmText, "Abnormal high cooling water pressure")
-	}
-	if (al.bitMap & AlarmCellVoltageHigh) != 0 {
-		alarmText = append(alarmText, "Stack cell high voltage abnormality")
-	}
-	if (al.bitMap & AlarmDcdcFault) != 0 {
-		alarmText = append(alarmText, "DC to DC Converter Fault")
-	}
-	if (al.bitMap & AlarmDcdcCommunicationFault) != 0 {
-		alarmText = append(alarmText, "DC to DC Converter Communication Fault")
-	}
-	if (al.bitMap & AlarmFcuToVcuFault) != 0 {
-		alarmText = append(alarmText, "FCU communication abnormal")
-	}
-	if (al.bitMap & AlarmH2AirDiffHighMinus) != 0 {
-		alarmText = append(alarmText, "Abnormal large hydrogen-air pressure difference (negative direction)")
-	}
-	if (al.bitMap & AlarmH2AirDiffHighPlus) != 0 {
-		alarmText = append(alarmText, "Abnormal hydrogen-air pressure difference (forward direction)")
-	}
-	if (al.bitMap & AlarmH2concentration) != 0 {
-		alarmText = append(alarmText, "Abnormal hydrogen concentration in the module")
-	}
-	if (al.bitMap & AlarmH2CirculatingPumpFault) != 0 {
-		alarmText = append(alarmText, "Abnormal hydrogen pump")
-	}
-	if (al.bitMap & AlarmH2Leakageloss) != 0 {
-		alarmText = append(alarmText, "Hydrogen leak check failed")
-	}
-	if (al.bitMap & AlarmH2OutPressureLow) != 0 {
-		alarmText = append(alarmText, "H2 Outlet Pressure Low")
-	}
-	if (al.bitMap & AlarmH2PressureHigh) != 0 {
-		alarmText = append(alarmText, "Abnormally high hydrogen pressure")
-	}
-	if (al.bitMap & AlarmH2PressureSensorFault) != 0 {
-		alarmText = append(alarmText, "The hydrogen outlet pressure sensor is abnormal")
-	}
-	if (al.bitMap & AlarmH2SOCLow) != 0 {
-		alarmText = append(alarmText, "Hydrogen tank SOC is too low")
-	}
-	if (al.bitMap & AlarmH2SPCheckFault) != 0 {
-		alarmText = append(alarmText, "Hydrogen pressure sensor self-test is abnormal")
-	}
-	if (al.bitMap & AlarmH2TankLowPressure) != 0 {
-		alarmText = append(alarmText, "Abnormal low pressure of hydrogen tank")
-	}
-	if (al.bitMap & AlarmH2TankMidPressure) != 0 {
-		alarmText = append(alarmText, "Abnormal pressure in the hydrogen tank")
-	}
-	if (al.bitMap & AlarmH2TankHighPressure) != 0 {
-		alarmText = append(alarmText, "Abnormal high pressure of hydrogen tank")
-	}
-	if (al.bitMap & AlarmH2TankTemp) != 0 {
-		alarmText = append(alarmText, "Abnormal temperature of hydrogen tank")
-	}
-	if (al.bitMap & AlarmIsoLow) != 0 {
-		alarmText = append(alarmText, "Abnormal low insulation")
-	}
-	if (al.bitMap & AlarmPtcFault) != 0 {
-		alarmText = append(alarmText, "Heater failure")
-	}
-	if (al.bitMap & AlarmStartUploss) != 0 {
-		alarmText = append(alarmText, "Low starting hydrogen pressure (below 20KPA)")
-	}
-	if (al.bitMap & AlarmTempSensorFault) != 0 {
-		alarmText = append(alarmText, "Abnormal temperature sensor")
-	}
-	if (al.bitMap & AlarmVoltageLow) != 0 {
-		alarmText = append(alarmText, "Single cell voltage undervoltage")
-	}
-	if (al.bitMap & AlarmWaterPumpFault) != 0 {
-		alarmText = append(alarmText, "Water pump failure")
+	for _, alarm := range alarmDescriptions {
+		if (al.bitMap & alarm.bit) != 0 {
+			alarmText = append(alarmText, alarm.text)
+		}
 	}
 	return alarmText
 }
@@ -365,16 +332,16 @@ type StackOutputType struct {
 	Power   uint32 //Stack power
 }
 
-func (t *StackOutputType) Load(data [8]byte) {
+func (t *StackOutputType) Load(data [8]byte, fc *PANFuelCell) {
 	t.Voltage = binary.LittleEndian.Uint16(data[0:2])
 	t.Current = binary.LittleEndian.Uint16(data[2:4])
 	// Power is actually a 24 bit value
 	t.Power = uint32(data[4]) | uint32(data[5])<<8 | uint32(data[6])<<16
 
-	dbRecord.mu.Lock()
-	defer dbRecord.mu.Unlock()
-	dbRecord.StackVoltage = t.Voltage
-	dbRecord.StackCurrent = t.Current
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.StackVoltage = t.Voltage
+	fc.record.StackCurrent = t.Current
 }
 
 func (t *StackOutputType) GetVoltage() float64 {
@@ -399,16 +366,16 @@ type CffMsgType struct {
 	LSBCheckSumq     byte
 }
 
-func (t *CffMsgType) Load(data [8]byte) {
+func (t *CffMsgType) Load(data [8]byte, fc *PANFuelCell) {
 	t.GasConcentration = data[0]
 	t.MSBSide = data[1]
 	t.CycleCounter = data[2] & 0x0f
 	t.SensorFaultCode = (data[2] & 0x30) >> 4
 	t.LSBCheckSumq = data[4]
 
-	dbRecord.mu.Lock()
-	defer dbRecord.mu.Unlock()
-	dbRecord.HydrogenConcentration = t.GasConcentration
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.HydrogenConcentration = t.GasConcentration
 }
 
 func (t *CffMsgType) GetGasConcentration() int16 {
@@ -425,16 +392,21 @@ type InsulationType struct {
 	IsolationLife        uint8
 }
 
-func (t *InsulationType) Load(data [8]byte) {
+func (t *InsulationType) Load(data [8]byte, fc *PANFuelCell) {
 	t.InsulationStatusCode = data[0] & 0x0f
 	t.InsulationStatus = (data[0] & 0x30) >> 4
 	t.InsulationResistance = binary.LittleEndian.Uint16(data[1:3])
 	t.IsolationBattVolt = binary.LittleEndian.Uint16(data[3:5])
 	t.IsolationLife = data[7]
+	alarms := make(map[string]string)
+	if t.InsulationStatus != 0 && !currentSettings.FuelCellSettings.IgnoreIsoLow {
+		alarms[fmt.Sprintf("%d", t.InsulationStatus)] = t.getFault()
+	}
+	Events.Update(fc.eventSource(EventSourceInsulation), alarms)
 
-	dbRecord.mu.Lock()
-	defer dbRecord.mu.Unlock()
-	dbRecord.InsulationResistance = t.InsulationResistance
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.InsulationResistance = t.InsulationResistance
 }
 
 func (t *InsulationType) getStatus() string {
@@ -494,9 +466,10 @@ type StackCellsType struct {
 	loop                       uint8
 }
 
-func (t *StackCellsType) Load(id uint32, data [8]byte) {
-	switch id {
-	case CanStackCellsID1to4Msg:
+func (t *StackCellsType) Load(id uint32, data [8]byte, fc *PANFuelCell) {
+	// Match on the PGN so a cell voltage monitor using a different source address is still decoded
+	switch pgnOf(id) {
+	case pgnOf(CanStackCellsID1to4Msg):
 		t.loop++
 		if t.loop > 4 {
 			t.loop = 0
@@ -505,59 +478,59 @@ func (t *StackCellsType) Load(id uint32, data [8]byte) {
 		t.StackCellVoltage[t.loop][1] = binary.LittleEndian.Uint16(data[2:4])
 		t.StackCellVoltage[t.loop][2] = binary.LittleEndian.Uint16(data[4:6])
 		t.StackCellVoltage[t.loop][3] = binary.LittleEndian.Uint16(data[6:8])
-	case CanStackCellsID5to8Msg:
+	case pgnOf(CanStackCellsID5to8Msg):
 		t.StackCellVoltage[t.loop][4] = binary.LittleEndian.Uint16(data[0:2])
 		t.StackCellVoltage[t.loop][5] = binary.LittleEndian.Uint16(data[2:4])
 		t.StackCellVoltage[t.loop][6] = binary.LittleEndian.Uint16(data[4:6])
 		t.StackCellVoltage[t.loop][7] = binary.LittleEndian.Uint16(data[6:8])
-	case CanStackCellsID9to12Msg:
+	case pgnOf(CanStackCellsID9to12Msg):
 		t.StackCellVoltage[t.loop][8] = binary.LittleEndian.Uint16(data[0:2])
 		t.StackCellVoltage[t.loop][9] = binary.LittleEndian.Uint16(data[2:4])
 		t.StackCellVoltage[t.loop][10] = binary.LittleEndian.Uint16(data[4:6])
 		t.StackCellVoltage[t.loop][11] = binary.LittleEndian.Uint16(data[6:8])
-	case CanStackCellsID13to16Msg:
+	case pgnOf(CanStackCellsID13to16Msg):
 		t.StackCellVoltage[t.loop][12] = binary.LittleEndian.Uint16(data[0:2])
 		t.StackCellVoltage[t.loop][13] = binary.LittleEndian.Uint16(data[2:4])
 		t.StackCellVoltage[t.loop][14] = binary.LittleEndian.Uint16(data[4:6])
 		t.StackCellVoltage[t.loop][15] = binary.LittleEndian.Uint16(data[6:8])
-	case CanStackCellsID17to20Msg:
+	case pgnOf(CanStackCellsID17to20Msg):
 		t.StackCellVoltage[t.loop][16] = binary.LittleEndian.Uint16(data[0:2])
 		t.StackCellVoltage[t.loop][17] = binary.LittleEndian.Uint16(data[2:4])
 		t.StackCellVoltage[t.loop][18] = binary.LittleEndian.Uint16(data[4:6])
 		t.StackCellVoltage[t.loop][19] = binary.LittleEndian.Uint16(data[6:8])
-	case CanStackCellsID21to24Msg:
+	case pgnOf(CanStackCellsID21to24Msg):
 		t.StackCellVoltage[t.loop][20] = binary.LittleEndian.Uint16(data[0:2])
 		t.StackCellVoltage[t.loop][21] = binary.LittleEndian.Uint16(data[2:4])
 		t.StackCellVoltage[t.loop][22] = binary.LittleEndian.Uint16(data[4:6])
 		t.StackCellVoltage[t.loop][23] = binary.LittleEndian.Uint16(data[6:8])
-	case CanStackCellsID25to28Msg:
+	case pgnOf(CanStackCellsID25to28Msg):
 		t.StackCellVoltage[t.loop][24] = binary.LittleEndian.Uint16(data[0:2])
 		t.StackCellVoltage[t.loop][25] = binary.LittleEndian.Uint16(data[2:4])
 		t.StackCellVoltage[t.loop][26] = binary.LittleEndian.Uint16(data[4:6])
 		t.StackCellVoltage[t.loop][27] = binary.LittleEndian.Uint16(data[6:8])
-	case CanStackCellsID29to32Msg:
+	case pgnOf(CanStackCellsID29to32Msg):
 		t.StackCellVoltage[t.loop][28] = binary.LittleEndian.Uint16(data[0:2])
 		t.StackCellVoltage[t.loop][29] = binary.LittleEndian.Uint16(data[2:4])
 		t.StackCellVoltage[t.loop][30] = binary.LittleEndian.Uint16(data[4:6])
 		t.StackCellVoltage[t.loop][31] = binary.LittleEndian.Uint16(data[6:8])
-	case CanMaxMinCellsMsg:
+	case pgnOf(CanMaxMinCellsMsg):
 		t.MaxCellVolts = binary.LittleEndian.Uint16(data[0:2])
 		t.MinCellVolts = binary.LittleEndian.Uint16(data[2:4])
 		t.AvgCellVolts = binary.LittleEndian.Uint16(data[4:6])
 		t.IndexMaxVoltsCell = data[6]
 		t.IndexMinVoltsCell = data[7]
-		dbRecord.mu.Lock()
-		defer dbRecord.mu.Unlock()
-		dbRecord.MaxCellVolts = t.MaxCellVolts
-		dbRecord.MinCellVolts = t.MinCellVolts
-		dbRecord.IdxMinCell = t.IndexMinVoltsCell
-		dbRecord.IdxMaxCell = t.IndexMaxVoltsCell
+		fc.record.mu.Lock()
+		defer fc.record.mu.Unlock()
+		fc.record.MaxCellVolts = t.MaxCellVolts
+		fc.record.MinCellVolts = t.MinCellVolts
+		fc.record.IdxMinCell = t.IndexMinVoltsCell
+		fc.record.IdxMaxCell = t.IndexMaxVoltsCell
 		if t.loop == 0 {
 			for i := 0; i < len(t.StackCellVoltage[0]); i++ {
-				dbRecord.CellVoltages[i] = t.GetStackCellVoltage(i)
+				fc.record.CellVoltages[i] = int16(math.Round(fc.cellMV(i)))
 			}
 		}
-	case CanTotalStackVoltageMsg:
+	case pgnOf(CanTotalStackVoltageMsg):
 		t.TotakStackVoltage = binary.LittleEndian.Uint16(data[0:2])
 		t.StdDeviation = binary.LittleEndian.Uint16(data[2:4])
 		t.Temperature = binary.LittleEndian.Uint16(data[4:6])
@@ -567,11 +540,16 @@ func (t *StackCellsType) Load(id uint32, data [8]byte) {
 }
 
 func (t *StackCellsType) GetStackCellVoltage(cell int) int16 {
+	return int16(t.averageRaw(cell)) - 5000
+}
+
+// averageRaw returns the unscaled cell voltage averaged over the last five readings
+func (t *StackCellsType) averageRaw(cell int) float64 {
 	var volts = int32(0)
 	for idx := 0; idx < 5; idx++ {
 		volts += int32(t.StackCellVoltage[idx][cell])
 	}
-	return int16(volts/5) - 5000
+	return float64(volts / 5)
 }
 
 func (t *StackCellsType) GetMaxCellVoltage() int16 {
@@ -593,13 +571,13 @@ type ATSCoolingFanType struct {
 	Speed  uint16
 }
 
-func (t *ATSCoolingFanType) Load(data [8]byte) {
+func (t *ATSCoolingFanType) Load(data [8]byte, fc *PANFuelCell) {
 	t.Enable = binary.LittleEndian.Uint16(data[0:2])
 	t.Speed = binary.LittleEndian.Uint16(data[2:4])
 
-	dbRecord.mu.Lock()
-	defer dbRecord.mu.Unlock()
-	dbRecord.CoolantFanSpeed = t.Speed
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.CoolantFanSpeed = t.Speed
 }
 
 const CanWaterPumpMsg = 0x98FAC503
@@ -610,16 +588,16 @@ type WaterPumpType struct {
 	Current uint8
 }
 
-func (t *WaterPumpType) Load(data [8]byte) {
+func (t *WaterPumpType) Load(data [8]byte, fc *PANFuelCell) {
 	t.Speed = binary.LittleEndian.Uint16(data[0:2])
 	t.Voltage = data[2]
 	t.Current = data[3]
 
-	dbRecord.mu.Lock()
-	defer dbRecord.mu.Unlock()
-	dbRecord.CoolantPumpSpeed = t.Speed
-	dbRecord.CoolantPumpAmps = t.Current
-	dbRecord.CoolantPumpVolts = t.Voltage
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.CoolantPumpSpeed = t.Speed
+	fc.record.CoolantPumpAmps = t.Current
+	fc.record.CoolantPumpVolts = t.Voltage
 }
 
 func (t *WaterPumpType) getVoltage() float64 {
@@ -639,17 +617,17 @@ type DCDCConverterType struct {
 	OutputVoltage uint16
 }
 
-func (t *DCDCConverterType) Load(data [8]byte) {
+func (t *DCDCConverterType) Load(data [8]byte, fc *PANFuelCell) {
 	t.InputCurrent = binary.LittleEndian.Uint16(data[0:2])
 	t.InputVoltage = binary.LittleEndian.Uint16(data[2:4])
 	t.OutputCurrent = binary.LittleEndian.Uint16(data[4:6])
 	t.OutputVoltage = binary.LittleEndian.Uint16(data[6:8])
-	dbRecord.mu.Lock()
-	defer dbRecord.mu.Unlock()
-	dbRecord.DCDCInVolts = t.InputVoltage
-	dbRecord.DCDCOutVolts = t.OutputVoltage
-	dbRecord.DCDCInAmps = t.InputCurrent
-	dbRecord.DCDCOutAmps = t.OutputCurrent
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.DCDCInVolts = t.InputVoltage
+	fc.record.DCDCOutVolts = t.OutputVoltage
+	fc.record.DCDCInAmps = t.InputCurrent
+	fc.record.DCDCOutAmps = t.OutputCurrent
 }
 
 func (t *DCDCConverterType) GetInputCurrent() float64 {
@@ -657,7 +635,7 @@ func (t *DCDCConverterType) GetInputCurrent() float64 {
 }
 
 func (t *DCDCConverterType) GetOutputCurrent() float64 {
-	return float64(t.OutputCurrent) / 10.0
+	return float64(t.OutputCurrent) / 100.0
 }
 
 func (t *DCDCConverterType) GetInputVoltage() float64 {
@@ -665,7 +643,7 @@ func (t *DCDCConverterType) GetInputVoltage() float64 {
 }
 
 func (t *DCDCConverterType) GetOutputVoltage() float64 {
-	return float64(t.OutputVoltage) / 100.0
+	return float64(t.OutputVoltage) / 10.0
 }
 
 const CanDCOutputMsg = 0x98FFB587
@@ -682,7 +660,7 @@ type DCOutputType struct {
 	LIFE         uint8
 }
 
-func (t *DCOutputType) Load(data [8]byte) {
+func (t *DCOutputType) Load(data [8]byte, fc *PANFuelCell) {
 	t.Temp = data[0]
 	t.Status = data[1] & 0x0f
 	t.FaultLevel = (data[1] & 0xf0) >> 4
@@ -692,9 +670,18 @@ func (t *DCOutputType) Load(data [8]byte) {
 	t.InputVoltage = data[5]
 	t.InternalTest = data[6]
 	t.LIFE = data[7]
-	dbRecord.mu.Lock()
-	defer dbRecord.mu.Unlock()
-	dbRecord.DCDCTemp = t.Temp
+	errors := make(map[string]string)
+	if t.ErrorCode != 0 {
+		description := t.GetFaultCode()
+		if description == "" {
+			description = "Unknown error"
+		}
+		errors[fmt.Sprintf("0x%02X", t.ErrorCode)] = fmt.Sprintf("%s, fault level %d", description, t.FaultLevel)
+	}
+	Events.Update(fc.eventSource(EventSourceDCOutput), errors)
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.DCDCTemp = t.Temp
 }
 
 func (t *DCOutputType) GetTemperature() int16 {
@@ -827,11 +814,108 @@ type PANFuelCell struct {
 	DCOutput      DCOutputType
 	BMSSettings   BMSSettingsType
 	Control       PanSettingsType
+	number        int   // 0 for the main fuel cell
+	offset        uint8 // Added to the source address of every PAN message
+	record        *PANDatabaseRecordType
+	signals       *DBCValuesType // Decoded using the DBC definitions
+}
+
+// The highest source address used by the PAN messages. SourceOffset must not take it past 0xFF
+const panMaxSourceAddress = 0xC2
+
+// Every CAN ID sent to or received from a PAN fuel cell
+var panMessageIDs = []uint32{CanOutputControlMsg, CanBatteryVoltageLimitsMsg, CanPowerModeMsg, CanPressuresMsg,
+	CanStackCoolantMsg, CanAirFlowMsg, CanAlarmsMsg, CanStackOutputMsg, CanCff1Msg, CanInsulationMsg,
+	CanStackCellsID1to4Msg, CanStackCellsID5to8Msg, CanStackCellsID9to12Msg, CanStackCellsID13to16Msg,
+	CanStackCellsID17to20Msg, CanStackCellsID21to24Msg, CanStackCellsID25to28Msg, CanStackCellsID29to32Msg,
+	CanMaxMinCellsMsg, CanTotalStackVoltageMsg, CanATSCoolingFanMsg, CanWaterPumpMsg, CanDCDCConverterMsg,
+	CanDCOutputMsg, CanKeyOnMsg, CanRunTimeMsg, CanBMSSettingsMsg}
+
+/*
+panOffsetsClash is true if two PAN fuel cells on the same bus with these source offsets would share a CAN ID.
+The PAN messages use a run of source addresses from 0xA1 so the offsets must be at least 0x22 apart.
+*/
+func panOffsetsClash(a, b uint8) bool {
+	ids := make(map[uint32]bool, len(panMessageIDs))
+	for _, id := range panMessageIDs {
+		ids[id+uint32(a)] = true
+	}
+	for _, id := range panMessageIDs {
+		if ids[id+uint32(b)] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+newPANFuelCell returns the driver for a PAN fuel cell. The main fuel cell uses the FuelCell and dbRecord globals.
+*/
+func newPANFuelCell(number int, settings FuelCellUnitSettingsType) FuelCellDriver {
+	fc := &FuelCell
+	if number == 0 {
+		fc.record = &dbRecord
+	} else {
+		fc = &PANFuelCell{record: new(PANDatabaseRecordType), offset: settings.SourceOffset}
+	}
+	fc.number = number
+	fc.signals = NewDBCValues()
+	fc.SystemInfo.exhaustFlagTimer = time.AfterFunc(time.Second, func() {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		fc.SystemInfo.ExhaustFlag = false
+	})
+	return fc
+}
+
+// canID returns the CAN ID used by this fuel cell for the given PAN message
+func (fc *PANFuelCell) canID(id uint32) uint32 {
+	return id + uint32(fc.offset)
+}
+
+/*
+addHandler registers the handler for the PAN message from this fuel cell. The frame is decoded into the fuel cell's
+signal values first, using the definition for the default CAN ID whatever source address it came from.
+*/
+func (fc *PANFuelCell) addHandler(bus *CANBus, message uint32, anySource bool, handler FrameHandler) {
+	bus.J1939.AddHandlerForID(fc.canID(message), anySource, func(frame can.Frame, bus *CANBus) {
+		fc.signals.Decode(CANDatabase(), message, frame)
+		handler(frame, bus)
+	})
+}
+
+// DecodedSignals returns the values decoded from this fuel cell's frames using the DBC definitions
+func (fc *PANFuelCell) DecodedSignals() *DBCValuesType {
+	return fc.signals
+}
+
+// freshnessName returns the name used to track the given message from this fuel cell
+func (fc *PANFuelCell) freshnessName(message string) string {
+	return fuelCellFreshnessName(fc.number, message)
+}
+
+// eventSource returns the event source used for this fuel cell
+func (fc *PANFuelCell) eventSource(source string) string {
+	return fuelCellFreshnessName(fc.number, source)
 }
 
-func (fc *PANFuelCell) init(canBus *CANBus) {
-	fc.bus = canBus
-	fc.SystemInfo.exhaustFlagTimer = time.AfterFunc(time.Second, func() { fc.SystemInfo.ExhaustFlag = false })
+/*
+signalOr returns the named signal as decoded from this fuel cell's frames using the DBC definitions. If the signal is
+not defined, or has not been received yet, the fallback value is returned.
+*/
+func (fc *PANFuelCell) signalOr(name string, fallback float64) float64 {
+	if value, found := fc.signals.Signal(name); found {
+		return value.Value
+	}
+	return fallback
+}
+
+// cellMV returns the cell voltage averaged over the last five readings and scaled using the DBC definition
+func (fc *PANFuelCell) cellMV(cell int) float64 {
+	if mV, found := CANDatabase().Scale(fmt.Sprintf("Cell%02dVolts", cell), fc.StackCells.averageRaw(cell)); found {
+		return mV
+	}
+	return float64(fc.StackCells.GetStackCellVoltage(cell))
 }
 
 func (fc *PANFuelCell) getJSON() (string, error) {
@@ -846,15 +930,19 @@ func (fc *PANFuelCell) getJSON() (string, error) {
 	}
 }
 
-func (fc *PANFuelCell) setTargetPower(kw float64) error {
-	if (kw <= 10.0) && (kw >= 0) {
+func (fc *PANFuelCell) SetTargetPower(kw float64) error {
+	if (kw <= fc.RatedKW()) && (kw >= 0) {
 		fc.Control.TargetPower = kw
 		return nil
 	}
-	return fmt.Errorf("valid range for target power is 0kW to 10kW. %01fkW was requested", kw)
+	return fmt.Errorf("valid range for target power is 0kW to %0.0fkW. %01fkW was requested", fc.RatedKW(), kw)
+}
+
+func (fc *PANFuelCell) RatedKW() float64 {
+	return 10.0
 }
 
-func (fc *PANFuelCell) setTargetBattHigh(volts float64) error {
+func (fc *PANFuelCell) SetTargetBattHigh(volts float64) error {
 	if (volts >= 35) && (volts <= 70) && (volts >= fc.Control.TargetBatteryLow) {
 		fc.Control.TargetBatteryHigh = volts
 		return nil
@@ -862,7 +950,7 @@ func (fc *PANFuelCell) setTargetBattHigh(volts float64) error {
 	return fmt.Errorf("valid range for battery voltage high is 35V to 70V and must be above or equal to battery voltage low. %01fV was requested", volts)
 }
 
-func (fc *PANFuelCell) setTargetBattLow(volts float64) error {
+func (fc *PANFuelCell) SetTargetBattLow(volts float64) error {
 	if (volts >= 35) && (volts <= 70) {
 		fc.Control.TargetBatteryLow = volts
 		if volts > fc.Control.TargetBatteryHigh {
@@ -873,42 +961,116 @@ func (fc *PANFuelCell) setTargetBattLow(volts float64) error {
 	return fmt.Errorf("valid range for battery voltage low is 35V to 70V and must be below or equal to battery voltage high. %01fV was requested", volts)
 }
 
-func (fc *PANFuelCell) start() {
+func (fc *PANFuelCell) Start() {
 	fc.Control.FuelCellOn = true
-	if err := fc.updateOutput(); err != nil {
+	if err := fc.UpdateOutput(); err != nil {
 		log.Println(err)
 	}
 	log.Println("Start the fuel cell")
 }
 
-func (fc *PANFuelCell) stop() {
+func (fc *PANFuelCell) Stop() {
 	fc.Control.FuelCellOn = false
-	if err := fc.updateOutput(); err != nil {
+	if err := fc.UpdateOutput(); err != nil {
 		log.Println(err)
 	}
 	log.Println("Stop the fuel cell")
 }
 
-func (fc *PANFuelCell) exhaustOpen() {
-	fc.Control.Exhaust = true
-	if err := fc.updateOutput(); err != nil {
+func (fc *PANFuelCell) SetExhaust(open bool) {
+	fc.Control.Exhaust = open
+	if err := fc.UpdateOutput(); err != nil {
 		log.Println(err)
 	}
-	log.Println("Exhaust is open")
+	if open {
+		log.Println("Exhaust is open")
+	} else {
+		log.Println("Exhaust is closed")
+	}
 }
 
-func (fc *PANFuelCell) exhaustClose() {
-	fc.Control.Exhaust = false
-	if err := fc.updateOutput(); err != nil {
-		log.Println(err)
+func (fc *PANFuelCell) Name() string {
+	return "PAN"
+}
+
+func (fc *PANFuelCell) Attach(bus *CANBus) {
+	fc.bus = bus
+}
+
+func (fc *PANFuelCell) Commands() FuelCellCommandsType {
+	return FuelCellCommandsType{TargetPower: fc.Control.TargetPower, TargetBatteryHigh: fc.Control.TargetBatteryHigh,
+		TargetBatteryLow: fc.Control.TargetBatteryLow, FuelCellOn: fc.Control.FuelCellOn, Exhaust: fc.Control.Exhaust}
+}
+
+func (fc *PANFuelCell) Running() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.SystemInfo.Run
+}
+
+func (fc *PANFuelCell) AlarmText() []string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.Alarms.Text()
+}
+
+/*
+Measurements returns the values shared by all fuel cell drivers. Cell voltages are in mV.
+*/
+func (fc *PANFuelCell) Measurements() FuelCellMeasurementsType {
+	var m FuelCellMeasurementsType
+	m.ModeValid = !Freshness.IsStale(fc.freshnessName("PowerMode"))
+	m.StackValid = !Freshness.IsStale(fc.freshnessName("StackOutput"))
+	m.OutputValid = !Freshness.IsStale(fc.freshnessName("DCDCConverter"))
+	m.CellsValid = !Freshness.IsStale(fc.freshnessName("StackCells"))
+	m.PressuresValid = !Freshness.IsStale(fc.freshnessName("Pressures"))
+	m.ExhaustValid = !Freshness.IsStale(fc.freshnessName("BMSSettings"))
+	m.CellMV = make([]float64, stackCellCount)
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	m.PowerMode = fc.PowerMode.PowerModeState
+	m.FaultCode = fc.PowerMode.FaultCode
+	m.StackVolts = fc.signalOr("StackVolts", fc.StackOutput.GetVoltage())
+	m.StackAmps = fc.signalOr("StackCurrent", fc.StackOutput.GetCurrent())
+	m.OutputVolts = fc.signalOr("DCOutVolts", fc.DCDCConverter.GetOutputVoltage())
+	m.OutputAmps = fc.signalOr("DCOutAmps", fc.DCDCConverter.GetOutputCurrent())
+	for cell := range m.CellMV {
+		m.CellMV[cell] = fc.cellMV(cell)
+	}
+	m.CoolantPressure = fc.signalOr("CoolantPressure", fc.Pressures.GetCoolantPressure())
+	m.ExhaustOpen = fc.SystemInfo.ExhaustFlag
+	return m
+}
+
+func (fc *PANFuelCell) SaveToDatabase() error {
+	fc.record.fromSignals(fc.signals)
+	return fc.record.saveToDatabase()
+}
+
+/*
+PrepareDatabase prepares the insert for this fuel cell's readings. The main fuel cell logs to PANFuelCell and
+additional fuel cells to PANFuelCell<n>, which is created from PANFuelCell if it does not exist.
+*/
+func (fc *PANFuelCell) PrepareDatabase(db *sql.DB) error {
+	table := "PANFuelCell"
+	if fc.number != 0 {
+		table = fmt.Sprintf("PANFuelCell%d", fc.number)
+		if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS firefly.%s LIKE firefly.PANFuelCell", table)); err != nil {
+			return err
+		}
 	}
-	log.Println("Exhaust is closed")
+	stmt, err := db.Prepare(fmt.Sprintf(panInsertSQL, table))
+	fc.record.mu.Lock()
+	defer fc.record.mu.Unlock()
+	fc.record.stmt = stmt
+	return err
 }
 
 /**
-updateSettings sends the can control messages to the fuel cell
+UpdateSettings sends the can control messages to the fuel cell
 */
-func (fc *PANFuelCell) updateSettings() error {
+func (fc *PANFuelCell) UpdateSettings() error {
 	var limits BatteryVoltageLimitsType
 
 	// Only send settings if the fuel cell is enabled
@@ -917,7 +1079,7 @@ func (fc *PANFuelCell) updateSettings() error {
 		limits.BMSLowVoltage = uint16(fc.Control.TargetBatteryLow * 10)
 		limits.IsoFlag = currentSettings.FuelCellSettings.IgnoreIsoLow
 		if fc.bus != nil {
-			return limits.UpdateFuelCell(fc.bus)
+			return limits.UpdateFuelCell(fc.bus, fc.canID(CanBatteryVoltageLimitsMsg))
 		} else {
 			return fmt.Errorf("no active CAN bus found for the fuel cell")
 		}
@@ -925,14 +1087,14 @@ func (fc *PANFuelCell) updateSettings() error {
 	return nil
 }
 
-func (fc *PANFuelCell) updateOutput() error {
+func (fc *PANFuelCell) UpdateOutput() error {
 	var output OutputControlType
 
 	// Only send commands if the fuel cell is enabled
 	if currentSettings.FuelCellSettings.Enabled {
 		if fc.Control.FuelCellOn {
 			output.FuelCellRunEnable = StartUp
-			output.PowerDemand = uint8(fc.Control.TargetPower * 10)
+			output.PowerDemand = uint8(math.Round(PowerSharing.Demand(fc.number) * 10)) // This fuel cell's share of the ramped or load following demand
 		} else {
 			output.FuelCellRunEnable = ShutDown
 			output.PowerDemand = 0
@@ -943,7 +1105,7 @@ func (fc *PANFuelCell) updateOutput() error {
 			output.ExhaustMode = ExhaustClosed
 		}
 		if fc.bus != nil {
-			return output.UpdateFuelCell(fc.bus)
+			return output.UpdateFuelCell(fc.bus, fc.canID(CanOutputControlMsg))
 		} else {
 			return fmt.Errorf("no active CAN bus found for the fuel cell")
 		}
@@ -951,11 +1113,11 @@ func (fc *PANFuelCell) updateOutput() error {
 	return nil
 }
 
+// PanStatus adds the values only the PAN fuel cell reports to the common status
 type PanStatus struct {
-	SystemName           string
+	FuelCellStatusType
 	RunTimeHours         uint16
 	RunTimeMinutes       uint8
-	RunState             bool
 	H2Pressure           float64 // Hydrogen pressure
 	AirPressure          float64 // Air pressure
 	CoolantPressure      float64 // Coolant pressure
@@ -965,13 +1127,8 @@ type PanStatus struct {
 	AirTemp              float64
 	AmbientTemp          float64
 	AirFlow              float64
-	StackVolts           float64
-	StackCurrent         float64
-	StackPower           float64
 	DCInVolts            float64
 	DCInAmps             float64
-	DCOutVolts           float64
-	DCOutAmps            float64
 	BMSPower             float64
 	BMSHigh              float64
 	BMSLow               float64
@@ -979,13 +1136,8 @@ type PanStatus struct {
 	BMSTargetPower       float64
 	BMSTargetHigh        float64
 	BMSTargetLow         float64
-	RunStatus            string
-	Alarms               []string
 	DCOutputStatus       string
 	DCOutputFaultCode    string
-	Start                bool
-	ExhaustOpen          bool
-	Enable               bool
 	InsulationResistance uint16
 	InsulationStatus     string
 	InsulationFault      string
@@ -997,7 +1149,7 @@ type PanStatus struct {
 /*
 GetStatus sends a status block from the fuel cell
 */
-func (fc *PANFuelCell) GetStatus() PanStatus {
+func (fc *PANFuelCell) GetStatus() FuelCellStatus {
 	var status PanStatus
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
@@ -1008,27 +1160,28 @@ func (fc *PANFuelCell) GetStatus() PanStatus {
 	status.ExhaustOpen = fc.SystemInfo.ExhaustFlag
 	status.RunState = fc.SystemInfo.Run
 	status.Enable = currentSettings.FuelCellSettings.Enabled
-	status.H2Pressure = (float64(fc.Pressures.H2Pressure) - 500) / 10.0
-	status.AirPressure = (float64(fc.Pressures.AirPressure) - 500) / 10.0
-	status.CoolantPressure = (float64(fc.Pressures.CoolantPressure) - 500) / 10.0
-	status.H2AirPressureDiff = (float64(fc.Pressures.H2AirPressureDiff) - 50) / 10.0
-	status.CoolantInletTemp = (float64(fc.StackCoolant.CoolantInTemp) - 400) / 10.0
-	status.CoolantOutletTemp = (float64(fc.StackCoolant.CoolantOutTemp) - 400) / 10.0
-	status.AirTemp = (float64(fc.StackCoolant.AirTemp) - 400) / 10.0
-	status.AmbientTemp = (float64(fc.StackCoolant.AmbientTemp) - 400) / 10.0
-	status.AirFlow = float64(fc.AirFlow.Flow) / 10.0
-	status.StackVolts = float64(fc.StackOutput.Voltage) / 10.0
-	status.StackCurrent = float64(fc.StackOutput.Current) / 10.0
-	status.StackPower = float64(fc.StackOutput.Power) / 10.0
-	status.DCInVolts = float64(fc.DCDCConverter.InputVoltage) / 100.0
-	status.DCOutVolts = float64(fc.DCDCConverter.OutputVoltage) / 10.0
-	status.DCInAmps = float64(fc.DCDCConverter.InputCurrent) / 10.0
-	status.DCOutAmps = float64(fc.DCDCConverter.OutputCurrent) / 100.0
-	status.BMSPower = float64(fc.BMSSettings.TargetPowerLevel)
-	status.BMSHigh = float64(fc.BMSSettings.BMSHigh) / 10.0
-	status.BMSLow = float64(fc.BMSSettings.BMSLow) / 10.0
-	status.BMSCurrentPower = float64(fc.BMSSettings.CurrentPower)
+	status.H2Pressure = fc.signalOr("H2Pressure", (float64(fc.Pressures.H2Pressure)-500)/10.0)
+	status.AirPressure = fc.signalOr("AirPressure", (float64(fc.Pressures.AirPressure)-500)/10.0)
+	status.CoolantPressure = fc.signalOr("CoolantPressure", (float64(fc.Pressures.CoolantPressure)-500)/10.0)
+	status.H2AirPressureDiff = fc.signalOr("H2AirPressureDiff", (float64(fc.Pressures.H2AirPressureDiff)-50)/10.0)
+	status.CoolantInletTemp = fc.signalOr("CoolantInletTemp", (float64(fc.StackCoolant.CoolantInTemp)-400)/10.0)
+	status.CoolantOutletTemp = fc.signalOr("CoolantOutletTemp", (float64(fc.StackCoolant.CoolantOutTemp)-400)/10.0)
+	status.AirTemp = fc.signalOr("AirTemp", (float64(fc.StackCoolant.AirTemp)-400)/10.0)
+	status.AmbientTemp = fc.signalOr("AmbientTemp", (float64(fc.StackCoolant.AmbientTemp)-400)/10.0)
+	status.AirFlow = fc.signalOr("AirFlow", float64(fc.AirFlow.Flow)/10.0)
+	status.StackVolts = fc.signalOr("StackVolts", float64(fc.StackOutput.Voltage)/10.0)
+	status.StackCurrent = fc.signalOr("StackCurrent", float64(fc.StackOutput.Current)/10.0)
+	status.StackPower = fc.signalOr("StackPower", float64(fc.StackOutput.Power)/10.0)
+	status.DCInVolts = fc.signalOr("DCInVolts", float64(fc.DCDCConverter.InputVoltage)/100.0)
+	status.DCOutVolts = fc.signalOr("DCOutVolts", float64(fc.DCDCConverter.OutputVoltage)/10.0)
+	status.DCInAmps = fc.signalOr("DCInAmps", float64(fc.DCDCConverter.InputCurrent)/10.0)
+	status.DCOutAmps = fc.signalOr("DCOutAmps", float64(fc.DCDCConverter.OutputCurrent)/100.0)
+	status.BMSPower = fc.signalOr("BMSPower", float64(fc.BMSSettings.TargetPowerLevel))
+	status.BMSHigh = fc.signalOr("BMSHigh", float64(fc.BMSSettings.BMSHigh)/10.0)
+	status.BMSLow = fc.signalOr("BMSLow", float64(fc.BMSSettings.BMSLow)/10.0)
+	status.BMSCurrentPower = fc.signalOr("BMSCurrentPower", float64(fc.BMSSettings.CurrentPower))
 	status.BMSTargetPower = fc.Control.TargetPower
+	status.PowerDemand = PowerSharing.Demand(fc.number)
 	status.BMSTargetHigh = fc.Control.TargetBatteryHigh
 	status.BMSTargetLow = fc.Control.TargetBatteryLow
 	status.RunStatus = fc.PowerMode.PowerModeState.String()
@@ -1048,7 +1201,9 @@ func (fc *PANFuelCell) GetStatus() PanStatus {
 	status.WaterPumpSpeed = fc.WaterPump.Speed
 	status.WaterPumpActive = fc.Control.PumpActive
 	status.CoolingFanSpeed = fc.ATSCoolingFan.Speed
-	return status
+	status.StaleValues, status.StaleMessages = Freshness.StaleFuelCellValues(fc.number)
+	status.Stale = len(status.StaleMessages) > 0
+	return &status
 }
 
 func (fc *PANFuelCell) GetStatusAsJSON() (string, error) {
@@ -1101,9 +1256,135 @@ type PANDatabaseRecordType struct {
 
 var dbRecord PANDatabaseRecordType
 
+// panInsertSQL logs a PANDatabaseRecordType. The table name is added with Sprintf
+const panInsertSQL = `INSERT INTO firefly.%s (StackCurrent
+	, StackVoltage
+	, CoolantInlTemp
+	, CoolantOutTemp
+	, OutputVoltage
+	, OutputCurrent
+	, CoolantFanSpeed
+	, CoolantPumpSpeed
+	, CoolantPumpVolts
+	, CoolantPumpAmps
+	, InsulationResistance
+	, HydrogenPressure
+	, AirPressure
+	, CoolantPressure
+	, AirinletTemp
+	, AmbientTemp
+	, AirFlow
+	, HydrogenConcentration
+	, DCDCTemp, DCDCInVolts
+	, DCDCOutVolts
+	, DCDCInAmps
+	, DCDCOutAmps
+	, MinCellVolts
+	, MaxCellVolts
+	, AvgCellVolts
+	, IdxMaxCell
+	, IdxMinCell
+	, RunStage
+	, FaultLevel
+	, PowerModeState
+	, Cell00Volts
+	, Cell01Volts
+	, Cell02Volts
+	, Cell03Volts
+	, Cell04Volts
+	, Cell05Volts
+	, Cell06Volts
+	, Cell07Volts
+	, Cell08Volts
+	, Cell09Volts
+	, Cell10Volts
+	, Cell11Volts
+	, Cell12Volts
+	, Cell13Volts
+	, Cell14Volts
+	, Cell15Volts
+	, Cell16Volts
+	, Cell17Volts
+	, Cell18Volts
+	, Cell19Volts
+	, Cell20Volts
+	, Cell21Volts
+	, Cell22Volts
+	, Cell23Volts
+	, Cell24Volts
+	, Cell25Volts
+	, Cell26Volts
+	, Cell27Volts
+	, Cell28Volts
+	, Cell29Volts
+	, Cell30Volts
+	, Cell31Volts
+	, Alarms
+	) 
+		 VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);`
+
+/*
+fromSignals fills the record from the DBC decoded signals. The database columns hold the unscaled values so the raw
+value of each signal is used. Columns whose signal is not defined keep the value set by the frame handlers.
+*/
+func (rec *PANDatabaseRecordType) fromSignals(values *DBCValuesType) {
+	raw := func(name string) (int64, bool) {
+		value, found := values.Signal(name)
+		return value.Raw, found
+	}
+	set16 := func(column *uint16, name string) {
+		if value, found := raw(name); found {
+			*column = uint16(value)
+		}
+	}
+	set8 := func(column *uint8, name string) {
+		if value, found := raw(name); found {
+			*column = uint8(value)
+		}
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	set16(&rec.StackCurrent, "StackCurrent")
+	set16(&rec.StackVoltage, "StackVolts")
+	set16(&rec.CoolantInlTemp, "CoolantInletTemp")
+	set16(&rec.CoolantOutTemp, "CoolantOutletTemp")
+	set16(&rec.CoolantFanSpeed, "CoolingFanSpeed")
+	set16(&rec.CoolantPumpSpeed, "WaterPumpSpeed")
+	set8(&rec.CoolantPumpVolts, "WaterPumpVolts")
+	set8(&rec.CoolantPumpAmps, "WaterPumpAmps")
+	set16(&rec.InsulationResistance, "InsulationResistance")
+	set16(&rec.HydrogenPressure, "H2Pressure")
+	set16(&rec.AirPressure, "AirPressure")
+	set16(&rec.CoolantPressure, "CoolantPressure")
+	set16(&rec.AirinletTemp, "AirTemp")
+	set16(&rec.AmbientTemp, "AmbientTemp")
+	set16(&rec.AirFlow, "AirFlow")
+	set8(&rec.HydrogenConcentration, "H2Concentration")
+	set8(&rec.DCDCTemp, "DCOutputTemp")
+	set16(&rec.DCDCInVolts, "DCInVolts")
+	set16(&rec.DCDCOutVolts, "DCOutVolts")
+	set16(&rec.DCDCInAmps, "DCInAmps")
+	set16(&rec.DCDCOutAmps, "DCOutAmps")
+	set16(&rec.MinCellVolts, "MinCellVolts")
+	set16(&rec.MaxCellVolts, "MaxCellVolts")
+	set16(&rec.AvgCellVolts, "AvgCellVolts")
+	set8(&rec.IdxMaxCell, "IdxMaxCell")
+	set8(&rec.IdxMinCell, "IdxMinCell")
+	set8(&rec.RunStage, "RunStage")
+	set8(&rec.FaultLevel, "FaultLevel")
+	set8(&rec.PowerModeState, "PowerModeState")
+	if value, found := raw("AlarmBitmap"); found {
+		rec.Alarms = uint32(value)
+	}
+}
+
 func (rec *PANDatabaseRecordType) saveToDatabase() error {
 	rec.mu.Lock()
 	defer rec.mu.Unlock()
+	if rec.stmt == nil {
+		return fmt.Errorf("the fuel cell database insert has not been prepared")
+	}
 	_, err := rec.stmt.Exec(rec.StackCurrent, rec.StackVoltage, rec.CoolantInlTemp, rec.CoolantOutTemp, rec.OutputVoltage,
 		rec.OutputCurrent, rec.CoolantFanSpeed, rec.CoolantPumpSpeed, rec.CoolantPumpVolts, rec.CoolantPumpAmps,
 		rec.InsulationResistance, rec.HydrogenPressure, rec.AirPressure, rec.CoolantPressure, rec.AirinletTemp,
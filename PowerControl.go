@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+PowerControl works out the power demand sent to the fuel cells. In fixed mode the setpoint is the target power. In
+load following mode a PI loop sets it from either the measured AC load or the battery charge current. Either way
+the demand moves towards the setpoint no faster than the configured ramp rates and it starts again from zero each
+time the fuel cell is started. With several fuel cells the demand is the total for those that are on and
+PowerSharing splits it between them.
+*/
+
+// Power control modes
+const (
+	PowerModeFixed         = "fixed"
+	PowerModeLoadFollowing = "loadFollowing"
+)
+
+// Load following measurement sources
+const (
+	LoadSourceAC = "ac" // Follow the AC load measured on an AC measurement device
+	LoadSourceDC = "dc" // Hold the battery current measured on a DC measurement device at TargetAmps
+)
+
+const powerControlStep = time.Millisecond * 500
+
+type PowerControlSettingsType struct {
+	Mode                string  // fixed or loadFollowing
+	RampUpKWPerSecond   float64 // Fastest increase in demand
+	RampDownKWPerSecond float64 // Fastest decrease in demand
+	Source              string  // ac or dc
+	Board               uint8   // Node ID of the board with the measurement
+	Device              uint8   // AC or DC measurement device 0-3
+	OffsetKW            float64 // ac: run this much above the measured load to cover losses and charge the battery
+	TargetAmps          float64 // dc: battery current to hold. Positive is charging
+	Kp                  float64 // kW per kW (ac) or kW per A (dc) of error
+	Ki                  float64 // Kp units per second
+	MinKW               float64 // Clamp on the load following setpoint
+	MaxKW               float64
+}
+
+type PowerControlType struct {
+	mu          sync.Mutex
+	demand      float64 // kW sent to the fuel cell
+	setpoint    float64 // kW the demand is ramping towards
+	integral    float64
+	measurement float64 // kW (ac) or A (dc)
+	err         float64
+	state       string
+	wasOn       bool
+	target      float64 // Total target power of the fuel cells that are on
+}
+
+var PowerControl PowerControlType
+
+func defaultPowerControlSettings() PowerControlSettingsType {
+	return PowerControlSettingsType{
+		Mode:                PowerModeFixed,
+		RampUpKWPerSecond:   0.1,
+		RampDownKWPerSecond: 0.5,
+		Source:              LoadSourceAC,
+		OffsetKW:            0.2,
+		Kp:                  0.5,
+		Ki:                  0.05,
+		MinKW:               0,
+		MaxKW:               10,
+	}
+}
+
+func (s *PowerControlSettingsType) validate() error {
+	if s.Mode != PowerModeFixed && s.Mode != PowerModeLoadFollowing {
+		return fmt.Errorf("mode must be %s or %s", PowerModeFixed, PowerModeLoadFollowing)
+	}
+	if s.RampUpKWPerSecond <= 0 || s.RampDownKWPerSecond <= 0 {
+		return fmt.Errorf("ramp rates must be greater than zero")
+	}
+	if s.Source != LoadSourceAC && s.Source != LoadSourceDC {
+		return fmt.Errorf("source must be %s or %s", LoadSourceAC, LoadSourceDC)
+	}
+	if GetBoard(s.Board) == nil {
+		return fmt.Errorf("there is no board with node ID %d", s.Board)
+	}
+	if s.Device > 3 {
+		return fmt.Errorf("measurement device must be 0 to 3")
+	}
+	if s.Kp < 0 || s.Ki < 0 {
+		return fmt.Errorf("the PI gains cannot be negative")
+	}
+	if rated := ratedKW(); s.MinKW < 0 || s.MaxKW > rated || s.MaxKW < s.MinKW {
+		return fmt.Errorf("the load following limits must be within 0kW to %0.0fkW with the minimum below the maximum", rated)
+	}
+	return nil
+}
+
+/*
+Demand returns the power demand to send to the fuel cell in kW
+*/
+func (pc *PowerControlType) Demand() float64 {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.demand
+}
+
+/*
+Run updates the power demand twice a second
+*/
+func (pc *PowerControlType) Run() {
+	stepTime := time.NewTicker(powerControlStep)
+	for {
+		<-stepTime.C
+		pc.step(powerControlStep.Seconds())
+	}
+}
+
+// measure returns the measured AC load in kW or battery current in A
+func (s *PowerControlSettingsType) measure() (float64, bool) {
+	board := GetBoard(s.Board)
+	if board == nil || s.Device > 3 {
+		return 0, false
+	}
+	if s.Source == LoadSourceAC {
+		if Freshness.IsStale(board.freshnessName(fmt.Sprintf("AC%d", s.Device))) {
+			return 0, false
+		}
+		return float64(board.ACMeasurements[s.Device].getPower()) / 1000.0, true
+	}
+	if Freshness.IsStale(board.freshnessName(fmt.Sprintf("DC%d", s.Device))) {
+		return 0, false
+	}
+	return float64(board.DCMeasurements[s.Device].getAmps()), true
+}
+
+func (pc *PowerControlType) step(dt float64) {
+	settings := currentSettings.FuelCellSettings.PowerControl
+	// The fuel cells that are commanded on are controlled as one. PowerSharing splits the demand between them.
+	on, running := false, false
+	target, outputKW := 0.0, 0.0
+	for _, fuelCell := range FuelCells {
+		commands := fuelCell.Commands()
+		if !commands.FuelCellOn {
+			continue
+		}
+		on = true
+		target += commands.TargetPower
+		measurements := fuelCell.Measurements()
+		running = running || measurements.PowerMode == PMManual
+		if measurements.OutputValid {
+			outputKW += measurements.OutputKW()
+		}
+	}
+	measurement, valid := settings.measure()
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.target = target
+	if !on {
+		// Start from nothing next time
+		pc.demand = 0
+		pc.setpoint = 0
+		pc.integral = 0
+		pc.wasOn = false
+		pc.state = "Fuel cell off"
+		return
+	}
+	if !pc.wasOn {
+		pc.wasOn = true
+		pc.integral = 0
+		// Load following starts from the fixed target until the fuel cell is running
+		pc.setpoint = target
+	}
+
+	switch {
+	case settings.Mode != PowerModeLoadFollowing:
+		pc.setpoint = target
+		pc.state = "Fixed"
+	case !running:
+		pc.setpoint = target
+		pc.state = "Waiting for the fuel cell to run"
+	case !valid:
+		// Hold the current setpoint
+		pc.state = "Measurement is stale. Holding the setpoint"
+	default:
+		pc.measurement = measurement
+		feedForward := 0.0
+		if settings.Source == LoadSourceAC {
+			feedForward = measurement + settings.OffsetKW
+			pc.err = feedForward - outputKW
+		} else {
+			pc.err = settings.TargetAmps - measurement
+		}
+		// Stop the integral winding up while the ramp is holding the demand back in the direction of the error
+		integrate := (pc.setpoint-pc.demand)*pc.err <= 0
+		if integrate {
+			pc.integral += pc.err * dt
+		}
+		output := feedForward + settings.Kp*pc.err + settings.Ki*pc.integral
+		// or while we are against a limit
+		if output > settings.MaxKW || output < settings.MinKW {
+			if integrate {
+				pc.integral -= pc.err * dt
+			}
+			output = math.Max(settings.MinKW, math.Min(settings.MaxKW, output))
+		}
+		pc.setpoint = output
+		pc.state = "Load following"
+	}
+
+	// Ramp the demand towards the setpoint
+	if pc.setpoint > pc.demand {
+		pc.demand = math.Min(pc.setpoint, pc.demand+settings.RampUpKWPerSecond*dt)
+	} else if pc.setpoint < pc.demand {
+		pc.demand = math.Max(pc.setpoint, pc.demand-settings.RampDownKWPerSecond*dt)
+	}
+}
+
+type PowerControlStatusType struct {
+	Settings    PowerControlSettingsType
+	State       string
+	TargetPower float64 // Fixed setpoint. The total for all of the fuel cells that are on
+	Setpoint    float64 // What the demand is ramping towards
+	Demand      float64 // Sent to the fuel cell
+	Measurement float64 // kW (ac) or A (dc)
+	Error       float64
+	Integral    float64
+}
+
+func (pc *PowerControlType) Status() PowerControlStatusType {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return PowerControlStatusType{Settings: currentSettings.FuelCellSettings.PowerControl, State: pc.state,
+		TargetPower: pc.target, Setpoint: roundTo(pc.setpoint, 3), Demand: roundTo(pc.demand, 3),
+		Measurement: roundTo(pc.measurement, 3), Error: roundTo(pc.err, 3), Integral: roundTo(pc.integral, 3)}
+}
+
+func getPowerControl(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Power Control"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(PowerControl.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func setPowerControl(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Power Control"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	settings := currentSettings.FuelCellSettings.PowerControl
+	if err := json.Unmarshal(body, &settings); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	if settings.Mode != currentSettings.FuelCellSettings.PowerControl.Mode {
+		log.Printf("Power control mode changed to %s", settings.Mode)
+	}
+	currentSettings.FuelCellSettings.PowerControl = settings
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getPowerControl(w, r)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// setBatteryAmps sets the current measured by DC measurement device 0 on the main board and marks it as fresh
+func setBatteryAmps(amps float64) {
+	board := MainBoard()
+	board.DCMeasurements[0].setAmps(uint32(amps*6000 + 554416))
+	setLastSeen(board.freshnessName("DC0"), time.Now())
+}
+
+// usePowerControlSettings installs the settings and starts the main fuel cell at the given target power
+func usePowerControlSettings(t *testing.T, settings PowerControlSettingsType, targetKW float64) {
+	t.Helper()
+	fuelCell := MainFuelCell()
+	saved := currentSettings.FuelCellSettings.PowerControl
+	currentSettings.FuelCellSettings.PowerControl = settings
+	if err := fuelCell.SetTargetPower(targetKW); err != nil {
+		t.Fatal(err)
+	}
+	fuelCell.FuelCellDriver.Start()
+	t.Cleanup(func() {
+		currentSettings.FuelCellSettings.PowerControl = saved
+		fuelCell.FuelCellDriver.Stop()
+		_ = fuelCell.SetTargetPower(0)
+		PowerControl.step(1)
+	})
+}
+
+func TestPowerControlRamp(t *testing.T) {
+	settings := defaultPowerControlSettings()
+	settings.RampUpKWPerSecond = 1
+	settings.RampDownKWPerSecond = 2
+	usePowerControlSettings(t, settings, 3)
+	fuelCell := MainFuelCell()
+
+	steps := []struct {
+		name   string
+		target float64
+		demand float64
+	}{
+		{name: "Starts from zero", target: 3, demand: 1},
+		{name: "Ramping up", target: 3, demand: 2},
+		{name: "Reached the target", target: 3, demand: 3},
+		{name: "Held", target: 3, demand: 3},
+		{name: "Ramping down", target: 0.5, demand: 1},
+		{name: "Reached the lower target", target: 0.5, demand: 0.5},
+	}
+	for _, step := range steps {
+		if err := fuelCell.SetTargetPower(step.target); err != nil {
+			t.Fatal(err)
+		}
+		PowerControl.step(1)
+		if demand := PowerControl.Demand(); math.Abs(demand-step.demand) > 1e-9 {
+			t.Errorf("%s: demand = %vkW, want %vkW", step.name, demand, step.demand)
+		}
+	}
+
+	fuelCell.FuelCellDriver.Stop()
+	PowerControl.step(1)
+	if demand := PowerControl.Demand(); demand != 0 {
+		t.Errorf("demand = %vkW with the fuel cell off", demand)
+	}
+	// and the ramp starts again from zero
+	fuelCell.FuelCellDriver.Start()
+	PowerControl.step(0.5)
+	if demand := PowerControl.Demand(); math.Abs(demand-0.5) > 1e-9 {
+		t.Errorf("demand = %vkW after a restart, want 0.5kW", demand)
+	}
+}
+
+/*
+TestPowerControlAntiWindup holds the battery current below its target and checks the integral only builds up while
+the demand is free to follow the setpoint and is not past a limit
+*/
+func TestPowerControlAntiWindup(t *testing.T) {
+	settings := defaultPowerControlSettings()
+	settings.Mode = PowerModeLoadFollowing
+	settings.Source = LoadSourceDC
+	settings.Board = MainBoard().NodeID
+	settings.TargetAmps = 10
+	settings.Kp = 0.2
+	settings.Ki = 0.1
+	settings.MaxKW = 5
+	settings.RampUpKWPerSecond = 0.5
+	usePowerControlSettings(t, settings, 1)
+	reportPowerMode(t, PMManual)
+	defer reportPowerMode(t, PMOff)
+
+	// 4A short of the target asks for 0.8kW straight away but the demand can only rise by 0.5kW a second
+	setBatteryAmps(6)
+	PowerControl.step(1)
+	if status := PowerControl.Status(); status.Integral != 0 || status.Demand != 0.5 || status.Setpoint != 0.8 {
+		t.Errorf("while ramping: %+v", status)
+	}
+	// Caught up, so the integral builds
+	PowerControl.step(1)
+	PowerControl.step(1)
+	if status := PowerControl.Status(); status.Integral != 4 || status.Demand != 1.2 {
+		t.Errorf("after catching up: integral %v, demand %vkW, want 4 and 1.2kW", status.Integral, status.Demand)
+	}
+
+	// 60A short is past the maximum so the integral is held
+	setBatteryAmps(-50)
+	for i := 0; i < 20; i++ {
+		PowerControl.step(1)
+	}
+	status := PowerControl.Status()
+	if status.Setpoint != settings.MaxKW || status.Demand != settings.MaxKW || status.Integral != 4 {
+		t.Errorf("against the maximum: setpoint %vkW, demand %vkW, integral %v, want 5kW, 5kW and 4", status.Setpoint,
+			status.Demand, status.Integral)
+	}
+	// so the demand comes straight back once the battery recovers
+	setBatteryAmps(10)
+	PowerControl.step(1)
+	if status := PowerControl.Status(); status.Setpoint != 0.4 {
+		t.Errorf("setpoint = %vkW once the battery current is on target, want 0.4kW", status.Setpoint)
+	}
+
+	// A stale measurement holds the setpoint
+	setLastSeen(MainBoard().freshnessName("DC0"), time.Time{})
+	PowerControl.step(1)
+	if status := PowerControl.Status(); status.Setpoint != 0.4 {
+		t.Errorf("setpoint = %vkW with a stale measurement, want 0.4kW", status.Setpoint)
+	}
+}
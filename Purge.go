@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+The purge scheduler opens the fuel cell exhaust for a set time to clear water and nitrogen from the stack. A purge
+is started a set time after the fuel cell reaches running, after a set number of run hours since the last purge or
+when the coolant pressure stays outside its limits. Purges can also be started by hand.
+
+The fuel cell toggles the exhaust flag in its BMS settings message while the exhaust is open. A purge that does not
+show the flag within ConfirmSeconds is abandoned and the exhaust closed. Scheduled purges are then held off for
+MinIntervalMinutes, and at least purgeRetryDelay, so an exhaust that does not respond is not opened and closed over
+and over. Every purge is logged as an event.
+Each fuel cell has its own scheduler and the run hours since the last purge are kept in the state file.
+*/
+
+// Purge scheduler states
+const (
+	PurgeDisabled = "Disabled" // Scheduled purges are turned off
+	PurgeIdle     = "Idle"     // Waiting for a purge to be due
+	PurgePurging  = "Purging"  // The exhaust is open
+)
+
+// Purge triggers
+const (
+	PurgeTriggerStartup  = "startup"
+	PurgeTriggerRunHours = "runHours"
+	PurgeTriggerPressure = "coolantPressure"
+	PurgeTriggerManual   = "manual"
+)
+
+// Run time steps longer than this are not counted. The fuel cell data was probably lost.
+const purgeMaxStep = time.Second * 5
+
+// Shortest wait before a scheduled purge is tried again after one that was not confirmed
+const purgeRetryDelay = time.Minute
+
+type PurgeSettingsType struct {
+	Enabled             bool    // Run the scheduled purges. Manual purges are always allowed
+	DurationSeconds     float64 // Time the exhaust is held open
+	ConfirmSeconds      float64 // Time for the fuel cell to report the exhaust is open
+	AfterStartSeconds   float64 // Purge this long after the fuel cell reaches running. 0 = off
+	RunHours            float64 // Purge after this many hours running since the last purge. 0 = off
+	CoolantPressureLow  float64 // kPa. Purge if the coolant pressure stays below this. 0 = off
+	CoolantPressureHigh float64 // kPa. Purge if the coolant pressure stays above this. 0 = off
+	PressureSeconds     float64 // Time the coolant pressure must stay outside its limits
+	MinIntervalMinutes  float64 // Shortest time between scheduled purges
+}
+
+// PurgeTotalsType is kept in the state file for each fuel cell
+type PurgeTotalsType struct {
+	RunHoursSincePurge float64
+	LastPurge          time.Time
+	Purges             int
+	Unconfirmed        int
+}
+
+type PurgeSchedulerType struct {
+	mu            sync.Mutex
+	state         string
+	trigger       string    // What started the current or last purge
+	started       time.Time // When the current purge started
+	confirmed     bool      // The exhaust flag has been seen during the current purge
+	lastResult    string
+	running       bool      // The fuel cell was running on the last pass
+	runningSince  time.Time // When the fuel cell reached running
+	startupDone   bool      // The after start purge has been done for this run
+	pressureSince time.Time // When the coolant pressure went outside its limits
+	unconfirmed   time.Time // When the last purge that was not confirmed finished
+	lastStep      time.Time
+	fuelCell      *FuelCellUnitType
+}
+
+func defaultPurgeSettings() PurgeSettingsType {
+	return PurgeSettingsType{
+		DurationSeconds:    5,
+		ConfirmSeconds:     3,
+		AfterStartSeconds:  300,
+		RunHours:           2,
+		PressureSeconds:    10,
+		MinIntervalMinutes: 10,
+	}
+}
+
+func (s *PurgeSettingsType) validate() error {
+	if s.DurationSeconds <= 0 || s.ConfirmSeconds <= 0 {
+		return fmt.Errorf("the purge duration and confirmation time must be greater than zero")
+	}
+	if s.ConfirmSeconds > s.DurationSeconds {
+		return fmt.Errorf("the confirmation time (%0.1fs) cannot be longer than the purge (%0.1fs)", s.ConfirmSeconds, s.DurationSeconds)
+	}
+	if s.AfterStartSeconds < 0 || s.RunHours < 0 || s.PressureSeconds < 0 || s.MinIntervalMinutes < 0 {
+		return fmt.Errorf("times cannot be negative")
+	}
+	if s.CoolantPressureLow != 0 && s.CoolantPressureHigh != 0 && s.CoolantPressureLow >= s.CoolantPressureHigh {
+		return fmt.Errorf("the low coolant pressure (%0.1fkPa) must be below the high pressure (%0.1fkPa)", s.CoolantPressureLow, s.CoolantPressureHigh)
+	}
+	return nil
+}
+
+// pressureOutOfLimits is true if the coolant pressure is outside the configured limits
+func (s *PurgeSettingsType) pressureOutOfLimits(kPa float64) bool {
+	return (s.CoolantPressureLow != 0 && kPa < s.CoolantPressureLow) || (s.CoolantPressureHigh != 0 && kPa > s.CoolantPressureHigh)
+}
+
+// purgeTotals must be called with the state locked
+func (st *PersistentStateType) purgeTotals(number int) *PurgeTotalsType {
+	if st.Purge == nil {
+		st.Purge = make(map[int]*PurgeTotalsType)
+	}
+	totals, found := st.Purge[number]
+	if !found {
+		totals = new(PurgeTotalsType)
+		st.Purge[number] = totals
+	}
+	return totals
+}
+
+// totals returns a copy of the persisted totals for the fuel cell
+func (pg *PurgeSchedulerType) totals() PurgeTotalsType {
+	State.mu.Lock()
+	defer State.mu.Unlock()
+	return *State.purgeTotals(pg.fuelCell.Number)
+}
+
+func (pg *PurgeSchedulerType) eventSource() string {
+	return fuelCellFreshnessName(pg.fuelCell.Number, EventSourcePurge)
+}
+
+// fuelCellRunning is true if the fuel cell has been told to run and reports that it is running
+func (pg *PurgeSchedulerType) fuelCellRunning() bool {
+	measurements := pg.fuelCell.Measurements()
+	return measurements.ModeValid && measurements.PowerMode == PMManual && pg.fuelCell.Commands().FuelCellOn
+}
+
+/*
+Run checks the fuel cell every second
+*/
+func (pg *PurgeSchedulerType) Run() {
+	checkTime := time.NewTicker(time.Second)
+	for {
+		now := <-checkTime.C
+		pg.step(now)
+	}
+}
+
+func (pg *PurgeSchedulerType) step(now time.Time) {
+	settings := currentSettings.FuelCellSettings.Purge
+	running := pg.fuelCellRunning()
+	measurements := pg.fuelCell.Measurements()
+	totals := pg.totals()
+
+	// action is carried out once the scheduler is unlocked
+	var action func()
+
+	pg.mu.Lock()
+	defer func() {
+		pg.mu.Unlock()
+		if action != nil {
+			action()
+		}
+	}()
+
+	step := now.Sub(pg.lastStep)
+	pg.lastStep = now
+	if running && pg.running && step <= purgeMaxStep {
+		State.mu.Lock()
+		State.purgeTotals(pg.fuelCell.Number).RunHoursSincePurge += step.Hours()
+		State.mu.Unlock()
+	}
+	if running && !pg.running {
+		pg.runningSince = now
+		pg.startupDone = false
+	}
+	pg.running = running
+	if measurements.PressuresValid && settings.pressureOutOfLimits(measurements.CoolantPressure) {
+		if pg.pressureSince.IsZero() {
+			pg.pressureSince = now
+		}
+	} else {
+		pg.pressureSince = time.Time{}
+	}
+
+	if pg.state == PurgePurging {
+		if measurements.ExhaustValid && measurements.ExhaustOpen {
+			pg.confirmed = true
+		}
+		elapsed := now.Sub(pg.started)
+		switch {
+		case !running:
+			action = pg.finish(now, false, "the fuel cell stopped running")
+		case !pg.confirmed && elapsed >= time.Duration(settings.ConfirmSeconds*float64(time.Second)):
+			action = pg.finish(now, false, fmt.Sprintf("the fuel cell did not report the exhaust open within %0.1fs", settings.ConfirmSeconds))
+		case elapsed >= time.Duration(settings.DurationSeconds*float64(time.Second)):
+			action = pg.finish(now, true, "")
+		}
+		return
+	}
+
+	if !settings.Enabled || !currentSettings.FuelCellSettings.Enabled {
+		pg.state = PurgeDisabled
+		return
+	}
+	pg.state = PurgeIdle
+	if !running {
+		return
+	}
+	if now.Before(pg.nextScheduled(settings, totals)) {
+		return
+	}
+	switch {
+	case settings.AfterStartSeconds > 0 && !pg.startupDone && now.Sub(pg.runningSince) >= time.Duration(settings.AfterStartSeconds*float64(time.Second)):
+		pg.startupDone = true
+		action = pg.begin(now, PurgeTriggerStartup)
+	case settings.RunHours > 0 && totals.RunHoursSincePurge >= settings.RunHours:
+		action = pg.begin(now, PurgeTriggerRunHours)
+	case !pg.pressureSince.IsZero() && now.Sub(pg.pressureSince) >= time.Duration(settings.PressureSeconds*float64(time.Second)):
+		pg.pressureSince = time.Time{}
+		action = pg.begin(now, PurgeTriggerPressure)
+	}
+}
+
+/*
+nextScheduled returns the earliest time a scheduled purge may start. It must be called with the scheduler locked.
+*/
+func (pg *PurgeSchedulerType) nextScheduled(settings PurgeSettingsType, totals PurgeTotalsType) time.Time {
+	minInterval := time.Duration(settings.MinIntervalMinutes * float64(time.Minute))
+	var next time.Time
+	if !totals.LastPurge.IsZero() {
+		next = totals.LastPurge.Add(minInterval)
+	}
+	if !pg.unconfirmed.IsZero() {
+		retry := minInterval
+		if retry < purgeRetryDelay {
+			retry = purgeRetryDelay
+		}
+		if retryAt := pg.unconfirmed.Add(retry); retryAt.After(next) {
+			next = retryAt
+		}
+	}
+	return next
+}
+
+// begin must be called with the scheduler locked. It returns the action that opens the exhaust.
+func (pg *PurgeSchedulerType) begin(now time.Time, trigger string) func() {
+	pg.state = PurgePurging
+	pg.trigger = trigger
+	pg.started = now
+	pg.confirmed = false
+	log.Printf("%s purge started (%s)", pg.fuelCell.Label(), trigger)
+	return func() { pg.fuelCell.SetExhaust(true) }
+}
+
+/*
+finish must be called with the scheduler locked. It logs the purge, resets the run hours if it was confirmed, holds
+off the next scheduled purge if it was not and returns the action that closes the exhaust.
+*/
+func (pg *PurgeSchedulerType) finish(now time.Time, completed bool, reason string) func() {
+	seconds := now.Sub(pg.started).Seconds()
+	State.mu.Lock()
+	totals := State.purgeTotals(pg.fuelCell.Number)
+	if pg.confirmed {
+		totals.RunHoursSincePurge = 0
+		totals.LastPurge = now
+		totals.Purges++
+		State.countPurge(pg.fuelCell.Number)
+		pg.unconfirmed = time.Time{}
+	} else {
+		totals.Unconfirmed++
+		pg.unconfirmed = now
+	}
+	State.mu.Unlock()
+
+	switch {
+	case completed:
+		pg.lastResult = fmt.Sprintf("%s purge for %0.1fs", pg.trigger, seconds)
+		Events.Record(pg.eventSource(), pg.trigger, fmt.Sprintf("Exhaust purged for %0.1fs", seconds))
+	case pg.confirmed:
+		pg.lastResult = fmt.Sprintf("%s purge cut short after %0.1fs - %s", pg.trigger, seconds, reason)
+		Events.Record(pg.eventSource(), pg.trigger, fmt.Sprintf("Exhaust purge cut short after %0.1fs - %s", seconds, reason))
+	default:
+		pg.lastResult = fmt.Sprintf("%s purge not confirmed - %s", pg.trigger, reason)
+		Events.Record(pg.eventSource(), "Unconfirmed", fmt.Sprintf("Exhaust purge (%s) not confirmed - %s", pg.trigger, reason))
+	}
+	pg.state = PurgeIdle
+	return func() { pg.fuelCell.SetExhaust(false) }
+}
+
+/*
+Start purges now. The fuel cell must be running.
+*/
+func (pg *PurgeSchedulerType) Start() error {
+	if !pg.fuelCellRunning() {
+		return fmt.Errorf("%s is not running", pg.fuelCell.Label())
+	}
+	pg.mu.Lock()
+	if pg.state == PurgePurging {
+		pg.mu.Unlock()
+		return fmt.Errorf("%s is already purging", pg.fuelCell.Label())
+	}
+	action := pg.begin(time.Now(), PurgeTriggerManual)
+	pg.mu.Unlock()
+	action()
+	return nil
+}
+
+/*
+Cancel closes the exhaust if a purge is running
+*/
+func (pg *PurgeSchedulerType) Cancel() {
+	pg.mu.Lock()
+	if pg.state != PurgePurging {
+		pg.mu.Unlock()
+		return
+	}
+	action := pg.finish(time.Now(), false, "cancelled")
+	pg.mu.Unlock()
+	action()
+}
+
+type PurgeStatusType struct {
+	State              string
+	Trigger            string `json:",omitempty"`
+	Since              time.Time
+	Confirmed          bool
+	LastResult         string
+	RunHoursSincePurge float64
+	LastPurge          time.Time
+	Purges             int
+	Unconfirmed        int
+	HeldOffUntil       *time.Time `json:",omitempty"` // Scheduled purges wait until this time
+	Settings           PurgeSettingsType
+}
+
+func (pg *PurgeSchedulerType) Status() PurgeStatusType {
+	totals := pg.totals()
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	status := PurgeStatusType{State: pg.state, LastResult: pg.lastResult, RunHoursSincePurge: roundTo(totals.RunHoursSincePurge, 3),
+		LastPurge: totals.LastPurge, Purges: totals.Purges, Unconfirmed: totals.Unconfirmed, Settings: currentSettings.FuelCellSettings.Purge}
+	if pg.state == PurgePurging {
+		status.Trigger = pg.trigger
+		status.Since = pg.started
+		status.Confirmed = pg.confirmed
+	} else if next := pg.nextScheduled(status.Settings, totals); time.Now().Before(next) {
+		status.HeldOffUntil = &next
+	}
+	return status
+}
+
+func getPurge(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Get Fuel Cell Purge"
+	fuelCell := fuelCellFromRequest(w, r, deviceString)
+	if fuelCell == nil {
+		return
+	}
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(fuelCell.Purge.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func startPurge(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Start Fuel Cell Purge"
+	fuelCell := fuelCellFromRequest(w, r, deviceString)
+	if fuelCell == nil {
+		return
+	}
+	if err := fuelCell.Purge.Start(); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusConflict, false)
+		return
+	}
+	getPurge(w, r)
+}
+
+func cancelPurge(w http.ResponseWriter, r *http.Request) {
+	fuelCell := fuelCellFromRequest(w, r, "Cancel Fuel Cell Purge")
+	if fuelCell == nil {
+		return
+	}
+	fuelCell.Purge.Cancel()
+	getPurge(w, r)
+}
+
+func setPurgeSettings(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Fuel Cell Purge"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	settings := currentSettings.FuelCellSettings.Purge
+	if err := json.Unmarshal(body, &settings); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	currentSettings.FuelCellSettings.Purge = settings
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getPurge(w, r)
+}
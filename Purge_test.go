@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/brutella/can"
+	"strings"
+	"testing"
+	"time"
+)
+
+// purgeStepType is one pass of the purge scheduler
+type purgeStepType struct {
+	at       time.Duration      // Time of the step from the start of the test
+	mode     PowerModeStateType // Reported by the fuel cell
+	exhaust  bool               // The fuel cell toggles its exhaust flag before the step
+	pressure float64            // Coolant pressure reported in kPa. Not sent if zero
+	purge    bool               // Start a manual purge before the step
+	state    string             // Expected scheduler state after the step
+	trigger  string             // Expected trigger of the current or last purge. Not checked if empty
+	result   string             // Text expected in the last result. Not checked if empty
+	open     bool               // The exhaust should be commanded open after the step
+}
+
+// toggleExhaust has the main fuel cell flip the exhaust flag in its BMS settings message as it does while purging
+func toggleExhaust(t *testing.T) {
+	t.Helper()
+	fuelCell := MainFuelCell()
+	FuelCell.mu.Lock()
+	frame := can.Frame{ID: CanBMSSettingsMsg, Length: 8}
+	if !FuelCell.SystemInfo.exhaustLastValue {
+		frame.Data[6] = 1
+	}
+	FuelCell.mu.Unlock()
+	inject(t, frame, func() bool {
+		measurements := fuelCell.Measurements()
+		return measurements.ExhaustValid && measurements.ExhaustOpen
+	})
+}
+
+// reportCoolantPressure has the main fuel cell report the given coolant pressure
+func reportCoolantPressure(t *testing.T, kPa float64) {
+	t.Helper()
+	fuelCell := MainFuelCell()
+	frame := can.Frame{ID: CanPressuresMsg, Length: 8}
+	binary.LittleEndian.PutUint16(frame.Data[4:6], uint16((kPa+50)*10))
+	inject(t, frame, func() bool {
+		measurements := fuelCell.Measurements()
+		return measurements.PressuresValid && measurements.CoolantPressure == kPa
+	})
+}
+
+func TestPurgeStep(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings func(settings *PurgeSettingsType)
+		runHours float64 // Run hours since the last purge at the start
+		steps    []purgeStepType
+	}{
+		{name: "Scheduled purges off", settings: func(s *PurgeSettingsType) { s.Enabled = false }, steps: []purgeStepType{
+			{mode: PMManual, state: PurgeDisabled},
+			{at: time.Hour, mode: PMManual, state: PurgeDisabled},
+		}},
+		{name: "Not running", steps: []purgeStepType{
+			{mode: PMOff, state: PurgeIdle},
+			{at: time.Hour, mode: PMOff, state: PurgeIdle},
+		}},
+		{name: "After start", steps: []purgeStepType{
+			{mode: PMManual, state: PurgeIdle},
+			{at: 299 * time.Second, mode: PMManual, state: PurgeIdle},
+			{at: 300 * time.Second, mode: PMManual, state: PurgePurging, trigger: PurgeTriggerStartup, open: true},
+			{at: 301 * time.Second, mode: PMManual, exhaust: true, state: PurgePurging, open: true},
+			{at: 305 * time.Second, mode: PMManual, exhaust: true, state: PurgeIdle, trigger: PurgeTriggerStartup,
+				result: "startup purge for 5.0s"},
+			{at: time.Hour, mode: PMManual, state: PurgeIdle, trigger: PurgeTriggerStartup},
+		}},
+		{name: "Not confirmed then held off", settings: func(s *PurgeSettingsType) { s.AfterStartSeconds = 0 }, runHours: 3,
+			steps: []purgeStepType{
+				{mode: PMManual, state: PurgePurging, trigger: PurgeTriggerRunHours, open: true},
+				{at: 3 * time.Second, mode: PMManual, state: PurgeIdle, result: "not confirmed"},
+				{at: 4 * time.Second, mode: PMManual, state: PurgeIdle},
+				{at: 602 * time.Second, mode: PMManual, state: PurgeIdle},
+				{at: 603 * time.Second, mode: PMManual, state: PurgePurging, trigger: PurgeTriggerRunHours, open: true},
+			}},
+		{name: "Run hours", settings: func(s *PurgeSettingsType) { s.AfterStartSeconds = 0 }, runHours: 2, steps: []purgeStepType{
+			{mode: PMManual, state: PurgePurging, trigger: PurgeTriggerRunHours, open: true},
+			{at: time.Second, mode: PMManual, exhaust: true, state: PurgePurging, open: true},
+			{at: 2 * time.Second, mode: PMManual, exhaust: true, state: PurgePurging, open: true},
+			{at: 5 * time.Second, mode: PMManual, state: PurgeIdle, result: "runHours purge for 5.0s"},
+		}},
+		{name: "Coolant pressure", settings: func(s *PurgeSettingsType) {
+			s.AfterStartSeconds = 0
+			s.CoolantPressureHigh = 200
+		}, steps: []purgeStepType{
+			{mode: PMManual, pressure: 150, state: PurgeIdle},
+			{at: time.Second, mode: PMManual, pressure: 250, state: PurgeIdle},
+			{at: 10 * time.Second, mode: PMManual, pressure: 250, state: PurgeIdle},
+			{at: 11 * time.Second, mode: PMManual, pressure: 250, state: PurgePurging, trigger: PurgeTriggerPressure, open: true},
+		}},
+		{name: "Pressure comes back", settings: func(s *PurgeSettingsType) {
+			s.AfterStartSeconds = 0
+			s.CoolantPressureLow = 100
+		}, steps: []purgeStepType{
+			{mode: PMManual, pressure: 80, state: PurgeIdle},
+			{at: 9 * time.Second, mode: PMManual, pressure: 120, state: PurgeIdle},
+			{at: 15 * time.Second, mode: PMManual, pressure: 80, state: PurgeIdle},
+			{at: 24 * time.Second, mode: PMManual, pressure: 80, state: PurgeIdle},
+			{at: 25 * time.Second, mode: PMManual, pressure: 80, state: PurgePurging, trigger: PurgeTriggerPressure, open: true},
+		}},
+		{name: "Manual purge cut short", settings: func(s *PurgeSettingsType) { s.AfterStartSeconds = 0 }, steps: []purgeStepType{
+			{mode: PMManual, purge: true, state: PurgePurging, trigger: PurgeTriggerManual, open: true},
+			{at: time.Second, mode: PMManual, exhaust: true, state: PurgePurging, open: true},
+			{at: 2 * time.Second, mode: PMShutdown, state: PurgeIdle, result: "cut short"},
+		}},
+	}
+
+	fuelCell := MainFuelCell()
+	savedSettings := currentSettings.FuelCellSettings
+	defer func() {
+		currentSettings.FuelCellSettings = savedSettings
+		fuelCell.Stop()
+		fuelCell.SetExhaust(false)
+	}()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			currentSettings.FuelCellSettings.Purge = defaultPurgeSettings()
+			currentSettings.FuelCellSettings.Purge.Enabled = true
+			if test.settings != nil {
+				test.settings(&currentSettings.FuelCellSettings.Purge)
+			}
+			State.mu.Lock()
+			State.Purge = nil
+			State.purgeTotals(fuelCell.Number).RunHoursSincePurge = test.runHours
+			State.mu.Unlock()
+			FuelCell.mu.Lock()
+			FuelCell.SystemInfo.ExhaustFlag = false
+			FuelCell.mu.Unlock()
+			fuelCell.SetExhaust(false)
+			reportCoolantPressure(t, 150)
+			if err := fuelCell.Start(); err != nil {
+				t.Fatal(err)
+			}
+			pg := &PurgeSchedulerType{state: PurgeIdle, fuelCell: fuelCell}
+			fuelCell.Purge = pg
+
+			start := time.Now()
+			for i, step := range test.steps {
+				reportPowerMode(t, step.mode)
+				if step.pressure != 0 {
+					reportCoolantPressure(t, step.pressure)
+				}
+				if step.exhaust {
+					toggleExhaust(t)
+				}
+				if step.purge {
+					if err := pg.Start(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				pg.step(start.Add(step.at))
+
+				pg.mu.Lock()
+				state, trigger, result := pg.state, pg.trigger, pg.lastResult
+				pg.mu.Unlock()
+				if state != step.state || (step.trigger != "" && trigger != step.trigger) || !strings.Contains(result, step.result) {
+					t.Fatalf("step %d: state %s trigger %q result %q, want %s %q %q", i+1, state, trigger, result,
+						step.state, step.trigger, step.result)
+				}
+				if open := fuelCell.Commands().Exhaust; open != step.open {
+					t.Fatalf("step %d: exhaust commanded open is %v, want %v", i+1, open, step.open)
+				}
+			}
+		})
+	}
+}
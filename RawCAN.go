@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/brutella/can"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Raw CAN access for remote diagnostics. /can/send transmits an arbitrary frame and /can/frames/ws streams the frames
+seen by handleCANFrame (and those we transmit) to each WebSocket client through its own filters.
+Both need the token given with -apiToken in the X-API-Token header or a token query parameter. They are disabled if
+no token has been set.
+*/
+
+const rawFrameQueueLength = 256
+
+type RawFrameType struct {
+	Time     time.Time
+	Dir      string // rx or tx
+	ID       string
+	Extended bool
+	RTR      bool
+	Length   uint8
+	Data     string
+	Name     string `json:",omitempty"` // Message name from the DBC definitions
+}
+
+// RawFrameFilterType matches frames the same way as candump. (frame ID & Mask) == (ID & Mask)
+type RawFrameFilterType struct {
+	ID   uint32
+	Mask uint32
+}
+
+type rawFrameClientType struct {
+	conn    *websocket.Conn
+	filters []RawFrameFilterType
+	frames  chan RawFrameType
+	dropped uint64
+}
+
+type RawFrameMonitorType struct {
+	mu      sync.Mutex
+	clients map[*rawFrameClientType]bool
+}
+
+var RawFrames = RawFrameMonitorType{clients: make(map[*rawFrameClientType]bool)}
+
+func (client *rawFrameClientType) matches(frame can.Frame) bool {
+	if len(client.filters) == 0 {
+		return true
+	}
+	id := frame.ID & can.MaskIDEff
+	for _, filter := range client.filters {
+		if id&filter.Mask == filter.ID&filter.Mask {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Dispatch passes the frame to every client whose filters match it. Slow clients lose frames rather than holding up
+the CAN bus.
+*/
+func (m *RawFrameMonitorType) Dispatch(frame can.Frame, direction string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.clients) == 0 {
+		return
+	}
+	var raw *RawFrameType
+	for client := range m.clients {
+		if !client.matches(frame) {
+			continue
+		}
+		if raw == nil {
+			raw = newRawFrame(frame, direction)
+		}
+		select {
+		case client.frames <- *raw:
+		default:
+			client.dropped++
+		}
+	}
+}
+
+func newRawFrame(frame can.Frame, direction string) *RawFrameType {
+	raw := &RawFrameType{Time: time.Now(), Dir: direction, Extended: frame.ID&can.MaskEff != 0, RTR: frame.ID&can.MaskRtr != 0,
+		Length: frame.Length, Name: CANDatabase().MessageName(frame.ID)}
+	if raw.Extended {
+		raw.ID = fmt.Sprintf("0x%08X", frame.ID&can.MaskIDEff)
+	} else {
+		raw.ID = fmt.Sprintf("0x%03X", frame.ID&can.MaskIDSff)
+	}
+	length := frame.Length
+	if length > can.MaxFrameDataLength {
+		length = can.MaxFrameDataLength
+	}
+	raw.Data = strings.ToUpper(hex.EncodeToString(frame.Data[:length]))
+	return raw
+}
+
+func (m *RawFrameMonitorType) add(client *rawFrameClientType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clients[client] = true
+}
+
+func (m *RawFrameMonitorType) remove(client *rawFrameClientType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.clients[client]; found {
+		delete(m.clients, client)
+		close(client.frames)
+	}
+}
+
+/*
+ParseRawFrameFilter decodes a candump style filter <id>:<mask> in hex. The mask defaults to all 29 bits.
+*/
+func ParseRawFrameFilter(text string) (RawFrameFilterType, error) {
+	var filter RawFrameFilterType
+	parts := strings.SplitN(text, ":", 2)
+	id, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(parts[0]), "0x"), 16, 32)
+	if err != nil {
+		return filter, fmt.Errorf("invalid filter ID %s - %v", parts[0], err)
+	}
+	filter.ID = uint32(id) & can.MaskIDEff
+	filter.Mask = can.MaskIDEff
+	if len(parts) == 2 {
+		mask, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(parts[1]), "0x"), 16, 32)
+		if err != nil {
+			return filter, fmt.Errorf("invalid filter mask %s - %v", parts[1], err)
+		}
+		filter.Mask = uint32(mask) & can.MaskIDEff
+	}
+	return filter, nil
+}
+
+/*
+authorised checks the API token. It writes the error response and returns false if the request is not allowed.
+*/
+func authorised(w http.ResponseWriter, r *http.Request, deviceString string) bool {
+	if apiToken == "" {
+		ReturnJSONErrorString(w, deviceString, "This function is disabled. Start the service with -apiToken to enable it", http.StatusForbidden, true)
+		return false
+	}
+	token := r.Header.Get("X-API-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+		ReturnJSONErrorString(w, deviceString, "Invalid or missing API token", http.StatusUnauthorized, true)
+		return false
+	}
+	return true
+}
+
+type RawFrameRequestType struct {
+	ID       string // Hex
+	Extended bool   // Send as a 29 bit ID. IDs above 0x7FF are always sent as extended frames
+	RTR      bool
+	Data     string // Hex, up to 8 bytes
+}
+
+/*
+sendRawFrame transmits the frame described by the JSON body
+
+	{"ID":"18FF0001","Extended":true,"Data":"0102030405060708"}
+*/
+func sendRawFrame(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Send CAN Frame"
+	if !authorised(w, r, deviceString) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	var request RawFrameRequestType
+	if err := json.Unmarshal(body, &request); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(request.ID), "0x"), 16, 32)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if id > can.MaskIDEff {
+		ReturnJSONErrorString(w, deviceString, fmt.Sprintf("Invalid CAN ID %s", request.ID), http.StatusBadRequest, true)
+		return
+	}
+	data, err := hex.DecodeString(strings.ReplaceAll(request.Data, " ", ""))
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if len(data) > can.MaxFrameDataLength {
+		ReturnJSONErrorString(w, deviceString, "A CAN frame carries at most 8 bytes", http.StatusBadRequest, true)
+		return
+	}
+
+	var frame can.Frame
+	frame.ID = uint32(id)
+	if request.Extended || id > can.MaskIDSff {
+		frame.ID |= can.MaskEff
+	}
+	if request.RTR {
+		frame.ID |= can.MaskRtr
+	}
+	frame.Length = uint8(len(data))
+	copy(frame.Data[:], data)
+
+	if canBus == nil {
+		ReturnJSONErrorString(w, deviceString, "The CAN bus is not connected", http.StatusServiceUnavailable, true)
+		return
+	}
+	log.Printf("Raw CAN frame sent from %s - %s", r.RemoteAddr, strings.TrimSpace(FormatCandump(time.Now(), canBus.interfaceName, frame, true)))
+	if err := canBus.Publish(frame); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(newRawFrame(frame, "tx")); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+startRawFrameWebSocket streams frames as JSON. Add one or more filter=<id>:<mask> query parameters to limit the
+frames sent, e.g. /can/frames/ws?filter=016:7FF&filter=18FF0000:1FFF0000
+*/
+func startRawFrameWebSocket(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "CAN Frame Stream"
+	if !authorised(w, r, deviceString) {
+		return
+	}
+	client := &rawFrameClientType{frames: make(chan RawFrameType, rawFrameQueueLength)}
+	for _, text := range r.URL.Query()["filter"] {
+		filter, err := ParseRawFrameFilter(text)
+		if err != nil {
+			ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+			return
+		}
+		client.filters = append(client.filters, filter)
+	}
+	conn, err := Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	client.conn = conn
+	RawFrames.add(client)
+	log.Printf("Streaming CAN frames to %s with %d filter(s)", r.RemoteAddr, len(client.filters))
+
+	// Watch for the client going away
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				RawFrames.remove(client)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for frame := range client.frames {
+			bytes, err := json.Marshal(frame)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, bytes); err != nil {
+				log.Printf("CAN frame stream to %s - %v", r.RemoteAddr, err)
+				RawFrames.remove(client)
+				break
+			}
+		}
+		if err := conn.Close(); err != nil {
+			log.Println(err)
+		}
+		RawFrames.mu.Lock()
+		dropped := client.dropped
+		RawFrames.mu.Unlock()
+		log.Printf("CAN frame stream to %s closed. %d frames dropped", r.RemoteAddr, dropped)
+	}()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/brutella/can"
+	"testing"
+	"time"
+)
+
+func TestRawFrameFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters []RawFrameFilterType
+		id      uint32
+		want    bool
+	}{
+		{name: "No filters", id: 0x123, want: true},
+		{name: "Exact match", filters: []RawFrameFilterType{{ID: 0x123, Mask: 0x7FF}}, id: 0x123, want: true},
+		{name: "Exact miss", filters: []RawFrameFilterType{{ID: 0x123, Mask: 0x7FF}}, id: 0x124},
+		{name: "Masked range", filters: []RawFrameFilterType{{ID: 0x110, Mask: 0x7F0}}, id: 0x11F, want: true},
+		{name: "Second filter", filters: []RawFrameFilterType{{ID: 0x200, Mask: 0x7FF}, {ID: 0x300, Mask: 0x7FF}}, id: 0x300, want: true},
+		{name: "Extended ignores the flag", filters: []RawFrameFilterType{{ID: 0x18FF0001, Mask: 0x1FFFFFFF}},
+			id: 0x18FF0001 | can.MaskEff, want: true},
+	}
+	for _, test := range tests {
+		client := &rawFrameClientType{filters: test.filters}
+		if got := client.matches(can.Frame{ID: test.id}); got != test.want {
+			t.Errorf("%s: matches = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestLoopbackEcho checks that our own frames coming back on a loopback bus are shown as sent and not counted as received
+func TestLoopbackEcho(t *testing.T) {
+	const id = 0x7E5
+	client := &rawFrameClientType{filters: []RawFrameFilterType{{ID: id, Mask: 0x7FF}}, frames: make(chan RawFrameType, 4)}
+	RawFrames.add(client)
+	defer RawFrames.remove(client)
+	received := func() uint64 {
+		CANStats.mu.Lock()
+		defer CANStats.mu.Unlock()
+		return CANStats.rxCount
+	}
+	next := func() RawFrameType {
+		t.Helper()
+		select {
+		case frame := <-client.frames:
+			return frame
+		case <-time.After(time.Second):
+			t.Fatal("no frame was dispatched")
+		}
+		return RawFrameType{}
+	}
+
+	before := received()
+	if err := canBus.Publish(can.Frame{ID: id, Length: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if frame := next(); frame.Dir != "tx" {
+		t.Errorf("our frame was dispatched as %s", frame.Dir)
+	}
+	if count := received(); count != before {
+		t.Errorf("%d frames counted as received for our own frame", count-before)
+	}
+
+	if err := testBus(t).Inject(can.Frame{ID: id, Length: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if frame := next(); frame.Dir != "rx" {
+		t.Errorf("a frame from another node was dispatched as %s", frame.Dir)
+	}
+	if count := received(); count != before+1 {
+		t.Errorf("%d frames counted as received, want 1", count-before)
+	}
+}
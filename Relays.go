@@ -15,6 +15,7 @@ type RelayType struct {
 type RelaysType struct {
 	Relays [16]RelayType `json:"Relays"`
 	mu     sync.Mutex
+	board  *BoardType
 }
 
 func (rl *RelaysType) InitRelays() {
@@ -73,9 +74,20 @@ func (rl *RelaysType) SetRelayName(relay uint8, name string) {
 	rl.Relays[relay].Name = name
 }
 
-func (rl *RelaysType) SetRelay(relay uint8, on bool) {
+/*
+SetRelay switches the relay. An InterlockError is returned if an interlock stops it being switched on.
+*/
+func (rl *RelaysType) SetRelay(relay uint8, on bool) error {
+	Interlocks.mu.Lock()
+	defer Interlocks.mu.Unlock()
+	if on {
+		if err := Interlocks.check(rl.board, ActionRelay, relay); err != nil {
+			return err
+		}
+	}
 	// Get the current relay settings
 	relays := rl.GetAllRelays()
+	wasOn := relays&(uint16(1)<<relay) != 0
 	// Set or reset the supplied relay
 	if on {
 		relays |= uint16(1) << relay
@@ -83,19 +95,20 @@ func (rl *RelaysType) SetRelay(relay uint8, on bool) {
 		relays &= ^(uint16(1) << relay)
 	}
 	// Set the hardware
-	if err := canBus.SetRelays(relays); err != nil {
+	if err := canBus.SetRelays(rl.board, relays); err != nil {
 		log.Print(err)
 	}
 	// Update the local copy
 	rl.SetAllRelays(relays)
+	Interlocks.switched(rl.board, ActionRelay, relay, wasOn, on)
+	return nil
 }
 
 func (rl *RelaysType) SetRelayByName(relay string, on bool) error {
 	relay = strings.ToLower(relay)
 	for idx, r := range rl.Relays {
 		if strings.ToLower(r.Name) == relay {
-			rl.SetRelay(uint8(idx), on)
-			return nil
+			return rl.SetRelay(uint8(idx), on)
 		}
 	}
 	return fmt.Errorf("invalid relay name - %s", relay)
@@ -106,7 +119,7 @@ UpdateRelays retransmits the current relay settings as a heartbeat signal to the
 */
 func (rl *RelaysType) UpdateRelays() {
 	relays := rl.GetAllRelays()
-	if err := canBus.SetRelays(relays); err != nil {
+	if err := canBus.SetRelays(rl.board, relays); err != nil {
 		log.Print(err)
 	}
 }
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Rules link the board inputs, analog values, AC/DC measurements and fuel cell state to the relays, digital outputs
+and fuel cells so each site's interlocks can be configured instead of written as custom code.
+
+A rule becomes active when all (or any) of its conditions have held for OnDelaySeconds and clears when they have
+been false for OffDelaySeconds. Threshold conditions have hysteresis so a value sitting on the threshold does not
+toggle the rule. Actions run once as the rule becomes active and ClearActions run once as it clears. Conditions
+whose data is stale or missing are treated as false.
+*/
+
+// Condition types
+const (
+	RuleConditionInput     = "input"     // Digital input is on or off
+	RuleConditionAnalog    = "analog"    // Calibrated analog input is above or below a threshold
+	RuleConditionAC        = "ac"        // AC measurement is above or below a threshold
+	RuleConditionDC        = "dc"        // DC measurement is above or below a threshold
+	RuleConditionPowerMode = "powerMode" // The fuel cell reports the given power mode
+	RuleConditionAlarm     = "alarm"     // The fuel cell has an alarm
+)
+
+const (
+	RuleMatchAll = "all"
+	RuleMatchAny = "any"
+)
+
+const ruleCheckInterval = time.Millisecond * 250
+
+type RuleConditionType struct {
+	Type       string  // input, analog, ac, dc, powerMode or alarm
+	Board      uint8   // Node ID of the board for input, analog, ac and dc
+	Channel    uint8   // Digital input, analog input or measurement device
+	Measure    string  // ac: volts, amps, power or frequency. dc: volts, amps or power
+	Compare    string  // above or below for analog, ac and dc
+	Threshold  float64 // Calibrated units
+	Hysteresis float64 // The value must come back past the threshold by this much before the condition clears
+	State      string  // input: on or off. powerMode: the mode name. alarm: text in the alarm, empty for any alarm
+	FuelCell   int     // Fuel cell for powerMode and alarm. 0 is the main fuel cell
+}
+
+type RuleType struct {
+	Name            string
+	Enabled         bool
+	Match           string // all or any. Empty for all
+	Conditions      []RuleConditionType
+	OnDelaySeconds  float64 // The conditions must hold this long before the rule becomes active
+	OffDelaySeconds float64 // The conditions must be false this long before the rule clears
+	Actions         []ActionType
+	ClearActions    []ActionType
+}
+
+type ruleStateType struct {
+	met        []bool // Each condition after hysteresis
+	values     []float64
+	errors     []string
+	active     bool
+	since      time.Time // When the rule last became active or cleared
+	changing   time.Time // When the conditions started to disagree with active. Zero if they agree
+	lastAction string
+}
+
+type RulesEngineType struct {
+	mu     sync.Mutex
+	states map[string]*ruleStateType // Keyed on rule name
+}
+
+var Rules = RulesEngineType{states: make(map[string]*ruleStateType)}
+
+func (c *RuleConditionType) validate() error {
+	switch c.Type {
+	case RuleConditionInput, RuleConditionAnalog, RuleConditionAC, RuleConditionDC:
+		if GetBoard(c.Board) == nil {
+			return fmt.Errorf("there is no board with node ID %d", c.Board)
+		}
+	case RuleConditionPowerMode, RuleConditionAlarm:
+		if GetFuelCell(c.FuelCell) == nil {
+			return fmt.Errorf("there is no fuel cell %d", c.FuelCell)
+		}
+	default:
+		return fmt.Errorf("condition type must be %s, %s, %s, %s, %s or %s", RuleConditionInput, RuleConditionAnalog,
+			RuleConditionAC, RuleConditionDC, RuleConditionPowerMode, RuleConditionAlarm)
+	}
+	switch c.Type {
+	case RuleConditionInput:
+		if c.Channel > 3 {
+			return fmt.Errorf("digital input must be 0 to 3")
+		}
+		if c.State != "on" && c.State != "off" {
+			return fmt.Errorf("digital input state must be on or off")
+		}
+		return nil
+	case RuleConditionPowerMode:
+		if _, found := powerModeByName(c.State); !found {
+			return fmt.Errorf("unknown power mode %s", c.State)
+		}
+		return nil
+	case RuleConditionAlarm:
+		return nil
+	case RuleConditionAnalog:
+		if c.Channel > 7 {
+			return fmt.Errorf("analog input must be 0 to 7")
+		}
+	case RuleConditionAC:
+		if c.Channel > 3 {
+			return fmt.Errorf("AC measurement device must be 0 to 3")
+		}
+		if c.Measure != "volts" && c.Measure != "amps" && c.Measure != "power" && c.Measure != "frequency" {
+			return fmt.Errorf("AC measure must be volts, amps, power or frequency")
+		}
+	case RuleConditionDC:
+		if c.Channel > 3 {
+			return fmt.Errorf("DC measurement device must be 0 to 3")
+		}
+		if c.Measure != "volts" && c.Measure != "amps" && c.Measure != "power" {
+			return fmt.Errorf("DC measure must be volts, amps or power")
+		}
+	}
+	if c.Compare != "above" && c.Compare != "below" {
+		return fmt.Errorf("compare must be above or below")
+	}
+	if c.Hysteresis < 0 {
+		return fmt.Errorf("hysteresis cannot be negative")
+	}
+	return nil
+}
+
+func (rule *RuleType) validate() error {
+	if rule.Name == "" {
+		return fmt.Errorf("every rule needs a name")
+	}
+	if rule.Match != "" && rule.Match != RuleMatchAll && rule.Match != RuleMatchAny {
+		return fmt.Errorf("%s: match must be %s or %s", rule.Name, RuleMatchAll, RuleMatchAny)
+	}
+	if len(rule.Conditions) == 0 {
+		return fmt.Errorf("%s: a rule needs at least one condition", rule.Name)
+	}
+	if rule.OnDelaySeconds < 0 || rule.OffDelaySeconds < 0 {
+		return fmt.Errorf("%s: delays cannot be negative", rule.Name)
+	}
+	for i := range rule.Conditions {
+		if err := rule.Conditions[i].validate(); err != nil {
+			return fmt.Errorf("%s condition %d: %v", rule.Name, i+1, err)
+		}
+	}
+	for i := range rule.Actions {
+		if err := rule.Actions[i].validate(); err != nil {
+			return fmt.Errorf("%s action %d: %v", rule.Name, i+1, err)
+		}
+	}
+	for i := range rule.ClearActions {
+		if err := rule.ClearActions[i].validate(); err != nil {
+			return fmt.Errorf("%s clear action %d: %v", rule.Name, i+1, err)
+		}
+	}
+	return nil
+}
+
+/*
+checkedRules returns a copy of the rules with any that fail validation, or reuse a name, disabled and logged
+*/
+func checkedRules(rules []RuleType) []RuleType {
+	checked := make([]RuleType, len(rules))
+	copy(checked, rules)
+	names := make(map[string]bool)
+	for i := range checked {
+		err := checked[i].validate()
+		if err == nil && names[checked[i].Name] {
+			err = fmt.Errorf("there is more than one rule called %s", checked[i].Name)
+		}
+		names[checked[i].Name] = true
+		if err != nil && checked[i].Enabled {
+			log.Printf("Rule %d disabled - %v", i+1, err)
+			checked[i].Enabled = false
+		}
+	}
+	return checked
+}
+
+func validateRules(rules []RuleType) error {
+	names := make(map[string]bool)
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return err
+		}
+		if names[rules[i].Name] {
+			return fmt.Errorf("there is more than one rule called %s", rules[i].Name)
+		}
+		names[rules[i].Name] = true
+	}
+	return nil
+}
+
+// powerModeByName returns the power mode with the given name, ignoring case
+func powerModeByName(name string) (PowerModeStateType, bool) {
+	for mode := PMOff; mode <= PMShutdown; mode++ {
+		if strings.EqualFold(mode.String(), name) {
+			return mode, true
+		}
+	}
+	return PMOff, false
+}
+
+/*
+value reads the condition's input. Inputs give 1 for on, power modes give the mode and alarms give the number of
+matching alarms. An error is returned if the board, fuel cell, channel or data is missing or stale.
+*/
+func (c *RuleConditionType) value() (value float64, err error) {
+	if c.Type == RuleConditionPowerMode || c.Type == RuleConditionAlarm {
+		fuelCell := GetFuelCell(c.FuelCell)
+		if fuelCell == nil {
+			return 0, fmt.Errorf("there is no fuel cell %d", c.FuelCell)
+		}
+		measurements := fuelCell.Measurements()
+		if !measurements.ModeValid {
+			return 0, fmt.Errorf("fuel cell data is stale")
+		}
+		if c.Type == RuleConditionPowerMode {
+			return float64(measurements.PowerMode), nil
+		}
+		count := 0
+		for _, alarm := range fuelCell.AlarmText() {
+			if c.State == "" || strings.Contains(strings.ToLower(alarm), strings.ToLower(c.State)) {
+				count++
+			}
+		}
+		return float64(count), nil
+	}
+
+	board := GetBoard(c.Board)
+	if board == nil {
+		return 0, fmt.Errorf("there is no board with node ID %d", c.Board)
+	}
+	switch c.Type {
+	case RuleConditionInput:
+		if int(c.Channel) >= len(board.Inputs.Inputs) {
+			return 0, fmt.Errorf("there is no digital input %d", c.Channel)
+		}
+		if Freshness.IsStale(board.freshnessName("AnalogInternal")) {
+			return 0, fmt.Errorf("input data is stale")
+		}
+		if board.Inputs.GetInput(c.Channel) {
+			return 1, nil
+		}
+		return 0, nil
+	case RuleConditionAnalog:
+		if int(c.Channel) >= len(board.AnalogInputs.Inputs) {
+			return 0, fmt.Errorf("there is no analog input %d", c.Channel)
+		}
+		message := "Analog0to3"
+		if c.Channel > 3 {
+			message = "Analog4to7"
+		}
+		if Freshness.IsStale(board.freshnessName(message)) {
+			return 0, fmt.Errorf("analog data is stale")
+		}
+		_, value := board.AnalogInputs.GetInput(c.Channel)
+		return float64(value), nil
+	case RuleConditionAC:
+		if int(c.Channel) >= len(board.ACMeasurements) {
+			return 0, fmt.Errorf("there is no AC measurement device %d", c.Channel)
+		}
+		if Freshness.IsStale(board.freshnessName(fmt.Sprintf("AC%d", c.Channel))) {
+			return 0, fmt.Errorf("AC measurement is stale")
+		}
+		ac := &board.ACMeasurements[c.Channel]
+		switch c.Measure {
+		case "volts":
+			return float64(ac.getVolts()), nil
+		case "amps":
+			return float64(ac.getAmps()), nil
+		case "power":
+			return float64(ac.getPower()), nil
+		default:
+			return float64(ac.getFrequency()), nil
+		}
+	case RuleConditionDC:
+		if int(c.Channel) >= len(board.DCMeasurements) {
+			return 0, fmt.Errorf("there is no DC measurement device %d", c.Channel)
+		}
+		if Freshness.IsStale(board.freshnessName(fmt.Sprintf("DC%d", c.Channel))) {
+			return 0, fmt.Errorf("DC measurement is stale")
+		}
+		dc := &board.DCMeasurements[c.Channel]
+		switch c.Measure {
+		case "volts":
+			return float64(dc.getVolts()), nil
+		case "amps":
+			return float64(dc.getAmps()), nil
+		default:
+			return float64(dc.getPower()), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown condition type %s", c.Type)
+}
+
+// met applies the comparison to the value. wasMet is used for the hysteresis.
+func (c *RuleConditionType) met(value float64, wasMet bool) bool {
+	switch c.Type {
+	case RuleConditionInput:
+		return (value != 0) == (c.State == "on")
+	case RuleConditionPowerMode:
+		mode, _ := powerModeByName(c.State)
+		return PowerModeStateType(value) == mode
+	case RuleConditionAlarm:
+		return value > 0
+	}
+	hysteresis := 0.0
+	if wasMet {
+		hysteresis = c.Hysteresis
+	}
+	if c.Compare == "above" {
+		return value > c.Threshold-hysteresis
+	}
+	return value < c.Threshold+hysteresis
+}
+
+/*
+Run evaluates the rules four times a second
+*/
+func (re *RulesEngineType) Run() {
+	checkTime := time.NewTicker(ruleCheckInterval)
+	for {
+		now := <-checkTime.C
+		re.step(now)
+	}
+}
+
+func (re *RulesEngineType) step(now time.Time) {
+	rules := currentSettings.ruleList()
+	type reading struct {
+		value float64
+		err   error
+	}
+	readings := make([][]reading, len(rules))
+	for i := range rules {
+		if !rules[i].Enabled {
+			continue
+		}
+		readings[i] = make([]reading, len(rules[i].Conditions))
+		for j := range rules[i].Conditions {
+			readings[i][j].value, readings[i][j].err = rules[i].Conditions[j].value()
+		}
+	}
+
+	type pendingActions struct {
+		rule    string
+		actions []ActionType
+	}
+	var pending []pendingActions
+
+	re.mu.Lock()
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Enabled {
+			// Start again from inactive if the rule is enabled again
+			delete(re.states, rule.Name)
+			continue
+		}
+		state := re.state(rule)
+		matched := 0
+		for j := range rule.Conditions {
+			state.values[j] = readings[i][j].value
+			state.errors[j] = ""
+			if readings[i][j].err != nil {
+				state.met[j] = false
+				state.errors[j] = readings[i][j].err.Error()
+			} else {
+				state.met[j] = rule.Conditions[j].met(readings[i][j].value, state.met[j])
+			}
+			if state.met[j] {
+				matched++
+			}
+		}
+		conditionsMet := matched == len(rule.Conditions)
+		if rule.Match == RuleMatchAny {
+			conditionsMet = matched > 0
+		}
+
+		if conditionsMet == state.active {
+			state.changing = time.Time{}
+			continue
+		}
+		if state.changing.IsZero() {
+			state.changing = now
+		}
+		delay := rule.OffDelaySeconds
+		if conditionsMet {
+			delay = rule.OnDelaySeconds
+		}
+		if now.Sub(state.changing) < time.Duration(delay*float64(time.Second)) {
+			continue
+		}
+		state.active = conditionsMet
+		state.since = now
+		state.changing = time.Time{}
+		actions := rule.ClearActions
+		if conditionsMet {
+			log.Printf("Rule %s is active", rule.Name)
+			actions = rule.Actions
+			state.lastAction = "Active"
+		} else {
+			log.Printf("Rule %s has cleared", rule.Name)
+			state.lastAction = "Cleared"
+		}
+		for _, action := range actions {
+			state.lastAction += ". " + action.String()
+		}
+		pending = append(pending, pendingActions{rule: rule.Name, actions: actions})
+	}
+	re.mu.Unlock()
+
+	for _, p := range pending {
+		for _, action := range p.actions {
+			action.run(EventSourceRule, p.rule)
+		}
+	}
+}
+
+// state must be called with the rules engine locked. It returns the state for the rule, creating it if needed.
+func (re *RulesEngineType) state(rule *RuleType) *ruleStateType {
+	state, found := re.states[rule.Name]
+	if !found || len(state.met) != len(rule.Conditions) {
+		state = &ruleStateType{met: make([]bool, len(rule.Conditions)), values: make([]float64, len(rule.Conditions)),
+			errors: make([]string, len(rule.Conditions))}
+		re.states[rule.Name] = state
+	}
+	return state
+}
+
+/*
+reset forgets the state of every rule. Called when the rules are changed so they all start again from inactive.
+*/
+func (re *RulesEngineType) reset() {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	re.states = make(map[string]*ruleStateType)
+}
+
+type RuleConditionStatusType struct {
+	RuleConditionType
+	Value float64
+	Met   bool
+	Error string `json:",omitempty"`
+}
+
+type RuleStatusType struct {
+	Name       string
+	Enabled    bool
+	Active     bool
+	Since      time.Time
+	Pending    float64 `json:",omitempty"` // Seconds the conditions have disagreed with the rule state
+	LastAction string  `json:",omitempty"`
+	Conditions []RuleConditionStatusType
+	Rule       RuleType
+}
+
+func (re *RulesEngineType) Status() []RuleStatusType {
+	rules := currentSettings.ruleList()
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	status := make([]RuleStatusType, 0, len(rules))
+	for i := range rules {
+		rule := &rules[i]
+		state := re.state(rule)
+		ruleStatus := RuleStatusType{Name: rule.Name, Enabled: rule.Enabled, Active: state.active, Since: state.since,
+			LastAction: state.lastAction, Rule: *rule}
+		if !state.changing.IsZero() {
+			ruleStatus.Pending = time.Since(state.changing).Seconds()
+		}
+		for j, condition := range rule.Conditions {
+			ruleStatus.Conditions = append(ruleStatus.Conditions, RuleConditionStatusType{RuleConditionType: condition,
+				Value: state.values[j], Met: state.met[j], Error: state.errors[j]})
+		}
+		status = append(status, ruleStatus)
+	}
+	return status
+}
+
+func getRules(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Rules"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(Rules.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+setRules replaces every rule with the JSON array in the body
+*/
+func setRules(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Rules"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	var rules []RuleType
+	if err := json.Unmarshal(body, &rules); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := validateRules(rules); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	currentSettings.setRuleList(rules)
+	Rules.reset()
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getRules(w, r)
+}
+
+/*
+enableRule turns the rule given by {name} on or off without changing anything else
+*/
+func enableRule(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Enable Rule"
+	vars := mux.Vars(r)
+	current := currentSettings.ruleList()
+	rules := make([]RuleType, len(current))
+	copy(rules, current)
+	found := false
+	for i := range rules {
+		if rules[i].Name == vars["name"] {
+			rules[i].Enabled = vars["state"] == "Enable"
+			found = true
+			// A rule from the settings file may have been disabled because it is not valid
+			if rules[i].Enabled {
+				if err := rules[i].validate(); err != nil {
+					ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+					return
+				}
+			}
+		}
+	}
+	if !found {
+		ReturnJSONErrorString(w, deviceString, fmt.Sprintf("There is no rule called %s", vars["name"]), http.StatusNotFound, false)
+		return
+	}
+	currentSettings.setRuleList(rules)
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getRules(w, r)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRuleConditionMet(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition RuleConditionType
+		value     float64
+		wasMet    bool
+		want      bool
+	}{
+		{"Input on", RuleConditionType{Type: RuleConditionInput, State: "on"}, 1, false, true},
+		{"Input off wanted on", RuleConditionType{Type: RuleConditionInput, State: "on"}, 0, false, false},
+		{"Input off", RuleConditionType{Type: RuleConditionInput, State: "off"}, 0, false, true},
+		{"Power mode matches", RuleConditionType{Type: RuleConditionPowerMode, State: "Manual"}, float64(PMManual), false, true},
+		{"Power mode differs", RuleConditionType{Type: RuleConditionPowerMode, State: "fault"}, float64(PMManual), false, false},
+		{"Alarm present", RuleConditionType{Type: RuleConditionAlarm}, 2, false, true},
+		{"No alarm", RuleConditionType{Type: RuleConditionAlarm}, 0, false, false},
+		{"Above threshold", RuleConditionType{Type: RuleConditionAnalog, Compare: "above", Threshold: 50}, 51, false, true},
+		{"At threshold is not above", RuleConditionType{Type: RuleConditionAnalog, Compare: "above", Threshold: 50}, 50, false, false},
+		{"Below threshold", RuleConditionType{Type: RuleConditionDC, Compare: "below", Threshold: 48}, 47.5, false, true},
+		{"Not below threshold", RuleConditionType{Type: RuleConditionDC, Compare: "below", Threshold: 48}, 48.5, false, false},
+		{"Above held by hysteresis", RuleConditionType{Type: RuleConditionAC, Compare: "above", Threshold: 50, Hysteresis: 5}, 46, true, true},
+		{"Above cleared past hysteresis", RuleConditionType{Type: RuleConditionAC, Compare: "above", Threshold: 50, Hysteresis: 5}, 45, true, false},
+		{"Hysteresis only once met", RuleConditionType{Type: RuleConditionAC, Compare: "above", Threshold: 50, Hysteresis: 5}, 46, false, false},
+		{"Below held by hysteresis", RuleConditionType{Type: RuleConditionDC, Compare: "below", Threshold: 48, Hysteresis: 2}, 49.5, true, true},
+		{"Below cleared past hysteresis", RuleConditionType{Type: RuleConditionDC, Compare: "below", Threshold: 48, Hysteresis: 2}, 50, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if met := test.condition.met(test.value, test.wasMet); met != test.want {
+				t.Errorf("met(%v, %v) = %v, want %v", test.value, test.wasMet, met, test.want)
+			}
+		})
+	}
+}
+
+func TestRuleConditionValueChannel(t *testing.T) {
+	board := MainBoard().NodeID
+	tests := []RuleConditionType{
+		{Type: RuleConditionInput, Board: board, Channel: 4, State: "on"},
+		{Type: RuleConditionAnalog, Board: board, Channel: 8, Compare: "above"},
+		{Type: RuleConditionAC, Board: board, Channel: 4, Measure: "volts", Compare: "above"},
+		{Type: RuleConditionDC, Board: board, Channel: 5, Measure: "volts", Compare: "above"},
+	}
+	for _, condition := range tests {
+		if _, err := condition.value(); err == nil {
+			t.Errorf("%s channel %d gave no error", condition.Type, condition.Channel)
+		}
+	}
+}
+
+// TestRulesCheckedOnLoad checks that rules from the settings file that would not pass the API are disabled
+func TestRulesCheckedOnLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	file := `{"Rules": [
+		{"Name": "Good", "Enabled": true, "Conditions": [{"Type": "input", "Channel": 1, "State": "on"}],
+			"Actions": [{"Type": "relay", "Channel": 2, "On": true}]},
+		{"Name": "Bad input", "Enabled": true, "Conditions": [{"Type": "input", "Channel": 5, "State": "on"}]},
+		{"Name": "Bad relay", "Enabled": true, "Conditions": [{"Type": "input", "Channel": 1, "State": "on"}],
+			"Actions": [{"Type": "relay", "Channel": 16, "On": true}]},
+		{"Name": "Good", "Enabled": true, "Conditions": [{"Type": "alarm"}]},
+		{"Name": "Off", "Conditions": [{"Type": "input", "Channel": 5, "State": "on"}]}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings := NewSettings()
+	if err := settings.LoadSettings(path); err != nil {
+		t.Fatal(err)
+	}
+	want := []bool{true, false, false, false, false}
+	rules := settings.ruleList()
+	if len(rules) != len(want) {
+		t.Fatalf("%d rules loaded, want %d", len(rules), len(want))
+	}
+	for i, rule := range rules {
+		if rule.Enabled != want[i] {
+			t.Errorf("rule %d (%s): enabled = %v, want %v", i+1, rule.Name, rule.Enabled, want[i])
+		}
+	}
+}
+
+// TestRulesStepBadChannel checks that an enabled rule with a channel past the end of the inputs does not panic
+func TestRulesStepBadChannel(t *testing.T) {
+	saved := currentSettings.ruleList()
+	defer func() {
+		currentSettings.setRuleList(saved)
+		Rules.reset()
+	}()
+	currentSettings.setRuleList([]RuleType{{Name: "Bad", Enabled: true,
+		Conditions: []RuleConditionType{{Type: RuleConditionInput, Board: MainBoard().NodeID, Channel: 5, State: "on"}}}})
+	Rules.step(time.Now())
+	status := Rules.Status()
+	if len(status) != 1 || status[0].Conditions[0].Error == "" {
+		t.Errorf("the bad channel was not reported - %+v", status)
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The scheduler runs actions at set times of day. Each schedule entry either has a cron expression
+(minute hour day-of-month month day-of-week) or runs at sunrise or sunset plus an offset. Sunrise and sunset are
+worked out here from the site latitude and longitude so no internet connection is needed. Times are in the local
+time zone of the controller.
+
+Holidays are dates on which entries can be skipped (or the only dates on which they run). Runs that were missed
+while the controller was off are not made up when it starts again.
+*/
+
+const (
+	ScheduleSunrise = "sunrise"
+	ScheduleSunset  = "sunset"
+)
+
+// What an entry does on a holiday
+const (
+	ScheduleHolidayRun  = "run"  // Ignore holidays
+	ScheduleHolidaySkip = "skip" // Do not run on holidays
+	ScheduleHolidayOnly = "only" // Only run on holidays
+)
+
+const schedulePreviewMaxHours = 24 * 31
+const schedulePreviewMaxRuns = 1000
+
+type ScheduleEntryType struct {
+	Name          string
+	Enabled       bool
+	Cron          string  `json:",omitempty"` // minute hour day-of-month month day-of-week
+	Sun           string  `json:",omitempty"` // sunrise or sunset. Used when Cron is empty
+	OffsetMinutes float64 // Added to sunrise or sunset. Negative runs before
+	Holidays      string  // run, skip or only. Empty for run
+	Actions       []ActionType
+	cron          *cronType // Cron parsed by validate
+}
+
+type ScheduleSettingsType struct {
+	Latitude  float64  // Degrees, north is positive
+	Longitude float64  // Degrees, east is positive
+	Holidays  []string // YYYY-MM-DD, or MM-DD for a holiday on the same date every year
+	Entries   []ScheduleEntryType
+}
+
+type scheduleStateType struct {
+	next       time.Time
+	valid      bool // false if the entry never runs
+	lastRun    time.Time
+	lastResult string
+}
+
+type SchedulerType struct {
+	mu     sync.Mutex
+	states map[string]*scheduleStateType // Keyed on entry name
+}
+
+var Scheduler = SchedulerType{states: make(map[string]*scheduleStateType)}
+
+/*
+cronType holds a parsed cron expression. Each field is a set of the values that match.
+*/
+type cronType struct {
+	minute  [60]bool
+	hour    [24]bool
+	dom     [32]bool
+	month   [13]bool
+	dow     [7]bool
+	domStar bool
+	dowStar bool
+}
+
+/*
+parseCronField parses one field of a cron expression. It accepts *, single values, ranges (a-b) and steps (a-b/n, or
+a star followed by /n) separated by commas.
+*/
+func parseCronField(field string, min int, max int, set []bool) (star bool, err error) {
+	star = field == "*"
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			if step, err = strconv.Atoi(part[slash+1:]); err != nil || step < 1 {
+				return false, fmt.Errorf("bad step in %s", part)
+			}
+			part = part[:slash]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return false, fmt.Errorf("bad value %s", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return false, fmt.Errorf("bad range %s", part)
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return false, fmt.Errorf("%s is outside %d to %d", part, min, max)
+		}
+		for value := low; value <= high; value += step {
+			set[value] = true
+		}
+	}
+	return star, nil
+}
+
+func parseCron(expression string) (*cronType, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have five fields - minute hour day-of-month month day-of-week")
+	}
+	cron := new(cronType)
+	var err error
+	if _, err = parseCronField(fields[0], 0, 59, cron.minute[:]); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if _, err = parseCronField(fields[1], 0, 23, cron.hour[:]); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if cron.domStar, err = parseCronField(fields[2], 1, 31, cron.dom[:]); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if _, err = parseCronField(fields[3], 1, 12, cron.month[:]); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	// Day of week allows 7 for Sunday as well as 0
+	var dow [8]bool
+	if cron.dowStar, err = parseCronField(fields[4], 0, 7, dow[:]); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	copy(cron.dow[:], dow[:7])
+	cron.dow[0] = cron.dow[0] || dow[7]
+	return cron, nil
+}
+
+/*
+dayMatches follows the usual cron rule. If both day of month and day of week are restricted the day matches if
+either of them does.
+*/
+func (cron *cronType) dayMatches(t time.Time) bool {
+	if !cron.month[t.Month()] {
+		return false
+	}
+	if cron.domStar || cron.dowStar {
+		return cron.dom[t.Day()] && cron.dow[t.Weekday()]
+	}
+	return cron.dom[t.Day()] || cron.dow[t.Weekday()]
+}
+
+// next returns the first matching minute after the given time. ok is false if there is none within a year.
+func (cron *cronType) next(after time.Time) (next time.Time, ok bool) {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(1, 0, 1)
+	for t.Before(limit) {
+		if !cron.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+/*
+sunriseSunset works out the times of sunrise and sunset on the given date using the NOAA sunrise equation. ok is
+false if the sun does not rise or does not set that day (polar day or night).
+*/
+func sunriseSunset(date time.Time, latitude float64, longitude float64) (sunrise time.Time, sunset time.Time, ok bool) {
+	const toRadians = math.Pi / 180
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	// Days since noon on 1st January 2000
+	n := math.Round(float64(noon.Unix())/86400 + 2440587.5 - 2451545.0)
+	meanSolarNoon := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanSolarNoon, 360) * toRadians
+	centre := 1.9148*math.Sin(anomaly) + 0.02*math.Sin(2*anomaly) + 0.0003*math.Sin(3*anomaly)
+	eclipticLongitude := math.Mod(anomaly/toRadians+centre+180+102.9372, 360) * toRadians
+	transit := 2451545.0 + meanSolarNoon + 0.0053*math.Sin(anomaly) - 0.0069*math.Sin(2*eclipticLongitude)
+	declination := math.Asin(math.Sin(eclipticLongitude) * math.Sin(23.4397*toRadians))
+	cosHourAngle := (math.Sin(-0.833*toRadians) - math.Sin(latitude*toRadians)*math.Sin(declination)) /
+		(math.Cos(latitude*toRadians) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) / toRadians
+	julianToTime := func(julian float64) time.Time {
+		return time.Unix(int64(math.Round((julian-2440587.5)*86400)), 0).In(date.Location())
+	}
+	return julianToTime(transit - hourAngle/360), julianToTime(transit + hourAngle/360), true
+}
+
+/*
+next returns the next time the entry runs after the given time. ok is false if it does not run within a year.
+A cron entry never runs until validate has parsed the expression.
+*/
+func (entry *ScheduleEntryType) next(after time.Time, settings *ScheduleSettingsType) (next time.Time, ok bool) {
+	if entry.Cron != "" {
+		if entry.cron == nil {
+			return time.Time{}, false
+		}
+		return entry.cron.next(after)
+	}
+	offset := time.Duration(entry.OffsetMinutes * float64(time.Minute))
+	// Start a day early in case a large negative offset moves tomorrow's run to today
+	day := time.Date(after.Year(), after.Month(), after.Day()-1, 12, 0, 0, 0, after.Location())
+	for i := 0; i < 368; i++ {
+		sunrise, sunset, found := sunriseSunset(day.AddDate(0, 0, i), settings.Latitude, settings.Longitude)
+		if !found {
+			continue
+		}
+		next = sunrise.Add(offset)
+		if entry.Sun == ScheduleSunset {
+			next = sunset.Add(offset)
+		}
+		if next.After(after) {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// isHoliday returns true if the date of t is in the holiday list
+func (settings *ScheduleSettingsType) isHoliday(t time.Time) bool {
+	date := t.Format("2006-01-02")
+	for _, holiday := range settings.Holidays {
+		if holiday == date || holiday == date[5:] {
+			return true
+		}
+	}
+	return false
+}
+
+// runsOn returns false if the holiday setting stops the entry running at time t
+func (entry *ScheduleEntryType) runsOn(t time.Time, settings *ScheduleSettingsType) bool {
+	switch entry.Holidays {
+	case ScheduleHolidaySkip:
+		return !settings.isHoliday(t)
+	case ScheduleHolidayOnly:
+		return settings.isHoliday(t)
+	}
+	return true
+}
+
+/*
+validate checks the entry and keeps the parsed cron expression so it is not parsed again each time the entry is due
+*/
+func (entry *ScheduleEntryType) validate(settings *ScheduleSettingsType) error {
+	if entry.Name == "" {
+		return fmt.Errorf("every schedule entry needs a name")
+	}
+	entry.cron = nil
+	if entry.Cron != "" {
+		if entry.Sun != "" {
+			return fmt.Errorf("%s: give either a cron expression or sunrise/sunset, not both", entry.Name)
+		}
+		cron, err := parseCron(entry.Cron)
+		if err != nil {
+			return fmt.Errorf("%s: %v", entry.Name, err)
+		}
+		entry.cron = cron
+	} else if entry.Sun != ScheduleSunrise && entry.Sun != ScheduleSunset {
+		return fmt.Errorf("%s: needs a cron expression or sun set to %s or %s", entry.Name, ScheduleSunrise, ScheduleSunset)
+	}
+	switch entry.Holidays {
+	case "", ScheduleHolidayRun, ScheduleHolidaySkip, ScheduleHolidayOnly:
+	default:
+		return fmt.Errorf("%s: holidays must be %s, %s or %s", entry.Name, ScheduleHolidayRun, ScheduleHolidaySkip, ScheduleHolidayOnly)
+	}
+	if len(entry.Actions) == 0 {
+		return fmt.Errorf("%s: an entry needs at least one action", entry.Name)
+	}
+	for i := range entry.Actions {
+		if err := entry.Actions[i].validate(); err != nil {
+			return fmt.Errorf("%s action %d: %v", entry.Name, i+1, err)
+		}
+	}
+	if _, ok := entry.next(time.Now(), settings); !ok {
+		return fmt.Errorf("%s never runs", entry.Name)
+	}
+	return nil
+}
+
+func validateHolidays(holidays []string) error {
+	for _, holiday := range holidays {
+		if _, err := time.Parse("2006-01-02", holiday); err == nil {
+			continue
+		}
+		if _, err := time.Parse("01-02", holiday); err != nil {
+			return fmt.Errorf("holiday %s must be YYYY-MM-DD or MM-DD", holiday)
+		}
+	}
+	return nil
+}
+
+func (settings *ScheduleSettingsType) validate() error {
+	if settings.Latitude < -90 || settings.Latitude > 90 {
+		return fmt.Errorf("latitude must be -90 to 90")
+	}
+	if settings.Longitude < -180 || settings.Longitude > 180 {
+		return fmt.Errorf("longitude must be -180 to 180")
+	}
+	if err := validateHolidays(settings.Holidays); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for i := range settings.Entries {
+		if err := settings.Entries[i].validate(settings); err != nil {
+			return err
+		}
+		if names[settings.Entries[i].Name] {
+			return fmt.Errorf("there is more than one schedule entry called %s", settings.Entries[i].Name)
+		}
+		names[settings.Entries[i].Name] = true
+	}
+	return nil
+}
+
+/*
+checkedSchedule returns a copy of the schedule with any entries that fail validation, or reuse a name, disabled and
+logged. The cron expressions of the others are parsed.
+*/
+func checkedSchedule(settings ScheduleSettingsType) ScheduleSettingsType {
+	entries := make([]ScheduleEntryType, len(settings.Entries))
+	copy(entries, settings.Entries)
+	settings.Entries = entries
+	names := make(map[string]bool)
+	for i := range entries {
+		err := entries[i].validate(&settings)
+		if err == nil && names[entries[i].Name] {
+			err = fmt.Errorf("there is more than one schedule entry called %s", entries[i].Name)
+		}
+		names[entries[i].Name] = true
+		if err != nil && entries[i].Enabled {
+			log.Printf("Schedule entry %d disabled - %v", i+1, err)
+			entries[i].Enabled = false
+		}
+	}
+	return settings
+}
+
+/*
+Run checks every second for entries that are due
+*/
+func (s *SchedulerType) Run() {
+	checkTime := time.NewTicker(time.Second)
+	for {
+		now := <-checkTime.C
+		s.step(now)
+	}
+}
+
+func (s *SchedulerType) step(now time.Time) {
+	settings := currentSettings.scheduleSettings()
+	type pendingActions struct {
+		entry   string
+		actions []ActionType
+	}
+	var pending []pendingActions
+
+	s.mu.Lock()
+	for i := range settings.Entries {
+		entry := &settings.Entries[i]
+		if !entry.Enabled {
+			delete(s.states, entry.Name)
+			continue
+		}
+		state, found := s.states[entry.Name]
+		if !found {
+			// Work out the first run from now so runs missed while we were stopped are not made up
+			state = new(scheduleStateType)
+			state.next, state.valid = entry.next(now, &settings)
+			s.states[entry.Name] = state
+			continue
+		}
+		if !state.valid || now.Before(state.next) {
+			continue
+		}
+		state.lastRun = state.next
+		if entry.runsOn(state.next, &settings) {
+			log.Printf("Schedule %s is running", entry.Name)
+			state.lastResult = "Ran"
+			for _, action := range entry.Actions {
+				state.lastResult += ". " + action.String()
+			}
+			pending = append(pending, pendingActions{entry: entry.Name, actions: entry.Actions})
+		} else {
+			log.Printf("Schedule %s skipped for the holiday setting", entry.Name)
+			state.lastResult = "Skipped for the holiday setting"
+		}
+		state.next, state.valid = entry.next(now, &settings)
+	}
+	s.mu.Unlock()
+
+	for _, p := range pending {
+		for _, action := range p.actions {
+			action.run(EventSourceSchedule, p.entry)
+		}
+	}
+}
+
+/*
+reset forgets when each entry is next due. Called when the schedule is changed.
+*/
+func (s *SchedulerType) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states = make(map[string]*scheduleStateType)
+}
+
+type ScheduleEntryStatusType struct {
+	ScheduleEntryType
+	Next       *time.Time `json:",omitempty"`
+	LastRun    *time.Time `json:",omitempty"`
+	LastResult string     `json:",omitempty"`
+}
+
+type ScheduleStatusType struct {
+	Latitude  float64
+	Longitude float64
+	Holidays  []string
+	Sunrise   *time.Time `json:",omitempty"` // Today
+	Sunset    *time.Time `json:",omitempty"`
+	Entries   []ScheduleEntryStatusType
+}
+
+func (s *SchedulerType) Status() ScheduleStatusType {
+	settings := currentSettings.scheduleSettings()
+	now := time.Now()
+	status := ScheduleStatusType{Latitude: settings.Latitude, Longitude: settings.Longitude, Holidays: settings.Holidays,
+		Entries: make([]ScheduleEntryStatusType, 0, len(settings.Entries))}
+	if sunrise, sunset, ok := sunriseSunset(now, settings.Latitude, settings.Longitude); ok {
+		status.Sunrise = &sunrise
+		status.Sunset = &sunset
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range settings.Entries {
+		entryStatus := ScheduleEntryStatusType{ScheduleEntryType: entry}
+		if state, found := s.states[entry.Name]; found {
+			if state.valid {
+				next := state.next
+				entryStatus.Next = &next
+			}
+			if !state.lastRun.IsZero() {
+				lastRun := state.lastRun
+				entryStatus.LastRun = &lastRun
+			}
+			entryStatus.LastResult = state.lastResult
+		}
+		status.Entries = append(status.Entries, entryStatus)
+	}
+	return status
+}
+
+type SchedulePreviewType struct {
+	Time    time.Time
+	Entry   string
+	Actions []string
+	Skipped bool `json:",omitempty"` // The holiday setting stops this run
+}
+
+/*
+Preview lists the runs of every enabled entry between from and from + hours in time order
+*/
+func (settings *ScheduleSettingsType) Preview(from time.Time, hours float64) []SchedulePreviewType {
+	end := from.Add(time.Duration(hours * float64(time.Hour)))
+	preview := make([]SchedulePreviewType, 0)
+	for i := range settings.Entries {
+		entry := &settings.Entries[i]
+		if !entry.Enabled {
+			continue
+		}
+		var actions []string
+		for _, action := range entry.Actions {
+			actions = append(actions, action.String())
+		}
+		for t, ok := entry.next(from, settings); ok && t.Before(end) && len(preview) < schedulePreviewMaxRuns; t, ok = entry.next(t, settings) {
+			preview = append(preview, SchedulePreviewType{Time: t, Entry: entry.Name, Actions: actions, Skipped: !entry.runsOn(t, settings)})
+		}
+	}
+	sort.SliceStable(preview, func(i, j int) bool { return preview[i].Time.Before(preview[j].Time) })
+	return preview
+}
+
+func getSchedule(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Schedule"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(Scheduler.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+setSchedule replaces the site position, holidays and every schedule entry with the JSON in the body
+*/
+func setSchedule(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Schedule"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	var settings ScheduleSettingsType
+	if err := json.Unmarshal(body, &settings); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	currentSettings.setScheduleSettings(settings)
+	Scheduler.reset()
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getSchedule(w, r)
+}
+
+/*
+setHolidays replaces the holiday list with the JSON array of dates in the body
+*/
+func setHolidays(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Set Holidays"
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	var holidays []string
+	if err := json.Unmarshal(body, &holidays); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, true)
+		return
+	}
+	if err := validateHolidays(holidays); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	settings := currentSettings.scheduleSettings()
+	settings.Holidays = holidays
+	currentSettings.setScheduleSettings(settings)
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getSchedule(w, r)
+}
+
+/*
+getSchedulePreview lists the runs due in the next hours (default 24, up to 31 days)
+*/
+func getSchedulePreview(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Get Schedule Preview"
+	hours := 24.0
+	if text := r.URL.Query().Get("hours"); text != "" {
+		var err error
+		if hours, err = strconv.ParseFloat(text, 64); err != nil || hours <= 0 || hours > schedulePreviewMaxHours {
+			ReturnJSONErrorString(w, deviceString, fmt.Sprintf("hours must be a number from 0 to %d", schedulePreviewMaxHours), http.StatusBadRequest, false)
+			return
+		}
+	}
+	settings := currentSettings.scheduleSettings()
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(settings.Preview(time.Now(), hours)); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+enableScheduleEntry turns the entry given by {name} on or off without changing anything else
+*/
+func enableScheduleEntry(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Enable Schedule Entry"
+	vars := mux.Vars(r)
+	settings := currentSettings.scheduleSettings()
+	entries := make([]ScheduleEntryType, len(settings.Entries))
+	copy(entries, settings.Entries)
+	settings.Entries = entries
+	found := false
+	for i := range settings.Entries {
+		if settings.Entries[i].Name == vars["name"] {
+			settings.Entries[i].Enabled = vars["state"] == "Enable"
+			found = true
+			// An entry from the settings file may have been disabled because it is not valid
+			if settings.Entries[i].Enabled {
+				if err := settings.Entries[i].validate(&settings); err != nil {
+					ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+					return
+				}
+			}
+		}
+	}
+	if !found {
+		ReturnJSONErrorString(w, deviceString, fmt.Sprintf("There is no schedule entry called %s", vars["name"]), http.StatusNotFound, false)
+		return
+	}
+	currentSettings.setScheduleSettings(settings)
+	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+		return
+	}
+	getSchedule(w, r)
+}
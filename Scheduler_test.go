@@ -0,0 +1,210 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expression string
+		wantErr    bool
+		minutes    []int
+		hours      []int
+		dows       []int
+		domStar    bool
+		dowStar    bool
+	}{
+		{expression: "0 6 * * *", minutes: []int{0}, hours: []int{6}, dows: []int{0, 1, 2, 3, 4, 5, 6}, domStar: true, dowStar: true},
+		{expression: "*/15 8-17 * * 1-5", minutes: []int{0, 15, 30, 45}, hours: []int{8, 9, 10, 11, 12, 13, 14, 15, 16, 17},
+			dows: []int{1, 2, 3, 4, 5}, domStar: true},
+		{expression: "5,35 0 1 * 7", minutes: []int{5, 35}, hours: []int{0}, dows: []int{0}},
+		{expression: "10-50/20 12 * * 0,6", minutes: []int{10, 30, 50}, hours: []int{12}, dows: []int{0, 6}, domStar: true},
+		{expression: "30 2/6 * * *", minutes: []int{30}, hours: []int{2, 8, 14, 20}, dows: []int{0, 1, 2, 3, 4, 5, 6},
+			domStar: true, dowStar: true},
+		{expression: "0 6 * *", wantErr: true},
+		{expression: "60 6 * * *", wantErr: true},
+		{expression: "0 24 * * *", wantErr: true},
+		{expression: "0 6 0 * *", wantErr: true},
+		{expression: "0 6 * 13 *", wantErr: true},
+		{expression: "0 6 * * 8", wantErr: true},
+		{expression: "*/0 6 * * *", wantErr: true},
+		{expression: "5-1 6 * * *", wantErr: true},
+		{expression: "a 6 * * *", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			cron, err := parseCron(test.expression)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("parseCron returned no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			check := func(field string, set []bool, want []int) {
+				expected := make([]bool, len(set))
+				for _, value := range want {
+					expected[value] = true
+				}
+				for value := range set {
+					if set[value] != expected[value] {
+						t.Errorf("%s %d is %v, want %v", field, value, set[value], expected[value])
+					}
+				}
+			}
+			check("minute", cron.minute[:], test.minutes)
+			check("hour", cron.hour[:], test.hours)
+			check("day of week", cron.dow[:], test.dows)
+			if cron.domStar != test.domStar || cron.dowStar != test.dowStar {
+				t.Errorf("stars = %v %v, want %v %v", cron.domStar, cron.dowStar, test.domStar, test.dowStar)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// Wednesday 15th March 2023
+	after := time.Date(2023, 3, 15, 10, 20, 30, 0, time.UTC)
+	tests := []struct {
+		expression string
+		want       time.Time
+		ok         bool
+	}{
+		{"* * * * *", time.Date(2023, 3, 15, 10, 21, 0, 0, time.UTC), true},
+		{"20 10 * * *", time.Date(2023, 3, 16, 10, 20, 0, 0, time.UTC), true},
+		{"0 6 * * *", time.Date(2023, 3, 16, 6, 0, 0, 0, time.UTC), true},
+		{"*/15 * * * *", time.Date(2023, 3, 15, 10, 30, 0, 0, time.UTC), true},
+		{"0 9 * * 1", time.Date(2023, 3, 20, 9, 0, 0, 0, time.UTC), true},
+		{"0 0 1 * *", time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 1 1 *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		// Day of month and day of week both restricted matches either. The 16th comes before the next Monday.
+		{"0 12 16 * 1", time.Date(2023, 3, 16, 12, 0, 0, 0, time.UTC), true},
+		{"0 12 29 2 *", time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), true},
+		{"0 12 31 2 *", time.Time{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			cron, err := parseCron(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next, ok := cron.next(after)
+			if ok != test.ok || !next.Equal(test.want) {
+				t.Errorf("next(%v) = %v %v, want %v %v", after, next, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestSunriseSunset(t *testing.T) {
+	// Published times rounded to the minute. The sunrise equation is good to a couple of minutes.
+	const tolerance = 3 * time.Minute
+	tests := []struct {
+		name      string
+		date      time.Time
+		latitude  float64
+		longitude float64
+		sunrise   time.Time
+		sunset    time.Time
+		ok        bool
+	}{
+		{"London midsummer", time.Date(2023, 6, 21, 0, 0, 0, 0, time.UTC), 51.5074, -0.1278,
+			time.Date(2023, 6, 21, 3, 43, 0, 0, time.UTC), time.Date(2023, 6, 21, 20, 21, 0, 0, time.UTC), true},
+		{"London midwinter", time.Date(2023, 12, 21, 0, 0, 0, 0, time.UTC), 51.5074, -0.1278,
+			time.Date(2023, 12, 21, 8, 4, 0, 0, time.UTC), time.Date(2023, 12, 21, 15, 54, 0, 0, time.UTC), true},
+		{"Equator equinox", time.Date(2023, 3, 20, 0, 0, 0, 0, time.UTC), 0, 0,
+			time.Date(2023, 3, 20, 6, 4, 0, 0, time.UTC), time.Date(2023, 3, 20, 18, 11, 0, 0, time.UTC), true},
+		{"Tromso polar night", time.Date(2023, 12, 21, 0, 0, 0, 0, time.UTC), 69.6492, 18.9553,
+			time.Time{}, time.Time{}, false},
+		{"Tromso midnight sun", time.Date(2023, 6, 21, 0, 0, 0, 0, time.UTC), 69.6492, 18.9553,
+			time.Time{}, time.Time{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sunrise, sunset, ok := sunriseSunset(test.date, test.latitude, test.longitude)
+			if ok != test.ok {
+				t.Fatalf("ok = %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if diff := sunrise.Sub(test.sunrise); math.Abs(float64(diff)) > float64(tolerance) {
+				t.Errorf("sunrise = %v, want %v", sunrise.UTC(), test.sunrise)
+			}
+			if diff := sunset.Sub(test.sunset); math.Abs(float64(diff)) > float64(tolerance) {
+				t.Errorf("sunset = %v, want %v", sunset.UTC(), test.sunset)
+			}
+		})
+	}
+}
+
+func TestCheckedSchedule(t *testing.T) {
+	relay := ActionType{Type: ActionRelay, Board: MainBoard().NodeID, Channel: 6, On: true}
+	schedule := checkedSchedule(ScheduleSettingsType{Entries: []ScheduleEntryType{
+		{Name: "Hourly", Enabled: true, Cron: "0 * * * *", Actions: []ActionType{relay}},
+		{Name: "Bad cron", Enabled: true, Cron: "0 25 * * *", Actions: []ActionType{relay}},
+		{Name: "Hourly", Enabled: true, Cron: "30 * * * *", Actions: []ActionType{relay}},
+		{Name: "Sunset", Enabled: true, Sun: ScheduleSunset, Actions: []ActionType{relay}},
+		{Name: "No actions", Enabled: true, Cron: "0 * * * *"},
+	}})
+	want := []bool{true, false, false, true, false}
+	for i, entry := range schedule.Entries {
+		if entry.Enabled != want[i] {
+			t.Errorf("entry %d (%s): enabled = %v, want %v", i+1, entry.Name, entry.Enabled, want[i])
+		}
+	}
+	if schedule.Entries[0].cron == nil {
+		t.Fatal("the cron expression was not kept")
+	}
+
+	from := time.Date(2023, 3, 15, 10, 20, 0, 0, time.Local)
+	preview := schedule.Preview(from, 24)
+	hourly := 0
+	for _, run := range preview {
+		if run.Entry == "Hourly" {
+			hourly++
+		}
+	}
+	if hourly != 24 {
+		t.Errorf("%d hourly runs in the preview, want 24", hourly)
+	}
+}
+
+func TestSchedulerStep(t *testing.T) {
+	board := MainBoard()
+	saved := currentSettings.scheduleSettings()
+	defer func() {
+		currentSettings.setScheduleSettings(saved)
+		Scheduler.reset()
+		board.Relays.SetAllRelays(0)
+	}()
+	currentSettings.setScheduleSettings(checkedSchedule(ScheduleSettingsType{Holidays: []string{"03-16"},
+		Entries: []ScheduleEntryType{
+			{Name: "Morning", Enabled: true, Cron: "0 6 * * *", Holidays: ScheduleHolidaySkip,
+				Actions: []ActionType{{Type: ActionRelay, Board: board.NodeID, Channel: 6, On: true}}},
+		}}))
+	Scheduler.reset()
+
+	start := time.Date(2023, 3, 15, 5, 0, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		now  time.Time
+		on   bool
+	}{
+		{name: "First pass only works out the next run", now: start},
+		{name: "Not yet due", now: start.Add(59 * time.Minute)},
+		{name: "Due", now: start.Add(time.Hour), on: true},
+		{name: "Skipped on the holiday", now: start.Add(25 * time.Hour)},
+	}
+	for _, test := range tests {
+		board.Relays.SetAllRelays(0)
+		Scheduler.step(test.now)
+		if on := board.Relays.GetRelay(6); on != test.on {
+			t.Errorf("%s: relay on = %v, want %v", test.name, on, test.on)
+		}
+	}
+}
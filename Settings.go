@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 )
 
 type AnalogSettingType struct {
@@ -30,15 +31,51 @@ type ModbusNameType struct {
 }
 
 type FuelCellSettingsType struct {
-	HighBatterySetpoint float64 // Default high battery setpoint
-	LowBatterySetpoint  float64 // Default low battery setpoint
-	PowerSetting        float64 // Default power level
-	IgnoreIsoLow        bool    // Flag to control IsoLow fault behaviour. True = suppress fault
-	Enabled             bool    // Allow us to control the fuel cell
+	HighBatterySetpoint float64                    // Default high battery setpoint
+	LowBatterySetpoint  float64                    // Default low battery setpoint
+	PowerSetting        float64                    // Default power level
+	IgnoreIsoLow        bool                       // Flag to control IsoLow fault behaviour. True = suppress fault
+	Enabled             bool                       // Allow us to control the fuel cell
+	Driver              string                     // Make of fuel cell. See fuelCellDrivers
+	Dispatch            AutoDispatchSettingsType   // Automatic start and stop on battery voltage
+	Supervisor          SupervisorSettingsType     // Start sequence timeouts and retries
+	CellHealth          CellHealthSettingsType     // Load band and thresholds for the cell voltage analysis
+	Hydrogen            HydrogenSettingsType       // Stack size and hydrogen price for the consumption figures
+	PowerControl        PowerControlSettingsType   // Ramp rates and load following
+	Purge               PurgeSettingsType          // When to open the exhaust to purge the stack
+	Maintenance         MaintenanceSettingsType    // Service intervals
+	Units               []FuelCellUnitSettingsType // Additional fuel cells. The main fuel cell uses the main CAN bus
+	Sharing             PowerSharingSettingsType   // How the power demand is split between the fuel cells
+}
+
+/*
+FuelCellUnitSettingsType describes an additional fuel cell. The setpoints and the supervisor, dispatch and power
+control settings above apply to every fuel cell.
+*/
+type FuelCellUnitSettingsType struct {
+	Name         string
+	Driver       string // Make of fuel cell. Empty to use FuelCellSettings.Driver
+	Interface    string // CAN interface. Empty to share the main CAN bus
+	SourceOffset uint8  // Added to every source address so fuel cells sharing a CAN bus can be told apart. At least 0x22 apart
+}
+
+/*
+BoardSettingsType describes an additional FireflyIO board. The main board uses the fields in SettingsType.
+*/
+type BoardSettingsType struct {
+	NodeID         uint8 // CAN IDs are offset by NodeID * BoardNodeOffset
+	Name           string
+	AnalogChannels [8]AnalogSettingType
+	DigitalInputs  [4]PortNameType
+	DigitalOutputs [6]PortNameType
+	Relays         [16]PortNameType
+	ACMeasurement  [4]ModbusNameType
+	DCMeasurement  [4]ModbusNameType
 }
 
 type SettingsType struct {
 	Name             string
+	NodeID           uint8 // Node ID of the main board
 	AnalogChannels   [8]AnalogSettingType
 	DigitalInputs    [4]PortNameType
 	DigitalOutputs   [6]PortNameType
@@ -46,9 +83,59 @@ type SettingsType struct {
 	FuelCellSettings FuelCellSettingsType
 	ACMeasurement    [4]ModbusNameType
 	DCMeasurement    [4]ModbusNameType
+	StaleData        StaleDataSettingsType
+	CANRecovery      CANRecoverySettingsType
+	Boards           []BoardSettingsType  // Additional FireflyIO boards on the same CAN bus
+	Rules            []RuleType           // Conditions on the inputs and fuel cells that drive the outputs
+	Schedule         ScheduleSettingsType // Timed actions, holidays and the site position for sunrise and sunset
+	FailSafe         FailSafeSettingsType // Safe states and what applies them
+	Interlocks       []InterlockType      // Conditions that stop relays and outputs being switched on
 	filepath         string
 }
 
+/*
+settingsMu guards the rules, schedule and interlocks, which the HTTP handlers replace while the rules engine,
+scheduler and switches are reading them. The handlers always install new slices rather than changing the old ones, so once fetched they can be
+read unlocked.
+*/
+var settingsMu sync.Mutex
+
+func (settings *SettingsType) ruleList() []RuleType {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	return settings.Rules
+}
+
+func (settings *SettingsType) setRuleList(rules []RuleType) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings.Rules = rules
+}
+
+func (settings *SettingsType) scheduleSettings() ScheduleSettingsType {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	return settings.Schedule
+}
+
+func (settings *SettingsType) setScheduleSettings(schedule ScheduleSettingsType) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings.Schedule = schedule
+}
+
+func (settings *SettingsType) interlockList() []InterlockType {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	return settings.Interlocks
+}
+
+func (settings *SettingsType) setInterlockList(interlocks []InterlockType) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settings.Interlocks = interlocks
+}
+
 func NewSettings() *SettingsType {
 	settings := new(SettingsType)
 	settings.Name = "FireflyIO"
@@ -77,6 +164,15 @@ func NewSettings() *SettingsType {
 	}
 	settings.FuelCellSettings.IgnoreIsoLow = false
 	settings.FuelCellSettings.Enabled = false
+	settings.FuelCellSettings.Driver = DefaultFuelCellDriver
+	settings.FuelCellSettings.Dispatch = defaultAutoDispatchSettings()
+	settings.FuelCellSettings.Supervisor = defaultSupervisorSettings()
+	settings.FuelCellSettings.Purge = defaultPurgeSettings()
+	settings.FuelCellSettings.Maintenance = defaultMaintenanceSettings()
+	settings.FuelCellSettings.CellHealth = defaultCellHealthSettings()
+	settings.FuelCellSettings.Hydrogen = defaultHydrogenSettings()
+	settings.FuelCellSettings.PowerControl = defaultPowerControlSettings()
+	settings.FuelCellSettings.Sharing = defaultPowerSharingSettings()
 
 	for i := range settings.ACMeasurement {
 		settings.ACMeasurement[i].Name = ""
@@ -89,9 +185,59 @@ func NewSettings() *SettingsType {
 	// Default to just one AC measurement device and no DC measurement devices.
 	settings.ACMeasurement[0].Name = "Firefly"
 
+	settings.StaleData.Timeouts = make(map[string]float64)
+	settings.StaleData.FaultAction = StaleActionNone
+	settings.CANRecovery = defaultCANRecoverySettings()
+	settings.FailSafe = defaultFailSafeSettings()
+
 	return settings
 }
 
+/*
+setDefaults fills in the ports, names and calibration that were left out when the board was added to the settings file
+*/
+func (board *BoardSettingsType) setDefaults() {
+	if board.Name == "" {
+		board.Name = fmt.Sprintf("Board-%d", board.NodeID)
+	}
+	for idx := range board.AnalogChannels {
+		board.AnalogChannels[idx].Port = uint8(idx)
+		if board.AnalogChannels[idx].Name == "" {
+			board.AnalogChannels[idx].Name = fmt.Sprintf("Analog-%d", idx)
+		}
+		if board.AnalogChannels[idx].UpperCalibrationAtoD == board.AnalogChannels[idx].LowerCalibrationAtoD {
+			board.AnalogChannels[idx].UpperCalibrationActual = 1024
+			board.AnalogChannels[idx].UpperCalibrationAtoD = 1024
+			board.AnalogChannels[idx].LowerCalibrationActual = 0
+			board.AnalogChannels[idx].LowerCalibrationAtoD = 0
+		}
+	}
+	for idx := range board.DigitalInputs {
+		board.DigitalInputs[idx].Port = uint8(idx)
+		if board.DigitalInputs[idx].Name == "" {
+			board.DigitalInputs[idx].Name = fmt.Sprintf("Intput-%d", idx)
+		}
+	}
+	for idx := range board.DigitalOutputs {
+		board.DigitalOutputs[idx].Port = uint8(idx)
+		if board.DigitalOutputs[idx].Name == "" {
+			board.DigitalOutputs[idx].Name = fmt.Sprintf("Output-%d", idx)
+		}
+	}
+	for idx := range board.Relays {
+		board.Relays[idx].Port = uint8(idx)
+		if board.Relays[idx].Name == "" {
+			board.Relays[idx].Name = fmt.Sprintf("Relay-%d", idx)
+		}
+	}
+	for idx := range board.ACMeasurement {
+		board.ACMeasurement[idx].SlaveID = 0x20 + uint8(idx)
+	}
+	for idx := range board.DCMeasurement {
+		board.DCMeasurement[idx].SlaveID = 0x10 + uint8(idx)
+	}
+}
+
 func (settings *SettingsType) LoadSettings(filepath string) error {
 	if file, err := ioutil.ReadFile(filepath); err != nil {
 		log.Println(err)
@@ -100,11 +246,22 @@ func (settings *SettingsType) LoadSettings(filepath string) error {
 		}
 	} else {
 		settings.filepath = filepath
-		if err := json.Unmarshal(file, settings); err != nil {
+		settingsMu.Lock()
+		// Unmarshal would reuse the arrays behind the rules, schedule and interlocks, which may be being read
+		settings.Rules = nil
+		settings.Schedule.Entries = nil
+		settings.Schedule.Holidays = nil
+		settings.Interlocks = nil
+		err = json.Unmarshal(file, settings)
+		settingsMu.Unlock()
+		if err != nil {
 			return err
 		}
 	}
 	settings.filepath = filepath
+	for board := range settings.Boards {
+		settings.Boards[board].setDefaults()
+	}
 	settings.calculateConstants()
 	for _, rl := range settings.Relays {
 		Relays.Relays[rl.Port].Name = rl.Name
@@ -124,19 +281,37 @@ func (settings *SettingsType) LoadSettings(filepath string) error {
 	for i, dc := range settings.DCMeasurement {
 		DCMeasurements[i].Name = dc.Name
 	}
+	settings.checkAutomation()
 	return nil
 }
 
+/*
+checkAutomation checks the rules, schedule and interlocks loaded from the settings file, which have not been through
+the checks the API makes. Rules and schedule entries that fail are disabled and interlocks that fail are dropped.
+They refer to the boards and fuel cells so nothing is checked until those have been created. startUp calls it again
+once they have been.
+*/
+func (settings *SettingsType) checkAutomation() {
+	if MainBoard() == nil || MainFuelCell() == nil {
+		return
+	}
+	settings.setRuleList(checkedRules(settings.ruleList()))
+	settings.setScheduleSettings(checkedSchedule(settings.scheduleSettings()))
+	settings.setInterlockList(checkedInterlocks(settings.interlockList()))
+}
+
 func (settings *SettingsType) SaveSettings(filepath string) error {
 	settings.filepath = filepath
-	if bData, err := json.Marshal(settings); err != nil {
+	settingsMu.Lock()
+	bData, err := json.Marshal(settings)
+	settingsMu.Unlock()
+	if err != nil {
 		log.Println("Error converting settings to text -", err)
 		return err
-	} else {
-		if err = ioutil.WriteFile(settings.filepath, bData, 0644); err != nil {
-			log.Println("Error writing JSON settings file -", err)
-			return err
-		}
+	}
+	if err = ioutil.WriteFile(settings.filepath, bData, 0644); err != nil {
+		log.Println("Error writing JSON settings file -", err)
+		return err
 	}
 	return nil
 }
@@ -150,6 +325,11 @@ func (settings *SettingsType) calculateConstants() {
 	for idx := range settings.AnalogChannels {
 		settings.AnalogChannels[idx].calculateConstants()
 	}
+	for board := range settings.Boards {
+		for idx := range settings.Boards[board].AnalogChannels {
+			settings.Boards[board].AnalogChannels[idx].calculateConstants()
+		}
+	}
 }
 
 func (settings *SettingsType) SendSettingsJSON(w http.ResponseWriter) {
@@ -171,29 +351,34 @@ func (settings *SettingsType) LoadFromJSON(jsonData []byte) error {
 }
 
 func (settings *SettingsType) getModbusFlags() (flags uint8) {
+	return modbusFlags(settings.ACMeasurement, settings.DCMeasurement)
+}
+
+// modbusFlags sets a bit for each AC and DC measurement device that has a name
+func modbusFlags(ac [4]ModbusNameType, dc [4]ModbusNameType) (flags uint8) {
 	flags = 0
-	if len(settings.ACMeasurement[0].Name) > 0 {
+	if len(ac[0].Name) > 0 {
 		flags |= 0b00000001
 	}
-	if len(settings.ACMeasurement[1].Name) > 0 {
+	if len(ac[1].Name) > 0 {
 		flags |= 0b00000010
 	}
-	if len(settings.ACMeasurement[2].Name) > 0 {
+	if len(ac[2].Name) > 0 {
 		flags |= 0b00000100
 	}
-	if len(settings.ACMeasurement[3].Name) > 0 {
+	if len(ac[3].Name) > 0 {
 		flags |= 0b00001000
 	}
-	if len(settings.DCMeasurement[0].Name) > 0 {
+	if len(dc[0].Name) > 0 {
 		flags |= 0b00010000
 	}
-	if len(settings.DCMeasurement[1].Name) > 0 {
+	if len(dc[1].Name) > 0 {
 		flags |= 0b00100000
 	}
-	if len(settings.DCMeasurement[2].Name) > 0 {
+	if len(dc[2].Name) > 0 {
 		flags |= 0b01000000
 	}
-	if len(settings.DCMeasurement[3].Name) > 0 {
+	if len(dc[3].Name) > 0 {
 		flags |= 0b10000000
 	}
 	return
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/brutella/can"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The simulator stands in for the FireflyIO board and the PAN fuel cell so the service can be commissioned and
+demonstrated with no hardware attached. It listens for the frames we transmit and answers with the frames the
+real hardware would send.
+*/
+
+const simulatorTick = time.Millisecond * 100
+const simulatorCellCount = 32
+
+// Time spent in each start-up and shut-down state of the simulated PAN power mode state machine
+const simH2IntakeTime = time.Second * 3
+const simStartTime = time.Second * 5
+const simAirPurgeTime = time.Second * 3
+const simShutdownTime = time.Second * 5
+
+// Simulated battery bank the fuel cell charges
+const simBatteryNominalVolts = 48.0
+const simBatteryAmpHours = 200.0
+const simBaseLoadWatts = 1500.0
+
+type SimulatorType struct {
+	mu        sync.Mutex
+	transport FrameTransport
+	ownsBus   bool // True if we opened our own transport rather than sharing the in-memory bus
+
+	// FireflyIO boards by node ID. A board is added when the service first addresses it.
+	boards       map[uint8]*simBoardType
+	analogPhase  float64
+	tickCount    uint64
+	stateEntered time.Time
+
+	// PAN fuel cell
+	runCommand     RunCommandType
+	powerDemand    float64 // kW requested
+	exhaustOpen    bool
+	exhaustToggle  bool
+	h2Cycle        uint8
+	bmsHigh        uint16
+	bmsLow         uint16
+	powerMode      PowerModeStateType
+	stackPower     float64 // W
+	stackCurrent   float64 // A
+	cellVolts      [simulatorCellCount]float64
+	coolantInTemp  float64
+	coolantOutTemp float64
+	alarms         uint32
+	runTime        time.Duration
+	batterySoC     float64 // 0 - 1
+}
+
+type simBoardType struct {
+	nodeID      uint8
+	relays      uint16
+	outputs     uint8
+	inputs      uint8
+	modbusFlags uint8
+	acEnergy    [4]float64
+}
+
+var Simulator SimulatorType
+
+// canID returns the ID used by the simulated board for the given board 0 ID
+func (board *simBoardType) canID(id uint32) uint32 {
+	return id + uint32(board.nodeID)*BoardNodeOffset
+}
+
+/*
+Attach connects the simulator to the given CAN bus. An in-memory bus is shared directly. Any other transport gets
+a second connection to the same interface so we see the frames the service sends and it sees our replies.
+*/
+func (sim *SimulatorType) Attach(bus *CANBus) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if sim.transport != nil && sim.ownsBus {
+		if err := sim.transport.Disconnect(); err != nil {
+			log.Println(err)
+		}
+	}
+	sim.transport = nil
+	if bus == nil {
+		return
+	}
+	busTransport := bus.transport()
+	if busTransport == nil {
+		return
+	}
+	if mem, ok := busTransport.(*MemoryTransport); ok {
+		sim.transport = mem
+		sim.ownsBus = false
+	} else {
+		transport, err := NewFrameTransport(bus.interfaceName)
+		if err != nil {
+			log.Println("Simulator failed to connect to the CAN bus -", err)
+			return
+		}
+		sim.transport = transport
+		sim.ownsBus = true
+		go func() {
+			if err := transport.ConnectAndPublish(); err != nil {
+				log.Println("Simulator CAN bus -", err)
+			}
+		}()
+	}
+	sim.transport.SubscribeFunc(sim.handleFrame)
+	log.Println("Simulator attached to", sim.transport.Name())
+}
+
+/*
+StartSimulator initialises the simulated hardware and starts sending the periodic frames. ConnectCANBus attaches
+the simulator to each CAN bus as it is connected.
+*/
+func StartSimulator() {
+	Simulator.mu.Lock()
+	Simulator.boards = make(map[uint8]*simBoardType)
+	Simulator.powerMode = PMOff
+	Simulator.stateEntered = time.Now()
+	Simulator.bmsHigh = 540
+	Simulator.bmsLow = 500
+	Simulator.coolantInTemp = 20
+	Simulator.coolantOutTemp = 20
+	Simulator.batterySoC = 0.6
+	Simulator.mu.Unlock()
+	go Simulator.run()
+}
+
+/*
+SimulatedInterfaceName returns the interface the simulator should run on. We never simulate on a real CAN adapter
+as the real hardware would be answering as well.
+*/
+func SimulatedInterfaceName(interfaceName string) string {
+	if interfaceName == MemoryTransportName || interfaceName == LoopbackTransportName || strings.HasPrefix(interfaceName, "vcan") {
+		return interfaceName
+	}
+	log.Printf("Simulation requested on %s. Using the in-memory CAN bus instead.", interfaceName)
+	return MemoryTransportName
+}
+
+// handleFrame receives everything the service transmits
+func (sim *SimulatorType) handleFrame(frame can.Frame) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if frame.ID&can.MaskEff == 0 && frame.ID/BoardNodeOffset <= MaxBoardNodeID {
+		node := uint8(frame.ID / BoardNodeOffset)
+		switch frame.ID % BoardNodeOffset {
+		case FlagsCanId:
+			sim.board(node).modbusFlags = frame.Data[0]
+		case RelaysAndDigitalOutCanId:
+			board := sim.board(node)
+			board.relays = binary.LittleEndian.Uint16(frame.Data[0:2])
+			board.outputs = frame.Data[2] & 0x3f
+			// The board echoes the relays, outputs and heartbeat so the service knows we are alive
+			var reply can.Frame
+			reply.ID = board.canID(RelaysOutputsAndHeartbeat)
+			reply.Length = 8
+			binary.LittleEndian.PutUint16(reply.Data[0:2], board.relays)
+			reply.Data[2] = board.outputs
+			copy(reply.Data[4:6], frame.Data[4:6])
+			sim.publish(reply)
+		}
+		return
+	}
+
+	switch frame.ID {
+	case CanOutputControlMsg:
+		sim.runCommand = RunCommandType(frame.Data[0])
+		sim.powerDemand = float64(frame.Data[1]) / 10.0
+		sim.exhaustOpen = ExhaustModeType(frame.Data[2]) == ExhaustOpen
+	case CanBatteryVoltageLimitsMsg:
+		sim.bmsHigh = binary.LittleEndian.Uint16(frame.Data[0:2])
+		sim.bmsLow = binary.LittleEndian.Uint16(frame.Data[2:4])
+	}
+}
+
+// board must be called with the simulator locked
+func (sim *SimulatorType) board(nodeID uint8) *simBoardType {
+	board, found := sim.boards[nodeID]
+	if !found {
+		log.Printf("Simulating FireflyIO board %d", nodeID)
+		board = &simBoardType{nodeID: nodeID}
+		sim.boards[nodeID] = board
+	}
+	return board
+}
+
+// publish must be called with the simulator locked
+func (sim *SimulatorType) publish(frame can.Frame) {
+	if sim.transport == nil {
+		return
+	}
+	if frame.Length == 0 {
+		frame.Length = 8
+	}
+	if err := sim.transport.Publish(frame); err != nil {
+		log.Println("Simulator -", err)
+	}
+}
+
+func (sim *SimulatorType) run() {
+	ticker := time.NewTicker(simulatorTick)
+	for {
+		<-ticker.C
+		sim.mu.Lock()
+		sim.tickCount++
+		sim.stepFuelCell(simulatorTick)
+		sim.sendAnalog()
+		if sim.tickCount%10 == 0 {
+			sim.sendMeasurements()
+		}
+		sim.sendFuelCell()
+		sim.mu.Unlock()
+	}
+}
+
+// setPowerMode must be called with the simulator locked
+func (sim *SimulatorType) setPowerMode(mode PowerModeStateType) {
+	log.Printf("Simulated fuel cell %s -> %s", sim.powerMode, mode)
+	sim.powerMode = mode
+	sim.stateEntered = time.Now()
+}
+
+/*
+stepFuelCell advances the PAN power mode state machine and the stack model
+*/
+func (sim *SimulatorType) stepFuelCell(dt time.Duration) {
+	inState := time.Since(sim.stateEntered)
+
+	switch sim.powerMode {
+	case PMOff, PMInit:
+		if sim.runCommand == StartUp {
+			sim.setPowerMode(PMH2Purge)
+		}
+	case PMH2Purge:
+		if sim.runCommand != StartUp {
+			sim.setPowerMode(PMShutdown)
+		} else if inState > simH2IntakeTime {
+			sim.setPowerMode(PMStartup)
+		}
+	case PMStartup:
+		if sim.runCommand != StartUp {
+			sim.setPowerMode(PMShutdown)
+		} else if inState > simStartTime {
+			sim.setPowerMode(PMAirPurge)
+		}
+	case PMAirPurge:
+		if sim.runCommand != StartUp {
+			sim.setPowerMode(PMShutdown)
+		} else if inState > simAirPurgeTime {
+			sim.setPowerMode(PMManual)
+		}
+	case PMManual:
+		if sim.runCommand != StartUp {
+			sim.setPowerMode(PMShutdown)
+		}
+	case PMShutdown, PMEmergencyShut, PMFault:
+		if inState > simShutdownTime && sim.runCommand != StartUp {
+			sim.setPowerMode(PMOff)
+		}
+	}
+
+	// The stack only delivers power once it is running. Power follows demand with a time constant of a few seconds.
+	target := 0.0
+	if sim.powerMode == PMManual {
+		target = sim.powerDemand * 1000
+	} else if sim.powerMode == PMStartup || sim.powerMode == PMAirPurge {
+		target = 300
+	}
+	sim.stackPower += (target - sim.stackPower) * dt.Seconds() / 3.0
+
+	// Polarisation curve : open circuit ~0.95V per cell falling with current
+	sim.stackCurrent = sim.stackPower / (simulatorCellCount * 0.75)
+	for cell := range sim.cellVolts {
+		cellOffset := 0.004 * math.Sin(float64(cell)*1.7)
+		sim.cellVolts[cell] = 0.95 - 0.0006*sim.stackCurrent + cellOffset
+	}
+
+	// Coolant heads for 25C plus 4.5C per kW
+	coolantTarget := 20.0
+	if sim.powerMode != PMOff {
+		coolantTarget = 25 + 4.5*sim.stackPower/1000
+	}
+	sim.coolantOutTemp += (coolantTarget - sim.coolantOutTemp) * dt.Seconds() / 60.0
+	sim.coolantInTemp = sim.coolantOutTemp - sim.stackPower/1000
+
+	sim.alarms = 0
+	if sim.coolantOutTemp > 80 {
+		sim.alarms |= AlarmCoolantTempHigh
+	}
+	if sim.coolantOutTemp-sim.coolantInTemp > 12 {
+		sim.alarms |= AlarmCoolantTempOutDiff
+	}
+	for _, v := range sim.cellVolts {
+		if v < 0.5 {
+			sim.alarms |= AlarmVoltageLow
+		}
+	}
+
+	if sim.powerMode == PMManual {
+		sim.runTime += dt
+	}
+
+	// Battery charges from the fuel cell and discharges into the base load
+	netWatts := sim.stackPower*0.95 - simBaseLoadWatts
+	sim.batterySoC += netWatts * dt.Hours() / (simBatteryNominalVolts * simBatteryAmpHours)
+	sim.batterySoC = math.Max(0.05, math.Min(1.0, sim.batterySoC))
+}
+
+func (sim *SimulatorType) batteryVolts() float64 {
+	return 44.0 + 10.0*sim.batterySoC
+}
+
+/*
+sendAnalog synthesises the FireflyIO analog frames 0x013 - 0x015
+*/
+func (sim *SimulatorType) sendAnalog() {
+	sim.analogPhase += 0.01
+	for _, board := range sim.boards {
+		var frame can.Frame
+		frame.ID = board.canID(AnalogInputs0to3CanId)
+		for ch := 0; ch < 4; ch++ {
+			binary.LittleEndian.PutUint16(frame.Data[ch*2:ch*2+2], uint16(2048+1000*math.Sin(sim.analogPhase+float64(ch))))
+		}
+		sim.publish(frame)
+
+		frame.ID = board.canID(AnalogInputs4to7CanId)
+		for ch := 4; ch < 8; ch++ {
+			binary.LittleEndian.PutUint16(frame.Data[(ch-4)*2:(ch-4)*2+2], uint16(2048+1000*math.Sin(sim.analogPhase+float64(ch))))
+		}
+		sim.publish(frame)
+
+		frame.ID = board.canID(AnalogInputsInternalCanId)
+		frame.Data = [8]byte{}
+		binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(int16(4200+50*math.Sin(sim.analogPhase/10))))
+		binary.LittleEndian.PutUint16(frame.Data[2:4], 1720)
+		binary.LittleEndian.PutUint16(frame.Data[4:6], 1650)
+		frame.Data[6] = board.inputs & 0x0f
+		sim.publish(frame)
+	}
+}
+
+/*
+sendMeasurements sends the AC and DC measurement frames for each Modbus device enabled in the flags frame
+*/
+func (sim *SimulatorType) sendMeasurements() {
+	acIds := [4][3]uint32{
+		{AcVoltsAmpsCanId0, AcPowerEnergyCanId0, AcHertzPfCanId0},
+		{AcVoltsAmpsCanId1, AcPowerEnergyCanId1, AcHertzPfCanId1},
+		{AcVoltsAmpsCanId2, AcPowerEnergyCanId2, AcHertzPfCanId2},
+		{AcVoltsAmpsCanId3, AcPowerEnergyCanId3, AcHertzPfCanId3},
+	}
+	dcIds := [4]uint32{DcVoltsAmpsCanId0, DcVoltsAmpsCanId1, DcVoltsAmpsCanId2, DcVoltsAmpsCanId3}
+
+	for _, board := range sim.boards {
+		for device := 0; device < 4; device++ {
+			if board.modbusFlags&(1<<device) == 0 {
+				continue
+			}
+			volts := 240.0 + 2*math.Sin(sim.analogPhase)
+			watts := simBaseLoadWatts * (1 + 0.2*math.Sin(sim.analogPhase/3+float64(device)))
+			amps := watts / volts
+			board.acEnergy[device] += watts / 3600.0
+
+			var frame can.Frame
+			frame.ID = board.canID(acIds[device][0])
+			binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(volts*10))
+			binary.LittleEndian.PutUint32(frame.Data[2:6], uint32(amps*1000))
+			sim.publish(frame)
+
+			frame = can.Frame{ID: board.canID(acIds[device][1])}
+			binary.LittleEndian.PutUint32(frame.Data[0:4], uint32(watts*10))
+			binary.LittleEndian.PutUint32(frame.Data[4:8], uint32(board.acEnergy[device]))
+			sim.publish(frame)
+
+			frame = can.Frame{ID: board.canID(acIds[device][2])}
+			binary.LittleEndian.PutUint16(frame.Data[0:2], 600)
+			binary.LittleEndian.PutUint16(frame.Data[2:4], 98)
+			sim.publish(frame)
+		}
+
+		for device := 0; device < 4; device++ {
+			if board.modbusFlags&(0x10<<device) == 0 {
+				continue
+			}
+			volts := sim.batteryVolts()
+			amps := (sim.stackPower*0.95 - simBaseLoadWatts) / volts
+			var frame can.Frame
+			frame.ID = board.canID(dcIds[device])
+			binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(volts*100))
+			binary.LittleEndian.PutUint32(frame.Data[2:6], uint32(int32(amps*6000)+554416))
+			sim.publish(frame)
+		}
+	}
+}
+
+/*
+sendFuelCell sends the PAN fuel cell status frames using the same scaling the decoders in PAN Fuel Cell.go expect
+*/
+func (sim *SimulatorType) sendFuelCell() {
+	running := sim.powerMode != PMOff
+	var frame can.Frame
+
+	frame.ID = CanPowerModeMsg
+	frame.Data[0] = byte(sim.powerMode)
+	if sim.alarms != 0 {
+		frame.Data[1] = 1
+	}
+	frame.Data[4] = byte(sim.powerMode)
+	sim.publish(frame)
+
+	frame = can.Frame{ID: CanKeyOnMsg}
+	if running {
+		frame.Data[0] = 1
+	}
+	sim.publish(frame)
+
+	stackVolts := 0.0
+	for _, v := range sim.cellVolts {
+		stackVolts += v
+	}
+	if !running {
+		stackVolts = 0
+	}
+	frame = can.Frame{ID: CanStackOutputMsg}
+	binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(stackVolts*10))
+	binary.LittleEndian.PutUint16(frame.Data[2:4], uint16(sim.stackCurrent*10))
+	power := uint32(sim.stackPower * 10)
+	frame.Data[4] = byte(power)
+	frame.Data[5] = byte(power >> 8)
+	frame.Data[6] = byte(power >> 16)
+	sim.publish(frame)
+
+	frame = can.Frame{ID: CanAlarmsMsg}
+	binary.LittleEndian.PutUint32(frame.Data[0:4], sim.alarms)
+	sim.publish(frame)
+
+	// Pressures are kPa x 10 offset by 500
+	h2 := 0.0
+	air := 0.0
+	if running {
+		h2 = 60 + sim.stackPower/500
+		air = 40 + sim.stackPower/1000
+	}
+	frame = can.Frame{ID: CanPressuresMsg}
+	binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(h2*10+500))
+	binary.LittleEndian.PutUint16(frame.Data[2:4], uint16(air*10+500))
+	binary.LittleEndian.PutUint16(frame.Data[4:6], uint16(30*10+500))
+	binary.LittleEndian.PutUint16(frame.Data[6:8], uint16((h2-air)*10+50))
+	sim.publish(frame)
+
+	// Temperatures are C x 10 offset by 400
+	frame = can.Frame{ID: CanStackCoolantMsg}
+	binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(sim.coolantInTemp*10+400))
+	binary.LittleEndian.PutUint16(frame.Data[2:4], uint16(sim.coolantOutTemp*10+400))
+	binary.LittleEndian.PutUint16(frame.Data[4:6], uint16(25*10+400))
+	binary.LittleEndian.PutUint16(frame.Data[6:8], uint16(22*10+400))
+	sim.publish(frame)
+
+	frame = can.Frame{ID: CanAirFlowMsg}
+	binary.LittleEndian.PutUint16(frame.Data[4:6], uint16(sim.stackPower/10))
+	sim.publish(frame)
+
+	// Cell voltages are mV offset by 5000
+	cellIds := [8]uint32{CanStackCellsID1to4Msg, CanStackCellsID5to8Msg, CanStackCellsID9to12Msg, CanStackCellsID13to16Msg,
+		CanStackCellsID17to20Msg, CanStackCellsID21to24Msg, CanStackCellsID25to28Msg, CanStackCellsID29to32Msg}
+	minCell, maxCell := 0, 0
+	sum := 0.0
+	for group, id := range cellIds {
+		frame = can.Frame{ID: id}
+		for i := 0; i < 4; i++ {
+			cell := group*4 + i
+			mv := 0.0
+			if running {
+				mv = sim.cellVolts[cell] * 1000
+			}
+			binary.LittleEndian.PutUint16(frame.Data[i*2:i*2+2], uint16(mv+5000))
+			sum += mv
+			if sim.cellVolts[cell] < sim.cellVolts[minCell] {
+				minCell = cell
+			}
+			if sim.cellVolts[cell] > sim.cellVolts[maxCell] {
+				maxCell = cell
+			}
+		}
+		sim.publish(frame)
+	}
+	frame = can.Frame{ID: CanMaxMinCellsMsg}
+	if running {
+		binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(sim.cellVolts[maxCell]*1000+5000))
+		binary.LittleEndian.PutUint16(frame.Data[2:4], uint16(sim.cellVolts[minCell]*1000+5000))
+		binary.LittleEndian.PutUint16(frame.Data[4:6], uint16(sum/simulatorCellCount+5000))
+	} else {
+		binary.LittleEndian.PutUint16(frame.Data[0:2], 5000)
+		binary.LittleEndian.PutUint16(frame.Data[2:4], 5000)
+		binary.LittleEndian.PutUint16(frame.Data[4:6], 5000)
+	}
+	frame.Data[6] = byte(maxCell)
+	frame.Data[7] = byte(minCell)
+	sim.publish(frame)
+
+	frame = can.Frame{ID: CanTotalStackVoltageMsg}
+	binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(stackVolts*10))
+	frame.Data[7] = byte(sim.tickCount)
+	sim.publish(frame)
+
+	// DC-DC converter. Output volts x 10, output amps x 100, input volts x 100, input amps x 10
+	battery := sim.batteryVolts()
+	frame = can.Frame{ID: CanDCDCConverterMsg}
+	binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(sim.stackCurrent*10))
+	binary.LittleEndian.PutUint16(frame.Data[2:4], uint16(stackVolts*100))
+	binary.LittleEndian.PutUint16(frame.Data[4:6], uint16(sim.stackPower*0.95/battery*100))
+	binary.LittleEndian.PutUint16(frame.Data[6:8], uint16(battery*10))
+	sim.publish(frame)
+
+	frame = can.Frame{ID: CanDCOutputMsg}
+	frame.Data[0] = byte(35 + 40)
+	if sim.powerMode == PMManual {
+		frame.Data[1] = 1
+	}
+	sim.publish(frame)
+
+	frame = can.Frame{ID: CanATSCoolingFanMsg}
+	if running {
+		binary.LittleEndian.PutUint16(frame.Data[0:2], 1)
+		binary.LittleEndian.PutUint16(frame.Data[2:4], uint16(1000+sim.stackPower/5))
+	}
+	sim.publish(frame)
+
+	frame = can.Frame{ID: CanWaterPumpMsg}
+	if running {
+		binary.LittleEndian.PutUint16(frame.Data[0:2], uint16(2000+sim.stackPower/4))
+		frame.Data[2] = 120 // 24V
+		frame.Data[3] = 15  // 3A
+	}
+	sim.publish(frame)
+
+	// Hydrogen sensor reporting no leak (11 * 500 - 5500 = 0)
+	sim.h2Cycle = (sim.h2Cycle + 1) & 0x0f
+	frame = can.Frame{ID: CanCff1Msg}
+	frame.Data[0] = 11
+	frame.Data[2] = sim.h2Cycle
+	sim.publish(frame)
+
+	frame = can.Frame{ID: CanInsulationMsg}
+	frame.Data[0] = 0x02
+	binary.LittleEndian.PutUint16(frame.Data[1:3], 2000)
+	binary.LittleEndian.PutUint16(frame.Data[3:5], uint16(stackVolts*10))
+	sim.publish(frame)
+
+	// The PAN toggles byte 6 of the BMS settings frame while the exhaust is open
+	if sim.exhaustOpen {
+		sim.exhaustToggle = !sim.exhaustToggle
+	} else {
+		sim.exhaustToggle = false
+	}
+	frame = can.Frame{ID: CanBMSSettingsMsg}
+	binary.LittleEndian.PutUint16(frame.Data[0:2], sim.bmsHigh)
+	binary.LittleEndian.PutUint16(frame.Data[2:4], sim.bmsLow)
+	frame.Data[4] = uint8(sim.powerDemand)
+	frame.Data[5] = uint8(sim.stackPower / 1000)
+	if sim.exhaustToggle {
+		frame.Data[6] = 1
+	}
+	sim.publish(frame)
+
+	if sim.tickCount%10 == 0 {
+		frame = can.Frame{ID: CanRunTimeMsg}
+		frame.Data[2] = byte(int(sim.runTime.Hours()))
+		frame.Data[3] = byte(int(sim.runTime.Minutes()) % 60)
+		sim.publish(frame)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/brutella/can"
+	"math"
+	"testing"
+	"time"
+)
+
+// newTestSimulator returns a simulator publishing to a bus of its own that nothing reads, so its frames can be checked
+func newTestSimulator() (*SimulatorType, *MemoryTransport) {
+	transport := NewMemoryTransport("simulator")
+	sim := &SimulatorType{transport: transport, boards: make(map[uint8]*simBoardType), powerMode: PMOff,
+		stateEntered: time.Now()}
+	return sim, transport
+}
+
+// published returns the frames the simulator has sent
+func published(transport *MemoryTransport) []can.Frame {
+	var frames []can.Frame
+	for {
+		select {
+		case frame := <-transport.frames:
+			frames = append(frames, frame)
+		default:
+			return frames
+		}
+	}
+}
+
+func TestSimulatorRelayEcho(t *testing.T) {
+	sim, transport := newTestSimulator()
+	command := can.Frame{ID: 2*BoardNodeOffset + RelaysAndDigitalOutCanId, Length: 8, Data: [8]byte{0x05, 0x01, 0x7F, 0, 0x34, 0x12}}
+	sim.handleFrame(command)
+
+	frames := published(transport)
+	if len(frames) != 1 {
+		t.Fatalf("%d frames sent in reply to the relay command, want 1", len(frames))
+	}
+	reply := frames[0]
+	if reply.ID != 2*BoardNodeOffset+RelaysOutputsAndHeartbeat {
+		t.Errorf("reply ID = 0x%03X, want 0x%03X", reply.ID, 2*BoardNodeOffset+RelaysOutputsAndHeartbeat)
+	}
+	if relays := binary.LittleEndian.Uint16(reply.Data[0:2]); relays != 0x0105 || reply.Data[2] != 0x3F {
+		t.Errorf("echoed relays 0x%04X and outputs 0x%02X, want 0x0105 and 0x3F", relays, reply.Data[2])
+	}
+	if heartbeat := binary.LittleEndian.Uint16(reply.Data[4:6]); heartbeat != 0x1234 {
+		t.Errorf("echoed heartbeat 0x%04X, want 0x1234", heartbeat)
+	}
+	if _, found := sim.boards[2]; !found {
+		t.Error("board 2 was not added to the simulation")
+	}
+}
+
+/*
+TestSimulatorPowerModes runs the simulated fuel cell through its start-up states to running and back to off. The time
+spent in each state is skipped by moving the time the state was entered.
+*/
+func TestSimulatorPowerModes(t *testing.T) {
+	sim, _ := newTestSimulator()
+	run := func(command RunCommandType, demand float64) {
+		sim.handleFrame(can.Frame{ID: CanOutputControlMsg, Length: 8, Data: [8]byte{byte(command), byte(demand * 10)}})
+	}
+	steps := []struct {
+		name    string
+		command RunCommandType
+		inState time.Duration
+		mode    PowerModeStateType
+	}{
+		{name: "Started", command: StartUp, mode: PMH2Purge},
+		{name: "Purging hydrogen", command: StartUp, mode: PMH2Purge},
+		{name: "Hydrogen purged", command: StartUp, inState: simH2IntakeTime, mode: PMStartup},
+		{name: "Started up", command: StartUp, inState: simStartTime, mode: PMAirPurge},
+		{name: "Air purged", command: StartUp, inState: simAirPurgeTime, mode: PMManual},
+		{name: "Running", command: StartUp, inState: time.Hour, mode: PMManual},
+		{name: "Stopped", command: ShutDown, mode: PMShutdown},
+		{name: "Shutting down", command: ShutDown, mode: PMShutdown},
+		{name: "Shut down", command: ShutDown, inState: simShutdownTime, mode: PMOff},
+	}
+	for _, step := range steps {
+		run(step.command, 2)
+		sim.stateEntered = time.Now().Add(-step.inState - time.Millisecond)
+		sim.stepFuelCell(simulatorTick)
+		if sim.powerMode != step.mode {
+			t.Errorf("%s: power mode %s, want %s", step.name, sim.powerMode, step.mode)
+		}
+	}
+}
+
+// TestSimulatorStackOutput checks the stack follows the demand and that the service decodes what the simulator sends
+func TestSimulatorStackOutput(t *testing.T) {
+	sim, transport := newTestSimulator()
+	sim.handleFrame(can.Frame{ID: CanOutputControlMsg, Length: 8, Data: [8]byte{byte(StartUp), 25}})
+	sim.powerMode = PMManual
+	for i := 0; i < 60; i++ {
+		sim.stepFuelCell(time.Second)
+	}
+	if math.Abs(sim.stackPower-2500) > 1 {
+		t.Errorf("stack power %0.1fW after a minute at 2.5kW demand", sim.stackPower)
+	}
+
+	defer reportPowerMode(t, PMOff)
+	fuelCell := MainFuelCell()
+	sim.sendFuelCell()
+	bus := testBus(t)
+	for _, frame := range published(transport) {
+		if err := bus.Inject(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the simulated fuel cell frames", func() bool {
+		measurements := fuelCell.Measurements()
+		return measurements.PowerMode == PMManual && measurements.StackAmps > 0
+	})
+	measurements := fuelCell.Measurements()
+	if math.Abs(measurements.StackAmps-sim.stackCurrent) > 0.1 {
+		t.Errorf("stack current decoded as %0.1fA, simulated %0.1fA", measurements.StackAmps, sim.stackCurrent)
+	}
+	stackVolts := 0.0
+	for _, v := range sim.cellVolts {
+		stackVolts += v
+	}
+	if math.Abs(measurements.StackVolts-stackVolts) > 0.1 {
+		t.Errorf("stack voltage decoded as %0.1fV, simulated %0.1fV", measurements.StackVolts, stackVolts)
+	}
+
+	sim.handleFrame(can.Frame{ID: CanOutputControlMsg, Length: 8, Data: [8]byte{byte(ShutDown)}})
+	sim.powerMode = PMOff
+	sim.stackPower, sim.stackCurrent = 0, 0
+	sim.sendFuelCell()
+	for _, frame := range published(transport) {
+		if err := bus.Inject(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the simulated fuel cell to stop", func() bool { return fuelCell.Measurements().StackAmps == 0 })
+}
+
+func TestSimulatedInterfaceName(t *testing.T) {
+	tests := []struct {
+		requested string
+		want      string
+	}{
+		{requested: "can0", want: MemoryTransportName},
+		{requested: "vcan0", want: "vcan0"},
+		{requested: MemoryTransportName, want: MemoryTransportName},
+		{requested: LoopbackTransportName, want: LoopbackTransportName},
+	}
+	for _, test := range tests {
+		if got := SimulatedInterfaceName(test.requested); got != test.want {
+			t.Errorf("SimulatedInterfaceName(%s) = %s, want %s", test.requested, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+State holds running totals that must survive a restart but change too often to live in the settings file.
+It is written to the file given by -stateFile every minute.
+*/
+
+const stateSaveInterval = time.Minute
+
+type PersistentStateType struct {
+	mu          sync.Mutex
+	Hydrogen    HydrogenTotalsType
+	Purge       map[int]*PurgeTotalsType         // Keyed on fuel cell number
+	Maintenance map[int]*FuelCellMaintenanceType // Keyed on fuel cell number
+	filepath    string
+}
+
+var State PersistentStateType
+
+/*
+Load reads the state file. A missing file is not an error as it is created on the first save.
+*/
+func (st *PersistentStateType) Load(filepath string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.filepath = filepath
+	file, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(file, st)
+}
+
+/*
+Save writes the state to a temporary file, syncs it to the disk and renames it so a power cut cannot leave a half
+written file
+*/
+func (st *PersistentStateType) Save() error {
+	st.mu.Lock()
+	bytes, err := json.MarshalIndent(st, "", "  ")
+	filepath := st.filepath
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(bytes); err != nil {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Println(closeErr)
+		}
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filepath+".tmp", filepath)
+}
+
+/*
+Run saves the state every minute
+*/
+func (st *PersistentStateType) Run() {
+	saveTime := time.NewTicker(stateSaveInterval)
+	for {
+		<-saveTime.C
+		if err := st.Save(); err != nil {
+			log.Println("Save state -", err)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Timed switches pulse a relay or digital output on for a number of milliseconds, or switch it on or off after a
+delay. The timers run here rather than in the browser so the operation completes even if the client goes away.
+
+Each relay or output can have one timed operation. Starting another on the same channel replaces it and setting
+the channel by hand cancels it. Cancelling a pulse switches the channel off straight away. Cancelling a delay
+leaves the channel as it is.
+*/
+
+// Timed operation modes
+const (
+	TimedPulse    = "pulse"    // On now, off after the time
+	TimedDelayOn  = "delayOn"  // On after the time
+	TimedDelayOff = "delayOff" // Off after the time
+)
+
+const timedSwitchMaxMilliseconds = 24 * 60 * 60 * 1000
+
+type timedSwitchType struct {
+	id      int
+	mode    string
+	action  ActionType // The switch made when the time is up
+	started time.Time
+	due     time.Time
+	timer   *time.Timer
+}
+
+type TimedSwitchesType struct {
+	mu         sync.Mutex
+	operations map[string]*timedSwitchType // Keyed on the channel
+	lastID     int
+}
+
+var TimedSwitches = TimedSwitchesType{operations: make(map[string]*timedSwitchType)}
+
+/*
+timedAction makes the action that switches the relay or output given by number or name on the board
+*/
+func timedAction(board *BoardType, portType string, port string) (ActionType, error) {
+	action := ActionType{Type: portType, Board: board.NodeID}
+	if channel, err := strconv.ParseUint(port, 10, 8); err == nil {
+		action.Channel = uint8(channel)
+	} else {
+		action.Name = port
+	}
+	channel, err := action.channel(board)
+	if err != nil {
+		return action, err
+	}
+	// Keep the channel rather than the name so the key is the same however the channel was given
+	action.Channel = channel
+	action.Name = ""
+	return action, nil
+}
+
+func timedKey(action *ActionType) string {
+	return portKey(action.Type, action.Board, action.Channel)
+}
+
+/*
+Start begins a timed operation on the channel in action, replacing any that is already running on it. An error is
+returned if a pulse cannot switch the channel on.
+*/
+func (ts *TimedSwitchesType) Start(action ActionType, mode string, duration time.Duration) (TimedSwitchStatusType, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if mode == TimedPulse {
+		on := action
+		on.On = true
+		if err := on.switchPort(); err != nil {
+			return TimedSwitchStatusType{}, err
+		}
+	}
+	key := timedKey(&action)
+	if previous, found := ts.operations[key]; found {
+		previous.timer.Stop()
+		delete(ts.operations, key)
+	}
+	ts.lastID++
+	now := time.Now()
+	operation := &timedSwitchType{id: ts.lastID, mode: mode, action: action, started: now, due: now.Add(duration)}
+	operation.action.On = mode == TimedDelayOn
+	id := operation.id
+	operation.timer = time.AfterFunc(duration, func() { ts.finish(key, id) })
+	ts.operations[key] = operation
+	log.Printf("Timed %s started on %s for %v", mode, key, duration)
+	return operation.status(now), nil
+}
+
+// finish makes the final switch when the time is up unless the operation has been replaced or cancelled
+func (ts *TimedSwitchesType) finish(key string, id int) {
+	ts.mu.Lock()
+	operation, found := ts.operations[key]
+	if !found || operation.id != id {
+		ts.mu.Unlock()
+		return
+	}
+	delete(ts.operations, key)
+	ts.mu.Unlock()
+
+	log.Printf("Timed %s finished on %s", operation.mode, key)
+	operation.action.run("Timed", operation.mode)
+}
+
+/*
+Cancel stops the operation with the given ID. A pulse is ended by switching the channel off.
+*/
+func (ts *TimedSwitchesType) Cancel(id int) error {
+	ts.mu.Lock()
+	for key, operation := range ts.operations {
+		if operation.id == id {
+			operation.timer.Stop()
+			delete(ts.operations, key)
+			ts.mu.Unlock()
+			log.Printf("Timed %s cancelled on %s", operation.mode, key)
+			if operation.mode == TimedPulse {
+				operation.action.run("Timed", operation.mode)
+			}
+			return nil
+		}
+	}
+	ts.mu.Unlock()
+	return fmt.Errorf("there is no timed operation %d", id)
+}
+
+/*
+Forget drops any operation on the channel without switching it. Called when the channel is set by hand.
+*/
+func (ts *TimedSwitchesType) Forget(board *BoardType, portType string, port string) {
+	action, err := timedAction(board, portType, port)
+	if err != nil {
+		return
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	key := timedKey(&action)
+	if operation, found := ts.operations[key]; found {
+		operation.timer.Stop()
+		delete(ts.operations, key)
+	}
+}
+
+type TimedSwitchStatusType struct {
+	ID          int
+	Mode        string
+	Type        string // relay or output
+	Board       uint8
+	Channel     uint8
+	Name        string
+	Started     time.Time
+	Due         time.Time
+	RemainingMs int64
+}
+
+func (operation *timedSwitchType) status(now time.Time) TimedSwitchStatusType {
+	status := TimedSwitchStatusType{ID: operation.id, Mode: operation.mode, Type: operation.action.Type,
+		Board: operation.action.Board, Channel: operation.action.Channel, Started: operation.started,
+		Due: operation.due, RemainingMs: operation.due.Sub(now).Milliseconds()}
+	if status.RemainingMs < 0 {
+		status.RemainingMs = 0
+	}
+	if board := GetBoard(operation.action.Board); board != nil {
+		if operation.action.Type == ActionRelay {
+			status.Name = board.Relays.GetRelayName(operation.action.Channel)
+		} else {
+			status.Name = board.Outputs.GetOutputName(operation.action.Channel)
+		}
+	}
+	return status
+}
+
+// Status returns the running operations in the order they were started
+func (ts *TimedSwitchesType) Status() []TimedSwitchStatusType {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	now := time.Now()
+	status := make([]TimedSwitchStatusType, 0, len(ts.operations))
+	for _, operation := range ts.operations {
+		status = append(status, operation.status(now))
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ID < status[j].ID })
+	return status
+}
+
+/*
+startTimedSwitch starts a timed operation from the {relay} or {output} and {ms} route variables. The board is given
+by {id} or is the main board if there is no {id}.
+*/
+func startTimedSwitch(w http.ResponseWriter, r *http.Request, portType string, mode string) {
+	deviceString := fmt.Sprintf("%s %s", mode, portType)
+	vars := mux.Vars(r)
+	board := MainBoard()
+	if _, found := vars["id"]; found {
+		if board = boardFromRequest(w, r, deviceString); board == nil {
+			return
+		}
+	}
+	ms, err := strconv.ParseInt(vars["ms"], 10, 64)
+	if err != nil || ms < 1 || ms > timedSwitchMaxMilliseconds {
+		ReturnJSONErrorString(w, deviceString, fmt.Sprintf("The time must be 1 to %d milliseconds", timedSwitchMaxMilliseconds), http.StatusBadRequest, false)
+		return
+	}
+	action, err := timedAction(board, portType, vars[portType])
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	if tripped, reason := FailSafe.Tripped(); tripped && mode != TimedDelayOff {
+		ReturnJSONErrorString(w, deviceString, fmt.Sprintf("The fail-safe state is held - %s", reason), http.StatusConflict, false)
+		return
+	}
+	status, err := TimedSwitches.Start(action, mode, time.Duration(ms)*time.Millisecond)
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, interlockStatus(err), false)
+		return
+	}
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(status); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func pulseRelay(w http.ResponseWriter, r *http.Request) {
+	startTimedSwitch(w, r, ActionRelay, TimedPulse)
+}
+
+func delayOnRelay(w http.ResponseWriter, r *http.Request) {
+	startTimedSwitch(w, r, ActionRelay, TimedDelayOn)
+}
+
+func delayOffRelay(w http.ResponseWriter, r *http.Request) {
+	startTimedSwitch(w, r, ActionRelay, TimedDelayOff)
+}
+
+func pulseOutput(w http.ResponseWriter, r *http.Request) {
+	startTimedSwitch(w, r, ActionOutput, TimedPulse)
+}
+
+func delayOnOutput(w http.ResponseWriter, r *http.Request) {
+	startTimedSwitch(w, r, ActionOutput, TimedDelayOn)
+}
+
+func delayOffOutput(w http.ResponseWriter, r *http.Request) {
+	startTimedSwitch(w, r, ActionOutput, TimedDelayOff)
+}
+
+func getTimedSwitches(w http.ResponseWriter, _ *http.Request) {
+	const deviceString = "Get Timed Operations"
+	setContentTypeHeader(w)
+	if bytes, err := json.Marshal(TimedSwitches.Status()); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusInternalServerError, true)
+	} else if _, err := fmt.Fprint(w, string(bytes)); err != nil {
+		log.Println(err)
+	}
+}
+
+func cancelTimedSwitch(w http.ResponseWriter, r *http.Request) {
+	const deviceString = "Cancel Timed Operation"
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusBadRequest, false)
+		return
+	}
+	if err := TimedSwitches.Cancel(id); err != nil {
+		ReturnJSONError(w, deviceString, err, http.StatusNotFound, false)
+		return
+	}
+	getTimedSwitches(w, r)
+}
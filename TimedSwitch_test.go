@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// timedRelay returns the action for relay 6 on the main board and clears the relays when the test finishes
+func timedRelay(t *testing.T) ActionType {
+	t.Helper()
+	board := MainBoard()
+	t.Cleanup(func() { board.Relays.SetAllRelays(0) })
+	action, err := timedAction(board, ActionRelay, "6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return action
+}
+
+func TestTimedPulse(t *testing.T) {
+	ts := TimedSwitchesType{operations: make(map[string]*timedSwitchType)}
+	relays := MainBoard().Relays
+	action := timedRelay(t)
+
+	if _, err := ts.Start(action, TimedPulse, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if !relays.GetRelay(6) {
+		t.Error("the pulse did not switch the relay on")
+	}
+	waitFor(t, "the pulse to end", func() bool { return !relays.GetRelay(6) })
+	if status := ts.Status(); len(status) != 0 {
+		t.Errorf("the finished pulse is still listed - %+v", status)
+	}
+
+	// Cancelling a pulse ends it straight away
+	status, err := ts.Start(action, TimedPulse, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Cancel(status.ID); err != nil {
+		t.Fatal(err)
+	}
+	if relays.GetRelay(6) {
+		t.Error("the cancelled pulse left the relay on")
+	}
+	if err := ts.Cancel(status.ID); err == nil {
+		t.Error("a cancelled operation was cancelled again")
+	}
+}
+
+func TestTimedDelays(t *testing.T) {
+	ts := TimedSwitchesType{operations: make(map[string]*timedSwitchType)}
+	relays := MainBoard().Relays
+	action := timedRelay(t)
+
+	if _, err := ts.Start(action, TimedDelayOn, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if relays.GetRelay(6) {
+		t.Error("the relay was switched on before the delay")
+	}
+	waitFor(t, "the delayed switch on", func() bool { return relays.GetRelay(6) })
+
+	// Cancelling a delay leaves the channel as it is
+	status, err := ts.Start(action, TimedDelayOff, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Cancel(status.ID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !relays.GetRelay(6) {
+		t.Error("the cancelled delay switched the relay off")
+	}
+
+	// Starting another on the channel replaces the first
+	if _, err := ts.Start(action, TimedDelayOff, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	replacement, err := ts.Start(action, TimedDelayOff, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !relays.GetRelay(6) {
+		t.Error("the replaced delay switched the relay off")
+	}
+	if status := ts.Status(); len(status) != 1 || status[0].ID != replacement.ID || status[0].Channel != 6 {
+		t.Errorf("operations = %+v, want only the replacement", status)
+	}
+
+	// Setting the channel by hand drops it without switching
+	ts.Forget(MainBoard(), ActionRelay, "6")
+	if status := ts.Status(); len(status) != 0 {
+		t.Errorf("operations = %+v after setting the relay by hand", status)
+	}
+	if !relays.GetRelay(6) {
+		t.Error("forgetting the delay switched the relay")
+	}
+}
@@ -39,6 +39,9 @@ func setUpWebSite() {
 	//	pool = NewPool()
 	pool.Init()
 	go pool.Start()
+	canStatsPool.Init()
+	go canStatsPool.Start()
+	go CANStatsLoop()
 
 	log.Println("Staring the WEB site on port ", WebPort)
 	router := mux.NewRouter().StrictSlash(true)
@@ -47,6 +50,26 @@ func setUpWebSite() {
 
 	router.HandleFunc("/setRelay/{relay}/{on}", setRelay).Methods("PUT")
 	router.HandleFunc("/setOutput/{output}/{on}", setOutput).Methods("PUT")
+	router.HandleFunc("/boards", getBoards).Methods("GET")                                  // Status of every FireflyIO board
+	router.HandleFunc("/board/{id}", getBoard).Methods("GET")                               // Status of the board with the given node ID
+	router.HandleFunc("/board/{id}/setRelay/{relay}/{on}", setBoardRelay).Methods("PUT")    // Set a relay on the given board
+	router.HandleFunc("/board/{id}/setOutput/{output}/{on}", setBoardOutput).Methods("PUT") // Set a digital output on the given board
+
+	router.HandleFunc("/pulseRelay/{relay}/{ms}", pulseRelay).Methods("PUT")                     // Relay on now and off after ms milliseconds
+	router.HandleFunc("/delayOnRelay/{relay}/{ms}", delayOnRelay).Methods("PUT")                 // Relay on after ms milliseconds
+	router.HandleFunc("/delayOffRelay/{relay}/{ms}", delayOffRelay).Methods("PUT")               // Relay off after ms milliseconds
+	router.HandleFunc("/pulseOutput/{output}/{ms}", pulseOutput).Methods("PUT")                  // Output on now and off after ms milliseconds
+	router.HandleFunc("/delayOnOutput/{output}/{ms}", delayOnOutput).Methods("PUT")              // Output on after ms milliseconds
+	router.HandleFunc("/delayOffOutput/{output}/{ms}", delayOffOutput).Methods("PUT")            // Output off after ms milliseconds
+	router.HandleFunc("/board/{id}/pulseRelay/{relay}/{ms}", pulseRelay).Methods("PUT")          // Pulse a relay on the given board
+	router.HandleFunc("/board/{id}/delayOnRelay/{relay}/{ms}", delayOnRelay).Methods("PUT")      // Delayed on for a relay on the given board
+	router.HandleFunc("/board/{id}/delayOffRelay/{relay}/{ms}", delayOffRelay).Methods("PUT")    // Delayed off for a relay on the given board
+	router.HandleFunc("/board/{id}/pulseOutput/{output}/{ms}", pulseOutput).Methods("PUT")       // Pulse an output on the given board
+	router.HandleFunc("/board/{id}/delayOnOutput/{output}/{ms}", delayOnOutput).Methods("PUT")   // Delayed on for an output on the given board
+	router.HandleFunc("/board/{id}/delayOffOutput/{output}/{ms}", delayOffOutput).Methods("PUT") // Delayed off for an output on the given board
+	router.HandleFunc("/timed", getTimedSwitches).Methods("GET")                                 // Pulses and delays that are running, with the time remaining
+	router.HandleFunc("/timed/{id}/Cancel", cancelTimedSwitch).Methods("PUT")                    // Cancel a pulse or delay. A pulse is switched off now
+
 	router.HandleFunc("/getSettings", getSettings).Methods("GET")
 	router.HandleFunc("/setSettings", setSettings).Methods("POST")
 	router.HandleFunc("/getStatus", getStatus).Methods("GET")
@@ -56,14 +79,89 @@ func setUpWebSite() {
 	router.HandleFunc("/setFuelCell/TargetBattLow/{volts}", setFcBatLow).Methods("PUT")    // Set the batery low voltage set point
 	router.HandleFunc("/setFuelCell/Start", startFc).Methods("PUT")                        // Start the fuel cell
 	router.HandleFunc("/setFuelCell/Stop", stopFc).Methods("PUT")                          // Stop the fuel cell
+	router.HandleFunc("/getFuelCell/Dispatch", getAutoDispatch).Methods("GET")             // Automatic start/stop settings and state
+	router.HandleFunc("/setFuelCell/Dispatch", setAutoDispatch).Methods("POST")            // Change the automatic start/stop settings (JSON body)
+	router.HandleFunc("/getFuelCell/PowerControl", getPowerControl).Methods("GET")         // Ramp and load following state
+	router.HandleFunc("/setFuelCell/PowerControl", setPowerControl).Methods("POST")        // Change the ramp rates and load following settings (JSON body)
+	router.HandleFunc("/getFuelCell/Supervisor", getSupervisor).Methods("GET")             // Supervisor state, reason and transition history
+	router.HandleFunc("/setFuelCell/Supervisor", setSupervisorSettings).Methods("POST")    // Change the supervisor timeouts and retries (JSON body)
+	router.HandleFunc("/setFuelCell/Supervisor/Reset", resetSupervisor).Methods("PUT")     // Clear a supervisor fault and leave the fuel cell stopped
+	router.HandleFunc("/getFuelCell/Purge", getPurge).Methods("GET")                       // Purge scheduler state and run hours since the last purge
+	router.HandleFunc("/setFuelCell/Purge", setPurgeSettings).Methods("POST")              // Change the purge schedule (JSON body)
+	router.HandleFunc("/setFuelCell/Purge/Start", startPurge).Methods("PUT")               // Purge now. The fuel cell must be running
+	router.HandleFunc("/setFuelCell/Purge/Cancel", cancelPurge).Methods("PUT")             // Close the exhaust and end the purge
 	router.HandleFunc("/setFuelCellSettings", setFuelCellSettings).Methods("POST")         // Submit a form with setpoints and power level
 	router.HandleFunc("/setFuelCell/ExhaustOpen", exhaustOpen).Methods("PUT")              // Start the water pump on high and beginn air removal
 	router.HandleFunc("/setFuelCell/ExhaustClose", exhaustClose).Methods("PUT")            // Stop the exhaust function
 	router.HandleFunc("/setFuelCell/Enable", enableFc).Methods("PUT")                      // Enable CAN communications to the fuel cell (we are always listening but may not be sending)
 	router.HandleFunc("/setFuelCell/Disable", disableFc).Methods("PUT")                    // Disable CAN communications to the fuel cell so it can be controlled locally by its own user interface
+
+	router.HandleFunc("/fuelcells", getFuelCells).Methods("GET")                            // Status of every fuel cell and how the power demand is shared
+	router.HandleFunc("/fuelcells/Sharing", setPowerSharing).Methods("POST")                // Change the power sharing mode (JSON body)
+	router.HandleFunc("/fuelcells/Start", startFuelCells).Methods("PUT")                    // Start every fuel cell that is not faulted
+	router.HandleFunc("/fuelcells/Stop", stopFuelCells).Methods("PUT")                      // Stop every fuel cell
+	router.HandleFunc("/fuelcell/{n}", getFuelCell).Methods("GET")                          // Status of fuel cell n. 0 is the main fuel cell
+	router.HandleFunc("/fuelcell/{n}/Start", startFc).Methods("PUT")                        // Start fuel cell n
+	router.HandleFunc("/fuelcell/{n}/Stop", stopFc).Methods("PUT")                          // Stop fuel cell n
+	router.HandleFunc("/fuelcell/{n}/ExhaustOpen", exhaustOpen).Methods("PUT")              // Open the exhaust on fuel cell n
+	router.HandleFunc("/fuelcell/{n}/ExhaustClose", exhaustClose).Methods("PUT")            // Close the exhaust on fuel cell n
+	router.HandleFunc("/fuelcell/{n}/signals", getSignals).Methods("GET")                   // All signals decoded for fuel cell n
+	router.HandleFunc("/fuelcell/{n}/signals/{name}", getSignal).Methods("GET")             // A single decoded signal from fuel cell n
+	router.HandleFunc("/fuelcell/{n}/TargetPower/{power}", setFcPower).Methods("PUT")       // Set the power setting for fuel cell n
+	router.HandleFunc("/fuelcell/{n}/TargetBattHigh/{volts}", setFcBattHigh).Methods("PUT") // Set the battery high voltage setpoint for fuel cell n
+	router.HandleFunc("/fuelcell/{n}/TargetBattLow/{volts}", setFcBatLow).Methods("PUT")    // Set the battery low voltage setpoint for fuel cell n
+	router.HandleFunc("/fuelcell/{n}/Supervisor", getSupervisor).Methods("GET")             // Supervisor state for fuel cell n
+	router.HandleFunc("/fuelcell/{n}/Supervisor/Reset", resetSupervisor).Methods("PUT")     // Clear a supervisor fault on fuel cell n
+	router.HandleFunc("/fuelcell/{n}/Purge", getPurge).Methods("GET")                       // Purge scheduler state for fuel cell n
+	router.HandleFunc("/fuelcell/{n}/Purge/Start", startPurge).Methods("PUT")               // Purge fuel cell n now
+	router.HandleFunc("/fuelcell/{n}/Purge/Cancel", cancelPurge).Methods("PUT")             // End the purge on fuel cell n
+
+	router.HandleFunc("/maintenance", getMaintenance).Methods("GET")                                // Lifetime counters and service intervals for every fuel cell
+	router.HandleFunc("/maintenance/Reminders", getMaintenanceReminders).Methods("GET")             // Services that are due or due soon
+	router.HandleFunc("/maintenance/Intervals", setMaintenanceSettings).Methods("POST")             // Replace the service intervals (JSON body)
+	router.HandleFunc("/maintenance/Acknowledge/{name}", acknowledgeMaintenance).Methods("PUT")     // Record a service on the main fuel cell. Optional by= and note= query parameters
+	router.HandleFunc("/maintenance/{n}/Acknowledge/{name}", acknowledgeMaintenance).Methods("PUT") // Record a service on fuel cell n
+
+	router.HandleFunc("/rules", getRules).Methods("GET")                                 // Every rule with its conditions and whether it is active
+	router.HandleFunc("/rules", setRules).Methods("POST")                                // Replace the rules (JSON array)
+	router.HandleFunc("/rules/{name}/{state:Enable|Disable}", enableRule).Methods("PUT") // Turn a rule on or off
+
+	router.HandleFunc("/schedule", getSchedule).Methods("GET")                                       // Schedule entries with their next and last runs, holidays and today's sunrise and sunset
+	router.HandleFunc("/schedule", setSchedule).Methods("POST")                                      // Replace the site position, holidays and entries (JSON body)
+	router.HandleFunc("/schedule/Preview", getSchedulePreview).Methods("GET")                        // Runs due in the next hours= (default 24)
+	router.HandleFunc("/schedule/Holidays", setHolidays).Methods("POST")                             // Replace the holidays (JSON array of YYYY-MM-DD or MM-DD)
+	router.HandleFunc("/schedule/{name}/{state:Enable|Disable}", enableScheduleEntry).Methods("PUT") // Turn a schedule entry on or off
+
+	router.HandleFunc("/failsafe", getFailSafe).Methods("GET")           // Safe states, triggers and whether the fail-safe state is held
+	router.HandleFunc("/failsafe", setFailSafe).Methods("POST")          // Change the safe states and triggers (JSON body)
+	router.HandleFunc("/failsafe/Trip", tripFailSafe).Methods("PUT")     // Apply the safe states now
+	router.HandleFunc("/failsafe/Reset", resetFailSafe).Methods("PUT")   // Release the fail-safe state once the triggers have cleared
+	router.HandleFunc("/failsafe/Watchdog", kickWatchdog).Methods("PUT") // Kick the watchdog
+
+	router.HandleFunc("/interlocks", getInterlocks).Methods("GET")  // Interlocks and the ports each one is stopping from switching on
+	router.HandleFunc("/interlocks", setInterlocks).Methods("POST") // Replace the interlocks (JSON array)
+
 	router.HandleFunc("/unknown", getUnknownFrames).Methods("GET")
+	router.HandleFunc("/events", getEvents).Methods("GET")                     // Alarm and fault history. Filter with source, code, active, start, end, page and pageSize
+	router.HandleFunc("/events/active", getActiveEvents).Methods("GET")        // Alarms and faults that are raised now
+	router.HandleFunc("/can/stats", getCANStats).Methods("GET")                // Frame counts, rates and interface error counters
+	router.HandleFunc("/can/ws", startCANStatsWebSocket).Methods("GET")        // Pushes the CAN statistics every second
+	router.HandleFunc("/can/send", sendRawFrame).Methods("POST")               // Transmit a raw frame. Needs the API token
+	router.HandleFunc("/can/frames/ws", startRawFrameWebSocket).Methods("GET") // Stream raw frames. Needs the API token
+	router.HandleFunc("/can/recovery", getCANRecovery).Methods("GET")          // Recovery state, settings and history of attempts
+	router.HandleFunc("/can/recovery/start", startCANRecovery).Methods("PUT")  // Run the next recovery strategy now. Needs the API token
+	router.HandleFunc("/can/recovery", setCANRecoverySettings).Methods("POST") // JSON body with the recovery settings. Needs the API token
+	router.HandleFunc("/freshness", getFreshness).Methods("GET")               // When each CAN message was last received
+	router.HandleFunc("/signals", getSignals).Methods("GET")                   // All signals decoded for the main fuel cell using the DBC definitions
+	router.HandleFunc("/signals/{name}", getSignal).Methods("GET")             // A single decoded signal
+	router.HandleFunc("/dbc", getDBCMessages).Methods("GET")                   // The DBC message definitions in use
+	router.HandleFunc("/dbc/reload", reloadDBC).Methods("PUT")                 // Reload the DBC file after editing
 
 	router.HandleFunc("/FuelCellData/DCDC", getFuelCellData).Methods("GET")
+	router.HandleFunc("/FuelCellData/Cells", getCellHealth).Methods("GET")                     // Per cell deviation, drift and degradation score
+	router.HandleFunc("/FuelCellData/Hydrogen", getHydrogen).Methods("GET")                    // Hydrogen consumption, efficiency and cost. Totals per day
+	router.HandleFunc("/FuelCellData/Hydrogen/Reset", resetHydrogen).Methods("PUT")            // Start the hydrogen totals again
+	router.HandleFunc("/FuelCellData/Hydrogen/Price/{price}", setHydrogenPrice).Methods("PUT") // Hydrogen price per kg. Optional currency= query parameter
 
 	fileServer := http.FileServer(neuteredFileSystem{http.Dir(webFiles)})
 	router.PathPrefix("/").Handler(http.StripPrefix("/", fileServer))
@@ -74,6 +172,11 @@ func setUpWebSite() {
 }
 
 func startDataWebSocket(w http.ResponseWriter, r *http.Request) {
+	registerWebSocket(&pool, w, r)
+}
+
+// registerWebSocket upgrades the connection and adds it to the given pool
+func registerWebSocket(p *Pool, w http.ResponseWriter, r *http.Request) {
 	//	fmt.Println("WebSocket Endpoint Hit")
 	conn, err := Upgrade(w, r)
 	if err != nil {
@@ -89,7 +192,7 @@ func startDataWebSocket(w http.ResponseWriter, r *http.Request) {
 		//		Pool: pool,
 	}
 
-	pool.Register <- client
+	p.Register <- client
 }
 
 func enableFc(w http.ResponseWriter, r *http.Request) {
@@ -119,6 +222,10 @@ func setFcPower(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	request := vars["power"]
 	const function = "Set Fuel Cell Power"
+	fuelCell := fuelCellFromRequest(w, r, function)
+	if fuelCell == nil {
+		return
+	}
 
 	fPower, err := strconv.ParseFloat(request, 64)
 	if err != nil {
@@ -126,12 +233,12 @@ func setFcPower(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("set fuel cell power to ", fPower)
-	err = FuelCell.setTargetPower(fPower)
+	err = fuelCell.SetTargetPower(fPower)
 	if err != nil {
 		ReturnJSONError(w, function, err, http.StatusBadRequest, true)
 		return
 	}
-	if err := FuelCell.updateOutput(); err != nil {
+	if err := fuelCell.UpdateOutput(); err != nil {
 		ReturnJSONError(w, "Set Fuel Cell Power", err, http.StatusInternalServerError, true)
 		return
 	}
@@ -142,6 +249,10 @@ func setFcBattHigh(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	request := vars["volts"]
 	const function = "Set Fuel Cell Batt High"
+	fuelCell := fuelCellFromRequest(w, r, function)
+	if fuelCell == nil {
+		return
+	}
 
 	fVolts, err := strconv.ParseFloat(request, 64)
 	if err != nil {
@@ -149,12 +260,12 @@ func setFcBattHigh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("set fuel cell high battery limit to ", fVolts)
-	err = FuelCell.setTargetBattHigh(fVolts)
+	err = fuelCell.SetTargetBattHigh(fVolts)
 	if err != nil {
 		ReturnJSONError(w, function, err, http.StatusBadRequest, true)
 		return
 	}
-	if err = FuelCell.updateSettings(); err != nil {
+	if err = fuelCell.UpdateSettings(); err != nil {
 		ReturnJSONError(w, function, err, http.StatusInternalServerError, true)
 		return
 	}
@@ -165,6 +276,10 @@ func setFcBatLow(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	request := vars["volts"]
 	const function = "Set Fuel Cell Batt Low"
+	fuelCell := fuelCellFromRequest(w, r, function)
+	if fuelCell == nil {
+		return
+	}
 
 	fVolts, err := strconv.ParseFloat(request, 64)
 	if err != nil {
@@ -172,12 +287,12 @@ func setFcBatLow(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("set fuel cell low battery limit to ", fVolts)
-	err = FuelCell.setTargetBattLow(fVolts)
+	err = fuelCell.SetTargetBattLow(fVolts)
 	if err != nil {
 		ReturnJSONError(w, function, err, http.StatusBadRequest, true)
 		return
 	}
-	if err = FuelCell.updateSettings(); err != nil {
+	if err = fuelCell.UpdateSettings(); err != nil {
 		ReturnJSONError(w, function, err, http.StatusInternalServerError, true)
 		return
 	}
@@ -185,23 +300,35 @@ func setFcBatLow(w http.ResponseWriter, r *http.Request) {
 }
 
 func startFc(w http.ResponseWriter, r *http.Request) {
-	FuelCell.start()
-	getFuelCell(w, r)
+	if fuelCell := fuelCellFromRequest(w, r, "Start Fuel Cell"); fuelCell != nil {
+		if err := fuelCell.Start(); err != nil {
+			ReturnJSONError(w, "Start Fuel Cell", err, http.StatusConflict, false)
+			return
+		}
+		getFuelCell(w, r)
+	}
 }
 
 func stopFc(w http.ResponseWriter, r *http.Request) {
-	FuelCell.stop()
-	getFuelCell(w, r)
+	if fuelCell := fuelCellFromRequest(w, r, "Stop Fuel Cell"); fuelCell != nil {
+		fuelCell.Stop()
+		fuelCell.Supervisor.CancelRetry()
+		getFuelCell(w, r)
+	}
 }
 
 func exhaustOpen(w http.ResponseWriter, r *http.Request) {
-	FuelCell.exhaustOpen()
-	getFuelCell(w, r)
+	if fuelCell := fuelCellFromRequest(w, r, "Open Exhaust"); fuelCell != nil {
+		fuelCell.SetExhaust(true)
+		getFuelCell(w, r)
+	}
 }
 
 func exhaustClose(w http.ResponseWriter, r *http.Request) {
-	FuelCell.exhaustClose()
-	getFuelCell(w, r)
+	if fuelCell := fuelCellFromRequest(w, r, "Close Exhaust"); fuelCell != nil {
+		fuelCell.SetExhaust(false)
+		getFuelCell(w, r)
+	}
 }
 
 func setFuelCellSettings(w http.ResponseWriter, r *http.Request) {
@@ -215,35 +342,59 @@ func setFuelCellSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	} else {
 		currentSettings.FuelCellSettings.PowerSetting = floatval
-		FuelCell.Control.TargetPower = floatval
+		for _, fuelCell := range FuelCells {
+			if err := fuelCell.SetTargetPower(floatval); err != nil {
+				ReturnJSONError(w, function, err, http.StatusBadRequest, true)
+				return
+			}
+		}
 	}
 	if floatval, err := strconv.ParseFloat(r.FormValue("LowBattDemand"), 64); err != nil {
 		ReturnJSONError(w, function, err, http.StatusBadRequest, true)
 	} else {
 		currentSettings.FuelCellSettings.LowBatterySetpoint = floatval
-		FuelCell.Control.TargetBatteryLow = floatval
+		for _, fuelCell := range FuelCells {
+			if err := fuelCell.SetTargetBattLow(floatval); err != nil {
+				ReturnJSONError(w, function, err, http.StatusBadRequest, true)
+				return
+			}
+		}
 	}
 	if floatval, err := strconv.ParseFloat(r.FormValue("HighBattDemand"), 64); err != nil {
 		ReturnJSONError(w, function, err, http.StatusBadRequest, true)
 	} else {
 		currentSettings.FuelCellSettings.HighBatterySetpoint = floatval
-		FuelCell.Control.TargetBatteryHigh = floatval
+		for _, fuelCell := range FuelCells {
+			if err := fuelCell.SetTargetBattHigh(floatval); err != nil {
+				ReturnJSONError(w, function, err, http.StatusBadRequest, true)
+				return
+			}
+		}
 	}
 	if err := currentSettings.SaveSettings(currentSettings.filepath); err != nil {
 		log.Print(err)
 	}
-	if FuelCell.SystemInfo.Run {
-		if err := FuelCell.updateSettings(); err != nil { // Update the battery limit settings
+	for _, fuelCell := range FuelCells {
+		if fuelCell.Running() {
+			if err := fuelCell.UpdateSettings(); err != nil { // Update the battery limit settings
+				log.Print(err)
+			}
+		}
+		if err := fuelCell.UpdateOutput(); err != nil { // Update the power setting
 			log.Print(err)
 		}
 	}
-	if err := FuelCell.updateOutput(); err != nil { // Update the power setting
-		log.Print(err)
-	}
 	http.Redirect(w, r, "/FuelCellSettings.html", http.StatusTemporaryRedirect)
 }
 
 func setRelay(w http.ResponseWriter, r *http.Request) {
+	if setRelayOnBoard(w, r, MainBoard()) {
+		getFuelCell(w, r)
+	}
+}
+
+// setRelayOnBoard sets the relay given by the {relay} and {on} route variables. Returns false if an error was returned.
+func setRelayOnBoard(w http.ResponseWriter, r *http.Request, board *BoardType) bool {
 	var bOn bool
 	vars := mux.Vars(r)
 	relay := vars["relay"]
@@ -256,26 +407,38 @@ func setRelay(w http.ResponseWriter, r *http.Request) {
 		bOn = false
 	} else {
 		ReturnJSONErrorString(w, "setRelay", "Invalid value given for relay setting. Valid values are on, true, 1, off, false or 0", http.StatusBadRequest, true)
-		return
+		return false
 	}
 	relayNum, err := strconv.ParseInt(relay, 10, 8)
 	if err != nil {
-		if err := Relays.SetRelayByName(relay, bOn); err != nil {
-			ReturnJSONError(w, "setRelay", err, http.StatusBadRequest, true)
-			return
+		if err := board.Relays.SetRelayByName(relay, bOn); err != nil {
+			ReturnJSONError(w, "setRelay", err, interlockStatus(err), true)
+			return false
 		}
 	} else {
-		if (relayNum >= 0) && (relayNum < int64(len(Relays.Relays))) {
-			Relays.SetRelay(uint8(relayNum), bOn)
+		if (relayNum >= 0) && (relayNum < int64(len(board.Relays.Relays))) {
+			if err := board.Relays.SetRelay(uint8(relayNum), bOn); err != nil {
+				ReturnJSONError(w, "setRelay", err, interlockStatus(err), true)
+				return false
+			}
 		} else {
 			ReturnJSONErrorString(w, "setRelay", fmt.Sprintf("Invalid relay number - %d", relayNum), http.StatusBadRequest, true)
-			return
+			return false
 		}
 	}
-	getFuelCell(w, r)
+	// Only drop a timed operation once the set has worked, so a rejected request leaves a pending switch off in place
+	TimedSwitches.Forget(board, ActionRelay, relay)
+	return true
 }
 
 func setOutput(w http.ResponseWriter, r *http.Request) {
+	if setOutputOnBoard(w, r, MainBoard()) {
+		getFuelCell(w, r)
+	}
+}
+
+// setOutputOnBoard sets the output given by the {output} and {on} route variables. Returns false if an error was returned.
+func setOutputOnBoard(w http.ResponseWriter, r *http.Request, board *BoardType) bool {
 	var bOn bool
 	vars := mux.Vars(r)
 	output := vars["output"]
@@ -288,24 +451,28 @@ func setOutput(w http.ResponseWriter, r *http.Request) {
 		bOn = false
 	} else {
 		ReturnJSONErrorString(w, "setOutput", "Invalid value given for output setting. Valid values are on, true, 1, off, false or 0", http.StatusBadRequest, true)
-		return
+		return false
 	}
 	outputNum, err := strconv.ParseInt(output, 10, 8)
 	if err != nil {
-		if err := Outputs.SetOutputByName(output, bOn); err != nil {
-			ReturnJSONError(w, "setOutput", err, http.StatusBadRequest, true)
-			return
+		if err := board.Outputs.SetOutputByName(output, bOn); err != nil {
+			ReturnJSONError(w, "setOutput", err, interlockStatus(err), true)
+			return false
 		}
 	} else {
-		if (outputNum >= 0) && (outputNum < int64(len(Outputs.Outputs))) {
+		if (outputNum >= 0) && (outputNum < int64(len(board.Outputs.Outputs))) {
 
-			Outputs.SetOutput(uint8(outputNum), bOn)
+			if err := board.Outputs.SetOutput(uint8(outputNum), bOn); err != nil {
+				ReturnJSONError(w, "setOutput", err, interlockStatus(err), true)
+				return false
+			}
 		} else {
 			ReturnJSONErrorString(w, "setOutput", fmt.Sprintf("Invalid output number - %d", outputNum), http.StatusBadRequest, true)
-			return
+			return false
 		}
 	}
-	getFuelCell(w, r)
+	TimedSwitches.Forget(board, ActionOutput, output)
+	return true
 }
 
 type ACValuesType struct {
@@ -317,12 +484,14 @@ type ACValuesType struct {
 	ACHertz       float32
 	ACPowerFactor float32
 	Error         string
+	Stale         bool
 }
 type DCValuesType struct {
 	Name    string
 	DCVolts float32
 	DCAmps  float32
 	Error   string
+	Stale   bool
 }
 type JsonDataType struct {
 	System            string
@@ -333,7 +502,11 @@ type JsonDataType struct {
 	DigitalIn         *DigitalInputsType
 	ACMeasurements    []ACValuesType
 	DCMeasurements    []DCValuesType
-	PanFuelCellStatus PanStatus
+	PanFuelCellStatus FuelCellStatus
+	FuelCells         []FuelCellStatus        `json:",omitempty"` // Every fuel cell when there is more than one
+	StaleData         []string                // Board messages that have not been received within their timeout
+	Reminders         []ServiceReminderType   `json:",omitempty"` // Services that are due or due soon
+	TimedOperations   []TimedSwitchStatusType `json:",omitempty"` // Pulses and delays that are running
 }
 
 func getJsonStatus() ([]byte, error) {
@@ -363,6 +536,7 @@ func getJsonStatus() ([]byte, error) {
 			data.ACMeasurements[i].ACHertz = ACMeasurements[idx].getFrequency()
 			data.ACMeasurements[i].ACPowerFactor = ACMeasurements[idx].getPowerFactor()
 			data.ACMeasurements[i].Error = ACMeasurements[idx].getError()
+			data.ACMeasurements[i].Stale = Freshness.IsStale(fmt.Sprintf("AC%d", idx))
 			i++
 		}
 	}
@@ -381,10 +555,20 @@ func getJsonStatus() ([]byte, error) {
 			data.DCMeasurements[i].DCVolts = DCMeasurements[i].getVolts()
 			data.DCMeasurements[i].DCAmps = DCMeasurements[i].getAmps()
 			data.DCMeasurements[i].Error = DCMeasurements[i].getError()
+			data.DCMeasurements[i].Stale = Freshness.IsStale(fmt.Sprintf("DC%d", i))
 			i++
 		}
 	}
-	data.PanFuelCellStatus = FuelCell.GetStatus()
+	data.PanFuelCellStatus = MainFuelCell().GetStatus()
+	if len(FuelCells) > 1 {
+		data.FuelCells = make([]FuelCellStatus, 0, len(FuelCells))
+		for _, fuelCell := range FuelCells {
+			data.FuelCells = append(data.FuelCells, fuelCell.GetStatus())
+		}
+	}
+	data.StaleData = Freshness.StaleBoard(MainBoard())
+	data.Reminders = Maintenance.DueReminders()
+	data.TimedOperations = TimedSwitches.Status()
 
 	JSONBytes, err := json.Marshal(data)
 	if err != nil {
@@ -484,8 +668,12 @@ func getStatus(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
-func getFuelCell(w http.ResponseWriter, _ *http.Request) {
-	strStatus, err := FuelCell.GetStatusAsJSON()
+func getFuelCell(w http.ResponseWriter, r *http.Request) {
+	fuelCell := fuelCellFromRequest(w, r, "FuelCell Status")
+	if fuelCell == nil {
+		return
+	}
+	strStatus, err := fuelCell.GetStatusAsJSON()
 	setContentTypeHeader(w)
 	if err != nil {
 		ReturnJSONError(w, "FuelCell Status", err, http.StatusInternalServerError, true)
@@ -4,19 +4,20 @@ import (
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
+	"sync/atomic"
 )
 
 var pool Pool
 
 // This will let us know if the client goes away so we can remove it from the pool
-func readLoop(c *Client) {
+func (p *Pool) readLoop(c *Client) {
 	for {
 		if _, _, err := c.Conn.NextReader(); err != nil {
 			log.Println("readLoop", err)
 			if err := c.Conn.Close(); err != nil {
 				log.Print(err)
 			}
-			pool.Unregister <- c
+			p.Unregister <- c
 			break
 		}
 	}
@@ -39,6 +40,12 @@ type Pool struct {
 	Register   chan *Client
 	Unregister chan *Client
 	Broadcast  chan []byte
+	count      int32 // Number of clients. Read it with ClientCount
+}
+
+// ClientCount returns the number of registered clients so senders can skip building messages nobody will get
+func (pool *Pool) ClientCount() int {
+	return int(atomic.LoadInt32(&pool.count))
 }
 
 func (p *Pool) Init() {
@@ -63,11 +70,13 @@ func (pool *Pool) Start() {
 		select {
 		case client := <-pool.Register:
 			pool.Clients[client] = true
-			go readLoop(client)
+			atomic.StoreInt32(&pool.count, int32(len(pool.Clients)))
+			go pool.readLoop(client)
 			log.Println("Size of Connection Pool: ", len(pool.Clients), client.ID, " added.")
 			break
 		case client := <-pool.Unregister:
 			delete(pool.Clients, client)
+			atomic.StoreInt32(&pool.count, int32(len(pool.Clients)))
 			log.Println("Size of Connection Pool: ", len(pool.Clients), client.ID, " dropped off.")
 			break
 		case message := <-pool.Broadcast:
@@ -76,6 +85,7 @@ func (pool *Pool) Start() {
 				if err := client.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
 					log.Printf("Broadcast update error - %s\n", err)
 					delete(pool.Clients, client)
+					atomic.StoreInt32(&pool.count, int32(len(pool.Clients)))
 				} else {
 					log.Print("Broadcast to - ", client.Conn.UnderlyingConn().RemoteAddr())
 				}